@@ -5,6 +5,7 @@ local bufcommand = vim.api.nvim_buf_create_user_command
 vim.bo[bufnr].buftype = "prompt"
 vim.bo[bufnr].bufhidden = "hide"
 vim.bo[bufnr].swapfile = false
+vim.bo[bufnr].omnifunc = "v:lua.require'acp'.omnifunc"
 
 vim.treesitter.start(bufnr)
 
@@ -25,6 +26,211 @@ end, {
 	complete = "custom,v:lua.require'acp'.acpsetmode_complete"
 })
 
+bufcommand(bufnr, "AcpModel", function(cmd)
+	acp.set_model(bufnr, cmd.args)
+end, {
+	nargs = "?",
+	desc = "Switch the agent to another model, picked from a list without argument",
+	complete = "custom,v:lua.require'acp'.acpmodel_complete",
+})
+
+bufcommand(bufnr, "AcpCycleMode", function(cmd)
+	local step = cmd.count > 0 and cmd.count or 1
+	acp.cycle_mode(bufnr, cmd.bang and -step or step)
+end, {
+	count = true,
+	bang = true,
+	desc = "Switch to the [count]th next mode of the agent, with ! the previous one",
+})
+
+-- Only offer attachments the agent accepts
+local session = acp.state.sessions[bufnr]
+local agent_info = session and session.agent_info
+
+if not agent_info or agent_info.image then
+	bufcommand(bufnr, "AcpAttachImage", function(cmd)
+		if cmd.args == "" then
+			acp.attach_clipboard_image(bufnr)
+		else
+			acp.attach_image(bufnr, vim.fn.expand(cmd.args))
+		end
+	end, {
+		nargs = "?",
+		desc = "Attach an image file, or the clipboard image, to the next prompt",
+		complete = "file",
+	})
+end
+
+if not agent_info or agent_info.audio then
+	bufcommand(bufnr, "AcpAttachAudio", function(cmd)
+		acp.attach_audio(bufnr, vim.fn.expand(cmd.args))
+	end, {
+		nargs = 1,
+		desc = "Attach an audio file to the next prompt",
+		complete = "file",
+	})
+end
+
+bufcommand(bufnr, "AcpAttachDiagnostics", function(cmd)
+	acp.attach_diagnostics(bufnr, cmd.args == "" and "buffer" or cmd.args)
+end, {
+	nargs = "?",
+	desc = "Attach diagnostics of the previous buffer, or of the workspace, to the next prompt",
+	complete = function()
+		return { "buffer", "workspace" }
+	end,
+})
+
+bufcommand(bufnr, "AcpAttachGitDiff", function(cmd)
+	if cmd.args == "--staged" or cmd.args == "--cached" then
+		acp.attach_git_diff(bufnr, { staged = true })
+	else
+		acp.attach_git_diff(bufnr, { range = cmd.args ~= "" and cmd.args or nil })
+	end
+end, {
+	nargs = "?",
+	desc = "Attach unstaged changes, staged changes (--staged) or a revision range to the next prompt",
+})
+
+bufcommand(bufnr, "AcpAttachTerminal", function(cmd)
+	acp.attach_terminal(bufnr, nil, cmd.count > 0 and cmd.count or nil)
+end, {
+	count = true,
+	desc = "Attach the last [count] lines of a terminal buffer to the next prompt",
+})
+
+bufcommand(bufnr, "AcpAttachSymbol", function()
+	acp.attach_symbol(bufnr)
+end, {
+	desc = "Attach LSP hover, signature and definition of the symbol under the cursor in the previous window",
+})
+
+bufcommand(bufnr, "AcpMcp", function(cmd)
+	if #cmd.fargs == 0 then
+		acp.mcp_status(bufnr)
+		return
+	end
+	acp.mcp(bufnr, cmd.fargs[1], cmd.fargs[2])
+end, {
+	nargs = "*",
+	desc = "List the MCP servers of the session, or add or remove one",
+	complete = "custom,v:lua.require'acp'.acpmcp_complete",
+})
+
+bufcommand(bufnr, "AcpTrace", function()
+	acp.open_trace(bufnr)
+end, {
+	desc = "Open the trace of the messages exchanged with the agent",
+})
+
+bufcommand(bufnr, "AcpAgentLogs", function(cmd)
+	acp.agent_logs(bufnr, cmd.count > 0 and cmd.count or nil)
+end, {
+	count = true,
+	desc = "Show the last [count] lines the agent wrote to stderr, following new ones",
+})
+
+bufcommand(bufnr, "AcpOutput", function(cmd)
+	acp.open_output(bufnr, tonumber(cmd.args))
+end, {
+	nargs = "?",
+	desc = "Open a large tool call output, the last one by default",
+})
+
+bufcommand(bufnr, "AcpExport", function(cmd)
+	acp.export_session(bufnr, cmd.fargs[1], cmd.fargs[2])
+end, {
+	nargs = "+",
+	complete = "file",
+	desc = "Export the transcript of the session to a file, as Markdown or JSON ({file} [markdown|json])",
+})
+
+bufcommand(bufnr, "AcpImport", function(cmd)
+	acp.import_transcript(bufnr, cmd.args, { replay = cmd.bang })
+end, {
+	nargs = 1,
+	bang = true,
+	complete = "file",
+	desc = "Show an exported transcript in the chat, with ! also send it to the agent with the next prompt",
+})
+
+bufcommand(bufnr, "AcpCompact", function()
+	acp.compact(bufnr)
+end, {
+	desc = "Replace the conversation by a summary of it, to free the context window of the agent",
+})
+
+bufcommand(bufnr, "AcpTurns", function()
+	acp.pick_turn(bufnr)
+end, {
+	desc = "Pick a turn of the chat and go to its prompt",
+})
+
+bufcommand(bufnr, "AcpYankCode", function(cmd)
+	acp.yank_code_block(bufnr, cmd.count > 0 and cmd.count or nil, cmd.reg)
+end, {
+	count = true,
+	register = true,
+	desc = "Yank the [count]th last code block of the replies of the agent to [x] register",
+})
+
+bufcommand(bufnr, "AcpOlder", function(cmd)
+	acp.show_older(bufnr, cmd.count > 0 and cmd.count or nil)
+end, {
+	count = true,
+	desc = "Show again the last [count] lines trimmed from the top of the chat, or all of them",
+})
+
+bufcommand(bufnr, "AcpLastError", function()
+	acp.last_error(bufnr)
+end, {
+	desc = "Show the details of the last failed request to the agent",
+})
+
+bufcommand(bufnr, "AcpTemplate", function(cmd)
+	local args = {}
+	for i = 2, #cmd.fargs do
+		local key, value = cmd.fargs[i]:match("^([%w_]+)=(.*)$")
+		if key then
+			args[key] = value
+		end
+	end
+	acp.send_template(bufnr, cmd.fargs[1], args)
+end, {
+	nargs = "+",
+	desc = "Send a prompt template, with optional key=value placeholder values",
+	complete = "custom,v:lua.require'acp'.acptemplate_complete",
+})
+
+bufcommand(bufnr, "AcpResend", function()
+	acp.resend_last(bufnr)
+end, { desc = "Send the previous prompt again" })
+
+bufcommand(bufnr, "AcpContinue", function()
+	acp.continue(bufnr)
+end, { desc = "Continue the turn the agent cut short" })
+
+bufcommand(bufnr, "AcpEditLast", function()
+	acp.edit_last(bufnr)
+end, { desc = "Edit the previous prompt" })
+
+bufcommand(bufnr, "AcpHistory", function(cmd)
+	acp.search_history(bufnr, cmd.args)
+end, { nargs = "?", desc = "Search prompts sent previously in this project" })
+
+-- Recall previous prompts with <Up>/<Down> on the prompt line
+for key, delta in pairs({ ["<Up>"] = 1, ["<Down>"] = -1 }) do
+	vim.keymap.set("i", key, function()
+		if vim.fn.line(".") ~= vim.fn.line("$") then
+			return key
+		end
+		vim.schedule(function()
+			acp.history_step(bufnr, delta)
+		end)
+		return ""
+	end, { buffer = bufnr, expr = true, desc = "Recall prompt from history" })
+end
+
 -- Highlight all lines started with the prompt OCP `"\027]133;A\a` as sign ▶
 vim.schedule(function()
 	vim.cmd [[
@@ -35,18 +241,44 @@ vim.schedule(function()
 end)
 
 vim.keymap.set("n", "[[", function()
-	vim.fn.search([[^\%x1b]133;A\%x07]], "b")
-end, { buffer = bufnr, desc = "Go to previous prompt" })
+	acp.jump_turn(bufnr, -1)
+end, { buffer = bufnr, desc = "Go to previous prompt or reply" })
 
 vim.keymap.set("n", "]]", function()
-	vim.fn.search([[^\%x1b]133;A\%x07]])
-end, { buffer = bufnr, desc = "Go to next prompt" })
+	acp.jump_turn(bufnr, 1)
+end, { buffer = bufnr, desc = "Go to next prompt or reply" })
 
 vim.b.undo_ftplugin = table.concat({
     vim.b.undo_ftplugin or "",
-	"setlocal buftype< bufhidden< swapfile< conceallevel< concealcursor",
+	"setlocal buftype< bufhidden< swapfile< omnifunc< conceallevel< concealcursor",
     "delcommand -buffer AcpSetMode",
+    "delcommand -buffer AcpCycleMode",
+    "delcommand -buffer AcpModel",
+    "silent! delcommand -buffer AcpAttachImage",
+    "silent! delcommand -buffer AcpAttachAudio",
+    "delcommand -buffer AcpAttachDiagnostics",
+    "delcommand -buffer AcpAttachGitDiff",
+    "delcommand -buffer AcpAttachTerminal",
+    "delcommand -buffer AcpAttachSymbol",
+    "delcommand -buffer AcpMcp",
+    "delcommand -buffer AcpTrace",
+    "delcommand -buffer AcpAgentLogs",
+    "delcommand -buffer AcpOutput",
+    "delcommand -buffer AcpExport",
+    "delcommand -buffer AcpImport",
+    "delcommand -buffer AcpCompact",
+    "delcommand -buffer AcpTurns",
+    "delcommand -buffer AcpYankCode",
+    "delcommand -buffer AcpOlder",
+    "delcommand -buffer AcpLastError",
+    "delcommand -buffer AcpTemplate",
+    "delcommand -buffer AcpResend",
+    "delcommand -buffer AcpContinue",
+    "delcommand -buffer AcpEditLast",
+    "delcommand -buffer AcpHistory",
     "lua vim.treesitter.stop(" .. bufnr .. ")",
 	"nunmap <buffer> [[",
 	"nunmap <buffer> ]]",
+	"iunmap <buffer> <Up>",
+	"iunmap <buffer> <Down>",
 }, "\n")
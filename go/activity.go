@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// ActivityLimits caps the work an agent may have going on at once in a
+// session, so that an aggressive agent can't swamp the editor. Work beyond a
+// cap waits for earlier work to finish. Zero fields use the defaults below
+// and negative ones disable the limit.
+type ActivityLimits struct {
+	// MaxToolCalls caps the running tool calls shown in the chat buffer.
+	// Further tool calls are shown once one of them finishes.
+	MaxToolCalls int `json:"max_tool_calls" msgpack:"max_tool_calls"`
+	// MaxTerminals caps the terminals created and not yet released.
+	MaxTerminals int `json:"max_terminals" msgpack:"max_terminals"`
+	// MaxFsRequests caps the file system requests handled at once.
+	MaxFsRequests int `json:"max_fs_requests" msgpack:"max_fs_requests"`
+}
+
+const (
+	defaultMaxToolCalls  = 8
+	defaultMaxTerminals  = 4
+	defaultMaxFsRequests = 16
+)
+
+// semaphore bounds the number of operations running at once. A nil
+// semaphore has no bound.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n < 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire waits for a free slot, or for ctx to be done.
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// limitFs makes an extension file system handler wait for a slot like
+// ReadTextFile and WriteTextFile do.
+func (c *acpClientImpl) limitFs(h extHandler) extHandler {
+	return func(ctx context.Context, params json.RawMessage) (any, error) {
+		if err := c.session.fsSlots.acquire(ctx); err != nil {
+			return nil, err
+		}
+		defer c.session.fsSlots.release()
+		return h(ctx, params)
+	}
+}
+
+// terminals tracks the terminals an agent created and didn't release.
+type terminals struct {
+	mu     sync.Mutex
+	slots  semaphore
+	nextID atomic.Int64
+	open   map[string]bool
+}
+
+// create waits for a slot and returns the ID of a new terminal.
+func (t *terminals) create(ctx context.Context) (string, error) {
+	if err := t.slots.acquire(ctx); err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("term-%d", t.nextID.Add(1))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.open == nil {
+		t.open = map[string]bool{}
+	}
+	t.open[id] = true
+	return id, nil
+}
+
+// release frees the slot of a terminal, once.
+func (t *terminals) release(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.open[id] {
+		delete(t.open, id)
+		t.slots.release()
+	}
+}
+
+// toolLimiter holds back the rendering of tool calls beyond max running at
+// once. Only SessionUpdate and the end of turns use it, from the session's
+// updateQueue, so it needs no lock.
+type toolLimiter struct {
+	// max is the number of tool calls shown as running, <= 0 for no limit
+	max     int
+	running map[acp.ToolCallId]bool
+	// held are the tool calls waiting for a slot in order, and updates the
+	// renderings of their updates
+	held    []acp.ToolCallId
+	updates map[acp.ToolCallId][]heldUpdate
+}
+
+type heldUpdate struct {
+	show func()
+	done bool
+}
+
+// render runs show, the rendering of an update of tool call id, now or once
+// the tool call gets a slot. done is set for the update that ends it.
+func (l *toolLimiter) render(id acp.ToolCallId, done bool, show func()) {
+	if l.max <= 0 {
+		show()
+		return
+	}
+	if l.running == nil {
+		l.running = map[acp.ToolCallId]bool{}
+		l.updates = map[acp.ToolCallId][]heldUpdate{}
+	}
+	if ups, ok := l.updates[id]; ok {
+		l.updates[id] = append(ups, heldUpdate{show, done})
+		return
+	}
+	if !l.running[id] {
+		if len(l.running) >= l.max {
+			l.held = append(l.held, id)
+			l.updates[id] = []heldUpdate{{show, done}}
+			return
+		}
+		l.running[id] = true
+	}
+	show()
+	if done {
+		delete(l.running, id)
+		l.promote()
+	}
+}
+
+// promote shows the held tool calls that fit in the free slots.
+func (l *toolLimiter) promote() {
+	for len(l.held) > 0 && len(l.running) < l.max {
+		id := l.held[0]
+		l.held = l.held[1:]
+		ups := l.updates[id]
+		delete(l.updates, id)
+		l.running[id] = true
+		for _, u := range ups {
+			u.show()
+			if u.done {
+				delete(l.running, id)
+			}
+		}
+	}
+}
+
+// endTurn shows all held tool calls, since agents don't always report the
+// end of the tool calls of a turn.
+func (l *toolLimiter) endTurn() {
+	for _, id := range l.held {
+		for _, u := range l.updates[id] {
+			u.show()
+		}
+	}
+	l.held = nil
+	l.running = nil
+	l.updates = nil
+}
+
+// toolCallDone reports whether a tool call with status has finished.
+func toolCallDone(status acp.ToolCallStatus) bool {
+	return status == acp.ToolCallStatusCompleted || status == acp.ToolCallStatusFailed
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+// agentLogLines is how many lines of the agent's stderr are kept.
+const agentLogLines = 1000
+
+// agentLog keeps the last lines the agent wrote to stderr, so that they don't
+// end up mixed with the logs of the plugin. The lines can also be mirrored
+// into a buffer as they come.
+type agentLog struct {
+	mu    sync.Mutex
+	lines []string // ring of up to agentLogLines lines, oldest at next when full
+	next  int
+	// partial is the last line, until its newline is written
+	partial []byte
+	// mirror is the buffer the lines are appended to, if any
+	mirror nvim.Buffer
+}
+
+func (l *agentLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	l.partial = append(l.partial, p...)
+	var lines []string
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimSuffix(l.partial[:i], []byte("\r")))
+		l.partial = l.partial[i+1:]
+		lines = append(lines, line)
+		if len(l.lines) < agentLogLines {
+			l.lines = append(l.lines, line)
+		} else {
+			l.lines[l.next] = line
+			l.next = (l.next + 1) % agentLogLines
+		}
+	}
+	mirror := l.mirror
+	l.mu.Unlock()
+
+	if mirror != 0 && len(lines) > 0 {
+		b := make([][]byte, len(lines))
+		for i, line := range lines {
+			b[i] = []byte(line)
+		}
+		if err := vim.api.SetBufferLines(mirror, -1, -1, false, b); err != nil {
+			// The buffer was most likely wiped out
+			logWarn("Stopped mirroring agent logs: %v", err)
+			l.mu.Lock()
+			if l.mirror == mirror {
+				l.mirror = 0
+			}
+			l.mu.Unlock()
+		}
+	}
+	return len(p), nil
+}
+
+// tail returns the last n lines, or all of them when n <= 0.
+func (l *agentLog) tail(n int) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]string, 0, len(l.lines))
+	out = append(out, l.lines[l.next:]...)
+	out = append(out, l.lines[:l.next]...)
+	if n > 0 && n < len(out) {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// AcpAgentLogs returns the last n lines the agent of a session wrote to
+// stderr, or all lines kept when n is 0
+func (m *SessionManager) AcpAgentLogs(bufnr int, n int) ([]string, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	return session.stderr.tail(n), nil
+}
+
+// AcpMirrorAgentLogs appends the lines the agent of a session writes to
+// stderr from now on to logBuf, or stops doing so when logBuf is 0
+func (m *SessionManager) AcpMirrorAgentLogs(bufnr int, logBuf int) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	session.stderr.mu.Lock()
+	session.stderr.mirror = nvim.Buffer(logBuf)
+	session.stderr.mu.Unlock()
+	return nil, nil
+}
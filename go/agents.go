@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+// AgentPreset describes a known ACP agent and how to launch it.
+type AgentPreset struct {
+	Name        string   `msgpack:"name"`
+	Description string   `msgpack:"description"`
+	Cmd         []string `msgpack:"cmd"`
+	// Env lists the environment variables the agent needs, unless the user
+	// logs in through the agent instead
+	Env []string `msgpack:"env"`
+	// Package is the package providing the command
+	Package string `msgpack:"package"`
+	// Install is the command installing the agent, if it can be installed
+	// without user interaction
+	Install []string `msgpack:"install"`
+}
+
+// agentPresets are the ACP agents known to the plugin.
+var agentPresets = []AgentPreset{
+	{
+		Name:        "claude-code",
+		Description: "Claude Code through Zed's ACP adapter",
+		Cmd:         []string{"claude-code-acp"},
+		Env:         []string{"ANTHROPIC_API_KEY"},
+		Package:     "@zed-industries/claude-code-acp",
+		Install:     []string{"npm", "install", "--global", "@zed-industries/claude-code-acp"},
+	},
+	{
+		Name:        "gemini",
+		Description: "Gemini CLI",
+		Cmd:         []string{"gemini", "--experimental-acp"},
+		Env:         []string{"GEMINI_API_KEY"},
+		Package:     "@google/gemini-cli",
+		Install:     []string{"npm", "install", "--global", "@google/gemini-cli"},
+	},
+	{
+		Name:        "codex",
+		Description: "OpenAI Codex through Zed's ACP adapter",
+		Cmd:         []string{"codex-acp"},
+		Env:         []string{"OPENAI_API_KEY"},
+		Package:     "@zed-industries/codex-acp",
+		Install:     []string{"npm", "install", "--global", "@zed-industries/codex-acp"},
+	},
+	{
+		Name:        "goose",
+		Description: "Goose by Block",
+		Cmd:         []string{"goose", "acp"},
+		Package:     "goose-cli",
+		Install:     []string{"cargo", "install", "--locked", "--git", "https://github.com/block/goose", "goose-cli"},
+	},
+	{
+		Name:        "opencode",
+		Description: "opencode",
+		Cmd:         []string{"opencode", "acp"},
+		Package:     "opencode-ai",
+		Install:     []string{"npm", "install", "--global", "opencode-ai"},
+	},
+	{
+		Name:        "qwen",
+		Description: "Qwen Code",
+		Cmd:         []string{"qwen", "--experimental-acp"},
+		Env:         []string{"DASHSCOPE_API_KEY"},
+		Package:     "@qwen-code/qwen-code",
+		Install:     []string{"npm", "install", "--global", "@qwen-code/qwen-code"},
+	},
+}
+
+// AgentStatus is an agent preset along with where its command was found.
+type AgentStatus struct {
+	AgentPreset
+	Installed bool   `msgpack:"installed"`
+	Path      string `msgpack:"path"`
+	// MissingEnv lists the variables of Env that are not set
+	MissingEnv []string `msgpack:"missing_env"`
+}
+
+// findAgentCommand looks for name in PATH, then in the node_modules/.bin
+// directories of the working directory and its parents, where npm installs
+// project dependencies.
+func findAgentCommand(name string) (string, bool) {
+	if path, err := exec.LookPath(name); err == nil {
+		return path, true
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", false
+	}
+	for {
+		path := filepath.Join(dir, "node_modules", ".bin", name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+// AcpListAgents reports the known agents and whether they are installed
+func (m *SessionManager) AcpListAgents() ([]AgentStatus, error) {
+	out := make([]AgentStatus, 0, len(agentPresets))
+	for _, preset := range agentPresets {
+		status := AgentStatus{AgentPreset: preset, MissingEnv: []string{}}
+		status.Path, status.Installed = findAgentCommand(preset.Cmd[0])
+		for _, name := range preset.Env {
+			if os.Getenv(name) == "" {
+				status.MissingEnv = append(status.MissingEnv, name)
+			}
+		}
+		out = append(out, status)
+	}
+	return out, nil
+}
+
+// AcpInstallAgent runs the install command of the agent preset called name,
+// streaming its output to the buffer logBuf. The editor is told the outcome
+// through require('acp').agent_installed.
+func (m *SessionManager) AcpInstallAgent(name string, logBuf int) (any, error) {
+	var preset *AgentPreset
+	for i := range agentPresets {
+		if agentPresets[i].Name == name {
+			preset = &agentPresets[i]
+		}
+	}
+	if preset == nil {
+		return nil, fmt.Errorf("unknown agent %s", name)
+	}
+	if len(preset.Install) == 0 {
+		return nil, fmt.Errorf("agent %s can't be installed automatically", name)
+	}
+
+	go func() {
+		err := runLogged(preset.Install, nvim.Buffer(logBuf))
+		if err == nil {
+			if _, ok := findAgentCommand(preset.Cmd[0]); !ok {
+				err = fmt.Errorf("%s is still not found after installing %s", preset.Cmd[0], preset.Package)
+			}
+		}
+		var msg any
+		if err != nil {
+			msg = err.Error()
+		}
+		if lErr := vim.api.ExecLua(`require('acp').agent_installed(...)`, nil, name, preset.Cmd, msg); lErr != nil {
+			logError("Error reporting installation of %s: %v", name, lErr)
+		}
+	}()
+	return nil, nil
+}
+
+// runLogged runs args, appending its output to buf line by line as it comes.
+func runLogged(args []string, buf nvim.Buffer) error {
+	appendLines := func(lines ...string) {
+		b := make([][]byte, len(lines))
+		for i, l := range lines {
+			b[i] = []byte(l)
+		}
+		if err := vim.api.SetBufferLines(buf, -1, -1, false, b); err != nil {
+			logError("Error appending to install log: %v", err)
+		}
+	}
+
+	appendLines("$ " + strings.Join(args, " "))
+	run := commandArgs(args)
+	cmd := exec.Command(run[0], run[1:]...)
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		appendLines(err.Error())
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			appendLines(scanner.Text())
+		}
+	}()
+	err := cmd.Wait()
+	pw.Close()
+	<-done
+	if err != nil {
+		appendLines(fmt.Sprintf("[%v]", err))
+		return err
+	}
+	appendLines("[Done]")
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// AcpApplyCodeOpts are the options of AcpApplyCodeBlock. Lines are 1-based.
+type AcpApplyCodeOpts struct {
+	// Placement is "cursor", "selection", "function", or "auto" (the
+	// default): the selection if any, else the function with the header
+	// of the block if found, else after the cursor
+	Placement string `msgpack:"placement"`
+	// Line is the line of the cursor in the target buffer
+	Line int `msgpack:"line"`
+	// Start and End are the lines of the selection, 0 without one
+	Start int `msgpack:"start"`
+	End   int `msgpack:"end"`
+}
+
+// definition matches the header of a function, method or class in most
+// languages. The group is the name.
+var definition = regexp.MustCompile(`^\s*(?:[\w.]+\s+)*?(?:func|function|def|fn|sub|class|struct|impl|interface|module|proc)\s+(?:\([^)]*\)\s*)?([\w.:$]+)`)
+
+// minHeaderSimilarity is the least similarity of a line of the target buffer
+// to the header of a code block to be taken for the same function.
+const minHeaderSimilarity = 0.6
+
+// AcpApplyCodeBlock puts code block id of the session of bufnr in target, 0
+// being the last block. The change is a single undo step and the '[ and ']
+// marks are set around it. Returns the placement used
+func (m *SessionManager) AcpApplyCodeBlock(bufnr, id, target int, opts AcpApplyCodeOpts) (string, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return "", err
+	}
+	session.flushBuffer()
+	block, ok := session.codeBlocks.get(id)
+	if !ok {
+		return "", fmt.Errorf("no code block %d", id)
+	}
+	code := strings.Split(strings.TrimSuffix(block.Content, "\n"), "\n")
+
+	tick, old, err := vim.bufferLines(target)
+	if err != nil {
+		return "", err
+	}
+
+	placement, start, end, err := placeCode(old, code, opts)
+	if err != nil {
+		return "", err
+	}
+	if placement == "function" {
+		code = reindent(code, old[start])
+	}
+	// An empty buffer has one empty line, which the code replaces
+	if len(old) == 1 && old[0] == "" {
+		start, end = 0, 1
+	}
+	lines := make([]string, 0, len(old)-(end-start)+len(code))
+	lines = append(append(append(lines, old[:start]...), code...), old[end:]...)
+
+	edit := bufferEdits(old, lines)
+	edit.Tick = tick
+	if err := vim.api.ExecLua(`require('acp').apply_edit(...)`, nil, target, lines, edit); err != nil {
+		return "", err
+	}
+	return placement, nil
+}
+
+// get returns code block id, or the last one for 0.
+func (cb *codeBlocks) get(id int) (CodeBlock, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if id == 0 {
+		id = len(cb.blocks)
+	}
+	if id < 1 || id > len(cb.blocks) {
+		return CodeBlock{}, false
+	}
+	return cb.blocks[id-1], true
+}
+
+// placeCode returns where code goes in lines: lines [start, end) are
+// replaced by it, 0-based.
+func placeCode(lines, code []string, opts AcpApplyCodeOpts) (placement string, start, end int, err error) {
+	placement = opts.Placement
+	if placement == "" || placement == "auto" {
+		switch {
+		case opts.Start > 0:
+			placement = "selection"
+		case findFunction(lines, code) >= 0:
+			placement = "function"
+		default:
+			placement = "cursor"
+		}
+	}
+
+	switch placement {
+	case "selection":
+		if opts.Start < 1 || opts.End < opts.Start || opts.End > len(lines) {
+			return "", 0, 0, fmt.Errorf("no selection")
+		}
+		return placement, opts.Start - 1, opts.End, nil
+	case "function":
+		header := findFunction(lines, code)
+		if header < 0 {
+			return "", 0, 0, fmt.Errorf("no function of the buffer matches the code block")
+		}
+		return placement, header, functionEnd(lines, header), nil
+	case "cursor":
+		line := min(max(opts.Line, 0), len(lines))
+		return placement, line, line, nil
+	}
+	return "", 0, 0, fmt.Errorf("unknown placement %q", placement)
+}
+
+// findFunction returns the line of lines most like the header of the
+// function in code, or -1 when none is alike enough.
+func findFunction(lines, code []string) int {
+	header := ""
+	for _, l := range code {
+		if definition.MatchString(l) {
+			header = l
+			break
+		}
+	}
+	if header == "" {
+		return -1
+	}
+	name := definition.FindStringSubmatch(header)[1]
+	words := identifiers(header)
+
+	best, bestScore := -1, minHeaderSimilarity
+	for i, l := range lines {
+		m := definition.FindStringSubmatch(l)
+		if m == nil {
+			continue
+		}
+		score := similarity(words, identifiers(l))
+		// A definition of the same name is the same function, even if
+		// its signature changed
+		if m[1] == name {
+			score += 1
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+var identifier = regexp.MustCompile(`[\w$]+`)
+
+func identifiers(line string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range identifier.FindAllString(line, -1) {
+		set[w] = true
+	}
+	return set
+}
+
+// similarity is the Jaccard index of a and b.
+func similarity(a, b map[string]bool) float64 {
+	common := 0
+	for w := range a {
+		if b[w] {
+			common++
+		}
+	}
+	union := len(a) + len(b) - common
+	if union == 0 {
+		return 0
+	}
+	return float64(common) / float64(union)
+}
+
+// functionEnd returns the line after the function whose header is at line
+// header: the first line indented no deeper than the header, unless it
+// closes the function. The blank lines after the function are kept.
+func functionEnd(lines []string, header int) int {
+	depth := indentOf(lines[header])
+	end := len(lines)
+	for i := header + 1; i < len(lines); i++ {
+		l := lines[i]
+		t := strings.TrimSpace(l)
+		if t == "" || len(indentOf(l)) > len(depth) {
+			continue
+		}
+		end = i
+		if strings.HasPrefix(t, "}") || strings.HasPrefix(t, ")") || strings.HasPrefix(t, "]") || t == "end" || strings.HasPrefix(t, "end ") {
+			return i + 1
+		}
+		break
+	}
+	for end > header+1 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	return end
+}
+
+func indentOf(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// reindent shifts code so that its header is indented like the line it
+// replaces.
+func reindent(code []string, replaced string) []string {
+	from := ""
+	for _, l := range code {
+		if definition.MatchString(l) {
+			from = indentOf(l)
+			break
+		}
+	}
+	to := indentOf(replaced)
+	if from == to {
+		return code
+	}
+	out := make([]string, len(code))
+	for i, l := range code {
+		if l != "" && strings.HasPrefix(l, from) {
+			l = to + l[len(from):]
+		}
+		out[i] = l
+	}
+	return out
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+// archiveIndex is the file of an archive directory listing its transcripts.
+const archiveIndex = "index.jsonl"
+
+// ArchiveEntry is a line of the index of an archive: a session whose
+// transcript is in File, relative to the archive directory.
+type ArchiveEntry struct {
+	File      string    `json:"file" msgpack:"file"`
+	SessionID string    `json:"session_id" msgpack:"session_id"`
+	Agent     string    `json:"agent" msgpack:"agent"`
+	Cwd       string    `json:"cwd" msgpack:"cwd"`
+	Start     time.Time `json:"start" msgpack:"-"`
+	// Title is the first prompt of the session, cut short
+	Title string `json:"title" msgpack:"title"`
+}
+
+// ArchiveQuery selects archived sessions. Empty fields match everything.
+type ArchiveQuery struct {
+	// Text are words that must all appear in the transcript, in any case
+	Text string `msgpack:"text"`
+	// Agent is part of the name of the agent's command, or of its address
+	Agent string `msgpack:"agent"`
+	// Project is part of the working directory of the session
+	Project string `msgpack:"project"`
+	// Since and Until are dates, as YYYY-MM-DD, bounding the start of the
+	// session
+	Since string `msgpack:"since"`
+	Until string `msgpack:"until"`
+	// Limit is the number of hits returned, 50 by default
+	Limit int `msgpack:"limit"`
+}
+
+// ArchiveHit is an archived session matching an ArchiveQuery.
+type ArchiveHit struct {
+	ArchiveEntry
+	// Path is the transcript file
+	Path string `msgpack:"path"`
+	// Date is the start of the session, as YYYY-MM-DD HH:MM
+	Date string `msgpack:"date"`
+	// Snippet is the text around the first match of the query text
+	Snippet string `msgpack:"snippet"`
+}
+
+const defaultArchiveHits = 50
+
+// archive writes the transcript of the session to its archive directory, if
+// it has one, at the end of each turn. The transcript is added to the index
+// of the archive the first time, so that sessions are found even if Neovim
+// doesn't exit cleanly. Only the turns of a session call it, one at a time.
+func (s *AcpSession) archive() {
+	if s.archiver.dir == "" || s.bufnr == 0 {
+		return
+	}
+	tr := s.snapshot()
+	if len(tr.Turns) == 0 {
+		return
+	}
+	if err := s.archiver.write(tr); err != nil {
+		logError("Error archiving session: %v", err)
+	}
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// archiver is where the transcript of a session is archived.
+type archiver struct {
+	dir string
+	// file is the name of the transcript in dir once it was written
+	file string
+}
+
+func (a *archiver) write(tr Transcript) error {
+	if err := os.MkdirAll(a.dir, 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(tr)
+	if err != nil {
+		return err
+	}
+	if a.file != "" {
+		return os.WriteFile(filepath.Join(a.dir, a.file), data, 0o600)
+	}
+
+	start := tr.Turns[0].Start
+	id := unsafeFileChars.ReplaceAllString(tr.SessionID, "_")
+	name := fmt.Sprintf("%s-%s.json", start.Format("20060102-150405"), id)
+	if err := os.WriteFile(filepath.Join(a.dir, name), data, 0o600); err != nil {
+		return err
+	}
+	a.file = name
+
+	entry := ArchiveEntry{
+		File:      name,
+		SessionID: tr.SessionID,
+		Agent:     tr.Agent,
+		Cwd:       tr.Cwd,
+		Start:     start,
+	}
+	for _, turn := range tr.Turns {
+		if t := strings.TrimSpace(turn.Prompt); t != "" {
+			entry.Title = truncate(strings.Join(strings.Fields(t), " "), 80)
+			break
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// Lines are appended in one write, so that Neovim instances sharing the
+	// archive don't mix them up
+	f, err := os.OpenFile(filepath.Join(a.dir, archiveIndex), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// truncate cuts s to at most n runes.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// AcpSearchArchive returns the sessions archived in dir matching query,
+// newest first
+func (m *SessionManager) AcpSearchArchive(dir string, query ArchiveQuery) ([]ArchiveHit, error) {
+	entries, err := readArchiveIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	var since, until time.Time
+	if query.Since != "" {
+		if since, err = time.ParseInLocation(time.DateOnly, query.Since, time.Local); err != nil {
+			return nil, fmt.Errorf("since: %w", err)
+		}
+	}
+	if query.Until != "" {
+		if until, err = time.ParseInLocation(time.DateOnly, query.Until, time.Local); err != nil {
+			return nil, fmt.Errorf("until: %w", err)
+		}
+		until = until.AddDate(0, 0, 1)
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultArchiveHits
+	}
+	words := strings.Fields(strings.ToLower(query.Text))
+
+	hits := []ArchiveHit{}
+	for i := len(entries) - 1; i >= 0 && len(hits) < limit; i-- {
+		e := entries[i]
+		switch {
+		case query.Agent != "" && !strings.Contains(e.Agent, query.Agent),
+			query.Project != "" && !strings.Contains(e.Cwd, query.Project),
+			!since.IsZero() && e.Start.Before(since),
+			!until.IsZero() && !e.Start.Before(until):
+			continue
+		}
+		hit := ArchiveHit{
+			ArchiveEntry: e,
+			Path:         filepath.Join(dir, e.File),
+			Date:         e.Start.Local().Format("2006-01-02 15:04"),
+		}
+		if len(words) > 0 {
+			snippet, ok := searchTranscript(hit.Path, words)
+			if !ok {
+				continue
+			}
+			hit.Snippet = snippet
+		}
+		hits = append(hits, hit)
+	}
+	return hits, nil
+}
+
+// readArchiveIndex returns the entries of the index of an archive, oldest
+// first. A missing archive is empty.
+func readArchiveIndex(dir string) ([]ArchiveEntry, error) {
+	f, err := os.Open(filepath.Join(dir, archiveIndex))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ArchiveEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e ArchiveEntry
+		// Skip lines cut short by a crash
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && e.File != "" {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// searchTranscript reports whether the transcript in path contains all of
+// words, which are lowercase, and returns the text around the first of them.
+func searchTranscript(path string, words []string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logWarn("Error reading archived session: %v", err)
+		return "", false
+	}
+	var tr Transcript
+	if err := json.Unmarshal(data, &tr); err != nil {
+		logWarn("Error reading archived session %s: %v", path, err)
+		return "", false
+	}
+
+	var texts []string
+	for _, turn := range tr.Turns {
+		texts = append(texts, turn.Prompt)
+		for _, ev := range turn.Events {
+			switch {
+			case ev.ToolCall != nil:
+				texts = append(texts, ev.ToolCall.Title)
+			default:
+				texts = append(texts, ev.Text)
+			}
+		}
+	}
+	lower := make([]string, len(texts))
+	for i, t := range texts {
+		lower[i] = strings.ToLower(t)
+	}
+	for _, w := range words {
+		if !slices.ContainsFunc(lower, func(t string) bool { return strings.Contains(t, w) }) {
+			return "", false
+		}
+	}
+
+	for i, t := range lower {
+		at := strings.Index(t, words[0])
+		if at < 0 {
+			continue
+		}
+		// Lowercasing may change the length of some characters, fall back to
+		// the start of the text then
+		text := texts[i]
+		if len(t) != len(text) {
+			at = 0
+		}
+		start, end := max(0, at-60), min(len(text), at+len(words[0])+60)
+		return strings.Join(strings.Fields(strings.ToValidUTF8(text[start:end], "")), " "), true
+	}
+	return "", true
+}
+
+// AcpLoadArchived renders an archived transcript as Markdown into outBuf
+func (m *SessionManager) AcpLoadArchived(path string, outBuf int) (any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tr Transcript
+	if err := json.Unmarshal(data, &tr); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	text := strings.TrimSuffix(tr.markdown(), "\n")
+	var lines [][]byte
+	for _, l := range strings.Split(text, "\n") {
+		lines = append(lines, []byte(l))
+	}
+	return nil, vim.api.SetBufferLines(nvim.Buffer(outBuf), 0, -1, false, lines)
+}
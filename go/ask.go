@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AcpAsk runs a single turn with a new agent process, without a chat buffer,
+// and returns the text the agent replied with
+func (m *SessionManager) AcpAsk(agent_cmd []string, prompt string, opts AcpNewSessionOpts) (any, error) {
+	if len(agent_cmd) == 0 {
+		return nil, fmt.Errorf("no agent command provided")
+	}
+	session, _, err := startSession(0, agent_cmd, opts, m.files)
+	if err != nil {
+		return nil, err
+	}
+	defer session.cleanup()
+
+	reply := &strings.Builder{}
+	session.mu.Lock()
+	session.reply = reply
+	session.mu.Unlock()
+
+	blocks, err := session.buildPrompt(prompt, AcpPromptOpts{})
+	if err != nil {
+		return nil, err
+	}
+	if err := session.prompt(blocks); err != nil {
+		return nil, err
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return reply.String(), nil
+}
+
+// collectReply records agent message text for sessions run by AcpAsk.
+func (s *AcpSession) collectReply(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reply != nil {
+		s.reply.WriteString(text)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// authRequiredCode is the JSON-RPC error code agents use when a request needs
+// the client to authenticate first.
+const authRequiredCode = -32000
+
+// isAuthRequired reports whether err is the agent asking for authentication.
+func isAuthRequired(err error) bool {
+	var re *acp.RequestError
+	return errors.As(err, &re) && re.Code == authRequiredCode
+}
+
+// errAuthCancelled is returned when the user doesn't pick an auth method.
+var errAuthCancelled = errors.New("authentication cancelled")
+
+// chooseAuthMethod lets the user pick one of the auth methods advertised by
+// the agent. The method preferred by the credential profile, or the only
+// method, is picked without asking.
+func (s *AcpSession) chooseAuthMethod() (acp.AuthMethod, error) {
+	methods := s.agentInfo.AuthMethods
+	if s.authMethod != "" {
+		for _, m := range methods {
+			if m.Id == s.authMethod {
+				return m, nil
+			}
+		}
+		logWarn("Auth method %s of profile %s is not offered by the agent", s.authMethod, s.profile)
+	}
+	switch len(methods) {
+	case 0:
+		return acp.AuthMethod{}, fmt.Errorf("agent requires authentication but advertises no auth method")
+	case 1:
+		return methods[0], nil
+	}
+
+	items := make([]string, len(methods))
+	for i, m := range methods {
+		items[i] = m.Name
+		if m.Description != nil && *m.Description != "" {
+			items[i] += " - " + *m.Description
+		}
+	}
+	s.flushBuffer()
+	choice, err := vim.uiSelect(items, selectOpts{Title: "Authenticate with:"})
+	if err != nil {
+		return acp.AuthMethod{}, err
+	}
+	if choice < 1 {
+		return acp.AuthMethod{}, errAuthCancelled
+	}
+	return methods[choice-1], nil
+}
+
+// authenticate runs the auth method chosen by the user.
+func (s *AcpSession) authenticate() error {
+	method, err := s.chooseAuthMethod()
+	if err != nil {
+		return err
+	}
+	if vim.api == nil && (authURL(method) != "" || needsAPIKey(method)) {
+		return fmt.Errorf("the agent needs to log in with %s, which can only be done in Neovim or with the agent itself", method.Name)
+	}
+	if url := authURL(method); url != "" {
+		return s.authenticateInBrowser(method, url)
+	}
+	if !needsAPIKey(method) {
+		if _, err := s.conn.Authenticate(s.ctx, acp.AuthenticateRequest{MethodId: method.Id}); err != nil {
+			return fmt.Errorf("authenticate with %s: %w", method.Name, err)
+		}
+		return nil
+	}
+
+	// Each profile has its own keys
+	name := s.agentName + "/" + string(method.Id)
+	if s.profile != "" {
+		name = s.agentName + "/" + s.profile + "/" + string(method.Id)
+	}
+	if s.secrets != nil {
+		key, ok, err := s.secrets.load(s.ctx, name)
+		if err != nil {
+			logError("Error loading API key %s: %v", name, err)
+		} else if ok && s.authenticateWithKey(method, key) == nil {
+			return nil
+		}
+	}
+
+	var key string
+	s.flushBuffer()
+	if err := vim.api.Call("inputsecret", &key, fmt.Sprintf("API key for %s: ", method.Name)); err != nil {
+		return fmt.Errorf("read API key: %w", err)
+	}
+	if key == "" {
+		return errAuthCancelled
+	}
+	if err := s.authenticateWithKey(method, key); err != nil {
+		return err
+	}
+
+	if s.secrets != nil {
+		choice, err := vim.uiSelect([]string{"Yes", "No"}, selectOpts{Title: fmt.Sprintf("Store the API key for %s (%s)?", method.Name, s.secrets.Type)})
+		if err == nil && choice == 1 {
+			if err := s.secrets.save(s.ctx, name, key); err != nil {
+				logError("Error storing API key %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// needsAPIKey reports whether the user must provide an API key for method.
+// ACP has no field for it, so agents mark such methods in _meta with
+// "type": "api_key" (or "env_var") or "api_key": true.
+func needsAPIKey(method acp.AuthMethod) bool {
+	meta, ok := method.Meta.(map[string]any)
+	if !ok {
+		return false
+	}
+	if t, _ := meta["type"].(string); t == "api_key" || t == "env_var" {
+		return true
+	}
+	b, _ := meta["api_key"].(bool)
+	return b
+}
+
+// authenticateWithKey runs method, passing key to the agent in _meta.
+func (s *AcpSession) authenticateWithKey(method acp.AuthMethod, key string) error {
+	_, err := s.conn.Authenticate(s.ctx, acp.AuthenticateRequest{
+		MethodId: method.Id,
+		Meta:     map[string]any{"api_key": key},
+	})
+	if err != nil {
+		return fmt.Errorf("authenticate with %s: %w", method.Name, err)
+	}
+	return nil
+}
+
+// newSession creates the ACP session, authenticating and trying once more
+// when the agent requires it.
+func (s *AcpSession) newSession(req acp.NewSessionRequest) (acp.NewSessionResponse, error) {
+	res, err := s.conn.NewSession(s.ctx, req)
+	if err != nil && isAuthRequired(err) {
+		if authErr := s.authenticate(); authErr != nil {
+			return acp.NewSessionResponse{}, authErr
+		}
+		res, err = s.conn.NewSession(s.ctx, req)
+	}
+	if err == nil {
+		if !s.supports(featureModes) {
+			res.Modes = nil
+		}
+		s.setModes(res.Modes)
+		s.setModels(res.Models)
+	}
+	return res, err
+}
+
+// authURL returns the page the user must visit to complete method, taken
+// from "url" in its _meta or else from its description.
+func authURL(method acp.AuthMethod) string {
+	if meta, ok := method.Meta.(map[string]any); ok {
+		if u, _ := meta["url"].(string); u != "" {
+			return u
+		}
+	}
+	if method.Description != nil {
+		return urlPattern.FindString(*method.Description)
+	}
+	return ""
+}
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"')]+`)
+
+// authenticateInBrowser runs an OAuth or device code method: the login page
+// is opened with the platform opener and the user code, if any, shown to the
+// user. The agent either answers authenticate once the login completes, or
+// keeps answering auth_required until then, in which case it is polled at
+// the interval and until the expiry given in _meta.
+func (s *AcpSession) authenticateInBrowser(method acp.AuthMethod, url string) error {
+	interval, expiresIn := 5*time.Second, 5*time.Minute
+	var userCode string
+	if meta, ok := method.Meta.(map[string]any); ok {
+		userCode, _ = meta["user_code"].(string)
+		if v, ok := meta["interval"].(float64); ok && v > 0 {
+			interval = time.Duration(v * float64(time.Second))
+		}
+		if v, ok := meta["expires_in"].(float64); ok && v > 0 {
+			expiresIn = time.Duration(v * float64(time.Second))
+		}
+	}
+
+	msg := fmt.Sprintf("Log in to %s at %s", method.Name, url)
+	if userCode != "" {
+		msg += fmt.Sprintf(" with the code %s", userCode)
+	}
+	s.appendToBuffer(fmt.Sprintf("[%s]\n", msg))
+	if err := vim.api.ExecLua(`vim.notify(...)`, nil, msg); err != nil {
+		logError("Error showing login message: %v", err)
+	}
+	if err := vim.api.ExecLua(`local _, err = vim.ui.open(...) if err then error(err) end`, nil, url); err != nil {
+		logError("Error opening %s: %v", url, err)
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, expiresIn)
+	defer cancel()
+	for {
+		_, err := s.conn.Authenticate(ctx, acp.AuthenticateRequest{MethodId: method.Id})
+		if err == nil {
+			s.appendToBuffer("[Logged in]\n")
+			return nil
+		}
+		if !isAuthRequired(err) {
+			return fmt.Errorf("authenticate with %s: %w", method.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("authenticate with %s: login not completed in %s", method.Name, expiresIn)
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "testing"
+
+func TestPermissionDeniedIsNotAuthRequired(t *testing.T) {
+	if isAuthRequired(errPermissionDenied) {
+		t.Errorf("agents would take the denial for auth_required: %v", errPermissionDenied)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import "strings"
+
+// TurnBookmark is where a turn is in the chat buffer. Lines are 1-based and
+// bytes 0-based, both are 0 when the lines were trimmed from the buffer.
+type TurnBookmark struct {
+	// Turn is the number of the turn in the session, from 1
+	Turn       int `msgpack:"turn"`
+	PromptLine int `msgpack:"prompt_line"`
+	PromptByte int `msgpack:"prompt_byte"`
+	// ReplyLine is the first line of the reply of the agent
+	ReplyLine int `msgpack:"reply_line"`
+	ReplyByte int `msgpack:"reply_byte"`
+	// Title is the first line of the prompt, cut short
+	Title string `msgpack:"title"`
+	// Time is the start of the turn, as HH:MM
+	Time       string `msgpack:"time"`
+	DurationMs int64  `msgpack:"duration_ms"`
+	ToolCalls  int    `msgpack:"tool_calls"`
+}
+
+// turnPosition is the position of a bookmark returned by turn_positions in
+// Lua.
+type turnPosition struct {
+	PromptLine int `msgpack:"prompt_line"`
+	PromptByte int `msgpack:"prompt_byte"`
+	ReplyLine  int `msgpack:"reply_line"`
+	ReplyByte  int `msgpack:"reply_byte"`
+}
+
+// newMark returns the ID of a new bookmark, for a turn recorded otherwise
+// than by startTurn.
+func (t *transcript) newMark() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.marks++
+	return t.marks
+}
+
+// markTurn bookmarks the turn being shown in the chat buffer. It must be
+// called once the prompt is in the buffer, and before the reply.
+func (s *AcpSession) markTurn(id int) {
+	s.callLua(`require('acp').mark_turn(...)`, s.bufnr, id)
+}
+
+// AcpTurns returns the bookmarks of the turns of a session, for a table of
+// contents of the chat buffer
+func (m *SessionManager) AcpTurns(bufnr int) ([]TurnBookmark, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	// Bookmarks are set along with the text
+	session.flushBuffer()
+	tr := session.snapshot()
+
+	var ids []int
+	for _, turn := range tr.Turns {
+		if turn.mark != 0 {
+			ids = append(ids, turn.mark)
+		}
+	}
+	var positions []turnPosition
+	if len(ids) > 0 {
+		if err := vim.api.ExecLua(`return require('acp').turn_positions(...)`, &positions, bufnr, ids); err != nil {
+			return nil, err
+		}
+	}
+
+	bookmarks := []TurnBookmark{}
+	for i, turn := range tr.Turns {
+		if turn.mark == 0 {
+			continue
+		}
+		b := TurnBookmark{
+			Turn:       i + 1,
+			Time:       turn.Start.Local().Format("15:04"),
+			DurationMs: turn.DurationMs,
+		}
+		if len(bookmarks) < len(positions) {
+			p := positions[len(bookmarks)]
+			b.PromptLine, b.PromptByte = p.PromptLine, p.PromptByte
+			b.ReplyLine, b.ReplyByte = p.ReplyLine, p.ReplyByte
+		}
+		title, _, _ := strings.Cut(strings.TrimSpace(turn.Prompt), "\n")
+		b.Title = truncate(title, 80)
+		for _, ev := range turn.Events {
+			if ev.ToolCall != nil {
+				b.ToolCalls++
+			}
+		}
+		bookmarks = append(bookmarks, b)
+	}
+	return bookmarks, nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AcpBroadcastPrompt sends the same prompt to the sessions of several chat
+// buffers. The agents answer concurrently, each in its own chat buffer
+func (m *SessionManager) AcpBroadcastPrompt(bufnrs []int, prompt string, opts AcpPromptOpts) (any, error) {
+	var failed []string
+	for _, bufnr := range bufnrs {
+		if _, err := m.AcpSendPrompt(bufnr, prompt, opts); err != nil {
+			failed = append(failed, fmt.Sprintf("buffer %d: %v", bufnr, err))
+		}
+	}
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("prompt not sent to %s", strings.Join(failed, ", "))
+	}
+	return nil, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// ContextLimits bounds the size of the attachments sent with a prompt. Zero
+// fields use the defaults below and negative ones disable the limit. Images,
+// audio and other binary attachments can't be cut, so they have a limit of
+// their own and don't count in the total of the text.
+type ContextLimits struct {
+	// MaxBlockBytes caps a single text attachment.
+	MaxBlockBytes int `json:"max_block_bytes" msgpack:"max_block_bytes"`
+	// MaxTotalBytes caps the text attachments of a prompt together.
+	MaxTotalBytes int `json:"max_total_bytes" msgpack:"max_total_bytes"`
+	// MaxBinaryBytes caps a single binary attachment, base64-encoded.
+	MaxBinaryBytes int `json:"max_binary_bytes" msgpack:"max_binary_bytes"`
+}
+
+const (
+	defaultMaxBlockBytes  = 256 * 1024
+	defaultMaxTotalBytes  = 1024 * 1024
+	defaultMaxBinaryBytes = 20 * 1024 * 1024
+)
+
+func limitOrDefault(v, def int) int {
+	switch {
+	case v == 0:
+		return def
+	case v < 0:
+		return -1
+	}
+	return v
+}
+
+// truncateText cuts s to at most n bytes, at a line break when there is one
+// in the second half of the kept text, and never inside a UTF-8 sequence.
+func truncateText(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	kept := s[:n]
+	if i := strings.LastIndexByte(kept, '\n'); i > n/2 {
+		kept = kept[:i+1]
+	}
+	return kept
+}
+
+// blockText returns the text of blocks that can be truncated.
+func blockText(b acp.ContentBlock) (string, bool) {
+	switch {
+	case b.Text != nil:
+		return b.Text.Text, true
+	case b.Resource != nil && b.Resource.Resource.TextResourceContents != nil:
+		return b.Resource.Resource.TextResourceContents.Text, true
+	}
+	return "", false
+}
+
+// withText returns a copy of b, a block with text, with text in place of its
+// own. The contents of b are shared with the prompt the user sent, which is
+// kept, so they are copied rather than changed.
+func withText(b acp.ContentBlock, text string) acp.ContentBlock {
+	switch {
+	case b.Text != nil:
+		t := *b.Text
+		t.Text = text
+		b.Text = &t
+	case b.Resource != nil && b.Resource.Resource.TextResourceContents != nil:
+		r := *b.Resource
+		c := *r.Resource.TextResourceContents
+		c.Text = text
+		r.Resource.TextResourceContents = &c
+		b.Resource = &r
+	}
+	return b
+}
+
+// binarySize returns the size of the data of binary blocks, and whether b is
+// one.
+func binarySize(b acp.ContentBlock) (int, bool) {
+	switch {
+	case b.Image != nil:
+		return len(b.Image.Data), true
+	case b.Audio != nil:
+		return len(b.Audio.Data), true
+	case b.Resource != nil && b.Resource.Resource.BlobResourceContents != nil:
+		return len(b.Resource.Resource.BlobResourceContents.Blob), true
+	}
+	return 0, false
+}
+
+// applyLimits truncates text attachments that go over the session's limits,
+// marking the cut in the text, and drops binary attachments over theirs, as
+// they can't be cut. It returns a warning for each attachment it changed.
+func (s *AcpSession) applyLimits(blocks []acp.ContentBlock) ([]acp.ContentBlock, []string) {
+	maxBlock := limitOrDefault(s.contextLimits.MaxBlockBytes, defaultMaxBlockBytes)
+	maxTotal := limitOrDefault(s.contextLimits.MaxTotalBytes, defaultMaxTotalBytes)
+	maxBinary := limitOrDefault(s.contextLimits.MaxBinaryBytes, defaultMaxBinaryBytes)
+
+	var warnings []string
+	out := make([]acp.ContentBlock, 0, len(blocks))
+	total := 0
+	for i, b := range blocks {
+		if size, ok := binarySize(b); ok {
+			if maxBinary >= 0 && size > maxBinary {
+				warnings = append(warnings, fmt.Sprintf("attachment %d (%d bytes) dropped: over the size limit of binary attachments", i+1, size))
+				continue
+			}
+			out = append(out, b)
+			continue
+		}
+
+		text, ok := blockText(b)
+		if !ok {
+			// Links to resources have no content to count
+			out = append(out, b)
+			continue
+		}
+		size := len(text)
+		allowed := size
+		if maxBlock >= 0 {
+			allowed = min(allowed, maxBlock)
+		}
+		if maxTotal >= 0 {
+			allowed = min(allowed, max(maxTotal-total, 0))
+		}
+		if allowed >= size {
+			out = append(out, b)
+			total += size
+			continue
+		}
+		if allowed == 0 {
+			warnings = append(warnings, fmt.Sprintf("attachment %d (%d bytes) dropped: over the context size limit", i+1, size))
+			continue
+		}
+		kept := truncateText(text, allowed)
+		out = append(out, withText(b, kept+fmt.Sprintf("\n[... truncated %d of %d bytes ...]\n", size-len(kept), size)))
+		warnings = append(warnings, fmt.Sprintf("attachment %d truncated from %d to %d bytes", i+1, size, len(kept)))
+		total += len(kept)
+	}
+	return out, warnings
+}
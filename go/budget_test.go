@@ -0,0 +1,96 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{name: "fits", s: "hello", n: 5, want: "hello"},
+		{name: "cut", s: "hello world", n: 5, want: "hello"},
+		{name: "zero", s: "hello", n: 0, want: ""},
+		{name: "at a line break", s: "one two\nthree four", n: 12, want: "one two\n"},
+		{name: "line break too early", s: "a\nbcdefghij", n: 8, want: "a\nbcdefg"},
+		{name: "in a 2-byte character", s: "aé", n: 2, want: "a"},
+		{name: "in a 4-byte character", s: "ab😀", n: 5, want: "ab"},
+		{name: "after a character", s: "é😀", n: 2, want: "é"},
+		{name: "only a cut character", s: "😀", n: 3, want: ""},
+	}
+	for _, tt := range tests {
+		if got := truncateText(tt.s, tt.n); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyLimits(t *testing.T) {
+	text := func(n int) acp.ContentBlock { return acp.TextBlock(strings.Repeat("x", n)) }
+	resource := acp.ResourceBlock(acp.EmbeddedResourceResource{
+		TextResourceContents: &acp.TextResourceContents{Uri: "file:///a.txt", Text: strings.Repeat("y", 100)},
+	})
+	image := acp.ImageBlock(strings.Repeat("A", 2<<20), "image/png")
+	audio := acp.AudioBlock(strings.Repeat("A", 300<<10), "audio/wav")
+	link := acp.ResourceLinkBlock("a.txt", "file:///a.txt")
+
+	tests := []struct {
+		name   string
+		limits ContextLimits
+		blocks []acp.ContentBlock
+		// sizes are those of the blocks kept, -1 for a link
+		sizes    []int
+		warnings int
+	}{
+		{name: "within the limits", blocks: []acp.ContentBlock{text(10), resource}, sizes: []int{10, 100}},
+		{name: "block over its limit", limits: ContextLimits{MaxBlockBytes: 50}, blocks: []acp.ContentBlock{resource, text(10)}, sizes: []int{50, 10}, warnings: 1},
+		{name: "over the total", limits: ContextLimits{MaxTotalBytes: 120}, blocks: []acp.ContentBlock{resource, text(50), text(10)}, sizes: []int{100, 20}, warnings: 2},
+		{name: "no limits", limits: ContextLimits{MaxBlockBytes: -1, MaxTotalBytes: -1}, blocks: []acp.ContentBlock{text(2 << 20)}, sizes: []int{2 << 20}},
+		{name: "default block limit", blocks: []acp.ContentBlock{text(300 << 10)}, sizes: []int{defaultMaxBlockBytes}, warnings: 1},
+		{name: "images and audio aren't text", blocks: []acp.ContentBlock{image, audio, text(10)}, sizes: []int{2 << 20, 300 << 10, 10}},
+		{name: "binary over its limit", limits: ContextLimits{MaxBinaryBytes: 1 << 20}, blocks: []acp.ContentBlock{image, audio}, sizes: []int{300 << 10}, warnings: 1},
+		{name: "no binary limit", limits: ContextLimits{MaxBinaryBytes: -1}, blocks: []acp.ContentBlock{acp.ImageBlock(strings.Repeat("A", 30<<20), "image/png")}, sizes: []int{30 << 20}},
+		{name: "links", limits: ContextLimits{MaxTotalBytes: 1}, blocks: []acp.ContentBlock{link}, sizes: []int{-1}},
+	}
+	for _, tt := range tests {
+		s := &AcpSession{contextLimits: tt.limits}
+		out, warnings := s.applyLimits(tt.blocks)
+		if len(warnings) != tt.warnings {
+			t.Errorf("%s: got warnings %q, want %d", tt.name, warnings, tt.warnings)
+		}
+		var sizes []int
+		for _, b := range out {
+			if size, ok := binarySize(b); ok {
+				sizes = append(sizes, size)
+			} else if text, ok := blockText(b); ok {
+				// Without the mark of the cut
+				kept, _, _ := strings.Cut(text, "\n[... truncated")
+				sizes = append(sizes, len(kept))
+			} else {
+				sizes = append(sizes, -1)
+			}
+		}
+		if !slices.Equal(sizes, tt.sizes) {
+			t.Errorf("%s: got blocks of %v bytes, want %v", tt.name, sizes, tt.sizes)
+		}
+	}
+}
+
+func TestApplyLimitsKeepsBlocks(t *testing.T) {
+	blocks := []acp.ContentBlock{acp.TextBlock("hello world")}
+	s := &AcpSession{contextLimits: ContextLimits{MaxBlockBytes: 5}}
+	out, _ := s.applyLimits(blocks)
+	if got := blocks[0].Text.Text; got != "hello world" {
+		t.Errorf("the block given was changed to %q", got)
+	}
+	if got := out[0].Text.Text; !strings.HasPrefix(got, "hello\n[... truncated 6 of 11 bytes ...]") {
+		t.Errorf("got %q", got)
+	}
+}
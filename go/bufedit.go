@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// textEdit replaces text of a buffer like nvim_buf_set_text: rows and
+// columns are 0-based, columns are in bytes and the end is exclusive.
+type textEdit struct {
+	StartRow int      `msgpack:"start_row"`
+	StartCol int      `msgpack:"start_col"`
+	EndRow   int      `msgpack:"end_row"`
+	EndCol   int      `msgpack:"end_col"`
+	Lines    []string `msgpack:"lines"`
+}
+
+// bufferEdit is the change of the content of a buffer to the agent's version
+// of the file, applied by apply_edit in Lua.
+type bufferEdit struct {
+	// Tick is the changedtick of the buffer the edits were computed for.
+	// The edits are only valid if the buffer hasn't changed since.
+	Tick int `msgpack:"tick"`
+	// Edits are sorted from the bottom of the buffer to the top, so that
+	// applying one doesn't move the others
+	Edits []textEdit `msgpack:"edits"`
+	// First and Last are the 1-based lines around the changes once applied
+	First int `msgpack:"first"`
+	Last  int `msgpack:"last"`
+}
+
+// lineHunk is a run of changed lines: old lines [oldStart, oldEnd) become new
+// lines [newStart, newEnd).
+type lineHunk struct {
+	oldStart, oldEnd int
+	newStart, newEnd int
+}
+
+// bufferEdits returns the edits turning the lines old into new. Only the
+// changed text is replaced, so marks, extmarks and folds elsewhere stay in
+// place.
+func bufferEdits(old, new []string) bufferEdit {
+	hunks := lineHunks(old, new)
+	if len(hunks) == 0 {
+		return bufferEdit{}
+	}
+
+	text := strings.Join(old, "\n")
+	// starts[i] is the offset of line i in text, as if text ended with a
+	// newline
+	starts := make([]int, len(old)+1)
+	for i, l := range old {
+		starts[i+1] = starts[i] + len(l) + 1
+	}
+	pos := func(off int) (row, col int) {
+		row = sort.Search(len(starts), func(i int) bool { return starts[i] > off }) - 1
+		return row, off - starts[row]
+	}
+
+	last := hunks[len(hunks)-1]
+	edit := bufferEdit{
+		First: min(hunks[0].newStart+1, len(new)),
+		Last:  min(max(last.newEnd, last.newStart+1), len(new)),
+	}
+	for i := len(hunks) - 1; i >= 0; i-- {
+		h := hunks[i]
+		start, end := starts[h.oldStart], starts[h.oldEnd]
+		repl := ""
+		if h.newEnd > h.newStart {
+			repl = strings.Join(new[h.newStart:h.newEnd], "\n") + "\n"
+		}
+		// The last line has no newline to replace, so take the newline
+		// before the hunk instead
+		if end > len(text) {
+			if start > 0 {
+				start, end = start-1, end-1
+				if repl != "" {
+					repl = "\n" + strings.TrimSuffix(repl, "\n")
+				}
+			} else {
+				end--
+				repl = strings.TrimSuffix(repl, "\n")
+			}
+		}
+
+		// Leave out the text the lines have in common
+		cur := text[start:end]
+		p := 0
+		for p < len(cur) && p < len(repl) && cur[p] == repl[p] {
+			p++
+		}
+		// Without splitting characters, which would leave invalid text
+		// in the buffer between the edits
+		for p > 0 && !(runeStart(cur, p) && runeStart(repl, p)) {
+			p--
+		}
+		q := 0
+		for q < len(cur)-p && q < len(repl)-p && cur[len(cur)-1-q] == repl[len(repl)-1-q] {
+			q++
+		}
+		for q > 0 && !(runeStart(cur, len(cur)-q) && runeStart(repl, len(repl)-q)) {
+			q--
+		}
+		start, end, repl = start+p, end-q, repl[p:len(repl)-q]
+
+		te := textEdit{Lines: strings.Split(repl, "\n")}
+		te.StartRow, te.StartCol = pos(start)
+		te.EndRow, te.EndCol = pos(end)
+		edit.Edits = append(edit.Edits, te)
+	}
+	return edit
+}
+
+// lineHunks returns the runs of changed lines between old and new. When the
+// files are too different to diff, all lines between the common prefix and
+// suffix make up a single hunk.
+func lineHunks(old, new []string) []lineHunk {
+	ops, ok := diffLines(old, new, maxDiffEdits)
+	if !ok {
+		pre := 0
+		for pre < len(old) && pre < len(new) && old[pre] == new[pre] {
+			pre++
+		}
+		suf := 0
+		for suf < len(old)-pre && suf < len(new)-pre && old[len(old)-1-suf] == new[len(new)-1-suf] {
+			suf++
+		}
+		return []lineHunk{{pre, len(old) - suf, pre, len(new) - suf}}
+	}
+
+	var hunks []lineHunk
+	i, k := 0, 0
+	for n := 0; n < len(ops); {
+		if ops[n].kind == ' ' {
+			i, k, n = i+1, k+1, n+1
+			continue
+		}
+		h := lineHunk{oldStart: i, newStart: k}
+		for ; n < len(ops) && ops[n].kind != ' '; n++ {
+			if ops[n].kind == '-' {
+				i++
+			} else {
+				k++
+			}
+		}
+		h.oldEnd, h.newEnd = i, k
+		hunks = append(hunks, h)
+	}
+	return hunks
+}
+
+// runeStart reports whether offset i of s is at the start of a character or
+// at the end of s.
+func runeStart(s string, i int) bool {
+	return i >= len(s) || utf8.RuneStart(s[i])
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// applyEdits applies edit to lines like apply_edit does with
+// nvim_buf_set_text.
+func applyEdits(lines []string, edit bufferEdit) []string {
+	lines = slices.Clone(lines)
+	for _, e := range edit.Edits {
+		repl := slices.Clone(e.Lines)
+		repl[0] = lines[e.StartRow][:e.StartCol] + repl[0]
+		repl[len(repl)-1] += lines[e.EndRow][e.EndCol:]
+		lines = slices.Concat(lines[:e.StartRow], repl, lines[e.EndRow+1:])
+	}
+	return lines
+}
+
+// checkEdits checks that edit turns old into new without splitting
+// characters.
+func checkEdits(t *testing.T, name string, old, new []string, edit bufferEdit) {
+	t.Helper()
+	if got := applyEdits(old, edit); !slices.Equal(got, new) {
+		t.Errorf("%s: the edits %+v turn %q into %q, want %q", name, edit.Edits, old, got, new)
+	}
+	for _, e := range edit.Edits {
+		if !utf8.ValidString(old[e.StartRow][:e.StartCol]) || !utf8.ValidString(old[e.EndRow][e.EndCol:]) {
+			t.Errorf("%s: the edit %+v splits a character", name, e)
+		}
+	}
+}
+
+func TestBufferEdits(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new []string
+		// edits is the number of edits, first and last the lines around the
+		// changes
+		edits, first, last int
+	}{
+		{name: "no change", old: []string{"a", "b"}, new: []string{"a", "b"}},
+		{name: "empty buffer filled", old: []string{""}, new: []string{"one", "two"}, edits: 1, first: 1, last: 2},
+		{name: "buffer emptied", old: []string{"one", "two"}, new: []string{""}, edits: 1, first: 1, last: 1},
+		{name: "change in a line", old: []string{"a", "hello world", "c"}, new: []string{"a", "hello there", "c"}, edits: 1, first: 2, last: 2},
+		{name: "line added at the end", old: []string{"a"}, new: []string{"a", "b"}, edits: 1, first: 2, last: 2},
+		{name: "last line removed", old: []string{"a", "b"}, new: []string{"a"}, edits: 1, first: 1, last: 1},
+		{name: "first line removed", old: []string{"a", "b"}, new: []string{"b"}, edits: 1, first: 1, last: 1},
+		{name: "two hunks", old: []string{"a", "b", "c", "d", "e"}, new: []string{"A", "b", "c", "d", "E"}, edits: 2, first: 1, last: 5},
+		{name: "CRLF lines", old: []string{"a\r", "b\r"}, new: []string{"a\r", "B\r", "c\r"}, edits: 1, first: 2, last: 3},
+		{name: "CR removed", old: []string{"a\r", "b\r"}, new: []string{"a", "b"}, edits: 1, first: 1, last: 2},
+		{name: "character with the same first byte", old: []string{"café"}, new: []string{"cafè"}, edits: 1, first: 1, last: 1},
+		{name: "character with the same last byte", old: []string{"aé"}, new: []string{"aŉ"}, edits: 1, first: 1, last: 1},
+		{name: "emoji", old: []string{"x😀y"}, new: []string{"x😃y"}, edits: 1, first: 1, last: 1},
+	}
+	for _, tt := range tests {
+		edit := bufferEdits(tt.old, tt.new)
+		checkEdits(t, tt.name, tt.old, tt.new, edit)
+		if len(edit.Edits) != tt.edits || edit.First != tt.first || edit.Last != tt.last {
+			t.Errorf("%s: got %d edits around lines %d-%d, want %d around %d-%d", tt.name, len(edit.Edits), edit.First, edit.Last, tt.edits, tt.first, tt.last)
+		}
+	}
+}
+
+func TestBufferEditsRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	words := []string{"", "a", "b", "é", "è", "😀", "\r", "ab"}
+	randomLines := func() []string {
+		lines := make([]string, 1+r.Intn(5))
+		for i := range lines {
+			for n := r.Intn(3); n > 0; n-- {
+				lines[i] += words[r.Intn(len(words))]
+			}
+		}
+		return lines
+	}
+	for i := 0; i < 2000; i++ {
+		old, new := randomLines(), randomLines()
+		checkEdits(t, strings.Join(old, "|")+" -> "+strings.Join(new, "|"), old, new, bufferEdits(old, new))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// cancellation follows the cancellation of a turn. The agent doesn't stop at
+// once: it may send updates until it ends the turn with the cancelled stop
+// reason, and the next prompt only goes once it did.
+type cancellation struct {
+	// running is set while a turn is in progress
+	running atomic.Bool
+	// requested is set once the turn in progress is cancelled
+	requested atomic.Bool
+	// after is set once the updates received before the cancellation are
+	// handled, in the update queue
+	after bool
+	// dropped counts the chunks received after the cancellation, which
+	// are left out of the chat buffer
+	dropped int
+}
+
+// startCancellable clears the cancellation of the previous turn.
+func (s *AcpSession) startCancellable() {
+	s.cancelling.requested.Store(false)
+	s.cancelling.running.Store(true)
+	s.updates.push(func(context.Context) {
+		s.cancelling.after = false
+		s.cancelling.dropped = 0
+	})
+}
+
+// requestCancel marks the turn in progress as cancelled. The updates queued
+// so far are still rendered.
+func (s *AcpSession) requestCancel() {
+	if !s.cancelling.running.Load() || s.cancelling.requested.Swap(true) {
+		return
+	}
+	s.callLua(`require('acp').on_cancel(...)`, s.bufnr, true)
+	s.updates.push(func(context.Context) {
+		s.cancelling.after = true
+		s.appendToBuffer("\n[Cancelling, waiting for the agent to end the turn]\n")
+	})
+}
+
+// dropAfterCancel reports whether a chunk of the reply or thoughts came
+// after the cancellation, and counts it. It runs in the update queue.
+func (s *AcpSession) dropAfterCancel() bool {
+	if !s.cancelling.after {
+		return false
+	}
+	s.cancelling.dropped++
+	return true
+}
+
+// endCancellable reports the end of a turn if it was cancelled. It runs in
+// the update queue, after the updates of the turn.
+func (s *AcpSession) endCancellable(reason acp.StopReason, err error) {
+	s.cancelling.running.Store(false)
+	if !s.cancelling.requested.Load() {
+		return
+	}
+	defer s.callLua(`require('acp').on_cancel(...)`, s.bufnr, false)
+	if err != nil {
+		return
+	}
+	if reason != acp.StopReasonCancelled {
+		logWarn("The agent ended the cancelled turn with stop reason %q", reason)
+	}
+	if s.cancelling.dropped > 0 {
+		s.appendToBuffer(fmt.Sprintf("[%d chunks received after the cancellation not shown]\n", s.cancelling.dropped))
+	}
+	s.appendToBuffer("Cancelled.\n")
+}
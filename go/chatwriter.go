@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// chatFlushDelay is how long text is held back to be appended along
+	// with the chunks that follow it
+	chatFlushDelay = 40 * time.Millisecond
+	// chatFlushSize is the size of held back text beyond which it is
+	// appended right away
+	chatFlushSize = 8 * 1024
+)
+
+// chatWriter coalesces the text appended to a chat buffer. Agents stream
+// their replies a few characters at a time, and appending each chunk with its
+// own ExecLua call makes Neovim stutter. Since all text of a session goes
+// through the same writer, tool calls and diffs stay in order with the
+// chunks around them. Other Lua calls made while handling an update can go
+// through the writer too, to be sent in the same call_atomic request as the
+// text around them.
+type chatWriter struct {
+	mu      sync.Mutex
+	pending strings.Builder
+	// calls are made before the pending text is appended
+	calls []luaCall
+	timer *time.Timer
+}
+
+type luaCall struct {
+	code string
+	args []any
+}
+
+// write appends text to the chat buffer bufnr, soon.
+func (w *chatWriter) write(bufnr int, text string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending.WriteString(text)
+	if w.pending.Len() >= chatFlushSize {
+		w.flushLocked(bufnr)
+	} else {
+		w.schedule(bufnr)
+	}
+}
+
+// call runs Lua code with args after the text written so far is appended,
+// soon.
+func (w *chatWriter) call(bufnr int, code string, args ...any) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.takePending(bufnr)
+	w.calls = append(w.calls, luaCall{code, args})
+	w.schedule(bufnr)
+}
+
+// takePending turns the pending text into a call.
+func (w *chatWriter) takePending(bufnr int) {
+	if w.pending.Len() == 0 {
+		return
+	}
+	w.calls = append(w.calls, luaCall{`require('acp').append_text(...)`, []any{bufnr, w.pending.String()}})
+	w.pending.Reset()
+}
+
+func (w *chatWriter) schedule(bufnr int) {
+	if w.timer == nil {
+		w.timer = time.AfterFunc(chatFlushDelay, func() { w.flush(bufnr) })
+	}
+}
+
+// flush appends the held back text now, e.g. before asking the user
+// something about it.
+func (w *chatWriter) flush(bufnr int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushLocked(bufnr)
+}
+
+// flushLocked sends the held back text and calls while holding mu, so that a
+// flush can't overtake another.
+func (w *chatWriter) flushLocked(bufnr int) {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.takePending(bufnr)
+	if len(w.calls) == 0 {
+		return
+	}
+	calls := w.calls
+	w.calls = nil
+	if len(calls) == 1 {
+		if err := vim.api.ExecLua(calls[0].code, nil, calls[0].args...); err != nil {
+			logError("Error updating chat buffer: %v", err)
+		}
+		return
+	}
+	b := vim.api.NewBatch()
+	for _, c := range calls {
+		b.ExecLua(c.code, nil, c.args...)
+	}
+	if err := b.Execute(); err != nil {
+		logError("Error updating chat buffer: %v", err)
+	}
+}
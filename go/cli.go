@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"acp/go/internal/acpfs"
+	"github.com/coder/acp-go-sdk"
+)
+
+// runCli runs a single turn with agent outside of Neovim: the prompt is
+// taken from args, or from stdin without args, and the chat is printed to
+// stdout, or its events as JSON lines with jsonEvents. Permission requests
+// are asked on the terminal unless autoApprove is set. readOnly starts a
+// read-only session. It returns the exit status.
+func runCli(agent string, args []string, autoApprove, jsonEvents, readOnly bool) int {
+	cmd := strings.Fields(agent)
+	if len(cmd) == 0 {
+		fmt.Fprintln(os.Stderr, "acp: -cli needs the command of the agent, given with -agent")
+		return 2
+	}
+	prompt := strings.Join(args, " ")
+	if len(args) == 0 {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "acp: read prompt: %v\n", err)
+			return 1
+		}
+		prompt = strings.TrimSpace(string(b))
+	}
+	if prompt == "" {
+		fmt.Fprintln(os.Stderr, "acp: empty prompt")
+		return 2
+	}
+
+	// Without an editor files are only read from and written to disk
+	files := &acpfs.FS{Buffers: noBuffers{}}
+	session, _, err := startSession(0, cmd, AcpNewSessionOpts{ReadOnly: readOnly}, files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "acp: %v\n", err)
+		return 1
+	}
+	defer session.cleanup()
+	session.autoApprove = autoApprove
+	if jsonEvents {
+		session.events = newEventWriter(os.Stdout)
+	} else {
+		session.print = os.Stdout
+	}
+
+	// Ctrl-C cancels the turn, the agent then ends it
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		for range interrupt {
+			if session.conn.Cancel(session.ctx, acp.CancelNotification{SessionId: session.sessionID}) == nil {
+				session.requestCancel()
+			}
+		}
+	}()
+
+	blocks, err := session.buildPrompt(prompt, AcpPromptOpts{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "acp: %v\n", err)
+		return 1
+	}
+	if err := session.prompt(blocks); err != nil {
+		return 1
+	}
+	session.appendToBuffer("\n")
+	return 0
+}
+
+// noBuffers is the acpfs.Buffers of the CLI, which has no buffer loaded.
+type noBuffers struct{}
+
+func (noBuffers) Find(path string) (int, bool, error)             { return 0, false, nil }
+func (noBuffers) LineCount(buf int) (int, error)                  { return 0, nil }
+func (noBuffers) Lines(buf int, start, end int) ([]string, error) { return nil, nil }
+func (noBuffers) EndsWithNewline(buf int) (bool, error)           { return true, nil }
+func (noBuffers) SetLines(buf int, lines []string) error          { return nil }
+
+// ttySelect is uiSelect for the CLI: the items are listed on stderr and the
+// choice read from the terminal. It returns 0 when there is no terminal.
+func ttySelect(items []string, opts selectOpts) (int, error) {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return 0, nil
+	}
+	defer tty.Close()
+
+	fmt.Fprintln(os.Stderr, opts.Title)
+	for i, item := range items {
+		fmt.Fprintf(os.Stderr, "%d. %s\n", i+1, item)
+	}
+	fmt.Fprint(os.Stderr, "Type number and <Enter>: ")
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return 0, nil
+	}
+	choice, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || choice < 1 || choice > len(items) {
+		return 0, nil
+	}
+	return choice, nil
+}
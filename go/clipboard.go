@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// clipboardTimeout bounds how long a clipboard tool may take.
+const clipboardTimeout = 5 * time.Second
+
+// readClipboardImage saves the image on the system clipboard as a PNG file
+// and returns its path.
+func readClipboardImage(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, clipboardTimeout)
+	defer cancel()
+
+	f, err := os.CreateTemp("", "acp-clipboard-*.png")
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	path := f.Name()
+	f.Close()
+
+	var cmd *exec.Cmd
+	switch {
+	case runtime.GOOS == "windows":
+		script := fmt.Sprintf(`Add-Type -AssemblyName System.Windows.Forms; $img = [System.Windows.Forms.Clipboard]::GetImage(); if ($img -eq $null) { exit 1 }; $img.Save('%s', [System.Drawing.Imaging.ImageFormat]::Png)`, path)
+		cmd = exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-Command", script)
+	case runtime.GOOS == "darwin":
+		cmd = exec.CommandContext(ctx, "pngpaste", path)
+	case os.Getenv("WAYLAND_DISPLAY") != "":
+		cmd = exec.CommandContext(ctx, "wl-paste", "--no-newline", "--type", "image/png")
+	default:
+		cmd = exec.CommandContext(ctx, "xclip", "-selection", "clipboard", "-target", "image/png", "-out")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(path)
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+			return "", fmt.Errorf("no image on clipboard: %s", msg)
+		}
+		return "", fmt.Errorf("no image on clipboard: %w", err)
+	}
+	// wl-paste and xclip write the image to stdout; the others save it to path
+	if stdout.Len() > 0 {
+		if err := os.WriteFile(path, stdout.Bytes(), 0o600); err != nil {
+			os.Remove(path)
+			return "", fmt.Errorf("write %s: %w", path, err)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+		os.Remove(path)
+		return "", fmt.Errorf("no image on clipboard")
+	}
+	return path, nil
+}
+
+// AcpAttachClipboardImage attaches the image on the system clipboard to the
+// next prompt and returns the path of the file it was saved to
+func (m *SessionManager) AcpAttachClipboardImage(bufnr int) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	path, err := readClipboardImage(session.ctx)
+	if err != nil {
+		return nil, err
+	}
+	block, err := session.imageBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	session.attach(block)
+	session.appendToBuffer("[Attached image from clipboard]\n")
+	return path, nil
+}
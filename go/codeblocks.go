@@ -0,0 +1,138 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// CodeBlock is a fenced code block of a reply of the agent.
+type CodeBlock struct {
+	// ID is the number of the block in the session, from 1
+	ID int `msgpack:"id"`
+	// Turn is the number of the turn of the reply, from 1
+	Turn    int    `msgpack:"turn"`
+	Lang    string `msgpack:"lang"`
+	Content string `msgpack:"content"`
+	// Complete is unset when the turn ended before the closing fence
+	Complete bool `msgpack:"complete"`
+	// Line is the line of the opening fence in the chat buffer, 0 when it
+	// was trimmed
+	Line int `msgpack:"line"`
+}
+
+var fenceLine = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})\\s*([^`\\s]*)")
+
+// codeBlocks collects the code blocks of the replies as they are streamed.
+// The parsing state is only used from the session's updateQueue, mu guards
+// the blocks.
+type codeBlocks struct {
+	mu     sync.Mutex
+	blocks []CodeBlock
+
+	// partial is the start of the line being streamed
+	partial string
+	// fence opened the current block, if any, and open is its index in
+	// blocks
+	fence string
+	open  int
+	body  strings.Builder
+}
+
+// appendReply appends text of the reply of the agent to the chat buffer,
+// bookmarking the code blocks in it.
+func (s *AcpSession) appendReply(text string) {
+	cb := &s.codeBlocks
+	text = s.replySanitizer.clean(text)
+	for text != "" {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			s.writeChat(s.reflow.reply(text, cb.fence != "" || verbatimLine(cb.partial+text)))
+			cb.partial += text
+			return
+		}
+		line := cb.partial + text[:i]
+		cb.partial = ""
+		s.writeChat(s.reflow.reply(text[:i+1], cb.fence != "" || verbatimLine(line)))
+		text = text[i+1:]
+		if id := cb.line(line, s.transcript.count()); id != 0 {
+			s.callLua(`require('acp').mark_code_block(...)`, s.bufnr, id)
+		}
+	}
+}
+
+// line handles a full line of the reply. It returns the ID of the block the
+// line opens, if any.
+func (cb *codeBlocks) line(line string, turn int) int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.handle(line, turn)
+}
+
+func (cb *codeBlocks) handle(line string, turn int) int {
+	if cb.fence == "" {
+		m := fenceLine.FindStringSubmatch(line)
+		if m == nil {
+			return 0
+		}
+		cb.fence = m[1]
+		cb.open = len(cb.blocks)
+		cb.body.Reset()
+		cb.blocks = append(cb.blocks, CodeBlock{ID: len(cb.blocks) + 1, Turn: turn, Lang: m[2]})
+		return len(cb.blocks)
+	}
+
+	// The closing fence is at least as long as the opening one
+	if t := strings.TrimSpace(line); strings.HasPrefix(t, cb.fence) && strings.Trim(t, cb.fence[:1]) == "" {
+		cb.blocks[cb.open].Complete = true
+		cb.fence = ""
+		return 0
+	}
+	cb.body.WriteString(line + "\n")
+	cb.blocks[cb.open].Content = cb.body.String()
+	return 0
+}
+
+// endTurn ends the block left open by the turn. Replies often end with a
+// closing fence without a newline.
+func (cb *codeBlocks) endTurn() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.fence != "" && cb.partial != "" {
+		cb.handle(cb.partial, 0)
+	}
+	cb.partial = ""
+	cb.fence = ""
+}
+
+// AcpGetCodeBlocks returns the code blocks of the replies of a session, the
+// last one last
+func (m *SessionManager) AcpGetCodeBlocks(bufnr int) ([]CodeBlock, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	// Bookmarks are set along with the text
+	session.flushBuffer()
+	cb := &session.codeBlocks
+	cb.mu.Lock()
+	blocks := append([]CodeBlock{}, cb.blocks...)
+	cb.mu.Unlock()
+
+	if len(blocks) > 0 && session.bufnr != 0 {
+		ids := make([]int, len(blocks))
+		for i, b := range blocks {
+			ids[i] = b.ID
+		}
+		var lines []int
+		if err := vim.api.ExecLua(`return require('acp').code_block_lines(...)`, &lines, bufnr, ids); err != nil {
+			return nil, err
+		}
+		for i := range blocks {
+			if i < len(lines) {
+				blocks[i].Line = lines[i]
+			}
+		}
+	}
+	return blocks, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+var slashCommandRe = regexp.MustCompile(`^/([A-Za-z0-9_:.-]+)(?:\s+(.*))?$`)
+
+// setCommands records the slash commands advertised by the agent and passes
+// them on to Lua for completion.
+func (s *AcpSession) setCommands(cmds []acp.AvailableCommand) {
+	s.mu.Lock()
+	s.commands = cmds
+	s.mu.Unlock()
+
+	type command struct {
+		Name        string `msgpack:"name"`
+		Description string `msgpack:"description"`
+		Hint        string `msgpack:"hint,omitempty"`
+	}
+	list := make([]command, 0, len(cmds))
+	for _, c := range cmds {
+		cmd := command{Name: c.Name, Description: c.Description}
+		if c.Input != nil && c.Input.UnstructuredCommandInput != nil {
+			cmd.Hint = c.Input.UnstructuredCommandInput.Hint
+		}
+		list = append(list, cmd)
+	}
+	s.callLua(`require('acp').set_commands(...)`, s.bufnr, list)
+}
+
+// slashCommand rewrites a prompt that invokes one of the agent's slash
+// commands into the canonical "/name input" form and checks that an input is
+// given when the command expects one. Text that doesn't start with an
+// advertised command is returned unchanged, so paths like "/etc/hosts" are
+// not mistaken for commands.
+func (s *AcpSession) slashCommand(text string) (string, error) {
+	m := slashCommandRe.FindStringSubmatch(strings.TrimSpace(text))
+	if m == nil {
+		return text, nil
+	}
+	name, input := m[1], strings.TrimSpace(m[2])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.commands {
+		if c.Name != name {
+			continue
+		}
+		if c.Input != nil && c.Input.UnstructuredCommandInput != nil && input == "" {
+			return "", fmt.Errorf("/%s expects input: %s", name, c.Input.UnstructuredCommandInput.Hint)
+		}
+		if input == "" {
+			return "/" + name, nil
+		}
+		return "/" + name + " " + input, nil
+	}
+	return text, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// compactPrompt asks for the summary that replaces the conversation.
+const compactPrompt = "Summarize our conversation so far, for it to go on in a new session that only has your summary. " +
+	"Keep the goals, the decisions made and why, the files involved, the state of the work and what is left to do. " +
+	"Leave out what no longer matters."
+
+// maxCompactBytes bounds the conversation sent to a summarizer.
+const maxCompactBytes = 128 * 1024
+
+// AcpCompactOpts are the options of AcpCompact.
+type AcpCompactOpts struct {
+	// SummarizerCmd is the command of an agent to write the summary from the
+	// transcript, in place of the agent of the session
+	SummarizerCmd  []string          `msgpack:"summarizer_cmd"`
+	SummarizerOpts AcpNewSessionOpts `msgpack:"summarizer_opts"`
+}
+
+// AcpCompact replaces the conversation of a session by a summary of it, to
+// free the context window of the agent. The summary is written by the agent,
+// or by the summarizer given in opts, then the agent starts a new session
+// that gets the summary with the next prompt. The chat buffer is kept
+func (m *SessionManager) AcpCompact(bufnr int, opts AcpCompactOpts) (any, error) {
+	return nil, m.whenReady(bufnr, func(session *AcpSession) {
+		session.queueTurn(func() {
+			if err := session.compact(m, opts); err != nil {
+				session.appendToBuffer(fmt.Sprintf("[Compaction failed: %v]\n", err))
+				session.flushBuffer()
+			}
+		})
+	})
+}
+
+func (s *AcpSession) compact(m *SessionManager, opts AcpCompactOpts) error {
+	summary, err := s.summarize(m, opts)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(summary) == "" {
+		return fmt.Errorf("the summary is empty")
+	}
+
+	servers, _ := s.mcpServers()
+	res, err := s.newSession(acp.NewSessionRequest{
+		Cwd:        s.paths.toRemote(s.cwd),
+		McpServers: servers,
+	})
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+	s.sessionID = res.SessionId
+	s.mu.Lock()
+	s.seed = summary
+	s.mu.Unlock()
+	s.appendToBuffer("\n[Conversation compacted, the agent goes on from the summary in a new session]\n")
+	s.flushBuffer()
+	return nil
+}
+
+// summarize returns the summary of the conversation, shown in the chat
+// buffer as it is written.
+func (s *AcpSession) summarize(m *SessionManager, opts AcpCompactOpts) (string, error) {
+	if len(opts.SummarizerCmd) > 0 {
+		tr := s.snapshot()
+		s.appendToBuffer("\n[Summarizing the conversation]\n")
+		s.flushBuffer()
+		prompt := fmt.Sprintf("%s\n\n<conversation>\n%s\n</conversation>", compactPrompt, tr.summary(maxCompactBytes))
+		reply, err := m.AcpAsk(opts.SummarizerCmd, prompt, opts.SummarizerOpts)
+		if err != nil {
+			return "", fmt.Errorf("summarizer: %w", err)
+		}
+		summary, _ := reply.(string)
+		s.appendToBuffer(strings.TrimSuffix(summary, "\n") + "\n")
+		return summary, nil
+	}
+
+	s.appendToBuffer("\n[Compacting the conversation]\n🤖 ")
+	reply := &strings.Builder{}
+	s.mu.Lock()
+	s.reply = reply
+	s.mu.Unlock()
+	err := s.prompt([]acp.ContentBlock{acp.TextBlock(compactPrompt)})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reply = nil
+	return reply.String(), err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// compatWarnings checks the protocol version of the agent against the one of
+// the client. The version of the agent itself isn't checked: what it supports
+// is taken from the capabilities it advertises.
+func compatWarnings(res acp.InitializeResponse) []string {
+	var warnings []string
+	switch {
+	case res.ProtocolVersion > acp.ProtocolVersionNumber:
+		warnings = append(warnings, fmt.Sprintf("the agent speaks ACP version %d but this client supports version %d", res.ProtocolVersion, acp.ProtocolVersionNumber))
+	case res.ProtocolVersion < acp.ProtocolVersionNumber:
+		w := fmt.Sprintf("the agent speaks ACP version %d, older than version %d of this client", res.ProtocolVersion, acp.ProtocolVersionNumber)
+		if missing := missingFeatures(res.ProtocolVersion); len(missing) > 0 {
+			w += "; " + strings.Join(missing, ", ") + " are disabled"
+		}
+		warnings = append(warnings, w)
+	}
+	return warnings
+}
+
+// AgentInfo describes the agent of a session, what it supports and its
+// compatibility with the client.
+type AgentInfo struct {
+	Name                  string   `msgpack:"name"`
+	Title                 string   `msgpack:"title"`
+	Version               string   `msgpack:"version"`
+	ProtocolVersion       int      `msgpack:"protocol_version"`
+	ClientProtocolVersion int      `msgpack:"client_protocol_version"`
+	Warnings              []string `msgpack:"warnings"`
+
+	LoadSession     bool `msgpack:"load_session"`
+	Image           bool `msgpack:"image"`
+	Audio           bool `msgpack:"audio"`
+	EmbeddedContext bool `msgpack:"embedded_context"`
+	McpHttp         bool `msgpack:"mcp_http"`
+	McpSse          bool `msgpack:"mcp_sse"`
+
+	AuthMethods []AuthMethodInfo `msgpack:"auth_methods"`
+}
+
+// AuthMethodInfo is an auth method advertised by the agent.
+type AuthMethodInfo struct {
+	Id          string `msgpack:"id"`
+	Name        string `msgpack:"name"`
+	Description string `msgpack:"description"`
+}
+
+// agentInfo summarizes the initialize response of an agent.
+func agentInfo(res acp.InitializeResponse) AgentInfo {
+	caps := res.AgentCapabilities
+	info := AgentInfo{
+		ProtocolVersion:       int(res.ProtocolVersion),
+		ClientProtocolVersion: acp.ProtocolVersionNumber,
+		Warnings:              compatWarnings(res),
+		LoadSession:           caps.LoadSession,
+		Image:                 caps.PromptCapabilities.Image,
+		Audio:                 caps.PromptCapabilities.Audio,
+		EmbeddedContext:       caps.PromptCapabilities.EmbeddedContext,
+		McpHttp:               caps.McpCapabilities.Http,
+		McpSse:                caps.McpCapabilities.Sse,
+		AuthMethods:           []AuthMethodInfo{},
+	}
+	if info.Warnings == nil {
+		info.Warnings = []string{}
+	}
+	if res.AgentInfo != nil {
+		info.Name = res.AgentInfo.Name
+		info.Version = res.AgentInfo.Version
+		if res.AgentInfo.Title != nil {
+			info.Title = *res.AgentInfo.Title
+		}
+	}
+	for _, m := range res.AuthMethods {
+		method := AuthMethodInfo{Id: string(m.Id), Name: m.Name}
+		if m.Description != nil {
+			method.Description = *m.Description
+		}
+		info.AuthMethods = append(info.AuthMethods, method)
+	}
+	return info
+}
+
+// AcpAgentInfo returns what the agent of a session reported about itself and
+// the capabilities it negotiated
+func (m *SessionManager) AcpAgentInfo(bufnr int) (AgentInfo, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return AgentInfo{}, err
+	}
+	return agentInfo(session.agentInfo), nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+func TestCompatWarnings(t *testing.T) {
+	tests := []struct {
+		name string
+		res  acp.InitializeResponse
+		want []string
+	}{
+		{name: "same version", res: acp.InitializeResponse{ProtocolVersion: acp.ProtocolVersionNumber}},
+		{name: "newer", res: acp.InitializeResponse{ProtocolVersion: acp.ProtocolVersionNumber + 1}, want: []string{"but this client supports"}},
+		{name: "older", res: acp.InitializeResponse{ProtocolVersion: 0}, want: []string{"older than version", featureTerminals}},
+		{name: "old agent release", res: acp.InitializeResponse{
+			ProtocolVersion: acp.ProtocolVersionNumber,
+			AgentInfo:       &acp.Implementation{Name: "gemini-cli", Version: "0.0.1"},
+		}},
+	}
+	for _, tt := range tests {
+		warnings := compatWarnings(tt.res)
+		got := strings.Join(warnings, "\n")
+		if len(tt.want) == 0 && len(warnings) > 0 {
+			t.Errorf("%s: got warnings %q", tt.name, warnings)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s: got %q, want %q in it", tt.name, got, w)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// toolUpdateDebounce is how long the updates of a running tool call are held
+// back, so that a burst of them is rendered as one.
+const toolUpdateDebounce = 150 * time.Millisecond
+
+// toolUpdates holds back the updates of running tool calls, merging the ones
+// for the same tool call, so that agents reporting progress many times a
+// second don't make the chat buffer flicker. Only the session's updateQueue
+// uses it, so it needs no lock.
+type toolUpdates struct {
+	held  map[acp.ToolCallId]*acp.SessionToolCallUpdate
+	order []acp.ToolCallId
+	// gen tells the timer of the current burst from the timers of earlier
+	// ones
+	gen int
+}
+
+// holdToolUpdate holds back u, merged into the update held for the same
+// tool call.
+func (s *AcpSession) holdToolUpdate(u *acp.SessionToolCallUpdate) {
+	t := &s.toolUpdates
+	if t.held == nil {
+		t.held = map[acp.ToolCallId]*acp.SessionToolCallUpdate{}
+	}
+	if prev, ok := t.held[u.ToolCallId]; ok {
+		t.held[u.ToolCallId] = mergeToolUpdate(prev, u)
+		return
+	}
+	t.held[u.ToolCallId] = u
+	t.order = append(t.order, u.ToolCallId)
+	if len(t.order) == 1 {
+		gen := t.gen
+		time.AfterFunc(toolUpdateDebounce, func() {
+			s.updates.push(func(context.Context) {
+				if s.toolUpdates.gen == gen {
+					s.flushToolUpdates()
+				}
+			})
+		})
+	}
+}
+
+// flushToolUpdates renders the held updates, in the order of their tool
+// calls' first held update. It runs before any other update is rendered, so
+// that the chat buffer keeps the order the agent sent them in.
+func (s *AcpSession) flushToolUpdates() {
+	t := &s.toolUpdates
+	if len(t.order) == 0 {
+		return
+	}
+	order, held := t.order, t.held
+	t.order, t.held = nil, nil
+	t.gen++
+	for _, id := range order {
+		s.showToolCallUpdate(held[id])
+	}
+}
+
+// mergeToolUpdate returns the update equivalent to prev followed by u. Each
+// field of an update replaces the previous value, so the latest set value of
+// each field wins.
+func mergeToolUpdate(prev, u *acp.SessionToolCallUpdate) *acp.SessionToolCallUpdate {
+	m := *u
+	if m.Title == nil {
+		m.Title = prev.Title
+	}
+	if m.Status == nil {
+		m.Status = prev.Status
+	}
+	if m.Kind == nil {
+		m.Kind = prev.Kind
+	}
+	if m.Content == nil {
+		m.Content = prev.Content
+	}
+	if m.Locations == nil {
+		m.Locations = prev.Locations
+	}
+	if m.RawInput == nil {
+		m.RawInput = prev.RawInput
+	}
+	if m.RawOutput == nil {
+		m.RawOutput = prev.RawOutput
+	}
+	return &m
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxDiffBytes is the size of the old and new text beyond which no diff
+	// is computed
+	maxDiffBytes = 2 << 20
+	// maxDiffEdits is the number of changed lines beyond which the diff is
+	// given up, since it would be too long to read in the chat anyway
+	maxDiffEdits = 2000
+	// diffContext is the number of unchanged lines shown around changes
+	diffContext = 3
+)
+
+// diffOp is a line of an edit script: ' ' kept, '-' deleted or '+' inserted.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the hunks of the unified diff from old to new, without
+// the file header. ok is false when the texts are too large or too different
+// to be worth showing.
+func unifiedDiff(old, new string) (diff string, ok bool) {
+	if len(old)+len(new) > maxDiffBytes {
+		return "", false
+	}
+	ops, ok := diffLines(splitLines(old), splitLines(new), maxDiffEdits)
+	if !ok {
+		return "", false
+	}
+
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change and the end of the changes close to it
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		last := first
+		for i := first; i < len(ops) && i <= last+2*diffContext; i++ {
+			if ops[i].kind != ' ' {
+				last = i
+			}
+		}
+		from := max(start, first-diffContext)
+		to := min(len(ops), last+diffContext+1)
+
+		// Line numbers of the hunk in the old and new text
+		oldStart, newStart := 1, 1
+		for _, op := range ops[:from] {
+			if op.kind != '+' {
+				oldStart++
+			}
+			if op.kind != '-' {
+				newStart++
+			}
+		}
+		var oldLen, newLen int
+		for _, op := range ops[from:to] {
+			if op.kind != '+' {
+				oldLen++
+			}
+			if op.kind != '-' {
+				newLen++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(oldStart, oldLen), hunkRange(newStart, newLen))
+		for _, op := range ops[from:to] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		start = to
+	}
+	return out.String(), true
+}
+
+// hunkRange formats the range of a hunk header like diff -u does.
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", start-1)
+	case 1:
+		return fmt.Sprint(start)
+	default:
+		return fmt.Sprintf("%d,%d", start, n)
+	}
+}
+
+// splitLines splits s after each newline.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the shortest edit script from a to b, or false when it
+// needs more than maxEdits insertions and deletions.
+func diffLines(a, b []string, maxEdits int) ([]diffOp, bool) {
+	// Most edits touch a small part of the file, so leave the common
+	// prefix and suffix out of the search
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	mid, ok := myers(a[pre:len(a)-suf], b[pre:len(b)-suf], maxEdits)
+	if !ok {
+		return nil, false
+	}
+	ops := make([]diffOp, 0, pre+len(mid)+suf)
+	for _, l := range a[:pre] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	ops = append(ops, mid...)
+	for _, l := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	return ops, true
+}
+
+// myers implements the O(ND) diff algorithm of Eugene W. Myers.
+func myers(a, b []string, maxEdits int) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	if n+m == 0 {
+		return nil, true
+	}
+	limit := min(n+m, maxEdits)
+
+	// v[offset+k] is the furthest x reached on diagonal k = x - y. trace[d]
+	// keeps the diagonals -d..d of v after d edits, to walk back the path.
+	offset := n + m
+	v := make([]int, 2*(n+m)+2)
+	var trace [][]int
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // insertion
+			} else {
+				x = v[offset+k-1] + 1 // deletion
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			if v[offset+k] >= n && v[offset+k]-k >= m {
+				return backtrack(a, b, trace), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// backtrack walks the path found by myers from the end, returning the edit
+// script in order.
+func backtrack(a, b []string, trace [][]int) []diffOp {
+	x, y := len(a), len(b)
+	var ops []diffOp
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1] // diagonals -(d-1)..d-1
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			ops = append(ops, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		ops = append(ops, diffOp{' ', a[x-1]})
+		x--
+		y--
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
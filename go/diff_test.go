@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+		tooLarge bool
+	}{
+		{name: "same", old: "a\nb\n", new: "a\nb\n", want: ""},
+		{name: "changed line", old: "a\nb\nc\n", new: "a\nB\nc\n", want: "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{name: "new file", old: "", new: "a\nb\n", want: "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{name: "file emptied", old: "a\n", new: "", want: "@@ -1 +0,0 @@\n-a\n"},
+		{name: "no newline at the end", old: "a\nb", new: "a\nc", want: "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n"},
+		{name: "newline added at the end", old: "a", new: "a\n", want: "@@ -1 +1 @@\n-a\n\\ No newline at end of file\n+a\n"},
+		{name: "CRLF", old: "a\r\nb\r\n", new: "a\r\nc\r\n", want: "@@ -1,2 +1,2 @@\n a\r\n-b\r\n+c\r\n"},
+		{name: "UTF-8", old: "café\n", new: "cafè\n", want: "@@ -1 +1 @@\n-café\n+cafè\n"},
+		{
+			name: "distant changes",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			new:  "one\n2\n3\n4\n5\n6\n7\n8\n9\nten\n",
+			want: "@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+ten\n",
+		},
+		{
+			name: "close changes",
+			old:  "1\n2\n3\n4\n5\n6\n7\n",
+			new:  "one\n2\n3\n4\n5\n6\nseven\n",
+			want: "@@ -1,7 +1,7 @@\n-1\n+one\n 2\n 3\n 4\n 5\n 6\n-7\n+seven\n",
+		},
+		{name: "too large", old: strings.Repeat("a", maxDiffBytes), new: "b", tooLarge: true},
+	}
+	for _, tt := range tests {
+		got, ok := unifiedDiff(tt.old, tt.new)
+		if ok == tt.tooLarge || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, r.Intn(8))
+		for i := range lines {
+			lines[i] = string(rune('a' + r.Intn(3)))
+		}
+		return lines
+	}
+	for i := 0; i < 2000; i++ {
+		a, b := randomLines(), randomLines()
+		ops, ok := diffLines(a, b, maxDiffEdits)
+		if !ok {
+			t.Fatalf("%q -> %q: no diff", a, b)
+		}
+		// The script must turn a into b
+		var gotA, gotB []string
+		edits := 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+			if op.kind != ' ' {
+				edits++
+			}
+		}
+		if !slices.Equal(gotA, a) || !slices.Equal(gotB, b) {
+			t.Fatalf("%q -> %q: got the script %v", a, b, ops)
+		}
+		if _, ok := diffLines(a, b, edits-1); ok && edits > 0 {
+			t.Errorf("%q -> %q: found a script of fewer than %d edits", a, b, edits)
+		}
+	}
+
+	if _, ok := diffLines([]string{"a", "b"}, []string{"c", "d"}, 3); ok {
+		t.Errorf("got a diff of 4 edits with a limit of 3")
+	}
+}
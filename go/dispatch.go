@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// updateQueueSize is how many session updates may wait for the editor
+// before reading from the agent pauses.
+const updateQueueSize = 256
+
+// updateQueue runs the session updates of a session one at a time, in the
+// order the agent sent them. The SDK handles every message in a goroutine of
+// its own, which lets chunks overtake each other on their way to the chat
+// buffer, and a stuck call to Neovim would pile up goroutines without bound.
+type updateQueue struct {
+	ctx context.Context
+	ch  chan func(ctx context.Context)
+}
+
+// start runs the queued updates until ctx is done.
+func (q *updateQueue) start(ctx context.Context) {
+	q.ctx = ctx
+	q.ch = make(chan func(ctx context.Context), updateQueueSize)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case fn := <-q.ch:
+				fn(ctx)
+			}
+		}
+	}()
+}
+
+// push queues fn. When the queue is full it waits, so that an editor that
+// can't keep up slows down reading from the agent instead.
+func (q *updateQueue) push(fn func(ctx context.Context)) {
+	select {
+	case q.ch <- fn:
+		return
+	default:
+	}
+	logWarn("%d session updates are waiting for the editor, pausing reading from the agent", updateQueueSize)
+	select {
+	case q.ch <- fn:
+	case <-q.ctx.Done():
+	}
+}
+
+// running reports whether the queue was started. Sessions replayed from a
+// file render their updates as they are read instead.
+func (q *updateQueue) running() bool {
+	return q.ch != nil
+}
+
+// wait returns once the updates queued so far have been handled. It must not
+// be called while handling one.
+func (q *updateQueue) wait() {
+	if q.ch == nil {
+		return
+	}
+	done := make(chan struct{})
+	q.push(func(context.Context) { close(done) })
+	select {
+	case <-done:
+	case <-q.ctx.Done():
+	}
+}
+
+// inlineHandlers returns the handlers of the notifications that extRouter
+// passes on as they are read, rather than to the SDK.
+func (c *acpClientImpl) inlineHandlers() map[string]func(params json.RawMessage) {
+	return map[string]func(params json.RawMessage){
+		acp.ClientMethodSessionUpdate: c.queueUpdate,
+	}
+}
+
+// sessionUpdateKinds are the session updates this client knows, others are
+// from a newer version of the protocol.
+var sessionUpdateKinds = map[string]bool{
+	"user_message_chunk":        true,
+	"agent_message_chunk":       true,
+	"agent_thought_chunk":       true,
+	"tool_call":                 true,
+	"tool_call_update":          true,
+	"plan":                      true,
+	"available_commands_update": true,
+	"current_mode_update":       true,
+}
+
+// updateKind returns the kind of the update of a session/update
+// notification, empty if it has none.
+func updateKind(params json.RawMessage) string {
+	var n struct {
+		Update struct {
+			SessionUpdate string `json:"sessionUpdate"`
+		} `json:"update"`
+	}
+	_ = json.Unmarshal(params, &n)
+	return n.Update.SessionUpdate
+}
+
+// queueUpdate queues a session/update notification for SessionUpdate.
+// Updates of an unknown kind, which the SDK would take for a known one, are
+// queued for unsupportedUpdate instead.
+func (c *acpClientImpl) queueUpdate(params json.RawMessage) {
+	if kind := updateKind(params); kind != "" && !sessionUpdateKinds[kind] {
+		c.session.updates.push(func(context.Context) {
+			c.session.unsupportedUpdate(kind, params)
+		})
+		return
+	}
+	params = c.session.chunks.join(params)
+	var n acp.SessionNotification
+	if err := json.Unmarshal(params, &n); err != nil {
+		logError("Error decoding session update: %v", err)
+		return
+	}
+	c.session.updates.push(func(ctx context.Context) {
+		if err := c.SessionUpdate(ctx, n); err != nil {
+			logError("Error handling session update: %v", err)
+		}
+	})
+}
+
+// unsupportedEvent is the data of the unsupported_update event.
+type unsupportedEvent struct {
+	Kind   string          `json:"kind"`
+	Params json.RawMessage `json:"params"`
+}
+
+// unsupportedUpdate notes a session update of an unknown kind in the chat
+// buffer and passes it on to Lua, which fires the AcpUnsupportedUpdate User
+// autocommand with it. The whole update is in the trace log.
+func (s *AcpSession) unsupportedUpdate(kind string, params json.RawMessage) {
+	if s.loading.Load() {
+		return
+	}
+	logTrace("Unsupported session update %s: %s", kind, params)
+	s.emit("unsupported_update", unsupportedEvent{Kind: kind, Params: params})
+	s.appendToBuffer(fmt.Sprintf("[unsupported update: %s]\n", kind))
+
+	var decoded any
+	if err := json.Unmarshal(params, &decoded); err != nil {
+		return
+	}
+	s.callLua(`require('acp').on_unsupported_update(...)`, s.bufnr, kind, decoded)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// envRef matches ${VAR} and ${VAR:-default}. The bare $VAR form is left
+// alone since values such as passwords may contain a literal $.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expander expands references to environment variables and the home
+// directory in config values. Variables of the project .env file take
+// precedence over those of the editor's environment.
+type expander struct {
+	dotenv map[string]string
+}
+
+func (e expander) lookup(name string) (string, bool) {
+	if v, ok := e.dotenv[name]; ok {
+		return v, true
+	}
+	return os.LookupEnv(name)
+}
+
+// expand replaces ${VAR} references in s, and a leading ~ with the home
+// directory.
+func (e expander) expand(s string) string {
+	s = envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		m := envRef.FindStringSubmatch(ref)
+		if v, ok := e.lookup(m[1]); ok && v != "" {
+			return v
+		}
+		return m[2]
+	})
+	if s == "~" || strings.HasPrefix(s, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			s = filepath.Join(home, s[1:])
+		}
+	}
+	return s
+}
+
+// expandAll expands every string in v, which is a config value decoded from
+// msgpack: strings, lists and maps of those.
+func (e expander) expandAll(v any) any {
+	switch v := v.(type) {
+	case string:
+		return e.expand(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = e.expandAll(item)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			out[k] = e.expandAll(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+func (e expander) expandStrings(list []string) []string {
+	out := make([]string, len(list))
+	for i, s := range list {
+		out[i] = e.expand(s)
+	}
+	return out
+}
+
+// agentEnv returns the environment of the agent: the variables of the .env
+// file, if any, followed by those of the config, with references expanded.
+// nil means the agent inherits the environment unchanged.
+func (e expander) agentEnv(config map[string]string) map[string]string {
+	if len(e.dotenv) == 0 && config == nil {
+		return nil
+	}
+	env := make(map[string]string, len(e.dotenv)+len(config))
+	for k, v := range e.dotenv {
+		env[k] = v
+	}
+	for k, v := range config {
+		env[k] = e.expand(v)
+	}
+	return env
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// codeInternalError is the JSON-RPC code of internal errors.
+const codeInternalError = -32603
+
+// ErrorEvent is a failed request to the agent, delivered to Lua as the
+// AcpError User autocommand and kept for AcpLastError.
+type ErrorEvent struct {
+	Method  string `json:"method" msgpack:"method"`
+	Code    int    `json:"code" msgpack:"code"`
+	Message string `json:"message" msgpack:"message"`
+	Data    any    `json:"data,omitempty" msgpack:"data"`
+	// Retryable is set for errors that may not happen again, such as
+	// internal errors of the agent or rate limits
+	Retryable bool `json:"retryable" msgpack:"retryable"`
+}
+
+// errorEvent describes the error of a request. Errors that are not JSON-RPC
+// errors, e.g. because the agent exited, have code 0.
+func errorEvent(method string, err error) ErrorEvent {
+	ev := ErrorEvent{Method: method, Message: err.Error()}
+	var re *acp.RequestError
+	if errors.As(err, &re) {
+		ev.Code, ev.Message = re.Code, re.Message
+		// Decode the data to plain values that msgpack can carry
+		if b, mErr := json.Marshal(re.Data); mErr == nil {
+			_ = json.Unmarshal(b, &ev.Data)
+		}
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+	case ev.Code == codeInternalError:
+		ev.Retryable = true
+	default:
+		msg := strings.ToLower(ev.Message)
+		ev.Retryable = strings.Contains(msg, "rate limit") || strings.Contains(msg, "overloaded") || strings.Contains(msg, "timeout")
+	}
+	return ev
+}
+
+// String is the line shown in the chat buffer, e.g. "Internal error
+// (-32603)". The data of the error is available from AcpLastError.
+func (e ErrorEvent) String() string {
+	msg := e.Message
+	if e.Code != 0 {
+		msg = fmt.Sprintf("%s (%d)", msg, e.Code)
+	}
+	if e.Retryable {
+		msg += ", try again"
+	}
+	return msg
+}
+
+// reportError records the error of a request to the agent as the last error
+// of the session and notifies Lua.
+func (s *AcpSession) reportError(method string, err error) ErrorEvent {
+	ev := errorEvent(method, err)
+	s.mu.Lock()
+	s.lastError = &ev
+	s.mu.Unlock()
+	s.emit("error", ev)
+	if s.bufnr != 0 {
+		if lErr := vim.api.ExecLua(`require('acp').on_error(...)`, nil, s.bufnr, ev); lErr != nil {
+			logError("Error reporting error of %s: %v", method, lErr)
+		}
+	}
+	return ev
+}
+
+// AcpLastError returns the last failed request of a session with all the
+// details the agent sent, or nil when no request failed
+func (m *SessionManager) AcpLastError(bufnr int) (*ErrorEvent, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.lastError, nil
+}
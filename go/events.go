@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// sessionEvent is a line of the JSON output of the command line mode.
+type sessionEvent struct {
+	// Type is one of prompt, update, unsupported_update, permission, error,
+	// turn_end and refusal
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data,omitempty"`
+}
+
+// eventWriter writes the events of a session as JSON lines, for other
+// frontends to run the session through this host.
+type eventWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func newEventWriter(w io.Writer) *eventWriter {
+	return &eventWriter{w: w, enc: json.NewEncoder(w)}
+}
+
+// emit writes an event of the session, if its events are written.
+func (s *AcpSession) emit(kind string, data any) {
+	e := s.events
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.enc.Encode(sessionEvent{Type: kind, Time: time.Now(), Data: data}); err != nil {
+		logError("Error writing %s event: %v", kind, err)
+	}
+}
+
+// permissionEvent is the data of a permission event: the request of the
+// agent and the option picked, none when the request was cancelled.
+type permissionEvent struct {
+	Request  acp.RequestPermissionRequest `json:"request"`
+	OptionId acp.PermissionOptionId       `json:"option_id,omitempty"`
+}
+
+// turnEndEvent is the data of a turn_end event.
+type turnEndEvent struct {
+	StopReason acp.StopReason `json:"stop_reason,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
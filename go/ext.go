@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/coder/acp-go-sdk"
+
+	"acp/go/internal/acpfs"
+)
+
+// extMethodPrefix is the prefix of the extension methods implemented by this
+// client. ACP reserves method names starting with an underscore for
+// extensions.
+const extMethodPrefix = "_acp.nvim/"
+
+// rpcMessage is the JSON-RPC envelope shared by requests, responses and
+// notifications.
+type rpcMessage struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      *json.RawMessage  `json:"id,omitempty"`
+	Method  string            `json:"method,omitempty"`
+	Params  json.RawMessage   `json:"params,omitempty"`
+	Result  json.RawMessage   `json:"result,omitempty"`
+	Error   *acp.RequestError `json:"error,omitempty"`
+}
+
+type extHandler func(ctx context.Context, params json.RawMessage) (any, error)
+
+// wireTap observes the messages sent to ("send") and received from ("recv")
+// the agent, see tracer and recorder.
+type wireTap interface {
+	log(dir string, line []byte)
+}
+
+// lockedWriter serializes writes to the agent's stdin. The SDK writes each
+// message with a single Write call, so locking per call keeps messages from
+// interleaving with the ones sent by extRouter.
+type lockedWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	taps []wireTap
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, t := range l.taps {
+		t.log("send", p)
+	}
+	return l.w.Write(p)
+}
+
+// extRouter sits between the agent process and the SDK connection. The SDK
+// answers every method it doesn't know with "method not found", so messages
+// for extension methods are picked out of the agent's output and handled
+// here, while everything else is passed through to the SDK untouched. Core
+// methods in handlers are handled here too, for them to be ordered.
+type extRouter struct {
+	ctx      context.Context
+	w        *lockedWriter
+	r        *bufio.Reader
+	pw       *io.PipeWriter
+	pr       *io.PipeReader
+	handlers map[string]extHandler
+	// inline handles notifications as they are read, to keep them in
+	// order. Its handlers must not block on the editor.
+	inline map[string]func(params json.RawMessage)
+	// fallback returns the handler of the extension methods not in
+	// handlers, if any
+	fallback func(method string) (extHandler, bool)
+	// unhandled gets the extension notifications without a handler
+	unhandled func(method string, params json.RawMessage)
+	// ticket returns the ticket of the requests that must run in the order
+	// they are received, or nil. It is called as the requests are read.
+	ticket func(method string, params json.RawMessage) *acpfs.Ticket
+	taps   []wireTap
+
+	// calls are the extension requests sent to the agent waiting for a
+	// response, by ID
+	mu       sync.Mutex
+	calls    map[string]chan rpcMessage
+	lastCall int
+}
+
+func newExtRouter(ctx context.Context, agentIn io.Writer, agentOut io.Reader, handlers map[string]extHandler, inline map[string]func(params json.RawMessage), fallback func(method string) (extHandler, bool), unhandled func(method string, params json.RawMessage), ticket func(method string, params json.RawMessage) *acpfs.Ticket, taps []wireTap) *extRouter {
+	pr, pw := io.Pipe()
+	r := &extRouter{
+		ctx:       ctx,
+		w:         &lockedWriter{w: agentIn, taps: taps},
+		r:         bufio.NewReader(agentOut),
+		pw:        pw,
+		pr:        pr,
+		handlers:  handlers,
+		inline:    inline,
+		fallback:  fallback,
+		unhandled: unhandled,
+		ticket:    ticket,
+		taps:      taps,
+		calls:     map[string]chan rpcMessage{},
+	}
+	go r.run()
+	return r
+}
+
+// writer returns the stream the SDK should write to.
+func (r *extRouter) writer() io.Writer {
+	return r.w
+}
+
+// reader returns the stream the SDK should read from.
+func (r *extRouter) reader() io.Reader {
+	return r.pr
+}
+
+func (r *extRouter) run() {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		for _, t := range r.taps {
+			t.log("recv", line)
+		}
+		if len(line) > 0 && !r.route(line) {
+			if _, werr := r.pw.Write(line); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				r.pw.Close()
+			} else {
+				r.pw.CloseWithError(err)
+			}
+			return
+		}
+	}
+}
+
+// route handles line if it is an extension request or notification, or an
+// inline notification, and reports whether it did.
+func (r *extRouter) route(line []byte) bool {
+	var msg rpcMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return false
+	}
+	if h, ok := r.inline[msg.Method]; ok && msg.ID == nil {
+		h(msg.Params)
+		return true
+	}
+	if msg.Method == "" && msg.ID != nil {
+		return r.answer(msg)
+	}
+	if _, ok := r.handlers[msg.Method]; !ok && !strings.HasPrefix(msg.Method, "_") {
+		return false
+	}
+	// The handlers run concurrently, so the turn of the requests that must
+	// keep their order is taken now
+	var t *acpfs.Ticket
+	if msg.ID != nil && r.ticket != nil {
+		t = r.ticket(msg.Method, msg.Params)
+	}
+	go r.dispatch(msg, t)
+	return true
+}
+
+// dispatch handles msg once the requests before it with the same ticket
+// paths are done, if it has a ticket t.
+func (r *extRouter) dispatch(msg rpcMessage, t *acpfs.Ticket) {
+	ctx := r.ctx
+	if t != nil {
+		defer t.Close()
+		if err := t.Wait(ctx); err != nil {
+			r.respond(msg.ID, nil, err)
+			return
+		}
+		ctx = acpfs.WithTicket(ctx, t)
+	}
+
+	logTrace("Extension method %s: %s", msg.Method, msg.Params)
+	handler, ok := r.handlers[msg.Method]
+	if !ok && r.fallback != nil {
+		handler, ok = r.fallback(msg.Method)
+	}
+	if !ok {
+		if msg.ID != nil {
+			r.respond(msg.ID, nil, acp.NewMethodNotFound(msg.Method))
+		} else if r.unhandled != nil {
+			r.unhandled(msg.Method, msg.Params)
+		} else {
+			logDebug("Ignoring unknown extension notification %s", msg.Method)
+		}
+		return
+	}
+
+	result, err := handler(ctx, msg.Params)
+	if msg.ID == nil {
+		if err != nil {
+			logError("Error handling extension notification %s: %v", msg.Method, err)
+		}
+		return
+	}
+	r.respond(msg.ID, result, err)
+}
+
+func (r *extRouter) respond(id *json.RawMessage, result any, err error) {
+	res := rpcMessage{JSONRPC: "2.0", ID: id}
+	if err != nil {
+		var re *acp.RequestError
+		if !errors.As(err, &re) {
+			re = acp.NewInternalError(map[string]any{"error": err.Error()})
+		}
+		res.Error = re
+	} else {
+		b, mErr := json.Marshal(result)
+		if mErr != nil {
+			res.Error = acp.NewInternalError(map[string]any{"error": mErr.Error()})
+		} else {
+			res.Result = b
+		}
+	}
+	r.send(res)
+}
+
+func (r *extRouter) send(msg rpcMessage) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		logError("Error encoding extension message: %v", err)
+		return
+	}
+	if _, err := r.w.Write(append(b, '\n')); err != nil {
+		logError("Error writing extension message: %v", err)
+	}
+}
+
+// call sends an extension request to the agent and waits for its result.
+// The IDs are strings, unlike the numbers the SDK uses, so that the responses
+// can be told apart.
+func (r *extRouter) call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan rpcMessage, 1)
+	r.mu.Lock()
+	r.lastCall++
+	key := fmt.Sprintf("acp.nvim-%d", r.lastCall)
+	r.calls[key] = ch
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.calls, key)
+		r.mu.Unlock()
+	}()
+
+	id := json.RawMessage(fmt.Sprintf("%q", key))
+	r.send(rpcMessage{JSONRPC: "2.0", ID: &id, Method: method, Params: b})
+	select {
+	case res := <-ch:
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		return res.Result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// answer passes the response msg to the call waiting for it, and reports
+// whether there was one.
+func (r *extRouter) answer(msg rpcMessage) bool {
+	var key string
+	if json.Unmarshal(*msg.ID, &key) != nil {
+		return false
+	}
+	r.mu.Lock()
+	ch, ok := r.calls[key]
+	r.mu.Unlock()
+	if ok {
+		ch <- msg
+	}
+	return ok
+}
+
+// notify sends an extension notification to the agent.
+func (r *extRouter) notify(method string, params any) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	r.send(rpcMessage{JSONRPC: "2.0", Method: method, Params: b})
+	return nil
+}
+
+// decodeExtParams unmarshals extension method params, reporting failures as
+// invalid params like the SDK does for core methods.
+func decodeExtParams(params json.RawMessage, v any) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return acp.NewInvalidParams(map[string]any{"error": err.Error()})
+	}
+	return nil
+}
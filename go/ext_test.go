@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coder/acp-go-sdk"
+
+	"acp/go/internal/acpfs"
+)
+
+func TestExtRouterKeepsWriteOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	fs := &acpfs.FS{Buffers: noBuffers{}}
+	// The handler of the earlier write is the slower one to get to it
+	handlers := map[string]extHandler{
+		acp.ClientMethodFsWriteTextFile: func(ctx context.Context, params json.RawMessage) (any, error) {
+			var p acp.WriteTextFileRequest
+			if err := decodeExtParams(params, &p); err != nil {
+				return nil, err
+			}
+			if p.Content == "first" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			_, err := fs.WriteTextFile(ctx, p.Path, p.Content)
+			return map[string]any{}, err
+		},
+	}
+	ticket := func(method string, params json.RawMessage) *acpfs.Ticket {
+		var p acp.WriteTextFileRequest
+		if json.Unmarshal(params, &p) != nil {
+			return nil
+		}
+		return fs.Reserve(p.Path)
+	}
+
+	agentOut, toClient := io.Pipe()
+	fromClient, agentIn := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	newExtRouter(ctx, agentIn, agentOut, handlers, nil, nil, nil, ticket, nil)
+	go func() {
+		for i, content := range []string{"first", "second"} {
+			fmt.Fprintf(toClient, `{"jsonrpc":"2.0","id":%d,"method":%q,"params":{"sessionId":"s","path":%q,"content":%q}}`+"\n", i, acp.ClientMethodFsWriteTextFile, path, content)
+		}
+	}()
+
+	responses := bufio.NewScanner(fromClient)
+	for i := 0; i < 2; i++ {
+		if !responses.Scan() {
+			t.Fatal("missing response")
+		}
+		var res rpcMessage
+		if err := json.Unmarshal(responses.Bytes(), &res); err != nil || res.Error != nil {
+			t.Fatalf("got response %s, %v", responses.Bytes(), err)
+		}
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "second" {
+		t.Errorf("file has %q, %v, want the later write", b, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// AcpExtRequest calls an extension method of the agent of a session, one
+// outside of the ACP spec whose name starts with an underscore, and returns
+// its result
+func (m *SessionManager) AcpExtRequest(bufnr int, method string, params any) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(method, "_") {
+		return nil, fmt.Errorf("extension methods start with an underscore: %s", method)
+	}
+	defer session.watch(method).done()
+	raw, err := session.ext.call(session.ctx, method, params)
+	if err != nil {
+		session.reportError(method, err)
+		return nil, err
+	}
+	var result any
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// AcpExtNotify sends an extension notification to the agent of a session
+func (m *SessionManager) AcpExtNotify(bufnr int, method string, params any) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(method, "_") {
+		return nil, fmt.Errorf("extension methods start with an underscore: %s", method)
+	}
+	return nil, session.ext.notify(method, params)
+}
+
+// extNotification passes an extension notification the client has no
+// handler for on to Lua, which fires the AcpExtNotification User
+// autocommand.
+func (c *acpClientImpl) extNotification(method string, params json.RawMessage) {
+	var decoded any
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &decoded); err != nil {
+			logError("Error decoding extension notification %s: %v", method, err)
+			return
+		}
+	}
+	if c.session.bufnr == 0 {
+		return
+	}
+	if err := vim.api.ExecLua(`require('acp').on_ext_notification(...)`, nil, c.session.bufnr, method, decoded); err != nil {
+		logError("Error passing on extension notification %s: %v", method, err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/coder/acp-go-sdk"
+
+	"acp/go/internal/acpfs"
+)
+
+// Extension methods for file management beyond reading and writing text
+// files. Every operation asks the user for permission unless auto-approve is
+// enabled, and is recorded in the chat buffer. Recursive deletes and changes
+// outside of the working directory are asked even with auto-approve.
+const (
+	extMethodFsMkdir  = extMethodPrefix + "fs/mkdir"
+	extMethodFsDelete = extMethodPrefix + "fs/delete"
+	extMethodFsMove   = extMethodPrefix + "fs/move"
+)
+
+type extMkdirRequest struct {
+	SessionId acp.SessionId `json:"sessionId"`
+	Path      string        `json:"path"`
+}
+
+type extDeleteRequest struct {
+	SessionId acp.SessionId `json:"sessionId"`
+	Path      string        `json:"path"`
+	Recursive bool          `json:"recursive,omitempty"`
+}
+
+type extMoveRequest struct {
+	SessionId acp.SessionId `json:"sessionId"`
+	From      string        `json:"from"`
+	To        string        `json:"to"`
+}
+
+// extFsCapabilities is advertised in the client capabilities' _meta so that
+// agents can discover the extension methods.
+var extFsCapabilities = map[string]any{
+	"fs/mkdir":  true,
+	"fs/delete": true,
+	"fs/move":   true,
+}
+
+// extHandlers returns the handlers of the extension methods, which manage
+// files only for the sessions that may write them. Text file writes are
+// handled by the router too, for them to be ordered with the other changes.
+func (c *acpClientImpl) extHandlers() map[string]extHandler {
+	if !c.session.caps.write {
+		return map[string]extHandler{}
+	}
+	return map[string]extHandler{
+		acp.ClientMethodFsWriteTextFile: c.extWriteTextFile,
+		extMethodFsMkdir:                c.recovered(extMethodFsMkdir, c.limitFs(c.timed(extMethodFsMkdir, c.extMkdir))),
+		extMethodFsDelete:               c.recovered(extMethodFsDelete, c.limitFs(c.timed(extMethodFsDelete, c.extDelete))),
+		extMethodFsMove:                 c.recovered(extMethodFsMove, c.limitFs(c.timed(extMethodFsMove, c.extMove))),
+	}
+}
+
+// fsTicket returns the ticket of the requests changing files, for the
+// changes to the same path to apply in the order the agent sent them.
+func (c *acpClientImpl) fsTicket(method string, params json.RawMessage) *acpfs.Ticket {
+	var p struct {
+		Path string `json:"path"`
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	switch method {
+	case acp.ClientMethodFsWriteTextFile, extMethodFsMkdir, extMethodFsDelete, extMethodFsMove:
+		// Requests that can't be decoded fail in their handler
+		if json.Unmarshal(params, &p) != nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+	paths := []string{p.Path}
+	if method == extMethodFsMove {
+		paths = []string{p.From, p.To}
+	}
+	return c.fs().Reserve(paths...)
+}
+
+// extWriteTextFile handles fs/write_text_file like the SDK does.
+func (c *acpClientImpl) extWriteTextFile(ctx context.Context, params json.RawMessage) (any, error) {
+	var p acp.WriteTextFileRequest
+	if err := decodeExtParams(params, &p); err != nil {
+		return nil, err
+	}
+	if err := p.Validate(); err != nil {
+		return nil, acp.NewInvalidParams(map[string]any{"error": err.Error()})
+	}
+	return c.WriteTextFile(ctx, p)
+}
+
+func (c *acpClientImpl) extMkdir(ctx context.Context, params json.RawMessage) (any, error) {
+	var p extMkdirRequest
+	err := decodeExtParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Path, err = c.session.paths.localFile(p.Path); err != nil {
+		return nil, err
+	}
+	if !c.session.confirmChange(fmt.Sprintf("Create directory %s", p.Path), false, p.Path) {
+		return nil, errPermissionDenied
+	}
+	if err := c.fs().Mkdir(ctx, p.Path); err != nil {
+		return nil, err
+	}
+	c.session.appendToBuffer(fmt.Sprintf("[Created directory %s]\n", p.Path))
+	return map[string]any{}, nil
+}
+
+func (c *acpClientImpl) extDelete(ctx context.Context, params json.RawMessage) (any, error) {
+	var p extDeleteRequest
+	err := decodeExtParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Path, err = c.session.paths.localFile(p.Path); err != nil {
+		return nil, err
+	}
+	title := fmt.Sprintf("Delete %s", p.Path)
+	if p.Recursive {
+		title = fmt.Sprintf("Delete %s and everything in it", p.Path)
+	}
+	if !c.session.confirmChange(title, p.Recursive, p.Path) {
+		return nil, errPermissionDenied
+	}
+	if err := c.fs().Remove(ctx, p.Path, p.Recursive); err != nil {
+		return nil, err
+	}
+	c.session.appendToBuffer(fmt.Sprintf("[Deleted %s]\n", p.Path))
+	return map[string]any{}, nil
+}
+
+func (c *acpClientImpl) extMove(ctx context.Context, params json.RawMessage) (any, error) {
+	var p extMoveRequest
+	err := decodeExtParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	if p.From, err = c.session.paths.localFile(p.From); err != nil {
+		return nil, err
+	}
+	if p.To, err = c.session.paths.localFile(p.To); err != nil {
+		return nil, err
+	}
+	if !c.session.confirmChange(fmt.Sprintf("Move %s to %s", p.From, p.To), false, p.From, p.To) {
+		return nil, errPermissionDenied
+	}
+	if err := c.fs().Rename(ctx, p.From, p.To); err != nil {
+		return nil, err
+	}
+	c.session.appendToBuffer(fmt.Sprintf("[Moved %s to %s]\n", p.From, p.To))
+	return map[string]any{}, nil
+}
+
+// confirmChange asks the user for permission to change paths, unless
+// auto-approve is enabled and the change isn't one that mustAsk.
+func (s *AcpSession) confirmChange(title string, recursive bool, paths ...string) bool {
+	if mustAsk(s.cwd, recursive, paths...) {
+		return s.ask(title)
+	}
+	return s.confirm(title)
+}
+
+// mustAsk reports whether a change to paths is asked even with
+// auto-approve: a recursive delete, or a change outside of cwd, which the
+// agent could otherwise make to any file of the user.
+func mustAsk(cwd string, recursive bool, paths ...string) bool {
+	if recursive || cwd == "" {
+		return true
+	}
+	dir := filepath.ToSlash(filepath.Clean(cwd))
+	for _, p := range paths {
+		if _, ok := cutDir(filepath.ToSlash(filepath.Clean(p)), dir); !ok {
+			return true
+		}
+	}
+	return false
+}
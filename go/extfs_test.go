@@ -0,0 +1,37 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMustAsk(t *testing.T) {
+	cwd := filepath.FromSlash("/home/user/project")
+	tests := []struct {
+		name      string
+		cwd       string
+		recursive bool
+		paths     []string
+		want      bool
+	}{
+		{name: "in cwd", cwd: cwd, paths: []string{"/home/user/project/a.txt"}},
+		{name: "cwd itself", cwd: cwd, paths: []string{"/home/user/project"}},
+		{name: "recursive in cwd", cwd: cwd, recursive: true, paths: []string{"/home/user/project/build"}, want: true},
+		{name: "outside cwd", cwd: cwd, paths: []string{"/home/user/.bashrc"}, want: true},
+		{name: "home", cwd: cwd, paths: []string{"/home/user"}, want: true},
+		{name: "sibling with the same prefix", cwd: cwd, paths: []string{"/home/user/project2/a.txt"}, want: true},
+		{name: "out through ..", cwd: cwd, paths: []string{"/home/user/project/../other"}, want: true},
+		{name: "move out of cwd", cwd: cwd, paths: []string{"/home/user/project/a.txt", "/etc/a.txt"}, want: true},
+		{name: "move in cwd", cwd: cwd, paths: []string{"/home/user/project/a.txt", "/home/user/project/b/a.txt"}},
+		{name: "no cwd", paths: []string{"/home/user/project/a.txt"}, want: true},
+	}
+	for _, tt := range tests {
+		var paths []string
+		for _, p := range tt.paths {
+			paths = append(paths, filepath.FromSlash(p))
+		}
+		if got := mustAsk(tt.cwd, tt.recursive, paths...); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// GitDiffOpts selects the changes attached by a git diff context block.
+type GitDiffOpts struct {
+	// Staged selects the changes in the index instead of the work tree.
+	Staged bool `json:"staged" msgpack:"staged"`
+	// Range is a revision range such as "main..HEAD". It takes precedence
+	// over Staged.
+	Range string `json:"range" msgpack:"range"`
+	// Paths limits the diff to the given paths.
+	Paths []string `json:"paths" msgpack:"paths"`
+}
+
+// gitDiff runs git diff in dir.
+func gitDiff(ctx context.Context, dir string, opts GitDiffOpts) (string, error) {
+	args := []string{"diff", "--no-color", "--no-ext-diff"}
+	switch {
+	case opts.Range != "":
+		if strings.HasPrefix(opts.Range, "-") {
+			return "", fmt.Errorf("invalid revision range %q", opts.Range)
+		}
+		args = append(args, opts.Range)
+	case opts.Staged:
+		args = append(args, "--cached")
+	}
+	if len(opts.Paths) > 0 {
+		args = append(args, "--")
+		args = append(args, opts.Paths...)
+	}
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git diff: %s", msg)
+		}
+		return "", fmt.Errorf("git diff: %w", err)
+	}
+	return stdout.String(), nil
+}
+
+// gitDiffBlock runs git diff in the session's working directory and wraps the
+// patch in a content block.
+func (s *AcpSession) gitDiffBlock(opts GitDiffOpts) (acp.ContentBlock, error) {
+	diff, err := gitDiff(s.ctx, s.cwd, opts)
+	if err != nil {
+		return acp.ContentBlock{}, err
+	}
+	if diff == "" {
+		return acp.ContentBlock{}, fmt.Errorf("git diff is empty")
+	}
+
+	what := "Unstaged changes"
+	switch {
+	case opts.Range != "":
+		what = fmt.Sprintf("Changes in %s", opts.Range)
+	case opts.Staged:
+		what = "Staged changes"
+	}
+	return acp.TextBlock(fmt.Sprintf("%s (git diff in %s):\n```diff\n%s```", what, s.cwd, diff)), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"sort"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// clientVersion is the version of the plugin reported to agents.
+const clientVersion = "0.1.0-alpha"
+
+// hostLog keeps the last messages logged by the RPC host, which are errors
+// and warnings, for :checkhealth.
+var hostLog agentLog
+
+// healthLogLines is how many of the last messages logged are reported.
+const healthLogLines = 20
+
+// HealthReport is the state of the RPC host rendered by :checkhealth.
+type HealthReport struct {
+	Version         string          `msgpack:"version"`
+	GoVersion       string          `msgpack:"go_version"`
+	ProtocolVersion int             `msgpack:"protocol_version"`
+	Agents          []AgentHealth   `msgpack:"agents"`
+	Sessions        []SessionHealth `msgpack:"sessions"`
+	Errors          []string        `msgpack:"errors"`
+}
+
+// AgentHealthConfig is the part of an agent config needed to find it.
+type AgentHealthConfig struct {
+	Cmd      []string  `msgpack:"cmd"`
+	Address  string    `msgpack:"address"`
+	Launcher *Launcher `msgpack:"launcher"`
+}
+
+// AgentHealth tells whether the command of a configured agent resolves.
+type AgentHealth struct {
+	Name string `msgpack:"name"`
+	// Command is what has to be found: the agent command, or the launcher
+	// for agents running in a container or over SSH
+	Command string `msgpack:"command"`
+	Path    string `msgpack:"path"`
+	Found   bool   `msgpack:"found"`
+	// Address is the address of agents that are already running
+	Address string `msgpack:"address,omitempty"`
+}
+
+// SessionHealth is an active session.
+type SessionHealth struct {
+	Bufnr     int       `msgpack:"bufnr"`
+	Agent     string    `msgpack:"agent"`
+	SessionID string    `msgpack:"session_id"`
+	Pid       int       `msgpack:"pid"`
+	Info      AgentInfo `msgpack:"info"`
+	Mcp       McpReport `msgpack:"mcp"`
+	// Failure is the internal error the session ran into, if any
+	Failure string `msgpack:"failure,omitempty"`
+}
+
+func agentHealth(name string, config AgentHealthConfig) AgentHealth {
+	h := AgentHealth{Name: name, Address: config.Address}
+	switch {
+	case config.Address != "":
+		h.Found = true
+	case config.Launcher != nil:
+		h.Command = config.Launcher.Type
+		path, err := exec.LookPath(h.Command)
+		h.Path, h.Found = path, err == nil
+	case len(config.Cmd) > 0:
+		h.Command = expander{}.expand(config.Cmd[0])
+		h.Path, h.Found = findAgentCommand(h.Command)
+	}
+	return h
+}
+
+// AcpHealth reports the version of the RPC host, whether the given agents
+// can be started, the active sessions and the last errors logged
+func (m *SessionManager) AcpHealth(agents map[string]AgentHealthConfig) (HealthReport, error) {
+	report := HealthReport{
+		Version:         clientVersion,
+		GoVersion:       runtime.Version(),
+		ProtocolVersion: acp.ProtocolVersionNumber,
+		Agents:          []AgentHealth{},
+		Sessions:        []SessionHealth{},
+		Errors:          hostLog.tail(healthLogLines),
+	}
+	for _, name := range sortedKeys(agents) {
+		report.Agents = append(report.Agents, agentHealth(name, agents[name]))
+	}
+
+	m.mu.RLock()
+	sessions := make([]*AcpSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mu.RUnlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].bufnr < sessions[j].bufnr })
+
+	for _, s := range sessions {
+		s.mu.Lock()
+		h := SessionHealth{
+			Bufnr:     s.bufnr,
+			Agent:     s.agentName,
+			SessionID: string(s.sessionID),
+			Info:      agentInfo(s.agentInfo),
+			Mcp:       s.mcpReport,
+		}
+		if s.cmd != nil && s.cmd.Process != nil {
+			h.Pid = s.cmd.Process.Pid
+		}
+		h.Failure, _ = s.failure.Load().(string)
+		s.mu.Unlock()
+		report.Sessions = append(report.Sessions, h)
+	}
+	return report, nil
+}
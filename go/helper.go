@@ -15,6 +15,9 @@ type selectOpts struct {
 
 // select displays a selection menu and returns the selected indexprompt
 func (vim Vim) uiSelect(items []string, opts selectOpts) (int, error) {
+	if vim.api == nil {
+		return ttySelect(items, opts)
+	}
 	promptLines := []string{opts.Title}
 	for i, item := range items {
 		promptLines = append(promptLines, fmt.Sprintf("%d. %s", i+1, item))
@@ -34,16 +37,96 @@ func (vim Vim) uiSelect(items []string, opts selectOpts) (int, error) {
 	return choice, nil
 }
 
-func (vim Vim) bufnr(name string, create bool) (nvim.Buffer, error) {
+// findBufferLua returns the number of the loaded buffer whose name is exactly
+// the given path, or -1. Unlike bufnr(), the name is not treated as a pattern
+// and partial matches are rejected. Names are compared ignoring case on
+// Windows, whose paths are case-insensitive.
+const findBufferLua = `
+local function key(name)
+	name = vim.fs.normalize(name)
+	return vim.fn.has("win32") == 1 and name:lower() or name
+end
+local path = key(...)
+for _, buf in ipairs(vim.api.nvim_list_bufs()) do
+	if vim.api.nvim_buf_is_loaded(buf) and key(vim.api.nvim_buf_get_name(buf)) == path then
+		return buf
+	end
+end
+return -1
+`
+
+// findBuffer returns the loaded buffer holding path. ok is false when no
+// buffer has that name or the buffer is not loaded.
+func (vim Vim) findBuffer(path string) (buf nvim.Buffer, ok bool, err error) {
 	var result int
-	err := vim.api.Call("bufnr", &result, []byte(name), create)
-	// Handle if result is falsy (0) because of error in ACP client
-	if result == 0 {
-		result = 1
+	if err := vim.api.ExecLua(findBufferLua, &result, path); err != nil {
+		return 0, false, fmt.Errorf("error looking up buffer for %s: %w", path, err)
+	}
+	if result <= 0 {
+		return 0, false, nil
+	}
+	return nvim.Buffer(result), true, nil
+}
+
+// bufferLines returns the lines of buf with its changedtick. Both are got in
+// one call, so that the lines match the changedtick.
+func (vim Vim) bufferLines(buf int) (tick int, lines []string, err error) {
+	var raw [][]byte
+	batch := vim.api.NewBatch()
+	batch.BufferChangedTick(nvim.Buffer(buf), &tick)
+	batch.BufferLines(nvim.Buffer(buf), 0, -1, false, &raw)
+	if err := batch.Execute(); err != nil {
+		return 0, nil, err
 	}
-	return nvim.Buffer(result), err
+	lines = make([]string, len(raw))
+	for i, l := range raw {
+		lines[i] = string(l)
+	}
+	return tick, lines, nil
 }
 
 func starString(s string) *string {
 	return &s
 }
+
+// vimBuffers exposes editor buffers to the fs layer.
+type vimBuffers struct {
+	vim Vim
+}
+
+func (b vimBuffers) Find(path string) (int, bool, error) {
+	buf, ok, err := b.vim.findBuffer(path)
+	return int(buf), ok, err
+}
+
+func (b vimBuffers) LineCount(buf int) (int, error) {
+	return b.vim.api.BufferLineCount(nvim.Buffer(buf))
+}
+
+func (b vimBuffers) Lines(buf int, start, end int) ([]string, error) {
+	lines, err := b.vim.api.BufferLines(nvim.Buffer(buf), start, end, false)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = string(l)
+	}
+	return out, nil
+}
+
+func (b vimBuffers) EndsWithNewline(buf int) (bool, error) {
+	var eol bool
+	err := b.vim.api.ExecLua(`local o = vim.bo[...]; return o.eol or (o.fixeol and not o.binary)`, &eol, buf)
+	return eol, err
+}
+
+func (b vimBuffers) SetLines(buf int, lines []string) error {
+	tick, old, err := b.vim.bufferLines(buf)
+	if err != nil {
+		return err
+	}
+	edit := bufferEdits(old, lines)
+	edit.Tick = tick
+	return b.vim.api.ExecLua(`require('acp').apply_edit(...)`, nil, buf, lines, edit)
+}
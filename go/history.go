@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// maxHistory is the number of prompts remembered per session.
+const maxHistory = 100
+
+// promptRecord is a prompt as typed by the user and as sent to the agent.
+type promptRecord struct {
+	text   string
+	blocks []acp.ContentBlock
+}
+
+// promptHistory keeps the prompts sent in a session, oldest first. When file
+// is set, prompts are also appended to it so that they can be recalled from
+// later sessions in the same project.
+type promptHistory struct {
+	mu      sync.Mutex
+	records []promptRecord
+	file    string
+}
+
+// historyEntry is a line of a history file.
+type historyEntry struct {
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// historyFile returns the history file of the project in cwd.
+func historyFile(dir, cwd string) string {
+	sum := sha1.Sum([]byte(cwd))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".jsonl")
+}
+
+func (h *promptHistory) add(text string, blocks []acp.ContentBlock) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, promptRecord{text: text, blocks: blocks})
+	if len(h.records) > maxHistory {
+		h.records = h.records[len(h.records)-maxHistory:]
+	}
+	if h.file != "" && strings.TrimSpace(text) != "" {
+		if err := appendHistory(h.file, historyEntry{Time: time.Now(), Text: text}); err != nil {
+			logError("Error saving prompt history: %v", err)
+		}
+	}
+}
+
+func appendHistory(path string, entry historyEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// entries returns the prompts of the history file, newest first and without
+// duplicates, or those of the session when there is no file.
+func (h *promptHistory) entries() ([]string, error) {
+	h.mu.Lock()
+	file := h.file
+	texts := make([]string, 0, len(h.records))
+	for _, r := range h.records {
+		texts = append(texts, r.text)
+	}
+	h.mu.Unlock()
+
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			defer f.Close()
+			texts = texts[:0]
+			scanner := bufio.NewScanner(f)
+			scanner.Buffer(nil, 1024*1024)
+			for scanner.Scan() {
+				var e historyEntry
+				if json.Unmarshal(scanner.Bytes(), &e) == nil {
+					texts = append(texts, e.Text)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	slices.Reverse(texts)
+	seen := make(map[string]bool)
+	out := texts[:0]
+	for _, t := range texts {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// fuzzyMatch reports whether the characters of query appear in text in
+// order, ignoring case.
+func fuzzyMatch(text, query string) bool {
+	runes := []rune(strings.ToLower(query))
+	i := 0
+	for _, r := range strings.ToLower(text) {
+		if i == len(runes) {
+			break
+		}
+		if r == runes[i] || (unicode.IsSpace(runes[i]) && unicode.IsSpace(r)) {
+			i++
+		}
+	}
+	return i == len(runes)
+}
+
+func (h *promptHistory) last() (promptRecord, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.records) == 0 {
+		return promptRecord{}, false
+	}
+	return h.records[len(h.records)-1], true
+}
+
+// AcpResendLast sends the previous prompt of a session again, with the same
+// attachments
+func (m *SessionManager) AcpResendLast(bufnr int) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	last, ok := session.history.last()
+	if !ok {
+		return nil, fmt.Errorf("no previous prompt")
+	}
+	session.history.add(last.text, last.blocks)
+	session.queuePrompt(last.blocks)
+	return nil, nil
+}
+
+// AcpEditLast returns the text of the previous prompt of a session so that it
+// can be edited and sent again
+func (m *SessionManager) AcpEditLast(bufnr int) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	last, ok := session.history.last()
+	if !ok {
+		return nil, fmt.Errorf("no previous prompt")
+	}
+	return last.text, nil
+}
+
+// AcpHistory returns up to limit previous prompts of the session's project,
+// newest first, keeping only those fuzzy-matching query when it is not empty
+func (m *SessionManager) AcpHistory(bufnr int, query string, limit int) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	texts, err := session.history.entries()
+	if err != nil {
+		return nil, fmt.Errorf("read prompt history: %w", err)
+	}
+	out := []string{}
+	for _, t := range texts {
+		if limit > 0 && len(out) == limit {
+			break
+		}
+		if query == "" || fuzzyMatch(t, query) {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+func TestPromptHistoryLast(t *testing.T) {
+	var h promptHistory
+	if _, ok := h.last(); ok {
+		t.Errorf("got a last prompt from an empty history")
+	}
+	for i := 1; i <= maxHistory+10; i++ {
+		text := fmt.Sprintf("prompt %d", i)
+		h.add(text, []acp.ContentBlock{acp.TextBlock(text)})
+	}
+	last, ok := h.last()
+	if !ok || last.text != fmt.Sprintf("prompt %d", maxHistory+10) || len(last.blocks) != 1 {
+		t.Errorf("got the last prompt %+v, %v", last, ok)
+	}
+	if len(h.records) != maxHistory || h.records[0].text != "prompt 11" {
+		t.Errorf("got %d prompts from %q, want the last %d", len(h.records), h.records[0].text, maxHistory)
+	}
+}
+
+func TestPromptHistoryFile(t *testing.T) {
+	dir := t.TempDir()
+	file := historyFile(dir, "/home/user/project")
+	if file != historyFile(dir, "/home/user/project") || file == historyFile(dir, "/home/user/other") {
+		t.Errorf("projects don't have a history file each: %s", file)
+	}
+
+	// Prompts are recalled from later sessions, newest first and once each
+	first := &promptHistory{file: file}
+	for _, text := range []string{"one", "  ", "two", "one", "multi\nline é"} {
+		first.add(text, nil)
+	}
+	second := &promptHistory{file: file}
+	second.add("three", nil)
+	got, err := second.entries()
+	if want := []string{"three", "multi\nline é", "one", "two"}; err != nil || !slices.Equal(got, want) {
+		t.Errorf("got %q, %v, want %q", got, err, want)
+	}
+
+	// Lines that can't be read are skipped
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("not json\n")
+	f.Close()
+	if got, err := second.entries(); err != nil || len(got) != 4 {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	// Without a file yet, or at all
+	missing := &promptHistory{file: filepath.Join(dir, "missing.jsonl")}
+	missing.records = []promptRecord{{text: "a"}, {text: "b"}, {text: "a"}}
+	if got, err := missing.entries(); err != nil || !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("got %q, %v", got, err)
+	}
+	session := &promptHistory{}
+	session.add("a", nil)
+	if got, err := session.entries(); err != nil || !slices.Equal(got, []string{"a"}) {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		text, query string
+		want        bool
+	}{
+		{"fix the tests", "", true},
+		{"fix the tests", "ftt", true},
+		{"fix the tests", "FIX", true},
+		{"fix the tests", "tf", false},
+		{"fix the\ttests", "the tests", true},
+		{"café crème", "cc", true},
+		{"café crème", "éè", true},
+		{"Étude", "étu", true},
+		{"short", "shorter", false},
+	}
+	for _, tt := range tests {
+		if got := fuzzyMatch(tt.text, tt.query); got != tt.want {
+			t.Errorf("%q in %q: got %v, want %v", tt.query, tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// maxSeedBytes bounds the summary of an imported transcript sent to the
+// agent. The most recent turns are kept.
+const maxSeedBytes = 32 * 1024
+
+// maxSeedReplyBytes bounds the part of each reply kept in the summary.
+const maxSeedReplyBytes = 2 * 1024
+
+// AcpImportOpts are the options of AcpImportTranscript.
+type AcpImportOpts struct {
+	// Replay sends a summary of the transcript to the agent along with the
+	// next prompt, so that it knows what the conversation was about
+	Replay bool `msgpack:"replay"`
+}
+
+// AcpImportTranscript renders a transcript written by AcpExportSession in the
+// chat buffer of a session. Markdown transcripts are shown as they are, and
+// their end is sent when replayed
+func (m *SessionManager) AcpImportTranscript(bufnr int, path string, opts AcpImportOpts) (any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tr *Transcript
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		tr = &Transcript{}
+		if err := json.Unmarshal(data, tr); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	return nil, m.whenReady(bufnr, func(session *AcpSession) {
+		session.appendToBuffer(fmt.Sprintf("\n[Imported from %s]\n", path))
+		seed := string(data)
+		if tr != nil {
+			session.showTranscript(tr)
+			seed = tr.summary(maxSeedBytes)
+		} else {
+			session.appendToBuffer(strings.TrimSuffix(seed, "\n") + "\n")
+			if len(seed) > maxSeedBytes {
+				seed = "[...]\n" + strings.ToValidUTF8(seed[len(seed)-maxSeedBytes:], "")
+			}
+		}
+		session.appendToBuffer("\n[End of the imported conversation]\n")
+		if opts.Replay {
+			session.mu.Lock()
+			session.seed = seed
+			session.mu.Unlock()
+			session.appendToBuffer("[It will be sent to the agent along with the next prompt]\n")
+		}
+		session.flushBuffer()
+	})
+}
+
+// showTranscript renders the turns of tr in the chat buffer like they were
+// rendered as they happened, and adds them to the transcript of the session
+// so that exporting it again keeps them.
+func (s *AcpSession) showTranscript(tr *Transcript) {
+	for i, turn := range tr.Turns {
+		if turn.Prompt != "" {
+			s.appendToBuffer(fmt.Sprintf("\n%s\n🤖 ", turn.Prompt))
+			tr.Turns[i].mark = s.transcript.newMark()
+			s.markTurn(tr.Turns[i].mark)
+		}
+		for _, ev := range turn.Events {
+			switch ev.Kind {
+			case "message":
+				s.appendToBuffer(ev.Text)
+			case "thought":
+				s.appendToBuffer(fmt.Sprintf("[Thought] %s\n", ev.Text))
+			case "plan":
+				s.appendToBuffer("[Plan update]\n")
+			case "tool_call":
+				tc := ev.ToolCall
+				s.appendToBuffer(fmt.Sprintf("\n🔧 %s (%s)\n", tc.Title, tc.Status))
+				if tc.Output != "" {
+					s.showToolOutput(tc.Output, outputHint{kind: acp.ToolKind(tc.Kind)})
+				}
+				for _, d := range tc.Diffs {
+					s.showDiff(d.Path, &d.OldText, d.NewText)
+				}
+			case "permission":
+				if ev.Permission.Option == "" {
+					s.appendToBuffer("\n[Permission denied]\n")
+				} else {
+					s.appendToBuffer(fmt.Sprintf("\n[Permission granted: %s]\n", ev.Permission.Option))
+				}
+			}
+		}
+		if turn.Error != "" {
+			s.appendToBuffer(fmt.Sprintf("[Error: %s]\n", turn.Error))
+		}
+	}
+
+	s.transcript.mu.Lock()
+	defer s.transcript.mu.Unlock()
+	s.transcript.version++
+	s.transcript.turns = append(tr.Turns, s.transcript.turns...)
+}
+
+// summary returns the prompts of the transcript and the replies to them, cut
+// short, within limit bytes. Tool calls are only mentioned by title.
+func (tr *Transcript) summary(limit int) string {
+	var turns []string
+	size := 0
+	for i := len(tr.Turns) - 1; i >= 0; i-- {
+		turn := tr.Turns[i]
+		var b strings.Builder
+		fmt.Fprintf(&b, "User: %s\n", strings.TrimSpace(turn.Prompt))
+		var reply strings.Builder
+		var tools []string
+		for _, ev := range turn.Events {
+			switch ev.Kind {
+			case "message":
+				reply.WriteString(ev.Text)
+			case "tool_call":
+				tools = append(tools, fmt.Sprintf("%s (%s)", ev.ToolCall.Title, ev.ToolCall.Status))
+			}
+		}
+		if len(tools) > 0 {
+			fmt.Fprintf(&b, "Tools: %s\n", strings.Join(tools, "; "))
+		}
+		text := strings.TrimSpace(reply.String())
+		if len(text) > maxSeedReplyBytes {
+			text = strings.ToValidUTF8(text[:maxSeedReplyBytes], "") + " [...]"
+		}
+		fmt.Fprintf(&b, "Assistant: %s\n", text)
+		if size+b.Len() > limit {
+			break
+		}
+		size += b.Len()
+		turns = append(turns, b.String())
+	}
+
+	var out strings.Builder
+	if len(turns) < len(tr.Turns) {
+		fmt.Fprintf(&out, "[%d earlier turns left out]\n\n", len(tr.Turns)-len(turns))
+	}
+	for i := len(turns) - 1; i >= 0; i-- {
+		out.WriteString(turns[i] + "\n")
+	}
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// takeSeed returns the block carrying an imported conversation to replay, if
+// any, once.
+func (s *AcpSession) takeSeed() []acp.ContentBlock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seed == "" {
+		return nil
+	}
+	text := fmt.Sprintf("<previous_conversation>\nThe conversation so far, from an earlier session:\n\n%s\n</previous_conversation>", s.seed)
+	s.seed = ""
+	return []acp.ContentBlock{acp.TextBlock(text)}
+}
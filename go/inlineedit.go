@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// inlineEditPrompt constrains the reply of the agent to the code replacing
+// the selection.
+const inlineEditPrompt = "Rewrite lines %d-%d of %s as instructed below. " +
+	"Reply with the code replacing these lines only, in a single fenced code block, without explanations. " +
+	"Keep the indentation of the lines. Don't change any file yourself.\n\nInstruction: %s"
+
+// AcpInlineEdit asks the agent of the session of bufnr to rewrite the lines
+// sel of buffer target as told by instruction. The replacement is shown as a
+// diff in the chat buffer and applied to target once the user accepts it
+func (m *SessionManager) AcpInlineEdit(bufnr, target int, sel Selection, instruction string) (any, error) {
+	return nil, m.whenReady(bufnr, func(session *AcpSession) {
+		session.queueTurn(func() {
+			if err := session.inlineEdit(target, sel, instruction); err != nil {
+				session.appendToBuffer(fmt.Sprintf("\n[Edit not applied: %v]\n", err))
+				session.flushBuffer()
+			}
+		})
+	})
+}
+
+func (s *AcpSession) inlineEdit(target int, sel Selection, instruction string) error {
+	name := sel.Path
+	if name == "" {
+		name = "[No Name]"
+	}
+	blocks, err := s.buildPrompt(fmt.Sprintf(inlineEditPrompt, sel.Start, sel.End, name, instruction), AcpPromptOpts{Selection: &sel})
+	if err != nil {
+		return err
+	}
+	s.history.add(instruction, blocks)
+
+	reply := &strings.Builder{}
+	s.mu.Lock()
+	s.reply = reply
+	s.mu.Unlock()
+	err = s.prompt(blocks)
+	s.mu.Lock()
+	s.reply = nil
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	code, ok := replyCode(reply.String())
+	if !ok {
+		return fmt.Errorf("the reply has no code")
+	}
+	s.showDiff(name, &sel.Text, code)
+	if !s.ask(fmt.Sprintf("Apply the edit to %s", name)) {
+		return nil
+	}
+	return replaceLines(target, sel, strings.Split(code, "\n"))
+}
+
+// replyCode returns the content of the first code block of reply, or the
+// whole reply if it has none.
+func replyCode(reply string) (string, bool) {
+	var cb codeBlocks
+	for _, line := range strings.Split(reply, "\n") {
+		cb.line(line, 0)
+	}
+	cb.endTurn()
+	code := strings.TrimSpace(reply)
+	if len(cb.blocks) > 0 {
+		code = strings.TrimSuffix(cb.blocks[0].Content, "\n")
+	}
+	return code, code != ""
+}
+
+// replaceLines replaces the lines of sel in buffer target by lines, as a
+// single undo step, unless they changed since sel was taken.
+func replaceLines(target int, sel Selection, lines []string) error {
+	tick, old, err := vim.bufferLines(target)
+	if err != nil {
+		return err
+	}
+	if sel.Start < 1 || sel.End > len(old) || strings.Join(old[sel.Start-1:sel.End], "\n") != sel.Text {
+		return fmt.Errorf("the lines changed since the edit was asked for")
+	}
+
+	edited := make([]string, 0, len(old)-(sel.End-sel.Start+1)+len(lines))
+	edited = append(append(append(edited, old[:sel.Start-1]...), lines...), old[sel.End:]...)
+	edit := bufferEdits(old, edited)
+	edit.Tick = tick
+	return vim.api.ExecLua(`require('acp').apply_edit(...)`, nil, target, edited, edit)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// defaultInstructionFiles are read from the session directory when the
+// session options don't list instruction files.
+var defaultInstructionFiles = []string{filepath.Join(".acp", "system.md")}
+
+// loadInstructions joins the instruction text with the content of the
+// instruction files found in cwd. Missing files are skipped.
+func loadInstructions(cwd string, text string, files []string) (string, error) {
+	if files == nil {
+		files = defaultInstructionFiles
+	}
+	parts := []string{}
+	if t := strings.TrimSpace(text); t != "" {
+		parts = append(parts, t)
+	}
+	for _, name := range files {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cwd, name)
+		}
+		b, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("read instructions %s: %w", name, err)
+		}
+		if t := strings.TrimSpace(string(b)); t != "" {
+			parts = append(parts, t)
+		}
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// takeInstructions returns the block carrying the project instructions if
+// they haven't been sent yet. ACP has no system prompt, so the instructions
+// travel with the first prompt of the session.
+func (s *AcpSession) takeInstructions() []acp.ContentBlock {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.instructions == "" {
+		return nil
+	}
+	text := fmt.Sprintf("<instructions>\n%s\n</instructions>", s.instructions)
+	s.instructions = ""
+	return []acp.ContentBlock{acp.TextBlock(text)}
+}
@@ -0,0 +1,276 @@
+// Package acpfs implements the file system side of the ACP client: reading
+// and writing text files on behalf of the agent, preferring the editor's
+// buffer over the file on disk when the file is loaded.
+package acpfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Buffers gives the fs layer access to files loaded in the editor.
+type Buffers interface {
+	// Find returns the buffer holding path. ok is false when the file is not
+	// loaded in the editor, in which case the file on disk is used instead.
+	// A non-nil error aborts the operation rather than falling back to disk,
+	// since the file may still be open with unsaved changes.
+	Find(path string) (buf int, ok bool, err error)
+	// LineCount returns the number of lines in buf.
+	LineCount(buf int) (int, error)
+	// Lines returns lines [start, end) of buf. end of -1 means the last line.
+	Lines(buf int, start, end int) ([]string, error)
+	// EndsWithNewline reports whether buf is written with a newline after
+	// its last line.
+	EndsWithNewline(buf int) (bool, error)
+	// SetLines replaces the whole content of buf. Implementations should
+	// make the change a single undo step for the user.
+	SetLines(buf int, lines []string) error
+}
+
+// FS reads and writes text files for the agent. Operations that modify a
+// path are serialized per path, in the order of their tickets (see Reserve),
+// so an FS must be shared rather than copied.
+type FS struct {
+	Buffers Buffers
+
+	queue pathQueue
+}
+
+// Reserve returns the ticket of an operation on paths, for it to run after
+// the operations reserved before it on any of them. Requests reserve their
+// ticket in the order they are received and hand it to their operation with
+// WithTicket; the ticket must be closed once the request is done.
+func (f *FS) Reserve(paths ...string) *Ticket {
+	return f.queue.reserve(paths...)
+}
+
+// Result describes a completed read or write.
+type Result struct {
+	Content  string
+	Bytes    int
+	InBuffer bool
+}
+
+// CheckPath applies the path policy shared by every fs operation.
+func CheckPath(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("path must be absolute: %s", path)
+	}
+	return nil
+}
+
+// LineRange converts the 1-based line and the line limit of a read request
+// into the 0-based, end-exclusive range [start, end) of a file with total
+// lines. A nil line starts at the first line and a nil limit reads to the end.
+// Ranges past the end of the file are clamped, so reading beyond the last
+// line yields no lines rather than an error.
+func LineRange(total int, line, limit *int) (start, end int, err error) {
+	if line != nil {
+		if *line < 1 {
+			return 0, 0, fmt.Errorf("line must be 1 or greater, got %d", *line)
+		}
+		start = min(*line-1, total)
+	}
+	end = total
+	if limit != nil {
+		if *limit < 0 {
+			return 0, 0, fmt.Errorf("limit must not be negative, got %d", *limit)
+		}
+		end = min(start+*limit, total)
+	}
+	return start, end, nil
+}
+
+// ReadTextFile reads path, restricted to limit lines starting at the 1-based
+// line when those are given. The lines read are each ended by "\n", but the
+// last line of a file that doesn't end with a newline, so that a file reads
+// the same from its buffer and from the disk, and the whole file reads as its
+// content.
+func (f *FS) ReadTextFile(path string, line, limit *int) (Result, error) {
+	if err := CheckPath(path); err != nil {
+		return Result{}, err
+	}
+	buf, ok, err := f.Buffers.Find(path)
+	if err != nil {
+		return Result{}, err
+	}
+	if ok {
+		total, err := f.Buffers.LineCount(buf)
+		if err != nil {
+			return Result{}, fmt.Errorf("get line count for %s: %w", path, err)
+		}
+		eol, err := f.Buffers.EndsWithNewline(buf)
+		if err != nil {
+			return Result{}, fmt.Errorf("get end of line for %s: %w", path, err)
+		}
+		if total == 1 {
+			// An empty buffer has a line, but it is written as an empty file
+			first, err := f.Buffers.Lines(buf, 0, 1)
+			if err != nil {
+				return Result{}, fmt.Errorf("get buffer lines for %s: %w", path, err)
+			}
+			if len(first) == 1 && first[0] == "" {
+				total = 0
+			}
+		}
+		start, end, err := LineRange(total, line, limit)
+		if err != nil {
+			return Result{}, err
+		}
+		var lines []string
+		if start < end {
+			lines, err = f.Buffers.Lines(buf, start, end)
+			if err != nil {
+				return Result{}, fmt.Errorf("get buffer lines for %s: %w", path, err)
+			}
+		}
+		content := joinLines(lines, eol || end < total)
+		return Result{Content: content, Bytes: len(content), InBuffer: true}, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Result{}, fmt.Errorf("read %s: %w", path, err)
+	}
+	content := string(b)
+	if line != nil || limit != nil {
+		// A trailing newline terminates the last line rather than starting
+		// an empty one, which keeps line numbers in step with the buffer.
+		lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+		if content == "" {
+			lines = nil
+		}
+		start, end, err := LineRange(len(lines), line, limit)
+		if err != nil {
+			return Result{}, err
+		}
+		content = joinLines(lines[start:end], strings.HasSuffix(content, "\n") || end < len(lines))
+	}
+	return Result{Content: content, Bytes: len(content)}, nil
+}
+
+// joinLines returns lines each ended by "\n", but the last one when eol is
+// false.
+func joinLines(lines []string, eol bool) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	content := strings.Join(lines, "\n")
+	if eol {
+		content += "\n"
+	}
+	return content
+}
+
+// WriteTextFile replaces the content of path, creating parent directories as
+// needed when the file is not loaded in the editor.
+func (f *FS) WriteTextFile(ctx context.Context, path, content string) (Result, error) {
+	if err := CheckPath(path); err != nil {
+		return Result{}, err
+	}
+	release, err := f.queue.acquire(ctx, path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer release()
+
+	buf, ok, err := f.Buffers.Find(path)
+	if err != nil {
+		return Result{}, err
+	}
+	if ok {
+		// The newline ending the last line is the buffer's 'eol', not a line
+		lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+		if err := f.Buffers.SetLines(buf, lines); err != nil {
+			return Result{}, fmt.Errorf("set buffer lines for %s: %w", path, err)
+		}
+		return Result{Bytes: len(content), InBuffer: true}, nil
+	}
+
+	dir := filepath.Dir(path)
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return Result{}, fmt.Errorf("mkdir %s: %w", dir, err)
+		}
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		return Result{}, fmt.Errorf("write %s: %w", path, err)
+	}
+	return Result{Bytes: len(content)}, nil
+}
+
+// Mkdir creates the directory path along with any missing parents.
+func (f *FS) Mkdir(ctx context.Context, path string) error {
+	if err := CheckPath(path); err != nil {
+		return err
+	}
+	release, err := f.queue.acquire(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", path, err)
+	}
+	return nil
+}
+
+// Remove deletes the file or directory at path. Directories that are not
+// empty are only removed when recursive is set.
+func (f *FS) Remove(ctx context.Context, path string, recursive bool) error {
+	if err := CheckPath(path); err != nil {
+		return err
+	}
+	path = filepath.Clean(path)
+	if filepath.Dir(path) == path {
+		return fmt.Errorf("refusing to remove root directory %s", path)
+	}
+	release, err := f.queue.acquire(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if recursive {
+		if _, err = os.Lstat(path); err == nil {
+			err = os.RemoveAll(path)
+		}
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		return fmt.Errorf("remove %s: %w", path, err)
+	}
+	return nil
+}
+
+// Rename moves from to to, creating the parent directory of to as needed. An
+// existing destination is never overwritten.
+func (f *FS) Rename(ctx context.Context, from, to string) error {
+	if err := CheckPath(from); err != nil {
+		return err
+	}
+	if err := CheckPath(to); err != nil {
+		return err
+	}
+	release, err := f.queue.acquire(ctx, from, to)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if _, err := os.Lstat(to); err == nil {
+		return fmt.Errorf("rename %s: destination %s already exists", from, to)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(to), err)
+	}
+	if err := os.Rename(from, to); err != nil {
+		return fmt.Errorf("rename %s: %w", from, err)
+	}
+	return nil
+}
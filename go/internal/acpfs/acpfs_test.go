@@ -0,0 +1,444 @@
+package acpfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBuffers is a Buffers with the files loaded in it by path.
+type fakeBuffers struct {
+	paths []string
+	lines map[int][]string
+	// noEOL are the buffers without a newline after their last line
+	noEOL map[int]bool
+	// err is returned by Find
+	err error
+}
+
+func newFakeBuffers(files map[string][]string) *fakeBuffers {
+	b := &fakeBuffers{lines: map[int][]string{}, noEOL: map[int]bool{}}
+	for path, lines := range files {
+		b.paths = append(b.paths, path)
+		b.lines[len(b.paths)] = lines
+	}
+	return b
+}
+
+func (b *fakeBuffers) Find(path string) (int, bool, error) {
+	if b.err != nil {
+		return 0, false, b.err
+	}
+	i := slices.Index(b.paths, path)
+	return i + 1, i >= 0, nil
+}
+
+func (b *fakeBuffers) LineCount(buf int) (int, error) {
+	return len(b.lines[buf]), nil
+}
+
+func (b *fakeBuffers) Lines(buf int, start, end int) ([]string, error) {
+	lines := b.lines[buf]
+	if end < 0 {
+		end = len(lines)
+	}
+	if start < 0 || start > end || end > len(lines) {
+		return nil, errors.New("index out of bounds")
+	}
+	return slices.Clone(lines[start:end]), nil
+}
+
+func (b *fakeBuffers) EndsWithNewline(buf int) (bool, error) {
+	return !b.noEOL[buf], nil
+}
+
+func (b *fakeBuffers) SetLines(buf int, lines []string) error {
+	b.lines[buf] = slices.Clone(lines)
+	return nil
+}
+
+func ptr(n int) *int { return &n }
+
+func TestLineRange(t *testing.T) {
+	tests := []struct {
+		name        string
+		total       int
+		line, limit *int
+		start, end  int
+		wantErr     bool
+	}{
+		{name: "whole file", total: 5, start: 0, end: 5},
+		{name: "from line", total: 5, line: ptr(2), start: 1, end: 5},
+		{name: "limit", total: 5, limit: ptr(2), start: 0, end: 2},
+		{name: "line and limit", total: 5, line: ptr(2), limit: ptr(2), start: 1, end: 3},
+		{name: "zero limit", total: 5, line: ptr(2), limit: ptr(0), start: 1, end: 1},
+		{name: "limit past the end", total: 5, line: ptr(4), limit: ptr(10), start: 3, end: 5},
+		{name: "line past the end", total: 5, line: ptr(9), start: 5, end: 5},
+		{name: "empty file", total: 0, line: ptr(1), limit: ptr(1), start: 0, end: 0},
+		{name: "line 0", total: 5, line: ptr(0), wantErr: true},
+		{name: "negative limit", total: 5, limit: ptr(-1), wantErr: true},
+	}
+	for _, tt := range tests {
+		start, end, err := LineRange(tt.total, tt.line, tt.limit)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got [%d, %d), want an error", tt.name, start, end)
+			}
+			continue
+		}
+		if err != nil || start != tt.start || end != tt.end {
+			t.Errorf("%s: got [%d, %d), %v, want [%d, %d)", tt.name, start, end, err, tt.start, tt.end)
+		}
+	}
+}
+
+func TestReadTextFile(t *testing.T) {
+	dir := t.TempDir()
+	// Each file is on disk and in a buffer with the same content, both must
+	// read the same
+	files := map[string]string{
+		"eol.txt":   "one\ntwo\nthree\n",
+		"noeol.txt": "one\ntwo\nthree",
+		"empty.txt": "",
+	}
+	buffered := map[string][]string{}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+		buffered[filepath.Join(dir, "buffer", name)] = lines
+	}
+	buffers := newFakeBuffers(buffered)
+	buffers.noEOL[slices.Index(buffers.paths, filepath.Join(dir, "buffer", "noeol.txt"))+1] = true
+	f := &FS{Buffers: buffers}
+
+	tests := []struct {
+		file        string
+		line, limit *int
+		want        string
+	}{
+		{file: "eol.txt", want: "one\ntwo\nthree\n"},
+		{file: "eol.txt", line: ptr(2), want: "two\nthree\n"},
+		{file: "eol.txt", line: ptr(2), limit: ptr(1), want: "two\n"},
+		{file: "eol.txt", line: ptr(1), limit: ptr(3), want: "one\ntwo\nthree\n"},
+		{file: "eol.txt", limit: ptr(0), want: ""},
+		{file: "eol.txt", line: ptr(3), limit: ptr(10), want: "three\n"},
+		{file: "eol.txt", line: ptr(4), want: ""},
+		{file: "eol.txt", line: ptr(9), limit: ptr(1), want: ""},
+		{file: "noeol.txt", want: "one\ntwo\nthree"},
+		{file: "noeol.txt", line: ptr(2), want: "two\nthree"},
+		{file: "noeol.txt", line: ptr(2), limit: ptr(1), want: "two\n"},
+		{file: "noeol.txt", limit: ptr(0), want: ""},
+		{file: "noeol.txt", line: ptr(3), limit: ptr(10), want: "three"},
+		{file: "noeol.txt", line: ptr(9), want: ""},
+		{file: "empty.txt", want: ""},
+		{file: "empty.txt", line: ptr(1), limit: ptr(1), want: ""},
+		{file: "empty.txt", line: ptr(2), want: ""},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{filepath.Join(dir, tt.file), filepath.Join(dir, "buffer", tt.file)} {
+			res, err := f.ReadTextFile(path, tt.line, tt.limit)
+			if err != nil || res.Content != tt.want || res.Bytes != len(tt.want) {
+				t.Errorf("%s, line %v, limit %v: got %q (%d bytes), %v, want %q", path, deref(tt.line), deref(tt.limit), res.Content, res.Bytes, err, tt.want)
+			}
+			if inBuffer := filepath.Base(filepath.Dir(path)) == "buffer"; res.InBuffer != inBuffer {
+				t.Errorf("%s: InBuffer is %v", path, res.InBuffer)
+			}
+		}
+	}
+
+	onDisk := filepath.Join(dir, "eol.txt")
+	if _, err := f.ReadTextFile(onDisk, ptr(0), nil); err == nil {
+		t.Errorf("read from line 0")
+	}
+	if _, err := f.ReadTextFile("relative.txt", nil, nil); err == nil {
+		t.Errorf("read a relative path")
+	}
+	if _, err := f.ReadTextFile(filepath.Join(dir, "missing.txt"), nil, nil); err == nil {
+		t.Errorf("read a missing file")
+	}
+	buffers.err = errors.New("no editor")
+	if _, err := f.ReadTextFile(onDisk, nil, nil); err == nil {
+		t.Errorf("read the disk when the buffers can't be looked up")
+	}
+}
+
+// deref returns what p points to, or "nil".
+func deref(p *int) any {
+	if p == nil {
+		return "nil"
+	}
+	return *p
+}
+
+func TestWriteTextFile(t *testing.T) {
+	dir := t.TempDir()
+	inBuffer := filepath.Join(dir, "buffer.txt")
+	buffers := newFakeBuffers(map[string][]string{inBuffer: {"old"}})
+	f := &FS{Buffers: buffers}
+
+	// The newline at the end is the buffer's 'eol'
+	res, err := f.WriteTextFile(context.Background(), inBuffer, "one\ntwo\n")
+	if err != nil || !res.InBuffer || res.Bytes != 8 {
+		t.Fatalf("write to buffer: got %+v, %v", res, err)
+	}
+	if got := buffers.lines[1]; !slices.Equal(got, []string{"one", "two"}) {
+		t.Errorf("buffer lines are %q", got)
+	}
+	if _, err := os.Stat(inBuffer); !os.IsNotExist(err) {
+		t.Errorf("the write to the buffer went to the disk: %v", err)
+	}
+
+	onDisk := filepath.Join(dir, "new", "dir", "disk.txt")
+	res, err = f.WriteTextFile(context.Background(), onDisk, "one\ntwo\n")
+	if err != nil || res.InBuffer || res.Bytes != 8 {
+		t.Fatalf("write to disk: got %+v, %v", res, err)
+	}
+	if b, err := os.ReadFile(onDisk); err != nil || string(b) != "one\ntwo\n" {
+		t.Errorf("file has %q, %v", b, err)
+	}
+
+	if _, err := f.WriteTextFile(context.Background(), "relative.txt", ""); err == nil {
+		t.Errorf("wrote a relative path")
+	}
+	buffers.err = errors.New("no editor")
+	if _, err := f.WriteTextFile(context.Background(), onDisk, "lost"); err == nil {
+		t.Errorf("wrote the disk when the buffers can't be looked up")
+	}
+}
+
+// acquire runs q.acquire in a goroutine, which sends the release function to
+// got once it returns.
+func acquire(q *pathQueue, got chan func(), paths ...string) {
+	go func() {
+		release, _ := q.acquire(context.Background(), paths...)
+		got <- release
+	}()
+}
+
+func TestPathQueue(t *testing.T) {
+	var q pathQueue
+	release, _ := q.acquire(context.Background(), "/a/b.txt")
+
+	tests := []struct {
+		name  string
+		paths []string
+		waits bool
+	}{
+		{name: "same path", paths: []string{"/a/b.txt"}, waits: true},
+		{name: "same path uncleaned", paths: []string{"/a/./c/../b.txt"}, waits: true},
+		{name: "several paths", paths: []string{"/z.txt", "/a/b.txt"}, waits: true},
+		{name: "other path", paths: []string{"/a/c.txt"}},
+		{name: "same path twice", paths: []string{"/d.txt", "/d.txt"}},
+	}
+	waiting := make(chan func(), len(tests))
+	waiters := 0
+	for _, tt := range tests {
+		got := make(chan func(), 1)
+		acquire(&q, got, tt.paths...)
+		select {
+		case r := <-got:
+			if tt.waits {
+				t.Errorf("%s: didn't wait for the path to be released", tt.name)
+			}
+			r()
+		case <-time.After(50 * time.Millisecond):
+			if !tt.waits {
+				t.Errorf("%s: waited for a path that isn't busy", tt.name)
+			}
+			waiters++
+			go func() { waiting <- <-got }()
+		}
+	}
+
+	// The waiters take the path one at a time
+	release()
+	for i := 0; i < waiters; i++ {
+		var r func()
+		select {
+		case r = <-waiting:
+		case <-time.After(time.Second):
+			t.Fatal("a waiter never got the path")
+		}
+		select {
+		case other := <-waiting:
+			t.Errorf("two waiters got the path at once")
+			other()
+			i++
+		case <-time.After(20 * time.Millisecond):
+		}
+		r()
+	}
+	if len(q.waiting) != 0 {
+		t.Errorf("tickets left after every release: %v", q.waiting)
+	}
+}
+
+func TestPathQueueTickets(t *testing.T) {
+	var q pathQueue
+	first := q.reserve("/a.txt")
+	second := q.reserve("/a.txt", "/b.txt")
+	other := q.reserve("/b.txt")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := second.Wait(ctx); err == nil {
+		t.Errorf("the second ticket didn't wait for the first")
+	}
+	if err := first.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The operation of a ticket runs in its turn, whatever the paths given
+	got := make(chan func(), 1)
+	go func() {
+		release, _ := q.acquire(WithTicket(context.Background(), second), "/elsewhere.txt")
+		got <- release
+	}()
+	select {
+	case <-got:
+		t.Fatal("the second ticket ran before the first was done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Closing a ticket whose operation runs leaves it to the operation
+	release, _ := q.acquire(WithTicket(context.Background(), first))
+	first.Close()
+	select {
+	case <-got:
+		t.Fatal("the second ticket ran before the operation of the first was done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case release = <-got:
+	case <-time.After(time.Second):
+		t.Fatal("the second ticket never ran")
+	}
+
+	// Tickets given up don't hold the ones after them
+	second.Close()
+	release()
+	if err := other.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+	if len(q.waiting) != 0 {
+		t.Errorf("tickets left after every release: %v", q.waiting)
+	}
+}
+
+func TestWriteTextFileInOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	f := &FS{Buffers: newFakeBuffers(nil)}
+	first := f.Reserve(path)
+	second := f.Reserve(path)
+
+	// The later write gets to run first, and must wait for the earlier one
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.WriteTextFile(WithTicket(context.Background(), second), path, "second")
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := f.WriteTextFile(WithTicket(context.Background(), first), path, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "second" {
+		t.Errorf("file has %q, %v, want the later write", b, err)
+	}
+}
+
+func TestMkdir(t *testing.T) {
+	dir := t.TempDir()
+	f := &FS{Buffers: newFakeBuffers(nil)}
+	ctx := context.Background()
+
+	path := filepath.Join(dir, "a", "b")
+	if err := f.Mkdir(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Errorf("no directory made: %v", err)
+	}
+	if err := f.Mkdir(ctx, path); err != nil {
+		t.Errorf("mkdir of an existing directory: %v", err)
+	}
+	if err := f.Mkdir(ctx, "relative"); err == nil {
+		t.Errorf("made a relative path")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	dir := t.TempDir()
+	f := &FS{Buffers: newFakeBuffers(nil)}
+	ctx := context.Background()
+
+	full := filepath.Join(dir, "full")
+	if err := os.MkdirAll(filepath.Join(full, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(full, "sub", "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Remove(ctx, full, false); err == nil {
+		t.Errorf("removed a directory that isn't empty without recursive")
+	}
+	if _, err := os.Stat(full); err != nil {
+		t.Errorf("the directory is gone: %v", err)
+	}
+	if err := f.Remove(ctx, full, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(full); !os.IsNotExist(err) {
+		t.Errorf("the directory is still there: %v", err)
+	}
+	if err := f.Remove(ctx, full, true); err == nil {
+		t.Errorf("removed a missing path")
+	}
+
+	root := filepath.VolumeName(dir) + string(filepath.Separator)
+	for _, path := range []string{root, filepath.Join(dir, strings.Repeat("../", 64))} {
+		if err := f.Remove(ctx, path, true); err == nil || !strings.Contains(err.Error(), "root") {
+			t.Errorf("remove %s: got %v, want the root to be refused", path, err)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	dir := t.TempDir()
+	f := &FS{Buffers: newFakeBuffers(nil)}
+	ctx := context.Background()
+
+	from, to := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	for path, content := range map[string]string{from: "a", to: "b"} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Rename(ctx, from, to); err == nil {
+		t.Errorf("moved onto an existing file")
+	}
+	if b, err := os.ReadFile(to); err != nil || string(b) != "b" {
+		t.Errorf("the destination has %q, %v", b, err)
+	}
+
+	moved := filepath.Join(dir, "new", "a.txt")
+	if err := f.Rename(ctx, from, moved); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(moved); err != nil || string(b) != "a" {
+		t.Errorf("the moved file has %q, %v", b, err)
+	}
+	if _, err := os.Stat(from); !os.IsNotExist(err) {
+		t.Errorf("the file is still at its old path: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package acpfs
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// pathQueue serializes operations on the same path, in the order of their
+// tickets. Requests are handled in goroutines of their own, so the order the
+// agent sent them in is kept by reserving their tickets as they are read, see
+// FS.Reserve. Operations without a ticket get one when they start.
+type pathQueue struct {
+	mu sync.Mutex
+	// waiting are the tickets of the operations on each path, in the order
+	// they are served. An operation runs once its ticket is the first one of
+	// each of its paths.
+	waiting map[string][]*Ticket
+	// changed is closed, and replaced, when a ticket leaves the queue
+	changed chan struct{}
+}
+
+// Ticket is the turn of an operation in the queue of the paths it touches.
+type Ticket struct {
+	q    *pathQueue
+	keys []string
+	// held is set once the operation runs, guarded by the queue's mu
+	held bool
+}
+
+// reserve returns a ticket for paths, served after the ones reserved before.
+// Tickets are added to all their paths at once, so that they are served in
+// the same order on every path and don't deadlock.
+func (q *pathQueue) reserve(paths ...string) *Ticket {
+	keys := make([]string, 0, len(paths))
+	for _, p := range paths {
+		keys = append(keys, filepath.Clean(p))
+	}
+	slices.Sort(keys)
+	t := &Ticket{q: q, keys: slices.Compact(keys)}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.waiting == nil {
+		q.waiting = make(map[string][]*Ticket)
+	}
+	for _, k := range t.keys {
+		q.waiting[k] = append(q.waiting[k], t)
+	}
+	return t
+}
+
+// Wait waits until the operation of t may run: the operations of the tickets
+// reserved before it on its paths are done.
+func (t *Ticket) Wait(ctx context.Context) error {
+	q := t.q
+	for {
+		q.mu.Lock()
+		first := true
+		for _, k := range t.keys {
+			if w := q.waiting[k]; len(w) == 0 || w[0] != t {
+				first = false
+			}
+		}
+		if q.changed == nil {
+			q.changed = make(chan struct{})
+		}
+		changed := q.changed
+		q.mu.Unlock()
+		if first {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close gives up the turn of t, unless its operation runs: the operation
+// then releases it when it is done. It is for the tickets of requests that
+// fail before their operation runs.
+func (t *Ticket) Close() {
+	t.q.mu.Lock()
+	defer t.q.mu.Unlock()
+	if !t.held {
+		t.q.removeLocked(t)
+	}
+}
+
+// release ends the turn of t once its operation is done.
+func (t *Ticket) release() {
+	t.q.mu.Lock()
+	defer t.q.mu.Unlock()
+	t.q.removeLocked(t)
+}
+
+func (q *pathQueue) removeLocked(t *Ticket) {
+	removed := false
+	for _, k := range t.keys {
+		w := q.waiting[k]
+		if i := slices.Index(w, t); i >= 0 {
+			w = slices.Delete(w, i, i+1)
+			removed = true
+		}
+		if len(w) == 0 {
+			delete(q.waiting, k)
+		} else {
+			q.waiting[k] = w
+		}
+	}
+	if removed && q.changed != nil {
+		close(q.changed)
+		q.changed = nil
+	}
+}
+
+// ticketKey is the key of the ticket of a request in its context.
+type ticketKey struct{}
+
+// WithTicket returns ctx carrying the ticket of the request it handles, for
+// the operation of the request to run in its turn.
+func WithTicket(ctx context.Context, t *Ticket) context.Context {
+	return context.WithValue(ctx, ticketKey{}, t)
+}
+
+// acquire waits for the turn of the operation on paths and returns a
+// function releasing them. The operation runs in the turn of the ticket of
+// ctx when there is one, reserved for the same paths, and else in the order
+// it got here.
+func (q *pathQueue) acquire(ctx context.Context, paths ...string) (release func(), err error) {
+	t, _ := ctx.Value(ticketKey{}).(*Ticket)
+	if t == nil || t.q != q {
+		t = q.reserve(paths...)
+	}
+	if err := t.Wait(ctx); err != nil {
+		t.Close()
+		return nil, err
+	}
+	q.mu.Lock()
+	t.held = true
+	q.mu.Unlock()
+	return t.release, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// Launcher runs the agent command in a container or on another machine over
+// SSH, talking to it through the stdio of docker exec or ssh. The agent then
+// works on a checkout at Workdir, which mirrors the working directory of
+// Neovim.
+type Launcher struct {
+	// Type is "docker", "podman", "ssh" or "wsl"
+	Type string `json:"type" msgpack:"type"`
+	// Container is the running container of "docker" and "podman"
+	Container string `json:"container" msgpack:"container"`
+	// Host is the [user@]host of "ssh"
+	Host string `json:"host" msgpack:"host"`
+	// Distro is the distribution of "wsl", the default one if empty
+	Distro string `json:"distro" msgpack:"distro"`
+	// Workdir is the directory of the checkout on the other side. Paths under
+	// it are translated to and from the local working directory.
+	Workdir string `json:"workdir" msgpack:"workdir"`
+	// Args are extra arguments of docker exec, podman exec, ssh or wsl.exe
+	Args []string `json:"args" msgpack:"args"`
+}
+
+// wrap returns the command running cmd with env through the launcher. env is
+// set on the other side rather than for the local process.
+func (l *Launcher) wrap(cmd []string, env map[string]string) ([]string, error) {
+	keys := sortedKeys(env)
+
+	switch l.Type {
+	case "docker", "podman":
+		if l.Container == "" {
+			return nil, fmt.Errorf("%s launcher needs a container", l.Type)
+		}
+		out := []string{l.Type, "exec", "-i"}
+		if l.Workdir != "" {
+			out = append(out, "-w", l.Workdir)
+		}
+		for _, k := range keys {
+			out = append(out, "-e", k+"="+env[k])
+		}
+		out = append(out, l.Args...)
+		out = append(out, l.Container)
+		return append(out, cmd...), nil
+	case "ssh":
+		if l.Host == "" {
+			return nil, fmt.Errorf("ssh launcher needs a host")
+		}
+		// ssh runs its arguments through the remote shell
+		var script strings.Builder
+		if l.Workdir != "" {
+			fmt.Fprintf(&script, "cd %s && ", shellQuote(l.Workdir))
+		}
+		script.WriteString("exec")
+		if len(keys) > 0 {
+			script.WriteString(" env")
+			for _, k := range keys {
+				script.WriteString(" " + shellQuote(k+"="+env[k]))
+			}
+		}
+		for _, a := range cmd {
+			script.WriteString(" " + shellQuote(a))
+		}
+		out := append([]string{"ssh", "-T"}, l.Args...)
+		return append(out, l.Host, script.String()), nil
+	case "wsl":
+		// wsl.exe starts in the WSL view of the current directory
+		out := []string{"wsl.exe"}
+		if l.Distro != "" {
+			out = append(out, "-d", l.Distro)
+		}
+		if l.Workdir != "" {
+			out = append(out, "--cd", l.Workdir)
+		}
+		out = append(out, l.Args...)
+		out = append(out, "--exec")
+		if len(keys) > 0 {
+			out = append(out, "env")
+			for _, k := range keys {
+				out = append(out, k+"="+env[k])
+			}
+		}
+		return append(out, cmd...), nil
+	default:
+		return nil, fmt.Errorf("unknown launcher type %q", l.Type)
+	}
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// pathMap translates paths between the local working directory and the
+// directory the agent sees it as, and between the Windows and the WSL views
+// of the files when Neovim and the agent run on different sides. The zero
+// value translates nothing.
+type pathMap struct {
+	local  string
+	remote string
+	// style is "wsl" when the agent runs in WSL and Neovim on Windows, and
+	// "windows" for the reverse
+	style string
+	// distro is the WSL distribution, whose files outside of /mnt are seen
+	// from Windows under \\wsl.localhost\<distro>
+	distro string
+}
+
+// newPathMap returns the pathMap of a session started in cwd with opts.
+func newPathMap(cwd string, opts AcpNewSessionOpts) (pathMap, error) {
+	m := pathMap{style: opts.PathStyle}
+	if l := opts.Launcher; l != nil {
+		if l.Workdir != "" {
+			m.local, m.remote = cwd, l.Workdir
+		}
+		if l.Type == "wsl" {
+			if m.style == "" {
+				m.style = "wsl"
+			}
+			m.distro = l.Distro
+		}
+	}
+	switch m.style {
+	case "", "wsl":
+	case "windows":
+		// Set by WSL for the processes of the distribution
+		m.distro = os.Getenv("WSL_DISTRO_NAME")
+	default:
+		return pathMap{}, fmt.Errorf("unknown path style %q", m.style)
+	}
+	return m, nil
+}
+
+// toLocal translates a path sent by the agent.
+func (m pathMap) toLocal(p string) string {
+	if m.remote != "" {
+		if rel, ok := cutDir(path.Clean(p), m.remote); ok {
+			return filepath.Join(m.local, filepath.FromSlash(rel))
+		}
+	}
+	switch m.style {
+	case "wsl":
+		return wslToWindows(p, m.distro)
+	case "windows":
+		return windowsToWsl(p)
+	}
+	return localPath(p)
+}
+
+// localFile translates the path of a file the agent asks to read or change.
+// An agent run by a launcher in a working directory of its own, e.g. in a
+// container or on another host, only has access to the files of the local
+// working directory: other paths are rejected rather than used as is.
+func (m pathMap) localFile(p string) (string, error) {
+	if m.remote == "" {
+		return m.toLocal(p), nil
+	}
+	if rel, ok := cutDir(path.Clean(p), m.remote); ok {
+		return filepath.Join(m.local, filepath.FromSlash(rel)), nil
+	}
+	return "", acp.NewInvalidParams(map[string]any{
+		"path":  p,
+		"error": fmt.Sprintf("%s is outside of the working directory %s", p, m.remote),
+	})
+}
+
+// toRemote translates a local path before sending it to the agent.
+func (m pathMap) toRemote(p string) string {
+	if m.remote != "" {
+		if rel, ok := cutDir(filepath.ToSlash(filepath.Clean(p)), filepath.ToSlash(m.local)); ok {
+			return path.Join(m.remote, rel)
+		}
+	}
+	switch m.style {
+	case "wsl":
+		return windowsToWsl(p)
+	case "windows":
+		return wslToWindows(p, m.distro)
+	}
+	return p
+}
+
+// localizeToolCall translates the paths of the diffs and the locations of a
+// tool call sent by the agent.
+func (m pathMap) localizeToolCall(content []acp.ToolCallContent, locations []acp.ToolCallLocation) {
+	for _, c := range content {
+		if c.Diff != nil {
+			c.Diff.Path = m.toLocal(c.Diff.Path)
+		}
+	}
+	for i := range locations {
+		locations[i].Path = m.toLocal(locations[i].Path)
+	}
+}
+
+// wslToWindows returns the Windows path of the WSL path p: /mnt/c/Users is
+// C:\Users and /home is \\wsl.localhost\<distro>\home. Relative paths, and
+// paths outside of /mnt without distro, are returned as is.
+func wslToWindows(p, distro string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+	p = path.Clean(p)
+	if rest, ok := strings.CutPrefix(p, "/mnt/"); ok && driveLetter(rest[0]) && (len(rest) == 1 || rest[1] == '/') {
+		return strings.ToUpper(rest[:1]) + `:\` + strings.ReplaceAll(strings.TrimPrefix(rest[1:], "/"), "/", `\`)
+	}
+	if distro == "" {
+		return p
+	}
+	return `\\wsl.localhost\` + distro + strings.ReplaceAll(p, "/", `\`)
+}
+
+// windowsToWsl returns the WSL path of the Windows path p, the reverse of
+// wslToWindows. Other paths are returned as is.
+func windowsToWsl(p string) string {
+	s := strings.ReplaceAll(p, `\`, "/")
+	if hasDrive(s) && (len(s) == 2 || s[2] == '/') {
+		return path.Join("/mnt", strings.ToLower(s[:1]), s[2:])
+	}
+	for _, prefix := range []string{"//wsl.localhost/", "//wsl$/"} {
+		if rest, ok := strings.CutPrefix(s, prefix); ok {
+			_, rest, _ = strings.Cut(rest, "/")
+			return path.Join("/", rest)
+		}
+	}
+	return p
+}
+
+// cutDir returns p relative to dir when p is dir or is inside it.
+func cutDir(p, dir string) (string, bool) {
+	dir = strings.TrimSuffix(dir, "/")
+	if p == dir {
+		return "", true
+	}
+	if rest, ok := strings.CutPrefix(p, dir+"/"); ok {
+		return rest, true
+	}
+	return "", false
+}
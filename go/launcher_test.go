@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPathMapLocalFile(t *testing.T) {
+	local := filepath.FromSlash("/home/u/project")
+	m := pathMap{local: local, remote: "/workspace"}
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"/workspace", local, true},
+		{"/workspace/a/b.go", filepath.Join(local, "a", "b.go"), true},
+		{"/workspace/a/../b.go", filepath.Join(local, "b.go"), true},
+		{"/workspace/../../etc/passwd", "", false},
+		{"/home/u/.ssh/id_rsa", "", false},
+		{"/workspace2/a", "", false},
+		{"a/b.go", "", false},
+	}
+	for _, tt := range tests {
+		got, err := m.localFile(tt.path)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("localFile(%q) = %q, %v, want %q, ok %v", tt.path, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// logLevel is the severity of a log message. Messages are written to stderr
+// as "[level] message", which the Lua side turns into notifications of the
+// same level.
+type logLevel int32
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+	levelTrace
+)
+
+var logLevelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// currentLogLevel is the most verbose level logged.
+var currentLogLevel atomic.Int32
+
+func init() {
+	currentLogLevel.Store(int32(levelWarn))
+}
+
+// parseLogLevel returns the level called name.
+func parseLogLevel(name string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+func logAt(level logLevel, format string, args ...any) {
+	if int32(level) > currentLogLevel.Load() {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	log.Printf("[%s] %s\n", level, msg)
+	if level <= levelWarn {
+		fmt.Fprintf(&hostLog, "[%s] %s\n", level, msg)
+	}
+}
+
+func logError(format string, args ...any) { logAt(levelError, format, args...) }
+func logWarn(format string, args ...any)  { logAt(levelWarn, format, args...) }
+func logInfo(format string, args ...any)  { logAt(levelInfo, format, args...) }
+func logDebug(format string, args ...any) { logAt(levelDebug, format, args...) }
+func logTrace(format string, args ...any) { logAt(levelTrace, format, args...) }
+
+// AcpSetLogLevel changes the most verbose level of the messages logged: one
+// of error, warn, info, debug and trace
+func (m *SessionManager) AcpSetLogLevel(level string) (any, error) {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	currentLogLevel.Store(int32(l))
+	return nil, nil
+}
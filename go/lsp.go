@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// definitionContext is the number of lines of a definition sent along with
+// its location.
+const definitionContext = 20
+
+// SymbolLocation is where a symbol is defined, as reported by the language
+// server.
+type SymbolLocation struct {
+	Path string `msgpack:"path"`
+	Line int    `msgpack:"line"`
+}
+
+// SymbolInfo is what the language servers know about the symbol under the
+// cursor of a window.
+type SymbolInfo struct {
+	Path        string           `msgpack:"path"`
+	Line        int              `msgpack:"line"`
+	Col         int              `msgpack:"col"`
+	Symbol      string           `msgpack:"symbol"`
+	Hover       string           `msgpack:"hover"`
+	Signature   string           `msgpack:"signature"`
+	Definitions []SymbolLocation `msgpack:"definitions"`
+}
+
+// symbolInfo asks the language servers attached to the buffer of win about
+// the symbol under the cursor.
+func symbolInfo(win int) (SymbolInfo, error) {
+	var info SymbolInfo
+	if err := vim.api.ExecLua(`return require('acp').lsp_symbol(...)`, &info, win); err != nil {
+		return SymbolInfo{}, err
+	}
+	if info.Hover == "" && info.Signature == "" && len(info.Definitions) == 0 {
+		return SymbolInfo{}, fmt.Errorf("no language server information for %q", info.Symbol)
+	}
+	return info, nil
+}
+
+// symbolBlock renders the hover text, signature and definitions of a symbol.
+// A few lines of each definition are included, read from the buffer when the
+// file is loaded.
+func (s *AcpSession) symbolBlock(info SymbolInfo) acp.ContentBlock {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Symbol `%s` at %s:%d:%d\n", info.Symbol, info.Path, info.Line, info.Col)
+	if info.Hover != "" {
+		fmt.Fprintf(&b, "\nHover:\n%s\n", info.Hover)
+	}
+	if info.Signature != "" {
+		fmt.Fprintf(&b, "\nSignature:\n%s\n", info.Signature)
+	}
+	for _, def := range info.Definitions {
+		fmt.Fprintf(&b, "\nDefinition at %s:%d", def.Path, def.Line)
+		limit := definitionContext
+		res, err := s.files.ReadTextFile(def.Path, &def.Line, &limit)
+		if err != nil || res.Content == "" {
+			b.WriteString("\n")
+			continue
+		}
+		fmt.Fprintf(&b, ":\n```\n%s\n```\n", strings.TrimSuffix(res.Content, "\n"))
+	}
+	return acp.TextBlock(b.String())
+}
+
+// AcpAttachSymbol attaches what the language servers know about the symbol
+// under the cursor of win to the next prompt
+func (m *SessionManager) AcpAttachSymbol(bufnr int, win int) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	info, err := symbolInfo(win)
+	if err != nil {
+		return nil, err
+	}
+	session.attach(session.symbolBlock(info))
+	session.appendToBuffer(fmt.Sprintf("[Attached symbol %s]\n", info.Symbol))
+	return nil, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// luaHandlers records the extension methods of the agent handled in Lua.
+// Lua keeps it up to date through AcpSetLuaHandlers.
+var luaHandlers struct {
+	mu      sync.Mutex
+	methods map[string]bool
+}
+
+// AcpSetLuaHandlers tells the host which extension methods have a handler
+// registered in Lua
+func (m *SessionManager) AcpSetLuaHandlers(methods []string) (any, error) {
+	luaHandlers.mu.Lock()
+	defer luaHandlers.mu.Unlock()
+	luaHandlers.methods = map[string]bool{}
+	for _, method := range methods {
+		luaHandlers.methods[method] = true
+	}
+	return nil, nil
+}
+
+// extFallback returns the Lua handler of an extension method the client
+// doesn't implement, if one is registered.
+func (c *acpClientImpl) extFallback(method string) (extHandler, bool) {
+	luaHandlers.mu.Lock()
+	ok := luaHandlers.methods[method]
+	luaHandlers.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return c.recovered(method, c.timed(method, func(ctx context.Context, params json.RawMessage) (any, error) {
+		var decoded any
+		if len(params) > 0 {
+			if err := decodeExtParams(params, &decoded); err != nil {
+				return nil, err
+			}
+		}
+		var result any
+		if err := vim.api.ExecLua(`return require('acp').handle_request(...)`, &result, c.session.bufnr, method, decoded); err != nil {
+			return nil, err
+		}
+		return result, nil
+	})), true
+}
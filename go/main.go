@@ -1,17 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"acp/go/internal/acpfs"
 	"github.com/coder/acp-go-sdk"
 	"github.com/neovim/go-client/nvim"
 )
@@ -20,17 +22,159 @@ import (
 type AcpSession struct {
 	bufnr       int
 	conn        *acp.ClientSideConnection
+	ext         *extRouter
 	sessionID   acp.SessionId
 	ctx         context.Context
 	cancel      context.CancelFunc
 	cmd         *exec.Cmd
+	remote      io.Closer // connection to an already running agent, in place of cmd
 	autoApprove bool
+	cwd         string
+	templates   map[string]string
+	quota       writeQuota
+
+	contextLimits ContextLimits
+	agentInfo     acp.InitializeResponse
+	// disabled are the features of the client missing from the version of
+	// ACP the agent speaks
+	disabled []string
+	// caps are the capabilities the session offers the agent
+	caps clientCaps
+	// readOnly sessions can't change files or run commands
+	readOnly bool
+	// retryPolicy retries the requests that fail for a transient reason,
+	// guarded by mu
+	retryPolicy RetryPolicy
+	// rate throttles the turns
+	rate rateLimiter
+	// autoContinue is how many turns cut short in a row are continued
+	// without asking, guarded by mu
+	autoContinue int
+	// continued counts the turns continued in a row, in the update queue
+	continued int
+
+	mu          sync.Mutex
+	attachments []acp.ContentBlock
+	commands    []acp.AvailableCommand
+	// modes are the modes the agent advertised, and the current one
+	modes acp.SessionModeState
+	// models are the models the agent can use, and the current one
+	models acp.SessionModelState
+	// instructions are sent with the first prompt, then cleared
+	instructions string
+	// seed is an imported conversation sent with the next prompt
+	seed    string
+	history promptHistory
+	// reply collects the agent's messages of sessions without a chat buffer
+	reply *strings.Builder
+	// opts and agentCmd are the config the session runs with, see
+	// AcpReloadConfig. opts is guarded by mu
+	opts     AcpNewSessionOpts
+	agentCmd []string
+	// print gets the text of the chat of sessions run from the command
+	// line
+	print io.Writer
+	// events gets the events of sessions run from the command line with
+	// JSON output
+	events *eventWriter
+
+	// agentName and secrets are used to remember API keys entered by the user
+	agentName string
+	secrets   *SecretStore
+	// profile is the credential profile of the session, and authMethod the
+	// auth method it uses without asking
+	profile    string
+	authMethod acp.AuthMethodId
+	// paths translates the paths of agents running through a launcher
+	paths pathMap
+	// env expands references to the environment in MCP configs added later
+	env expander
+	// mcp is the config of the MCP servers of the session by name, guarded
+	// by mu
+	mcp       map[string]map[string]any
+	mcpReport McpReport
+	// preflight is set when the MCP servers can be checked before passing
+	// them, that is when the agent runs on this machine
+	preflight bool
+	// trace logs the messages exchanged with the agent, if enabled
+	trace *tracer
+	// capture records the messages exchanged with the agent, if enabled
+	capture *recorder
+	// stderr keeps what the agent process writes to stderr
+	stderr  agentLog
+	metrics sessionMetrics
+	// failure describes the internal error the session ran into, if any.
+	// It isn't guarded by mu, which the panicking code may hold.
+	failure atomic.Value
+	// lastError is the last failed request to the agent, guarded by mu
+	lastError *ErrorEvent
+	// cancel follows the cancellation of the turn in progress
+	cancelling cancellation
+	// promptCall watches the prompt in progress until the first update
+	promptCall atomic.Pointer[slowCall]
+	// out holds back text appended to the chat buffer to send it in batches
+	out chatWriter
+	// sanitizer cleans the text appended to the chat buffer of control
+	// characters, and replySanitizer the chunks of the replies, which
+	// other text may come between
+	sanitizer      sanitizer
+	replySanitizer sanitizer
+	// reflow breaks the lines of the replies at the text width
+	reflow reflower
+	// toolHints tell the languages of the outputs of the tool calls of the
+	// turn, used from the update queue
+	toolHints map[acp.ToolCallId]outputHint
+	// loading is set while the agent replays the session, whose updates
+	// are already in the chat buffer
+	loading atomic.Bool
+	// scrollback keeps the lines trimmed from the chat buffer
+	scrollback scrollback
+	// chunks joins the characters split between chunks, as they are read
+	chunks chunkJoiner
+	// updates runs the session updates in order, away from the connection
+	updates updateQueue
+	// turns runs the prompts sent from Neovim in order
+	turns turnQueue
+	// outputs are the files of large tool call outputs, guarded by mu
+	outputs []string
+	// tools, terminals and fsSlots bound the work of the agent, see
+	// ActivityLimits
+	tools     toolLimiter
+	terminals terminals
+	fsSlots   semaphore
+	// files reads and writes the files of the agent
+	files *acpfs.FS
+	// toolUpdates are the updates of running tool calls not rendered yet
+	toolUpdates toolUpdates
+	// transcript records the turns for AcpExportSession
+	transcript transcript
+	// archiver keeps the transcript in the archive, if enabled
+	archiver archiver
+	// checkpoints save the transcript for recovery after a crash
+	checkpoints checkpointer
+	// codeBlocks are the code blocks of the replies
+	codeBlocks codeBlocks
 }
 
-// SessionManager manages multiple ACP sessions
+// SessionManager manages multiple ACP sessions. mu only guards the map:
+// the state of each session has locks of its own, so that a slow call in one
+// session doesn't hold up the others.
 type SessionManager struct {
-	mu       sync.Mutex
+	mu       sync.RWMutex
 	sessions map[int]*AcpSession
+	// starting holds the buffers whose session is being started
+	starting map[int]*pendingStart
+	// declared holds the sessions declared with AcpDeclareSession, which
+	// start on their first prompt
+	declared map[int]declaredSession
+	// files is shared by the sessions so that writes to the same path from
+	// different sessions are serialized too
+	files *acpfs.FS
+}
+
+type declaredSession struct {
+	cmd  []string
+	opts AcpNewSessionOpts
 }
 
 type acpClientImpl struct {
@@ -40,7 +184,26 @@ type acpClientImpl struct {
 var vim Vim
 
 // RequestPermission handles permission requests from ACP
-func (c *acpClientImpl) RequestPermission(ctx context.Context, params acp.RequestPermissionRequest) (acp.RequestPermissionResponse, error) {
+func (c *acpClientImpl) RequestPermission(ctx context.Context, params acp.RequestPermissionRequest) (resp acp.RequestPermissionResponse, err error) {
+	defer c.session.recoverPanic("session/request_permission", &err)
+	defer c.session.watch("session/request_permission").done()
+	defer func() {
+		c.session.transcript.permission(params, resp, c.session.autoApprove)
+		ev := permissionEvent{Request: params}
+		if resp.Outcome.Selected != nil {
+			ev.OptionId = resp.Outcome.Selected.OptionId
+		}
+		c.session.emit("permission", ev)
+	}()
+	c.session.paths.localizeToolCall(params.ToolCall.Content, params.ToolCall.Locations)
+	if c.session.readOnlyDenies(params.ToolCall) {
+		return c.session.denyReadOnly(params), nil
+	}
+	// The turn is over for the user once cancelled, what is still pending
+	// is cancelled too
+	if c.session.cancelling.requested.Load() {
+		return acp.RequestPermissionResponse{Outcome: acp.RequestPermissionOutcome{Cancelled: &acp.RequestPermissionOutcomeCancelled{}}}, nil
+	}
 	// If auto-approve is enabled, automatically select first allow option
 	if c.session.autoApprove {
 		for _, o := range params.Options {
@@ -65,10 +228,15 @@ func (c *acpClientImpl) RequestPermission(ctx context.Context, params acp.Reques
 		opts = append(opts, o.Name)
 	}
 
+	c.session.flushBuffer()
 	choice, err := vim.uiSelect(opts, selectOpts{Title: fmt.Sprintf("Permission request: %s", title)})
 
 	if err != nil {
-		fmt.Printf("Error displaying permission prompt: %v\n", err)
+		logError("Error displaying permission prompt: %v", err)
+		return acp.RequestPermissionResponse{Outcome: acp.RequestPermissionOutcome{Cancelled: &acp.RequestPermissionOutcomeCancelled{}}}, nil
+	}
+
+	if c.session.cancelling.requested.Load() {
 		return acp.RequestPermissionResponse{Outcome: acp.RequestPermissionOutcome{Cancelled: &acp.RequestPermissionOutcomeCancelled{}}}, nil
 	}
 
@@ -86,148 +254,196 @@ func (c *acpClientImpl) RequestPermission(ctx context.Context, params acp.Reques
 }
 
 // SessionUpdate handles streaming updates from ACP
-func (c *acpClientImpl) SessionUpdate(ctx context.Context, params acp.SessionNotification) error {
+func (c *acpClientImpl) SessionUpdate(ctx context.Context, params acp.SessionNotification) (err error) {
+	defer c.session.recoverPanic("session/update", &err)
+	defer c.session.watch("session/update").done()
+	// The agent is responsive
+	c.session.promptCall.Swap(nil).done()
+	if c.session.loading.Load() {
+		return nil
+	}
 	u := params.Update
+	if tc := u.ToolCall; tc != nil {
+		c.session.paths.localizeToolCall(tc.Content, tc.Locations)
+	}
+	if tu := u.ToolCallUpdate; tu != nil {
+		c.session.paths.localizeToolCall(tu.Content, tu.Locations)
+	}
+	c.session.transcript.update(u)
+	c.session.emit("update", u)
+	// Updates of running tool calls come in bursts, render them once the
+	// burst is over
+	if tu := u.ToolCallUpdate; tu != nil && c.session.updates.running() && (tu.Status == nil || !toolCallDone(*tu.Status)) {
+		c.session.holdToolUpdate(tu)
+		return nil
+	}
+	c.session.flushToolUpdates()
 	switch {
 	case u.AgentMessageChunk != nil:
 		content := u.AgentMessageChunk.Content
 		if content.Text != nil {
-			c.session.appendToBuffer(content.Text.Text)
-		}
-	case u.ToolCall != nil:
-		c.session.appendToBuffer(fmt.Sprintf("\n🔧 %s (%s)\n", u.ToolCall.Title, u.ToolCall.Status))
-
-		// Display tool call content if available
-		for _, tc := range u.ToolCall.Content {
-			if tc.Content != nil && tc.Content.Content.Text != nil {
-				c.session.appendToBuffer(tc.Content.Content.Text.Text)
+			c.session.metrics.chunk(len(content.Text.Text))
+			if c.session.dropAfterCancel() {
+				return nil
 			}
-			if tc.Diff != nil {
-				// Use vim.diff to generate a proper unified diff
-				c.session.showDiff(tc.Diff.Path, tc.Diff.OldText, tc.Diff.NewText)
+			text, ok := c.session.responseMiddleware(content.Text.Text)
+			if ok {
+				c.session.collectReply(text)
+				c.session.appendReply(text)
 			}
 		}
-	case u.ToolCallUpdate != nil:
-		// Only show status updates if there's meaningful content or a title change
-		hasContent := len(u.ToolCallUpdate.Content) > 0
-		hasTitle := u.ToolCallUpdate.Title != nil
-
-		if hasTitle && u.ToolCallUpdate.Status != nil {
-			c.session.appendToBuffer(fmt.Sprintf("\n🔧 %s (%s)\n", *u.ToolCallUpdate.Title, *u.ToolCallUpdate.Status))
-		} else if hasTitle {
-			c.session.appendToBuffer(fmt.Sprintf("\n🔧 %s\n", *u.ToolCallUpdate.Title))
-		} else if u.ToolCallUpdate.Status != nil && hasContent {
-			// Only show status if there's content to display
-			c.session.appendToBuffer(fmt.Sprintf("\n🔧 %s\n", *u.ToolCallUpdate.Status))
+	case u.ToolCall != nil:
+		c.session.metrics.toolCall(string(u.ToolCall.Kind))
+		tc := u.ToolCall
+		hint := outputHint{kind: tc.Kind}
+		if len(tc.Locations) > 0 {
+			hint.path = tc.Locations[0].Path
 		}
-
-		// Display content updates if available
-		for _, tc := range u.ToolCallUpdate.Content {
-			if tc.Content != nil && tc.Content.Content.Text != nil {
-				c.session.appendToBuffer(tc.Content.Content.Text.Text)
-			}
-			if tc.Diff != nil {
-				// Use vim.diff to generate a proper unified diff
-				c.session.showDiff(tc.Diff.Path, tc.Diff.OldText, tc.Diff.NewText)
+		c.session.setToolHint(tc.ToolCallId, hint)
+		c.session.tools.render(tc.ToolCallId, toolCallDone(tc.Status), func() {
+			c.session.appendToBuffer(fmt.Sprintf("\n🔧 %s (%s)\n", tc.Title, tc.Status))
+
+			// Display tool call content if available
+			for _, tc := range tc.Content {
+				if tc.Content != nil && tc.Content.Content.Text != nil {
+					c.session.showToolOutput(tc.Content.Content.Text.Text, hint)
+				}
+				if tc.Diff != nil {
+					// Show the change as a unified diff
+					c.session.showDiff(tc.Diff.Path, tc.Diff.OldText, tc.Diff.NewText)
+				}
 			}
-		}
+		})
+	case u.ToolCallUpdate != nil:
+		c.session.showToolCallUpdate(u.ToolCallUpdate)
 	case u.Plan != nil:
 		c.session.appendToBuffer("[Plan update]\n")
 	case u.AgentThoughtChunk != nil:
 		thought := u.AgentThoughtChunk.Content
 		if thought.Text != nil {
+			c.session.metrics.chunk(len(thought.Text.Text))
+			if c.session.dropAfterCancel() {
+				return nil
+			}
 			c.session.appendToBuffer(fmt.Sprintf("[Thought] %s\n", thought.Text.Text))
 		}
 	case u.AvailableCommandsUpdate != nil:
-		// TODO
+		c.session.setCommands(u.AvailableCommandsUpdate.AvailableCommands)
 	case u.UserMessageChunk != nil:
 		// Silent for user messages
 	case u.CurrentModeUpdate != nil:
+		c.session.setCurrentMode(u.CurrentModeUpdate.CurrentModeId)
 	}
 	return nil
 }
 
-// WriteTextFile implements file writing capability
-func (c *acpClientImpl) WriteTextFile(ctx context.Context, params acp.WriteTextFileRequest) (acp.WriteTextFileResponse, error) {
-	if !filepath.IsAbs(params.Path) {
-		return acp.WriteTextFileResponse{}, fmt.Errorf("path must be absolute: %s", params.Path)
-	}
-	buf, err := vim.bufnr(params.Path, false)
-	if err == nil && buf != -1 {
-		content := []byte(params.Content)
-		lines := bytes.Split(content, []byte("\n"))
-		if err := vim.api.SetBufferLines(buf, 0, -1, false, lines); err != nil {
-			return acp.WriteTextFileResponse{}, fmt.Errorf("set buffer lines for %s: %w", params.Path, err)
-		}
-		c.session.appendToBuffer(fmt.Sprintf("[Wrote %d bytes to buffer %s]\n", len(params.Content), params.Path))
-		return acp.WriteTextFileResponse{}, nil
-	} else {
-		dir := filepath.Dir(params.Path)
-		if dir != "" {
-			if err := os.MkdirAll(dir, 0o755); err != nil {
-				return acp.WriteTextFileResponse{}, fmt.Errorf("mkdir %s: %w", dir, err)
-			}
+// showToolCallUpdate renders an update of a tool call.
+func (s *AcpSession) showToolCallUpdate(tu *acp.SessionToolCallUpdate) {
+	hint := s.toolHints[tu.ToolCallId].withUpdate(tu)
+	s.setToolHint(tu.ToolCallId, hint)
+	done := tu.Status != nil && toolCallDone(*tu.Status)
+	s.tools.render(tu.ToolCallId, done, func() {
+		// Only show status updates if there's meaningful content or a title change
+		hasContent := len(tu.Content) > 0
+		hasTitle := tu.Title != nil
+
+		if hasTitle && tu.Status != nil {
+			s.appendToBuffer(fmt.Sprintf("\n🔧 %s (%s)\n", *tu.Title, *tu.Status))
+		} else if hasTitle {
+			s.appendToBuffer(fmt.Sprintf("\n🔧 %s\n", *tu.Title))
+		} else if tu.Status != nil && hasContent {
+			// Only show status if there's content to display
+			s.appendToBuffer(fmt.Sprintf("\n🔧 %s\n", *tu.Status))
 		}
-		if err := os.WriteFile(params.Path, []byte(params.Content), 0o644); err != nil {
-			return acp.WriteTextFileResponse{}, fmt.Errorf("write %s: %w", params.Path, err)
+
+		// Display content updates if available
+		for _, tc := range tu.Content {
+			if tc.Content != nil && tc.Content.Content.Text != nil {
+				s.showToolOutput(tc.Content.Content.Text.Text, hint)
+			}
+			if tc.Diff != nil {
+				// Show the change as a unified diff
+				s.showDiff(tc.Diff.Path, tc.Diff.OldText, tc.Diff.NewText)
+			}
 		}
-		c.session.appendToBuffer(fmt.Sprintf("[Wrote %d bytes to %s]\n", len(params.Content), params.Path))
-		return acp.WriteTextFileResponse{}, nil
+	})
+}
+
+// WriteTextFile implements file writing capability
+func (c *acpClientImpl) WriteTextFile(ctx context.Context, params acp.WriteTextFileRequest) (_ acp.WriteTextFileResponse, err error) {
+	defer c.session.recoverPanic("fs/write_text_file", &err)
+	defer c.session.watch("fs/write_text_file").done()
+	if err := c.session.fsSlots.acquire(ctx); err != nil {
+		return acp.WriteTextFileResponse{}, err
+	}
+	defer c.session.fsSlots.release()
+	if !c.session.caps.write {
+		return acp.WriteTextFileResponse{}, acp.NewMethodNotFound(acp.ClientMethodFsWriteTextFile)
+	}
+	if params.Path, err = c.session.paths.localFile(params.Path); err != nil {
+		return acp.WriteTextFileResponse{}, err
+	}
+	if err := c.session.checkWrite(params.Path, len(params.Content)); err != nil {
+		return acp.WriteTextFileResponse{}, err
+	}
+	res, err := withTimeout(c.session, ctx, acp.ClientMethodFsWriteTextFile, func() (acpfs.Result, error) {
+		return c.fs().WriteTextFile(ctx, params.Path, params.Content)
+	})
+	if err != nil {
+		return acp.WriteTextFileResponse{}, err
 	}
+	c.session.quota.record(params.Path, res.Bytes)
+	if res.InBuffer {
+		c.session.appendToBuffer(fmt.Sprintf("[Wrote %d bytes to buffer %s]\n", res.Bytes, params.Path))
+	} else {
+		c.session.appendToBuffer(fmt.Sprintf("[Wrote %d bytes to %s]\n", res.Bytes, params.Path))
+	}
+	return acp.WriteTextFileResponse{}, nil
 }
 
 // ReadTextFile implements file reading capability
-func (c *acpClientImpl) ReadTextFile(ctx context.Context, params acp.ReadTextFileRequest) (acp.ReadTextFileResponse, error) {
-	if !filepath.IsAbs(params.Path) {
-		return acp.ReadTextFileResponse{}, fmt.Errorf("path must be absolute: %s", params.Path)
-	}
-	if buf, err := vim.bufnr(params.Path, false); err == nil && buf != -1 {
-		var start, end int
-		if params.Line != nil && *params.Line > 0 {
-			start = *params.Line - 1
-		} else {
-			start = 0
-		}
-		if params.Limit != nil && *params.Limit > 0 {
-			end = start + *params.Limit
-		} else {
-			end = -1
-		}
-		lines, err := vim.api.BufferLines(buf, start, end, false)
-		if err != nil {
-			return acp.ReadTextFileResponse{}, fmt.Errorf("get buffer lines for %s: %w", params.Path, err)
-		}
-		content := string(bytes.Join(lines, []byte("\n")))
-		c.session.appendToBuffer(fmt.Sprintf("[Read %s (%d bytes) from buffer]\n", params.Path, len(content)))
-		return acp.ReadTextFileResponse{Content: content}, nil
+func (c *acpClientImpl) ReadTextFile(ctx context.Context, params acp.ReadTextFileRequest) (_ acp.ReadTextFileResponse, err error) {
+	defer c.session.recoverPanic("fs/read_text_file", &err)
+	defer c.session.watch("fs/read_text_file").done()
+	if err := c.session.fsSlots.acquire(ctx); err != nil {
+		return acp.ReadTextFileResponse{}, err
+	}
+	defer c.session.fsSlots.release()
+	if !c.session.caps.read {
+		return acp.ReadTextFileResponse{}, acp.NewMethodNotFound(acp.ClientMethodFsReadTextFile)
+	}
+	if params.Path, err = c.session.paths.localFile(params.Path); err != nil {
+		return acp.ReadTextFileResponse{}, err
+	}
+	res, err := withTimeout(c.session, ctx, acp.ClientMethodFsReadTextFile, func() (acpfs.Result, error) {
+		return c.fs().ReadTextFile(params.Path, params.Line, params.Limit)
+	})
+	if err != nil {
+		return acp.ReadTextFileResponse{}, err
+	}
+	if res.InBuffer {
+		c.session.appendToBuffer(fmt.Sprintf("[Read %s (%d bytes) from buffer]\n", params.Path, res.Bytes))
 	} else {
-		b, err := os.ReadFile(params.Path)
-		if err != nil {
-			return acp.ReadTextFileResponse{}, fmt.Errorf("read %s: %w", params.Path, err)
-		}
-		content := string(b)
-		if params.Line != nil || params.Limit != nil {
-			lines := strings.Split(content, "\n")
-			start := 0
-			if params.Line != nil && *params.Line > 0 {
-				start = min(max(*params.Line-1, 0), len(lines))
-			}
-			end := len(lines)
-			if params.Limit != nil && *params.Limit > 0 {
-				if start+*params.Limit < end {
-					end = start + *params.Limit
-				}
-			}
-			content = strings.Join(lines[start:end], "\n")
-		}
-		c.session.appendToBuffer(fmt.Sprintf("[Read %s (%d bytes)]\n", params.Path, len(content)))
-		return acp.ReadTextFileResponse{Content: content}, nil
+		c.session.appendToBuffer(fmt.Sprintf("[Read %s (%d bytes)]\n", params.Path, res.Bytes))
 	}
+	return acp.ReadTextFileResponse{Content: res.Content}, nil
+}
+
+func (c *acpClientImpl) fs() *acpfs.FS {
+	return c.session.files
 }
 
-// Terminal methods (no-op implementations)
+// Terminal methods (no-op implementations, apart from the limit on open
+// terminals)
 func (c *acpClientImpl) CreateTerminal(ctx context.Context, params acp.CreateTerminalRequest) (acp.CreateTerminalResponse, error) {
-	return acp.CreateTerminalResponse{TerminalId: "term-1"}, nil
+	if !c.session.caps.terminal {
+		return acp.CreateTerminalResponse{}, acp.NewMethodNotFound(acp.ClientMethodTerminalCreate)
+	}
+	id, err := c.session.terminals.create(ctx)
+	if err != nil {
+		return acp.CreateTerminalResponse{}, err
+	}
+	return acp.CreateTerminalResponse{TerminalId: id}, nil
 }
 
 func (c *acpClientImpl) TerminalOutput(ctx context.Context, params acp.TerminalOutputRequest) (acp.TerminalOutputResponse, error) {
@@ -235,6 +451,7 @@ func (c *acpClientImpl) TerminalOutput(ctx context.Context, params acp.TerminalO
 }
 
 func (c *acpClientImpl) ReleaseTerminal(ctx context.Context, params acp.ReleaseTerminalRequest) (acp.ReleaseTerminalResponse, error) {
+	c.session.terminals.release(params.TerminalId)
 	return acp.ReleaseTerminalResponse{}, nil
 }
 
@@ -249,8 +466,72 @@ func (c *acpClientImpl) KillTerminalCommand(ctx context.Context, params acp.Kill
 // SessionManager methods exposed to Lua
 
 type AcpNewSessionOpts struct {
-	Env map[string]string         `json:"env" msgpack:"env"`
-	Mcp map[string]map[string]any `json:"mcp" msgpack:"mcp"`
+	Env        map[string]string         `json:"env" msgpack:"env"`
+	Mcp        map[string]map[string]any `json:"mcp" msgpack:"mcp"`
+	WriteLimit WriteLimits               `json:"write_limit" msgpack:"write_limit"`
+	Templates  map[string]string         `json:"templates" msgpack:"templates"`
+	// Instructions are sent to the agent before the first prompt, followed by
+	// the content of InstructionFiles (relative to the session directory)
+	Instructions     string        `json:"instructions" msgpack:"instructions"`
+	InstructionFiles []string      `json:"instruction_files" msgpack:"instruction_files"`
+	ContextLimit     ContextLimits `json:"context_limit" msgpack:"context_limit"`
+	// HistoryDir is where prompt history files are kept, one per project
+	HistoryDir string `json:"history_dir" msgpack:"history_dir"`
+	// ArchiveDir is where the transcripts of sessions are archived, see
+	// AcpSearchArchive
+	ArchiveDir string `json:"archive_dir" msgpack:"archive_dir"`
+	// RecoveryDir is where sessions are checkpointed, see AcpRecover
+	RecoveryDir string `json:"recovery_dir" msgpack:"recovery_dir"`
+	// Agent is the name of the agent in the config, to start it again when
+	// recovering the session
+	Agent string `json:"agent" msgpack:"agent"`
+	// Secrets is where API keys entered by the user are stored, if anywhere
+	Secrets *SecretStore `json:"secrets" msgpack:"secrets"`
+	// Dotenv is a file, relative to the working directory, whose variables
+	// are added to the agent environment and used to expand ${VAR} in the
+	// config
+	Dotenv string `json:"dotenv" msgpack:"dotenv"`
+	// Launcher runs the agent command in a container, over SSH or in WSL
+	Launcher *Launcher `json:"launcher" msgpack:"launcher"`
+	// PathStyle is "wsl" when the agent runs in WSL and Neovim on Windows,
+	// or "windows" for the reverse, for the paths to be translated between
+	// the two. The "wsl" launcher sets "wsl"
+	PathStyle string `json:"path_style" msgpack:"path_style"`
+	// Address of an already running agent to connect to instead of starting
+	// the agent command, see dialAgent
+	Address string `json:"address" msgpack:"address"`
+	// Profile is the name of the credential profile the session uses, and
+	// AuthMethod the auth method it prefers
+	Profile    string `json:"profile" msgpack:"profile"`
+	AuthMethod string `json:"auth_method" msgpack:"auth_method"`
+	// Trace logs the messages exchanged with the agent when set
+	Trace *TraceConfig `json:"trace" msgpack:"trace"`
+	// CaptureDir is where the messages exchanged with the agent are
+	// recorded for AcpReplay, if anywhere
+	CaptureDir string `json:"capture_dir" msgpack:"capture_dir"`
+	// ActivityLimit caps the work the agent may have going on at once
+	ActivityLimit ActivityLimits `json:"activity_limit" msgpack:"activity_limit"`
+	// Capabilities are the capabilities advertised to the agent, which
+	// can't use the others
+	Capabilities Capabilities `json:"capabilities" msgpack:"capabilities"`
+	// ReadOnly sessions are for explaining and reviewing code: files can't
+	// be written, terminals aren't offered and the edits and commands of the
+	// agent are denied without asking
+	ReadOnly bool `json:"read_only" msgpack:"read_only"`
+	// Retry retries the prompts, mode changes and cancellations that fail
+	// for a transient reason
+	Retry RetryPolicy `json:"retry" msgpack:"retry"`
+	// RateLimit throttles the turns, for providers with strict rate limits
+	RateLimit RateLimit `json:"rate_limit" msgpack:"rate_limit"`
+	// AutoContinue is how many turns cut short by a limit of the agent are
+	// continued in a row without asking, 0 only offers to continue them
+	AutoContinue int `json:"auto_continue" msgpack:"auto_continue"`
+	// RequestTimeouts bounds the time taken to answer the requests of the
+	// agent handled through Neovim, so that a stuck call can't hang it
+	RequestTimeouts RequestTimeouts `json:"request_timeouts" msgpack:"request_timeouts"`
+	// TextWidth is the width the prose of the replies is reflowed to, 0 to
+	// leave it as the agent wrote it
+	TextWidth int `json:"text_width" msgpack:"text_width"`
 }
 
 func ConvertMcpConfigToMcpServer(name string, config map[string]any) (*acp.McpServer, error) {
@@ -273,12 +554,16 @@ func ConvertMcpConfigToMcpServer(name string, config map[string]any) (*acp.McpSe
 			serverName = n
 		}
 
+		url, ok := config["url"].(string)
+		if !ok || url == "" {
+			return nil, fmt.Errorf("%s server %s needs a url", t, name)
+		}
 		if t == "http" {
 			return &acp.McpServer{
 				Http: &acp.McpServerHttp{
 					Name:    serverName,
 					Type:    "http",
-					Url:     config["url"].(string),
+					Url:     url,
 					Headers: headers,
 				},
 			}, nil
@@ -287,7 +572,7 @@ func ConvertMcpConfigToMcpServer(name string, config map[string]any) (*acp.McpSe
 				Sse: &acp.McpServerSse{
 					Name:    serverName,
 					Type:    "sse",
-					Url:     config["url"].(string),
+					Url:     url,
 					Headers: headers,
 				},
 			}, nil
@@ -338,227 +623,610 @@ func ConvertMcpConfigToMcpServer(name string, config map[string]any) (*acp.McpSe
 	}
 }
 
-// AcpNewSession initializes an ACP connection for a buffer
+// AcpNewSession starts an ACP session for a buffer. It returns right away:
+// Lua is told how the start goes with on_session_status, and prompts sent
+// meanwhile are sent once the session is ready
 func (m *SessionManager) AcpNewSession(bufnr int, agent_cmd []string, opts AcpNewSessionOpts) (any, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if _, exists := m.sessions[bufnr]; exists || m.starting[bufnr] != nil {
+		return nil, fmt.Errorf("ACP session already exists for buffer %d", bufnr)
+	}
+	delete(m.declared, bufnr)
+	p := &pendingStart{}
+	m.starting[bufnr] = p
+	go m.start(bufnr, declaredSession{cmd: agent_cmd, opts: opts}, p, false)
+	return nil, nil
+}
+
+// pendingStart is a session being started.
+type pendingStart struct {
+	// queued are run with the session once it is ready, guarded by the
+	// manager's mu
+	queued []func(*AcpSession)
+	// stopped is set when the chat is closed before the session is ready,
+	// guarded by the manager's mu
+	stopped bool
+}
+
+// start starts the session of bufnr and runs the calls queued meanwhile. A
+// lazy session that fails to start is declared again, to try again on the
+// next prompt.
+func (m *SessionManager) start(bufnr int, d declaredSession, p *pendingStart, lazy bool) {
+	session, newSess, err := startSession(bufnr, d.cmd, d.opts, m.files)
+	if err != nil {
+		logError("Failed to start session for buffer %d: %v", bufnr, err)
+		m.mu.Lock()
+		delete(m.starting, bufnr)
+		stopped := p.stopped
+		if lazy && !stopped {
+			m.declared[bufnr] = d
+		}
+		m.mu.Unlock()
+		if !stopped {
+			sessionStatus(bufnr, "failed", err.Error())
+		}
+		return
+	}
+	m.mu.RLock()
+	stopped := p.stopped
+	m.mu.RUnlock()
+	if stopped {
+		logInfo("Stopped session %s of closed buffer %d", session.sessionID, bufnr)
+		session.cleanup()
+		return
+	}
+	logInfo("Started session %s with %s for buffer %d", session.sessionID, session.agentName, bufnr)
+
+	modes := acp.SessionModeState{}
+	if newSess.Modes != nil {
+		modes = *newSess.Modes
+	}
+	vim.api.ExecLua(`require('acp').set_and_show_prompt_buf(...)`, nil, bufnr, map[string]any{"modes": modes, "session_id": session.sessionID, "agent_info": agentInfo(session.agentInfo)})
+	for _, w := range compatWarnings(session.agentInfo) {
+		session.appendToBuffer(fmt.Sprintf("[Warning: %s]\n", w))
+	}
+	if len(session.mcp) > 0 {
+		session.appendToBuffer(fmt.Sprintf("[MCP: %s]\n", session.mcpReport))
+	}
+	if session.capture != nil {
+		session.appendToBuffer(fmt.Sprintf("[Recording to %s]\n", session.capture.f.Name()))
+	}
+
+	m.mu.Lock()
+	delete(m.starting, bufnr)
+	if p.stopped {
+		// The chat was closed meanwhile
+		m.mu.Unlock()
+		session.cleanup()
+		return
+	}
+	m.sessions[bufnr] = session
+	queued := p.queued
+	m.mu.Unlock()
+	sessionStatus(bufnr, "ready", "")
+	for _, fn := range queued {
+		fn(session)
+	}
+}
 
-	if _, exists := m.sessions[bufnr]; exists {
+// sessionStatus tells Lua how the start of the session of bufnr goes.
+func sessionStatus(bufnr int, status string, message string) {
+	if bufnr == 0 {
+		return
+	}
+	if err := vim.api.ExecLua(`require('acp').on_session_status(...)`, nil, bufnr, status, message); err != nil {
+		logError("Error reporting session status: %v", err)
+	}
+}
+
+// AcpDeclareSession records the agent of a chat buffer without starting it,
+// which only happens on the first prompt
+func (m *SessionManager) AcpDeclareSession(bufnr int, agent_cmd []string, opts AcpNewSessionOpts) (any, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.sessions[bufnr]; exists || m.starting[bufnr] != nil {
 		return nil, fmt.Errorf("ACP session already exists for buffer %d", bufnr)
 	}
+	m.declared[bufnr] = declaredSession{cmd: agent_cmd, opts: opts}
+	return nil, nil
+}
+
+// whenReady runs fn with the session of bufnr: now if it is running, once
+// started if it is starting, and after starting it if it was only declared.
+func (m *SessionManager) whenReady(bufnr int, fn func(*AcpSession)) error {
+	m.mu.Lock()
+	if session, ok := m.sessions[bufnr]; ok {
+		m.mu.Unlock()
+		fn(session)
+		return nil
+	}
+	if p, ok := m.starting[bufnr]; ok {
+		p.queued = append(p.queued, fn)
+		m.mu.Unlock()
+		return nil
+	}
+	d, ok := m.declared[bufnr]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("no ACP session for buffer %d", bufnr)
+	}
+	delete(m.declared, bufnr)
+	p := &pendingStart{queued: []func(*AcpSession){fn}}
+	m.starting[bufnr] = p
+	m.mu.Unlock()
+	go m.start(bufnr, d, p, true)
+	return nil
+}
 
+// startSession launches the agent, initializes the connection and creates an
+// ACP session. bufnr is the chat buffer, or 0 for sessions without one, and
+// files reads and writes the files of the agent.
+func startSession(bufnr int, agent_cmd []string, opts AcpNewSessionOpts, files *acpfs.FS) (*AcpSession, acp.NewSessionResponse, error) {
 	session := &AcpSession{
 		bufnr:       bufnr,
 		autoApprove: false,
+		files:       files,
 	}
-
-	session.ctx, session.cancel = context.WithCancel(context.Background())
-
-	// Start the agent process
-	cmd := exec.CommandContext(session.ctx, agent_cmd[0], agent_cmd[1:]...)
-	cmd.Stderr = os.Stderr
-
-	// Set environment variables from opts.env if provided
-	if opts.Env != nil {
-		cmd.Env = os.Environ()
-		for key, value := range opts.Env {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
-		}
+	session.opts = opts
+	session.agentCmd = agent_cmd
+	session.caps = opts.Capabilities.resolve()
+	session.retryPolicy = opts.Retry
+	session.rate.limit = opts.RateLimit
+	session.autoContinue = opts.AutoContinue
+	session.reflow.width = opts.TextWidth
+	if opts.ReadOnly {
+		session.readOnly = true
+		session.caps.write, session.caps.terminal = false, false
 	}
-	stdin, err := cmd.StdinPipe()
+	session.quota.limits = opts.WriteLimit
+	session.templates = opts.Templates
+	session.contextLimits = opts.ContextLimit
+	session.tools.max = limitOrDefault(opts.ActivityLimit.MaxToolCalls, defaultMaxToolCalls)
+	session.terminals.slots = newSemaphore(limitOrDefault(opts.ActivityLimit.MaxTerminals, defaultMaxTerminals))
+	session.fsSlots = newSemaphore(limitOrDefault(opts.ActivityLimit.MaxFsRequests, defaultMaxFsRequests))
+
+	cwd, err := os.Getwd()
 	if err != nil {
-		return nil, fmt.Errorf("stdin pipe error: %w", err)
+		return nil, acp.NewSessionResponse{}, fmt.Errorf("getwd error: %w", err)
 	}
-	stdout, err := cmd.StdoutPipe()
+	session.paths, err = newPathMap(cwd, opts)
 	if err != nil {
-		return nil, fmt.Errorf("stdout pipe error: %w", err)
+		return nil, acp.NewSessionResponse{}, err
 	}
 
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start %s: %w", agent_cmd[0], err)
+	// Expand references to the environment in the config, loading the
+	// project .env file first if asked to
+	var exp expander
+	if opts.Dotenv != "" {
+		exp.dotenv, err = readEnvFile(filepath.Join(cwd, opts.Dotenv))
+		if err != nil {
+			return nil, acp.NewSessionResponse{}, fmt.Errorf("read %s: %w", opts.Dotenv, err)
+		}
+	}
+	agent_cmd = exp.expandStrings(agent_cmd)
+	opts.Env = exp.agentEnv(opts.Env)
+	for name, config := range opts.Mcp {
+		opts.Mcp[name], _ = exp.expandAll(config).(map[string]any)
 	}
-	session.cmd = cmd
+	session.env = exp
 
-	client := &acpClientImpl{session: session}
-	session.conn = acp.NewClientSideConnection(client, stdin, stdout)
+	session.ctx, session.cancel = context.WithCancel(context.Background())
 
-	// Initialize
-	initRes, err := session.conn.Initialize(session.ctx, acp.InitializeRequest{
-		ProtocolVersion: acp.ProtocolVersionNumber,
-		ClientCapabilities: acp.ClientCapabilities{
-			Fs:       acp.FileSystemCapability{ReadTextFile: true, WriteTextFile: true},
-			Terminal: true,
-		},
-		ClientInfo: &acp.Implementation{
-			Name:    "brianhuster/acp.nvim",
-			Title: starString("ACP client plugin for Neovim"),
-			Version: "0.1.0-alpha",
-		},
-	})
-	if err != nil {
-		session.cleanup()
-		if re, ok := err.(*acp.RequestError); ok {
-			if b, mErr := json.MarshalIndent(re, "", "  "); mErr == nil {
-				return nil, fmt.Errorf("initialize error: %s", string(b))
+	sessionStatus(bufnr, "launching", "")
+	var agentIn io.Writer
+	var agentOut io.Reader
+	if opts.Address != "" {
+		// Connect to an agent that is already running
+		conn, err := dialAgent(session.ctx, opts.Address)
+		if err != nil {
+			session.cancel()
+			return nil, acp.NewSessionResponse{}, fmt.Errorf("failed to connect to %s: %w", opts.Address, err)
+		}
+		session.remote = conn
+		agentIn, agentOut = conn, conn
+	} else {
+		if len(agent_cmd) == 0 {
+			session.cancel()
+			return nil, acp.NewSessionResponse{}, fmt.Errorf("agent has neither a command nor an address")
+		}
+
+		env := opts.Env
+		if opts.Launcher != nil {
+			// The environment is set on the other side of the launcher
+			wrapped, err := opts.Launcher.wrap(agent_cmd, env)
+			if err != nil {
+				session.cancel()
+				return nil, acp.NewSessionResponse{}, err
 			}
-			return nil, fmt.Errorf("initialize error (%d): %s", re.Code, re.Message)
+			agent_cmd, env = wrapped, nil
 		}
-		return nil, fmt.Errorf("initialize error: %w", err)
-	}
 
-	// Create new session
-	cwd, err := os.Getwd()
-	if err != nil {
-		session.cleanup()
-		return nil, fmt.Errorf("getwd error: %w", err)
+		// Start the agent process
+		args := commandArgs(agent_cmd)
+		cmd := exec.CommandContext(session.ctx, args[0], args[1:]...)
+		// The agent and the processes it starts are killed as a group when
+		// the session stops, by AcpStopSession or when Neovim is gone. Being
+		// a group of their own, they aren't killed with the group of Neovim.
+		setProcessGroup(cmd)
+		cmd.Cancel = func() error { return killProcess(cmd.Process) }
+		cmd.Stderr = &session.stderr
+
+		// Set environment variables from opts.env if provided
+		if env != nil {
+			cmd.Env = os.Environ()
+			for key, value := range env {
+				cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+			}
+		}
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			session.cancel()
+			return nil, acp.NewSessionResponse{}, fmt.Errorf("stdin pipe error: %w", err)
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			session.cancel()
+			return nil, acp.NewSessionResponse{}, fmt.Errorf("stdout pipe error: %w", err)
+		}
+
+		if err := cmd.Start(); err != nil {
+			session.cancel()
+			return nil, acp.NewSessionResponse{}, fmt.Errorf("failed to start %s: %w", agent_cmd[0], err)
+		}
+		session.cmd = cmd
+		agentIn, agentOut = stdin, stdout
 	}
 
-	var mcpServers []acp.McpServer
-	for name, config := range opts.Mcp {
-		srv, err := ConvertMcpConfigToMcpServer(name, config)
+	var taps []wireTap
+	if opts.Trace != nil {
+		session.trace, err = newTracer(*opts.Trace, bufnr)
 		if err != nil {
 			session.cleanup()
-			return nil, fmt.Errorf("invalid MCP server config for %s: %w", name, err)
+			return nil, acp.NewSessionResponse{}, fmt.Errorf("trace error: %w", err)
 		}
-		mcpServers = append(mcpServers, *srv)
+		taps = append(taps, session.trace)
 	}
-
-	supportHttpMcp := initRes.AgentCapabilities.McpCapabilities.Http
-	supportSseMcp := initRes.AgentCapabilities.McpCapabilities.Sse
-
-	// if not support http or sse, filter them out
-	filteredMcpServers := make([]acp.McpServer, 0)
-	for _, srv := range mcpServers {
-		if srv.Http != nil && !supportHttpMcp {
-			continue
-		}
-		if srv.Sse != nil && !supportSseMcp {
-			continue
+	if opts.CaptureDir != "" {
+		session.capture, err = newRecorder(opts.CaptureDir, bufnr)
+		if err != nil {
+			session.cleanup()
+			return nil, acp.NewSessionResponse{}, fmt.Errorf("capture error: %w", err)
 		}
-		filteredMcpServers = append(filteredMcpServers, srv)
+		taps = append(taps, session.capture)
 	}
-	mcpServers = filteredMcpServers
 
-	newSess, err := session.conn.NewSession(session.ctx, acp.NewSessionRequest{
-		Cwd:        cwd,
-		McpServers: mcpServers,
-	})
+	client := &acpClientImpl{session: session}
+	session.updates.start(session.ctx)
+	session.ext = newExtRouter(session.ctx, agentIn, agentOut, client.extHandlers(), client.inlineHandlers(), client.extFallback, client.extNotification, client.fsTicket, taps)
+	session.conn = acp.NewClientSideConnection(client, session.ext.writer(), session.ext.reader())
+
+	// Initialize
+	sessionStatus(bufnr, "initializing", "")
+	initRes, err := session.initialize()
 	if err != nil {
 		session.cleanup()
-		if re, ok := err.(*acp.RequestError); ok {
-			if b, mErr := json.MarshalIndent(re, "", "  "); mErr == nil {
-				return nil, fmt.Errorf("newSession error: %s", string(b))
-			}
-			return nil, fmt.Errorf("newSession error (%d): %s", re.Code, re.Message)
-		}
-		return nil, fmt.Errorf("newSession error: %w", err)
+		return nil, acp.NewSessionResponse{}, fmt.Errorf("initialize error: %s", errorEvent(acp.AgentMethodInitialize, err))
 	}
-	session.sessionID = newSess.SessionId
 
-	modes := acp.SessionModeState{}
-	if newSess.Modes != nil {
-		modes = *newSess.Modes
+	// Create new session
+	session.cwd = cwd
+	session.preflight = opts.Launcher == nil && opts.Address == ""
+	if opts.Address != "" {
+		session.agentName = opts.Address
+	} else {
+		session.agentName = filepath.Base(agent_cmd[0])
 	}
-	vim.api.ExecLua(`require('acp').set_and_show_prompt_buf(...)`, nil, bufnr, map[string]any{"modes": modes, "session_id": session.sessionID})
+	session.secrets = opts.Secrets
+	session.profile = opts.Profile
+	session.authMethod = acp.AuthMethodId(opts.AuthMethod)
+	if opts.HistoryDir != "" {
+		session.history.file = historyFile(opts.HistoryDir, cwd)
+	}
+	session.archiver.dir = opts.ArchiveDir
+	session.checkpoints.agent = opts.Agent
+	session.checkpoints.profile = opts.Profile
+	session.startCheckpoints(opts.RecoveryDir)
 
-	m.sessions[bufnr] = session
-	return nil, nil
-}
+	session.instructions, err = loadInstructions(cwd, opts.Instructions, opts.InstructionFiles)
+	if err != nil {
+		session.cleanup()
+		return nil, acp.NewSessionResponse{}, err
+	}
 
-func (m *SessionManager) AcpSendPrompt(bufnr int, prompt string) (any, error) {
-	if prompt == "" {
-		return nil, fmt.Errorf("no prompt provided")
+	session.agentInfo = initRes
+	session.mcp = opts.Mcp
+	mcpServers, _ := session.mcpServers()
+
+	sessionStatus(bufnr, "creating", "")
+	newSess, err := session.newSession(acp.NewSessionRequest{
+		Cwd:        session.paths.toRemote(cwd),
+		McpServers: mcpServers,
+	})
+	if err != nil {
+		session.cleanup()
+		return nil, acp.NewSessionResponse{}, fmt.Errorf("newSession error: %s", errorEvent(acp.AgentMethodSessionNew, err))
 	}
+	session.sessionID = newSess.SessionId
+	return session, newSess, nil
+}
 
-	m.mu.Lock()
+// get returns the session of a buffer
+func (m *SessionManager) get(bufnr int) (*AcpSession, error) {
+	m.mu.RLock()
 	session, exists := m.sessions[bufnr]
-	m.mu.Unlock()
+	m.mu.RUnlock()
 
 	if !exists {
 		return nil, fmt.Errorf("no ACP session for buffer %d", bufnr)
 	}
+	return session, nil
+}
 
-	_, err := session.conn.Prompt(session.ctx, acp.PromptRequest{
-		SessionId: session.sessionID,
-		Prompt:    []acp.ContentBlock{acp.TextBlock(prompt)},
+func (m *SessionManager) AcpSendPrompt(bufnr int, prompt string, opts AcpPromptOpts) (any, error) {
+	return nil, m.whenReady(bufnr, func(session *AcpSession) {
+		blocks, err := session.buildPrompt(prompt, opts)
+		if err != nil {
+			session.appendToBuffer(fmt.Sprintf("Error: %v\n", err))
+			return
+		}
+		session.history.add(prompt, blocks)
+		session.queuePrompt(blocks)
 	})
-	if err != nil {
-		if re, ok := err.(*acp.RequestError); ok {
-			if b, mErr := json.MarshalIndent(re, "", "  "); mErr == nil {
-				session.appendToBuffer(fmt.Sprintf("Error: %s\n", string(b)))
-			} else {
-				session.appendToBuffer(fmt.Sprintf("Error (%d): %s\n", re.Code, re.Message))
-			}
-			return nil, err
+}
+
+// prompt runs a turn with the given content and reports failures in the
+// chat buffer.
+func (s *AcpSession) prompt(blocks []acp.ContentBlock) error {
+	s.throttle()
+	s.startCancellable()
+	s.quota.reset()
+	req := acp.PromptRequest{
+		SessionId: s.sessionID,
+		Prompt:    blocks,
+	}
+	s.metrics.startTurn()
+	s.markTurn(s.transcript.startTurn(blocks))
+	s.emit("prompt", blocks)
+	var resp acp.PromptResponse
+	err := s.retry(acp.AgentMethodSessionPrompt, func() (err error) {
+		// Only the wait for the first update is watched, turns can be long
+		s.promptCall.Store(s.watch("session/prompt (no update yet)"))
+		resp, err = s.conn.Prompt(s.ctx, req)
+		w := s.promptCall.Swap(nil)
+		w.done()
+		if w == nil && err != nil {
+			// The agent started on the prompt, it must not get it twice
+			return noRetry{err}
 		}
-		session.appendToBuffer(fmt.Sprintf("Error: %v\n", err))
-		return nil, err
+		return err
+	})
+	defer func() { s.metrics.endTurn(err) }()
+	defer s.archive()
+	defer s.checkpoint()
+	// The user's next prompt goes after the reply
+	defer s.flushBuffer()
+	defer s.updates.push(func(context.Context) {
+		s.flushToolUpdates()
+		s.tools.endTurn()
+		clear(s.toolHints)
+		s.codeBlocks.endTurn()
+		if held := s.reflow.other(""); held != "" {
+			s.writeChat(held)
+		}
+		s.transcript.endTurn(resp.StopReason, err)
+		ev := turnEndEvent{StopReason: resp.StopReason}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		s.emit("turn_end", ev)
+		s.endCancellable(resp.StopReason, err)
+		if err == nil {
+			s.stopped(resp.StopReason)
+		}
+	})
+	if isAuthRequired(err) {
+		// Credentials may expire during a session, log in again and retry
+		// once rather than showing the error
+		s.appendToBuffer("[Authentication required]\n")
+		if authErr := s.authenticate(); authErr != nil {
+			s.appendToBuffer(fmt.Sprintf("Error: %v\n", authErr))
+			return authErr
+		}
+		s.quota.reset()
+		resp, err = s.conn.Prompt(s.ctx, req)
 	}
-
-	return nil, nil
+	if err != nil {
+		ev := s.reportError(acp.AgentMethodSessionPrompt, err)
+		s.appendToBuffer(fmt.Sprintf("[Error: %s]\n", ev))
+		return err
+	}
+	return nil
 }
 
 // AcpCancel cancels the current prompt for a buffer
 func (m *SessionManager) AcpCancel(bufnr int) (any, error) {
-	m.mu.Lock()
-	session, exists := m.sessions[bufnr]
-	m.mu.Unlock()
-
-	if !exists {
-		return nil, fmt.Errorf("no ACP session for buffer %d", bufnr)
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
 	}
 
-	err := session.conn.Cancel(session.ctx, acp.CancelNotification{SessionId: session.sessionID})
+	err = session.retry(acp.AgentMethodSessionCancel, func() error {
+		return session.conn.Cancel(session.ctx, acp.CancelNotification{SessionId: session.sessionID})
+	})
 	if err != nil {
-		fmt.Printf("Cancel error: %v", err)
+		session.metrics.failed()
+		session.reportError(acp.AgentMethodSessionCancel, err)
+		logError("Cancel error: %v", err)
 		return nil, err
 	}
-	session.appendToBuffer("Cancelled.\n")
+	session.requestCancel()
 	return nil, nil
 }
 
 // AcpSetMode sets the mode for an ACP session
 func (m *SessionManager) AcpSetMode(bufnr int, modeId string) (any, error) {
-	m.mu.Lock()
-	session, exists := m.sessions[bufnr]
-	m.mu.Unlock()
-
-	if !exists {
-		return nil, fmt.Errorf("no ACP session for buffer %d", bufnr)
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.checkMode(modeId); err != nil {
+		return nil, err
 	}
 
 	// Call setSessionMode on the agent
-	_, err := session.conn.SetSessionMode(session.ctx, acp.SetSessionModeRequest{
-		SessionId: session.sessionID,
-		ModeId:    acp.SessionModeId(modeId),
+	defer session.watch(acp.AgentMethodSessionSetMode).done()
+	err = session.retry(acp.AgentMethodSessionSetMode, func() error {
+		_, err := session.conn.SetSessionMode(session.ctx, acp.SetSessionModeRequest{
+			SessionId: session.sessionID,
+			ModeId:    acp.SessionModeId(modeId),
+		})
+		return err
 	})
 	if err != nil {
-		fmt.Printf("Set mode error: %v\n", err)
+		session.metrics.failed()
+		session.reportError(acp.AgentMethodSessionSetMode, err)
+		logError("Set mode error: %v", err)
 		return nil, err
 	}
+	session.setCurrentMode(acp.SessionModeId(modeId))
 
 	return modeId, nil
 }
 
+// cleanup stops the agent and releases what the session holds. The context
+// of the session is canceled rather than cleared, for the handlers still
+// running to see ctx.Err().
 func (s *AcpSession) cleanup() {
 	if s.cancel != nil {
 		s.cancel()
 	}
 	if s.cmd != nil && s.cmd.Process != nil {
-		_ = s.cmd.Process.Kill()
+		_ = killProcess(s.cmd.Process)
+	}
+	if s.remote != nil {
+		_ = s.remote.Close()
 	}
+	s.trace.close()
+	s.capture.close()
+	s.removeOutputs()
+	s.removeCheckpoint()
 	s.conn = nil
 	s.sessionID = ""
-	s.ctx = nil
-	s.cancel = nil
 	s.cmd = nil
+	s.remote = nil
 }
 
-func (s *AcpSession) appendToBuffer(text string) {
-	err := vim.api.ExecLua(`return require('acp').append_text(...)`, nil, s.bufnr, text)
+// stop stops the session of a chat that was closed: the agent is killed at
+// once, the queued turns are dropped and the session is cleaned up after the
+// running turn, which fails with the agent.
+func (s *AcpSession) stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.turns.mu.Lock()
+	s.turns.pending = nil
+	s.turns.mu.Unlock()
+	s.queueTurn(s.cleanup)
+}
+
+// AcpStopSession stops the session of a chat buffer, when it is wiped out
+func (m *SessionManager) AcpStopSession(bufnr int) (any, error) {
+	m.mu.Lock()
+	session := m.sessions[bufnr]
+	delete(m.sessions, bufnr)
+	delete(m.declared, bufnr)
+	if p := m.starting[bufnr]; p != nil {
+		p.stopped = true
+	}
+	m.mu.Unlock()
+	if session != nil {
+		logInfo("Stopping session %s of buffer %d", session.sessionID, bufnr)
+		session.stop()
+	}
+	return nil, nil
+}
+
+// stopAll kills the agents of all the sessions, when Neovim is gone. Their
+// checkpoints are kept, for the sessions to be recovered.
+func (m *SessionManager) stopAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.starting {
+		p.stopped = true
+	}
+	for _, session := range m.sessions {
+		if session.cancel != nil {
+			session.cancel()
+		}
+		if session.cmd != nil && session.cmd.Process != nil {
+			_ = killProcess(session.cmd.Process)
+		}
+		if session.remote != nil {
+			_ = session.remote.Close()
+		}
+	}
+}
+
+// errPermissionDenied answers the requests the user denied. Agents take
+// -32000 for auth_required, so it must not be that.
+var errPermissionDenied = acp.NewInvalidRequest(map[string]any{"error": "permission denied by user"})
+
+// confirm asks the user to allow an operation requested by the agent.
+func (s *AcpSession) confirm(title string) bool {
+	if s.autoApprove {
+		return true
+	}
+	return s.ask(title)
+}
+
+// ask prompts the user to allow an operation regardless of auto-approve.
+func (s *AcpSession) ask(title string) bool {
+	s.flushBuffer()
+	choice, err := vim.uiSelect([]string{"Allow", "Reject"}, selectOpts{Title: fmt.Sprintf("Permission request: %s", title)})
 	if err != nil {
-		log.Printf("Error appending to buffer: %v\n", err)
+		logError("Error displaying permission prompt: %v", err)
+		return false
+	}
+	if choice != 1 {
+		s.appendToBuffer(fmt.Sprintf("\n[Permission denied: %s]\n", title))
+		return false
+	}
+	return true
+}
+
+func (s *AcpSession) appendToBuffer(text string) {
+	s.writeChat(s.reflow.other(s.sanitizer.clean(text)))
+}
+
+// writeChat appends text already sanitized to the chat buffer.
+func (s *AcpSession) writeChat(text string) {
+	if s.bufnr == 0 {
+		if s.print != nil {
+			io.WriteString(s.print, text)
+		}
+		return
+	}
+	s.out.write(s.bufnr, text)
+}
+
+// callLua runs Lua code in order with the text appended to the chat buffer,
+// in the same batch.
+func (s *AcpSession) callLua(code string, args ...any) {
+	if s.bufnr == 0 {
+		return
 	}
+	s.out.call(s.bufnr, code, args...)
+}
+
+// flushBuffer appends the session updates received so far and the text held
+// back by appendToBuffer now. It must not be called from SessionUpdate.
+func (s *AcpSession) flushBuffer() {
+	s.updates.wait()
+	if s.bufnr == 0 {
+		return
+	}
+	s.out.flush(s.bufnr)
 }
 
 func (s *AcpSession) showDiff(path string, oldText *string, newText string) {
@@ -567,11 +1235,9 @@ func (s *AcpSession) showDiff(path string, oldText *string, newText string) {
 		old = *oldText
 	}
 
-	var diff string
-	err := vim.api.ExecLua(`return vim.text.diff(...)`, &diff, old, newText)
-
-	if err != nil {
-		log.Printf("Error generating diff: %v\n", err)
+	diff, ok := unifiedDiff(old, newText)
+	if !ok {
+		s.appendToBuffer(fmt.Sprintf("\n[Diff of %s too large, open the file to see the changes]\n", path))
 		return
 	}
 
@@ -587,6 +1253,28 @@ func main() {
 	// Turn off timestamps in output.
 	log.SetFlags(0)
 
+	mock := flag.Bool("mock", false, "run a scripted ACP agent on stdio instead of the RPC host, for development")
+	pprofAddr := flag.String("pprof", "", "serve net/http/pprof on this loopback `address`, e.g. localhost:6060")
+	cli := flag.Bool("cli", false, "run a single turn outside of Neovim, with the prompt given as arguments or on stdin, and print the chat to stdout")
+	agent := flag.String("agent", "", "`command` of the agent to run with -cli")
+	autoApprove := flag.Bool("auto-approve", false, "allow all the permission requests of the agent, with -cli")
+	cwd := flag.String("cwd", "", "working `directory` of the session, with -cli")
+	jsonEvents := flag.Bool("json", false, "print the events of the session as JSON lines in place of the chat, with -cli")
+	readOnly := flag.Bool("read-only", false, "deny the agent writing files, running commands and editing, with -cli")
+	flag.Parse()
+	if *mock {
+		runMockAgent()
+		return
+	}
+	if *cli {
+		if *cwd != "" {
+			if err := os.Chdir(*cwd); err != nil {
+				log.Fatal(err)
+			}
+		}
+		os.Exit(runCli(*agent, flag.Args(), *autoApprove, *jsonEvents, *readOnly))
+	}
+
 	// Direct writes by the application to stdout garble the RPC stream.
 	// Redirect the application's direct use of stdout to stderr.
 	stdout := os.Stdout
@@ -595,25 +1283,97 @@ func main() {
 
 	// Create a client connected to stdio. Configure the client to use the
 	// standard log package for logging.
-	api, err := nvim.New(os.Stdin, stdout, stdout, log.Printf)
+	api, err := nvim.New(os.Stdin, stdout, stdout, logError)
 	if err != nil {
 		log.Fatal(err)
 	}
 	vim = Vim{api: api}
 
+	// Profiles help find leaks in hosts that ran for days
+	dumpProfilesOnSignal()
+	if *pprofAddr != "" {
+		if err := servePprof(*pprofAddr); err != nil {
+			logError("Error serving pprof: %v", err)
+		}
+	}
 	// Create session manager
 	manager := &SessionManager{
 		sessions: make(map[int]*AcpSession),
+		starting: make(map[int]*pendingStart),
+		declared: make(map[int]declaredSession),
+		files:    &acpfs.FS{Buffers: vimBuffers{vim: vim}},
 	}
 
 	// Register RPC handlers
 	vim.api.RegisterHandler("AcpNewSession", manager.AcpNewSession)
+	vim.api.RegisterHandler("AcpDeclareSession", manager.AcpDeclareSession)
 	vim.api.RegisterHandler("AcpSendPrompt", manager.AcpSendPrompt)
+	vim.api.RegisterHandler("AcpSendPromptWithSelection", manager.AcpSendPromptWithSelection)
+	vim.api.RegisterHandler("AcpBroadcastPrompt", manager.AcpBroadcastPrompt)
+	vim.api.RegisterHandler("AcpResendLast", manager.AcpResendLast)
+	vim.api.RegisterHandler("AcpContinue", manager.AcpContinue)
+	vim.api.RegisterHandler("AcpEditLast", manager.AcpEditLast)
+	vim.api.RegisterHandler("AcpHistory", manager.AcpHistory)
+	vim.api.RegisterHandler("AcpAsk", manager.AcpAsk)
 	vim.api.RegisterHandler("AcpCancel", manager.AcpCancel)
 	vim.api.RegisterHandler("AcpSetMode", manager.AcpSetMode)
+	vim.api.RegisterHandler("AcpListModes", manager.AcpListModes)
+	vim.api.RegisterHandler("AcpCycleMode", manager.AcpCycleMode)
+	vim.api.RegisterHandler("AcpListModels", manager.AcpListModels)
+	vim.api.RegisterHandler("AcpSetModel", manager.AcpSetModel)
+	vim.api.RegisterHandler("AcpExtRequest", manager.AcpExtRequest)
+	vim.api.RegisterHandler("AcpExtNotify", manager.AcpExtNotify)
+	vim.api.RegisterHandler("AcpSendTemplate", manager.AcpSendTemplate)
+	vim.api.RegisterHandler("AcpListTemplates", manager.AcpListTemplates)
+	vim.api.RegisterHandler("AcpAttach", manager.AcpAttach)
+	vim.api.RegisterHandler("AcpAttachImage", manager.AcpAttachImage)
+	vim.api.RegisterHandler("AcpAttachClipboardImage", manager.AcpAttachClipboardImage)
+	vim.api.RegisterHandler("AcpAttachTerminal", manager.AcpAttachTerminal)
+	vim.api.RegisterHandler("AcpFindFiles", manager.AcpFindFiles)
+	vim.api.RegisterHandler("AcpAttachSymbol", manager.AcpAttachSymbol)
+	vim.api.RegisterHandler("AcpSetMiddleware", manager.AcpSetMiddleware)
+	vim.api.RegisterHandler("AcpSetLuaHandlers", manager.AcpSetLuaHandlers)
+	vim.api.RegisterHandler("AcpReloadConfig", manager.AcpReloadConfig)
+	vim.api.RegisterHandler("AcpListAgents", manager.AcpListAgents)
+	vim.api.RegisterHandler("AcpInstallAgent", manager.AcpInstallAgent)
+	vim.api.RegisterHandler("AcpAgentInfo", manager.AcpAgentInfo)
+	vim.api.RegisterHandler("AcpAddMcpServer", manager.AcpAddMcpServer)
+	vim.api.RegisterHandler("AcpRemoveMcpServer", manager.AcpRemoveMcpServer)
+	vim.api.RegisterHandler("AcpListMcpServers", manager.AcpListMcpServers)
+	vim.api.RegisterHandler("AcpMcpStatus", manager.AcpMcpStatus)
+	vim.api.RegisterHandler("AcpLoadMcpFiles", manager.AcpLoadMcpFiles)
+	vim.api.RegisterHandler("AcpTracePath", manager.AcpTracePath)
+	vim.api.RegisterHandler("AcpAgentLogs", manager.AcpAgentLogs)
+	vim.api.RegisterHandler("AcpMirrorAgentLogs", manager.AcpMirrorAgentLogs)
+	vim.api.RegisterHandler("AcpHealth", manager.AcpHealth)
+	vim.api.RegisterHandler("AcpSetLogLevel", manager.AcpSetLogLevel)
+	vim.api.RegisterHandler("AcpMetrics", manager.AcpMetrics)
+	vim.api.RegisterHandler("AcpReplay", manager.AcpReplay)
+	vim.api.RegisterHandler("AcpLastError", manager.AcpLastError)
+	vim.api.RegisterHandler("AcpSetSlowCallThreshold", manager.AcpSetSlowCallThreshold)
+	vim.api.RegisterHandler("AcpTrimLines", manager.AcpTrimLines)
+	vim.api.RegisterHandler("AcpRestoreLines", manager.AcpRestoreLines)
+	vim.api.RegisterHandler("AcpLoadOutput", manager.AcpLoadOutput)
+	vim.api.RegisterHandler("AcpExportSession", manager.AcpExportSession)
+	vim.api.RegisterHandler("AcpImportTranscript", manager.AcpImportTranscript)
+	vim.api.RegisterHandler("AcpSearchArchive", manager.AcpSearchArchive)
+	vim.api.RegisterHandler("AcpLoadArchived", manager.AcpLoadArchived)
+	vim.api.RegisterHandler("AcpListRecoverable", manager.AcpListRecoverable)
+	vim.api.RegisterHandler("AcpRecover", manager.AcpRecover)
+	vim.api.RegisterHandler("AcpDiscardRecoverable", manager.AcpDiscardRecoverable)
+	vim.api.RegisterHandler("AcpDiscardCheckpoints", manager.AcpDiscardCheckpoints)
+	vim.api.RegisterHandler("AcpCompact", manager.AcpCompact)
+	vim.api.RegisterHandler("AcpTurns", manager.AcpTurns)
+	vim.api.RegisterHandler("AcpGetCodeBlocks", manager.AcpGetCodeBlocks)
+	vim.api.RegisterHandler("AcpApplyCodeBlock", manager.AcpApplyCodeBlock)
+	vim.api.RegisterHandler("AcpInlineEdit", manager.AcpInlineEdit)
+	vim.api.RegisterHandler("AcpStopSession", manager.AcpStopSession)
 
 	// Serve RPC requests
-	if err := vim.api.Serve(); err != nil {
+	err = vim.api.Serve()
+	// The agents must not outlive Neovim
+	manager.stopAll()
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"acp/go/internal/acpfs"
+)
+
+// TestMain runs the mock agent instead of the tests when the tests start
+// the test binary as an agent, see startMockSession.
+func TestMain(m *testing.M) {
+	if os.Getenv("ACP_TEST_MOCK_AGENT") == "1" {
+		runMockAgent()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestCleanupCancelsContext(t *testing.T) {
+	var chat strings.Builder
+	s := startMockSession(t, &chat)
+	ctx := s.ctx
+	s.cleanup()
+	if s.ctx != ctx || s.ctx.Err() != context.Canceled {
+		t.Errorf("got the context %v after cleanup, want it canceled", s.ctx)
+	}
+	// Cleaning up again is harmless
+	s.cleanup()
+}
+
+func TestStartSessionFails(t *testing.T) {
+	files := &acpfs.FS{Buffers: noBuffers{}}
+	tests := []struct {
+		name string
+		cmd  []string
+		opts AcpNewSessionOpts
+	}{
+		{name: "no command", cmd: nil},
+		{name: "missing command", cmd: []string{filepath.Join(t.TempDir(), "missing-agent")}},
+		{name: "agent exiting", cmd: []string{os.Args[0], "-test.run=^$"}},
+	}
+	for _, tt := range tests {
+		if s, _, err := startSession(0, tt.cmd, tt.opts, files); err == nil {
+			s.cleanup()
+			t.Errorf("%s: the session started", tt.name)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// McpReport tells which MCP servers of a session are passed to the agent and
+// which are skipped, because they are disabled in the config, the agent
+// doesn't support their transport or they failed the preflight check.
+type McpReport struct {
+	Serving []McpServerStatus `msgpack:"serving"`
+	Skipped []McpServerStatus `msgpack:"skipped"`
+}
+
+// McpServerStatus is an MCP server of McpReport.
+type McpServerStatus struct {
+	Name      string `msgpack:"name"`
+	Transport string `msgpack:"transport"`
+	Reason    string `msgpack:"reason,omitempty"`
+}
+
+// String summarizes the report for the chat buffer, e.g. "serving 2 stdio
+// servers; skipped 'linear' (http unsupported by agent)".
+func (r McpReport) String() string {
+	counts := map[string]int{}
+	for _, srv := range r.Serving {
+		counts[srv.Transport]++
+	}
+	var parts []string
+	for _, t := range sortedKeys(counts) {
+		noun := "servers"
+		if counts[t] == 1 {
+			noun = "server"
+		}
+		parts = append(parts, fmt.Sprintf("%d %s %s", counts[t], t, noun))
+	}
+	summary := "no server"
+	if len(parts) > 0 {
+		summary = "serving " + strings.Join(parts, ", ")
+	}
+	for _, srv := range r.Skipped {
+		summary += fmt.Sprintf("; skipped '%s' (%s)", srv.Name, srv.Reason)
+	}
+	return summary
+}
+
+// mcpServers converts the MCP server configs of the session, leaving out the
+// servers whose config is invalid, that are disabled, not enabled for the
+// project, whose transport the agent doesn't support or that fail the
+// preflight check.
+func (s *AcpSession) mcpServers() ([]acp.McpServer, McpReport) {
+	s.mu.Lock()
+	configs := maps.Clone(s.mcp)
+	s.mu.Unlock()
+
+	caps := s.agentInfo.AgentCapabilities.McpCapabilities
+	names := sortedKeys(configs)
+	converted := make([]acp.McpServer, len(names))
+	statuses := make([]McpServerStatus, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		srv, err := ConvertMcpConfigToMcpServer(name, configs[name])
+		if err != nil {
+			transport, _ := configs[name]["type"].(string)
+			if transport == "" {
+				transport = "stdio"
+			}
+			statuses[i] = McpServerStatus{Name: name, Transport: transport, Reason: fmt.Sprintf("invalid config: %v", err)}
+			continue
+		}
+		converted[i] = *srv
+		status := McpServerStatus{Name: name, Transport: "stdio"}
+		if srv.Http != nil {
+			status.Transport = "http"
+		} else if srv.Sse != nil {
+			status.Transport = "sse"
+		}
+		switch {
+		case configDisabled(configs[name]):
+			status.Reason = "disabled"
+		case !inRoots(configs[name], s.cwd):
+			status.Reason = "not enabled for this project"
+		case srv.Http != nil && !caps.Http:
+			status.Reason = "http unsupported by agent"
+		case srv.Sse != nil && !caps.Sse:
+			status.Reason = "sse unsupported by agent"
+		}
+		if status.Reason == "" {
+			if err := s.env.resolveHeaders(s.ctx, &converted[i]); err != nil {
+				status.Reason = err.Error()
+			}
+		}
+		statuses[i] = status
+
+		if status.Reason == "" && s.preflight {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := preflightMcp(s.ctx, converted[i]); err != nil {
+					statuses[i].Reason = err.Error()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	servers := make([]acp.McpServer, 0, len(names))
+	report := McpReport{Serving: []McpServerStatus{}, Skipped: []McpServerStatus{}}
+	for i, status := range statuses {
+		if status.Reason != "" {
+			report.Skipped = append(report.Skipped, status)
+			continue
+		}
+		report.Serving = append(report.Serving, status)
+		servers = append(servers, converted[i])
+	}
+
+	s.mu.Lock()
+	s.mcpReport = report
+	s.mu.Unlock()
+	return servers, report
+}
+
+// resolveHeaders replaces the secret references in the headers of an HTTP or
+// SSE server. They are resolved each time the server is passed to the agent
+// rather than kept in the session config.
+func (e expander) resolveHeaders(ctx context.Context, srv *acp.McpServer) error {
+	var headers []acp.HttpHeader
+	switch {
+	case srv.Http != nil:
+		headers = srv.Http.Headers
+	case srv.Sse != nil:
+		headers = srv.Sse.Headers
+	}
+	for i, h := range headers {
+		value, err := e.resolveSecrets(ctx, h.Value)
+		if err != nil {
+			return fmt.Errorf("header %s: %w", h.Name, err)
+		}
+		headers[i].Value = value
+	}
+	return nil
+}
+
+// mcpPreflightTimeout bounds the reachability check of an HTTP server.
+const mcpPreflightTimeout = 3 * time.Second
+
+// preflightMcp checks that the command of a stdio server can be run and that
+// an HTTP or SSE server answers, so that broken servers are reported up front
+// rather than by the agent failing to create the session.
+func preflightMcp(ctx context.Context, srv acp.McpServer) error {
+	var url string
+	var headers []acp.HttpHeader
+	switch {
+	case srv.Stdio != nil:
+		if _, err := exec.LookPath(srv.Stdio.Command); err != nil {
+			return fmt.Errorf("command %s not found or not executable", srv.Stdio.Command)
+		}
+		return nil
+	case srv.Http != nil:
+		url, headers = srv.Http.Url, srv.Http.Headers
+	case srv.Sse != nil:
+		url, headers = srv.Sse.Url, srv.Sse.Headers
+	default:
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mcpPreflightTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("invalid url %s", url)
+	}
+	for _, h := range headers {
+		req.Header.Set(h.Name, h.Value)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unreachable: %v", err)
+	}
+	res.Body.Close()
+	// Any answer will do: MCP endpoints may reject a bare GET. Only failed
+	// authentication is reported since the agent would fail the same way.
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("rejected the configured headers: %s", res.Status)
+	}
+	return nil
+}
+
+// configDisabled reports whether an MCP server is turned off in its config
+// with "disabled": true.
+func configDisabled(config map[string]any) bool {
+	disabled, _ := config["disabled"].(bool)
+	return disabled
+}
+
+// inRoots reports whether an MCP server is enabled in the project at cwd.
+// Servers with "roots" in their config are only enabled in those
+// directories and below, others everywhere.
+func inRoots(config map[string]any, cwd string) bool {
+	roots, ok := config["roots"].([]any)
+	if !ok || len(roots) == 0 {
+		return true
+	}
+	for _, r := range roots {
+		root, ok := r.(string)
+		if !ok || root == "" {
+			continue
+		}
+		if _, ok := cutDir(filepath.ToSlash(filepath.Clean(cwd)), filepath.ToSlash(filepath.Clean(root))); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AcpMcpStatus reports the effective MCP servers of a session: those passed
+// to the agent and those skipped, with the reason
+func (m *SessionManager) AcpMcpStatus(bufnr int) (McpReport, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return McpReport{}, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.mcpReport, nil
+}
+
+// reloadMcp applies a change of the MCP servers to the live session. ACP
+// only takes MCP servers when a session is created or loaded, so the session
+// is loaded again when the agent can, and replaced by a new one otherwise.
+func (s *AcpSession) reloadMcp() error {
+	servers, report := s.mcpServers()
+
+	if s.agentInfo.AgentCapabilities.LoadSession {
+		s.loading.Store(true)
+		defer func() {
+			// The replayed updates may still be queued
+			s.updates.wait()
+			s.loading.Store(false)
+		}()
+		res, err := s.conn.LoadSession(s.ctx, acp.LoadSessionRequest{
+			SessionId:  s.sessionID,
+			Cwd:        s.paths.toRemote(s.cwd),
+			McpServers: servers,
+		})
+		if err != nil {
+			return fmt.Errorf("reload session: %w", err)
+		}
+		s.setModes(res.Modes)
+		s.setModels(res.Models)
+		s.appendToBuffer(fmt.Sprintf("\n[MCP: %s]\n", report))
+		return nil
+	}
+
+	res, err := s.newSession(acp.NewSessionRequest{
+		Cwd:        s.paths.toRemote(s.cwd),
+		McpServers: servers,
+	})
+	if err != nil {
+		return fmt.Errorf("restart session: %w", err)
+	}
+	s.sessionID = res.SessionId
+	s.appendToBuffer(fmt.Sprintf("\n[MCP: %s. The agent can't reload sessions, so a new one was started without the previous conversation]\n", report))
+	return nil
+}
+
+// AcpAddMcpServer adds an MCP server to a live session, or replaces the one
+// with the same name, once the running turn ends
+func (m *SessionManager) AcpAddMcpServer(bufnr int, name string, config map[string]any) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	config, _ = session.env.expandAll(config).(map[string]any)
+	if _, err := ConvertMcpConfigToMcpServer(name, config); err != nil {
+		return nil, fmt.Errorf("invalid MCP server config for %s: %w", name, err)
+	}
+
+	session.queueTurn(func() {
+		if err := session.setMcpServer(name, config); err != nil {
+			session.appendToBuffer(fmt.Sprintf("\n[Error adding MCP server %s: %v]\n", name, err))
+		}
+		session.flushBuffer()
+	})
+	return nil, nil
+}
+
+// AcpRemoveMcpServer removes an MCP server from a live session, once the
+// running turn ends
+func (m *SessionManager) AcpRemoveMcpServer(bufnr int, name string) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+
+	session.mu.Lock()
+	_, existed := session.mcp[name]
+	session.mu.Unlock()
+	if !existed {
+		return nil, fmt.Errorf("no MCP server %s in this session", name)
+	}
+
+	session.queueTurn(func() {
+		if err := session.setMcpServer(name, nil); err != nil {
+			session.appendToBuffer(fmt.Sprintf("\n[Error removing MCP server %s: %v]\n", name, err))
+		}
+		session.flushBuffer()
+	})
+	return nil, nil
+}
+
+// setMcpServer sets the config of the MCP server called name, or removes the
+// server when config is nil, and reloads the MCP servers of the agent. It
+// talks to the agent, so it runs in the queue of the turns.
+func (s *AcpSession) setMcpServer(name string, config map[string]any) error {
+	s.mu.Lock()
+	previous, existed := s.mcp[name]
+	if config == nil {
+		delete(s.mcp, name)
+	} else {
+		if s.mcp == nil {
+			s.mcp = map[string]map[string]any{}
+		}
+		s.mcp[name] = config
+	}
+	s.mu.Unlock()
+
+	if err := s.reloadMcp(); err != nil {
+		// Keep the config in step with what the agent runs
+		s.mu.Lock()
+		if existed {
+			s.mcp[name] = previous
+		} else {
+			delete(s.mcp, name)
+		}
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// AcpListMcpServers returns the names of the MCP servers of a session
+func (m *SessionManager) AcpListMcpServers(bufnr int) ([]string, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return sortedKeys(session.mcp), nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
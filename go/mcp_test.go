@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConvertMcpConfigToMcpServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]any
+		want    string
+		wantErr string
+	}{
+		{name: "http", config: map[string]any{"type": "http", "url": "https://example.com/mcp"}, want: "http"},
+		{name: "sse", config: map[string]any{"type": "sse", "url": "https://example.com/sse"}, want: "sse"},
+		{name: "stdio", config: map[string]any{"cmd": []any{"server", "--stdio"}}, want: "stdio"},
+		{name: "http without url", config: map[string]any{"type": "http"}, wantErr: "http server http without url needs a url"},
+		{name: "sse with empty url", config: map[string]any{"type": "sse", "url": ""}, wantErr: "needs a url"},
+		{name: "url not a string", config: map[string]any{"type": "http", "url": 8080}, wantErr: "needs a url"},
+	}
+	for _, tt := range tests {
+		srv, err := ConvertMcpConfigToMcpServer(tt.name, tt.config)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got %v, want an error with %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := "stdio"
+		if srv.Http != nil {
+			got = "http"
+		} else if srv.Sse != nil {
+			got = "sse"
+		}
+		if got != tt.want {
+			t.Errorf("%s: got a %s server, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAcpAddMcpServerRejectsInvalidConfig(t *testing.T) {
+	session := &AcpSession{}
+	m := &SessionManager{sessions: map[int]*AcpSession{1: session}}
+	if _, err := m.AcpAddMcpServer(1, "web", map[string]any{"type": "http"}); err == nil {
+		t.Fatal("added an http server without url")
+	}
+	if len(session.turns.pending) > 0 || session.turns.running {
+		t.Errorf("queued the reload of an invalid config")
+	}
+}
+
+func TestMcpServersSkipsInvalidConfig(t *testing.T) {
+	// As loaded from a malformed .mcp.json of the project
+	s := &AcpSession{mcp: map[string]map[string]any{
+		"broken": {"type": "http"},
+		"local":  {"cmd": []any{"server"}},
+	}}
+	servers, report := s.mcpServers()
+	if len(servers) != 1 || servers[0].Stdio == nil || servers[0].Stdio.Name != "local" {
+		t.Errorf("got servers %+v, want local only", servers)
+	}
+	if len(report.Skipped) != 1 || report.Skipped[0].Name != "broken" || !strings.HasPrefix(report.Skipped[0].Reason, "invalid config") {
+		t.Errorf("got skipped %+v, want broken with an invalid config", report.Skipped)
+	}
+}
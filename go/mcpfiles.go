@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultMcpFiles returns the MCP config files of other tools, user files
+// first so that project files take precedence.
+func defaultMcpFiles(cwd string) []string {
+	var paths []string
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".cursor", "mcp.json"))
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths,
+			filepath.Join(dir, "Claude", "claude_desktop_config.json"),
+			filepath.Join(dir, "zed", "settings.json"),
+		)
+	}
+	return append(paths,
+		filepath.Join(cwd, ".mcp.json"),
+		filepath.Join(cwd, ".cursor", "mcp.json"),
+		filepath.Join(cwd, ".vscode", "mcp.json"),
+		filepath.Join(cwd, ".zed", "settings.json"),
+	)
+}
+
+// mcpFileServer is an MCP server as written in the config files of Claude,
+// Cursor, VS Code and Zed.
+type mcpFileServer struct {
+	Type    string            `json:"type"`
+	Command json.RawMessage   `json:"command"`
+	Args    []string          `json:"args"`
+	Env     map[string]string `json:"env"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// mcpFile holds the keys under which the supported tools keep MCP servers:
+// mcpServers for Claude and Cursor, servers for VS Code and context_servers
+// for Zed.
+type mcpFile struct {
+	McpServers     map[string]mcpFileServer `json:"mcpServers"`
+	Servers        map[string]mcpFileServer `json:"servers"`
+	ContextServers map[string]mcpFileServer `json:"context_servers"`
+}
+
+// loadMcpFile reads the MCP servers of a config file into the format of the
+// plugin config. A missing file has no servers.
+func loadMcpFile(path string) (map[string]map[string]any, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f mcpFile
+	if err := json.Unmarshal(stripJSONC(b), &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	out := map[string]map[string]any{}
+	for _, servers := range []map[string]mcpFileServer{f.McpServers, f.Servers, f.ContextServers} {
+		for name, srv := range servers {
+			config, err := srv.config()
+			if err != nil {
+				return nil, fmt.Errorf("%s: MCP server %s: %w", path, name, err)
+			}
+			if config != nil {
+				out[name] = config
+			}
+		}
+	}
+	return out, nil
+}
+
+// config converts srv to the format of the plugin config, or returns nil for
+// entries that don't describe a server, such as Zed extensions.
+func (srv mcpFileServer) config() (map[string]any, error) {
+	if srv.URL != "" {
+		t := srv.Type
+		if t == "" || t == "streamable-http" || t == "streamableHttp" {
+			t = "http"
+			if strings.HasSuffix(strings.TrimSuffix(srv.URL, "/"), "/sse") {
+				t = "sse"
+			}
+		}
+		headers := map[string]any{}
+		for k, v := range srv.Headers {
+			headers[k] = v
+		}
+		return map[string]any{"type": t, "url": srv.URL, "headers": headers}, nil
+	}
+
+	if len(srv.Command) == 0 {
+		return nil, nil
+	}
+	var command string
+	args, env := srv.Args, srv.Env
+	if err := json.Unmarshal(srv.Command, &command); err != nil {
+		// Older Zed settings nest the command: {"path": ..., "args": ..., "env": ...}
+		var nested struct {
+			Path string            `json:"path"`
+			Args []string          `json:"args"`
+			Env  map[string]string `json:"env"`
+		}
+		if err := json.Unmarshal(srv.Command, &nested); err != nil {
+			return nil, fmt.Errorf("invalid command: %w", err)
+		}
+		command, args, env = nested.Path, nested.Args, nested.Env
+	}
+
+	cmd := []any{command}
+	for _, a := range args {
+		cmd = append(cmd, a)
+	}
+	envMap := map[string]any{}
+	for k, v := range env {
+		envMap[k] = v
+	}
+	return map[string]any{"cmd": cmd, "env": envMap}, nil
+}
+
+// stripJSONC removes the comments and trailing commas allowed in the JSON
+// with comments of VS Code and Zed settings.
+func stripJSONC(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	inString := false
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if inString {
+			out = append(out, c)
+			if c == '\\' && i+1 < len(b) {
+				i++
+				out = append(out, b[i])
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch {
+		case c == '"':
+			inString = true
+			out = append(out, c)
+		case c == '/' && i+1 < len(b) && b[i+1] == '/':
+			for i < len(b) && b[i] != '\n' {
+				i++
+			}
+			i--
+		case c == '/' && i+1 < len(b) && b[i+1] == '*':
+			i += 2
+			for i+1 < len(b) && !(b[i] == '*' && b[i+1] == '/') {
+				i++
+			}
+			i++
+		case c == ']' || c == '}':
+			// Drop a comma left before the closing bracket
+			j := len(out) - 1
+			for j >= 0 && strings.ContainsRune(" \t\r\n", rune(out[j])) {
+				j--
+			}
+			if j >= 0 && out[j] == ',' {
+				out = append(out[:j], out[j+1:]...)
+			}
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// AcpLoadMcpFiles reads the MCP servers of the given config files, or of the
+// files of Claude, Cursor, VS Code and Zed when paths is empty. Servers of
+// later files override those of earlier files with the same name.
+func (m *SessionManager) AcpLoadMcpFiles(paths []string) (map[string]map[string]any, error) {
+	if len(paths) == 0 {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		paths = defaultMcpFiles(cwd)
+	}
+
+	out := map[string]map[string]any{}
+	for _, path := range paths {
+		servers, err := loadMcpFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, config := range servers {
+			out[name] = config
+		}
+	}
+	return out, nil
+}
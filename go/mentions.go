@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// fileIndexTTL is how long a project file list is reused before the tree
+	// is listed again.
+	fileIndexTTL = 30 * time.Second
+	// maxIndexedFiles bounds the size of a project file list.
+	maxIndexedFiles = 200000
+	// defaultFileMatches is the number of matches returned when no limit is
+	// given.
+	defaultFileMatches = 50
+)
+
+// fileIndex is the list of files of a project, relative to its root.
+type fileIndex struct {
+	files []string
+	built time.Time
+}
+
+// fileIndexCache keeps a file list per project root, so that completing a
+// mention doesn't walk the whole tree on every keystroke.
+type fileIndexCache struct {
+	mu      sync.Mutex
+	indexes map[string]*fileIndex
+}
+
+var fileIndexes = &fileIndexCache{indexes: map[string]*fileIndex{}}
+
+// files returns the files under root, listing the tree again when the cached
+// list is older than fileIndexTTL.
+func (c *fileIndexCache) files(ctx context.Context, root string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if idx, ok := c.indexes[root]; ok && time.Since(idx.built) < fileIndexTTL {
+		return idx.files, nil
+	}
+	files, err := listFiles(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	c.indexes[root] = &fileIndex{files: files, built: time.Now()}
+	return files, nil
+}
+
+// listFiles lists the files under root that are not ignored. git is asked
+// first, as it knows every ignore file that applies; outside of a repository
+// the tree is walked honoring the .gitignore at root.
+func listFiles(ctx context.Context, root string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-files", "--cached", "--others", "--exclude-standard", "-z")
+	cmd.Dir = root
+	if out, err := cmd.Output(); err == nil {
+		var files []string
+		for _, f := range bytes.Split(out, []byte{0}) {
+			if len(f) > 0 && len(files) < maxIndexedFiles {
+				files = append(files, string(f))
+			}
+		}
+		return files, nil
+	}
+	return walkFiles(root)
+}
+
+func walkFiles(root string) ([]string, error) {
+	ignore := readIgnoreFile(filepath.Join(root, ".gitignore"))
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable directories are skipped rather than failing the
+			// whole listing
+			return nil
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(d.Name(), ".") || ignored(ignore, rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			files = append(files, rel)
+			if len(files) >= maxIndexedFiles {
+				return filepath.SkipAll
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// readIgnoreFile reads the patterns of a gitignore file. Negated patterns are
+// not supported and are dropped.
+func readIgnoreFile(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+// ignored reports whether the slash separated path rel matches one of the
+// gitignore patterns.
+func ignored(patterns []string, rel string, dir bool) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "/") {
+			if !dir {
+				continue
+			}
+			p = strings.TrimSuffix(p, "/")
+		}
+		if strings.Contains(strings.TrimPrefix(p, "/"), "/") || strings.HasPrefix(p, "/") {
+			if ok, _ := path.Match(strings.TrimPrefix(p, "/"), rel); ok {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fuzzyScore scores how well query matches path, or returns -1 when the
+// characters of query don't all appear in path in order. Consecutive
+// characters, characters at the start of a path segment or word, and
+// matches in the file name score higher, and shorter paths win ties.
+func fuzzyScore(path, query string) int {
+	orig := []rune(path)
+	text := []rune(strings.ToLower(path))
+	q := []rune(strings.ToLower(query))
+	base := len(text) - len([]rune(filepath.Base(path)))
+
+	score, qi, prev := 0, 0, -2
+	for i, r := range text {
+		if qi == len(q) {
+			break
+		}
+		if r != q[qi] {
+			continue
+		}
+		score++
+		if i == prev+1 {
+			score += 5
+		}
+		if i == 0 || strings.ContainsRune("/_-. ", text[i-1]) || (i < len(orig) && unicode.IsUpper(orig[i])) {
+			score += 3
+		}
+		if i >= base {
+			score += 2
+		}
+		prev = i
+		qi++
+	}
+	if qi < len(q) {
+		return -1
+	}
+	return score*1000 - len(text)
+}
+
+// findFiles returns the files under root that best match query, best match
+// first.
+func findFiles(ctx context.Context, root, query string, limit int) ([]string, error) {
+	if limit <= 0 {
+		limit = defaultFileMatches
+	}
+	files, err := fileIndexes.files(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	type match struct {
+		path  string
+		score int
+	}
+	var matches []match
+	for _, f := range files {
+		if s := fuzzyScore(f, query); s >= 0 {
+			matches = append(matches, match{f, s})
+		}
+	}
+	slices.SortFunc(matches, func(a, b match) int {
+		if a.score != b.score {
+			return b.score - a.score
+		}
+		return strings.Compare(a.path, b.path)
+	})
+
+	out := make([]string, 0, min(limit, len(matches)))
+	for _, m := range matches[:min(limit, len(matches))] {
+		out = append(out, m.path)
+	}
+	return out, nil
+}
+
+// AcpFindFiles fuzzy-matches query against the files of the session's
+// project and returns up to limit paths relative to the project root
+func (m *SessionManager) AcpFindFiles(bufnr int, query string, limit int) ([]string, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	return findFiles(session.ctx, session.cwd, query, limit)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// Metrics are the performance counters of a session, for debugging and
+// statuslines. Durations are in milliseconds.
+type Metrics struct {
+	Turns int `msgpack:"turns"`
+	// Running is set while a turn is in progress
+	Running bool `msgpack:"running"`
+	// FirstChunkMs is the time to the first chunk of the last turn, or -1
+	// when the agent replied with no chunk
+	FirstChunkMs int64          `msgpack:"first_chunk_ms"`
+	LastTurnMs   int64          `msgpack:"last_turn_ms"`
+	AvgTurnMs    int64          `msgpack:"avg_turn_ms"`
+	Chunks       int            `msgpack:"chunks"`
+	Bytes        int64          `msgpack:"bytes"`
+	ToolCalls    map[string]int `msgpack:"tool_calls"`
+	Errors       int            `msgpack:"errors"`
+}
+
+// sessionMetrics collects the Metrics of a session as updates come.
+type sessionMetrics struct {
+	mu          sync.Mutex
+	m           Metrics
+	turnStart   time.Time
+	gotChunk    bool
+	totalTurnMs int64
+}
+
+func (sm *sessionMetrics) startTurn() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.turnStart = time.Now()
+	sm.gotChunk = false
+	sm.m.Running = true
+	sm.m.FirstChunkMs = -1
+}
+
+func (sm *sessionMetrics) endTurn(err error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if !sm.m.Running {
+		return
+	}
+	sm.m.Running = false
+	sm.m.Turns++
+	sm.m.LastTurnMs = time.Since(sm.turnStart).Milliseconds()
+	sm.totalTurnMs += sm.m.LastTurnMs
+	sm.m.AvgTurnMs = sm.totalTurnMs / int64(sm.m.Turns)
+	if err != nil {
+		sm.m.Errors++
+	}
+}
+
+// chunk counts a chunk of n bytes of the agent's reply or thoughts.
+func (sm *sessionMetrics) chunk(n int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.m.Running && !sm.gotChunk {
+		sm.gotChunk = true
+		sm.m.FirstChunkMs = time.Since(sm.turnStart).Milliseconds()
+	}
+	sm.m.Chunks++
+	sm.m.Bytes += int64(n)
+}
+
+func (sm *sessionMetrics) toolCall(kind string) {
+	if kind == "" {
+		kind = "other"
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.m.ToolCalls == nil {
+		sm.m.ToolCalls = map[string]int{}
+	}
+	sm.m.ToolCalls[kind]++
+}
+
+// failed counts a failed request to the agent other than a prompt.
+func (sm *sessionMetrics) failed() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.m.Errors++
+}
+
+func (sm *sessionMetrics) snapshot() Metrics {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	m := sm.m
+	m.ToolCalls = maps.Clone(sm.m.ToolCalls)
+	if m.ToolCalls == nil {
+		m.ToolCalls = map[string]int{}
+	}
+	return m
+}
+
+// AcpMetrics returns the performance counters of a session
+func (m *SessionManager) AcpMetrics(bufnr int) (Metrics, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return Metrics{}, err
+	}
+	return session.metrics.snapshot(), nil
+}
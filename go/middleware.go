@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// errDroppedByMiddleware is returned when a prompt hook cancels the prompt.
+var errDroppedByMiddleware = errors.New("prompt dropped by middleware")
+
+// middleware records which kinds of Lua hooks are registered, so that the
+// editor is only called when a hook can change something. Lua keeps it up to
+// date through AcpSetMiddleware.
+var middleware struct {
+	mu       sync.Mutex
+	prompt   bool
+	response bool
+}
+
+// AcpSetMiddleware tells the host whether prompt and response hooks are
+// registered in Lua
+func (m *SessionManager) AcpSetMiddleware(prompt bool, response bool) (any, error) {
+	middleware.mu.Lock()
+	defer middleware.mu.Unlock()
+	middleware.prompt = prompt
+	middleware.response = response
+	return nil, nil
+}
+
+func hasMiddleware(kind string) bool {
+	middleware.mu.Lock()
+	defer middleware.mu.Unlock()
+	if kind == "prompt" {
+		return middleware.prompt
+	}
+	return middleware.response
+}
+
+// runMiddleware passes payload through the Lua hooks of kind and returns the
+// payload they produced, or nil when a hook dropped it.
+func runMiddleware(kind string, bufnr int, payload map[string]any) (map[string]any, error) {
+	var result any
+	if err := vim.api.ExecLua(`return require('acp').middleware(...)`, &result, kind, bufnr, payload); err != nil {
+		return nil, fmt.Errorf("%s middleware: %w", kind, err)
+	}
+	if result == nil {
+		return nil, nil
+	}
+	out, ok := result.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s middleware returned %T instead of a table", kind, result)
+	}
+	return out, nil
+}
+
+// promptMiddleware runs the prompt hooks on the text typed by the user and
+// the content blocks built from it. Blocks go through their JSON form, which
+// is the shape documented by ACP and the one hooks are given.
+func (s *AcpSession) promptMiddleware(text string, blocks []acp.ContentBlock) ([]acp.ContentBlock, error) {
+	if !hasMiddleware("prompt") {
+		return blocks, nil
+	}
+
+	b, err := json.Marshal(blocks)
+	if err != nil {
+		return nil, err
+	}
+	var list []any
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+
+	out, err := runMiddleware("prompt", s.bufnr, map[string]any{"text": text, "blocks": list})
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return nil, errDroppedByMiddleware
+	}
+
+	b, err = json.Marshal(out["blocks"])
+	if err != nil {
+		return nil, fmt.Errorf("prompt middleware: %w", err)
+	}
+	var result []acp.ContentBlock
+	if err := json.Unmarshal(b, &result); err != nil {
+		return nil, fmt.Errorf("prompt middleware returned invalid blocks: %w", err)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no prompt provided")
+	}
+	return result, nil
+}
+
+// responseMiddleware runs the response hooks on a chunk of the agent's
+// reply. ok is false when a hook dropped the chunk. Hooks that fail are
+// reported and the chunk is shown as received.
+func (s *AcpSession) responseMiddleware(text string) (string, bool) {
+	if !hasMiddleware("response") {
+		return text, true
+	}
+	out, err := runMiddleware("response", s.bufnr, map[string]any{"text": text})
+	if err != nil {
+		s.appendToBuffer(fmt.Sprintf("\n[Warning: %v]\n", err))
+		return text, true
+	}
+	if out == nil {
+		return "", false
+	}
+	t, ok := out["text"].(string)
+	if !ok {
+		return text, true
+	}
+	return t, true
+}
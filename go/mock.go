@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// mockAgent is a scripted ACP agent, run with acp-nvim -mock, to exercise
+// the client without API keys or network access. It echoes prompts, and the
+// slash commands of mockCommands trigger tool calls, diffs, plans and
+// permission requests.
+type mockAgent struct {
+	conn *acp.AgentSideConnection
+
+	mu sync.Mutex
+	// cancels holds the cancel function of the running prompt of each
+	// session
+	cancels map[acp.SessionId]context.CancelFunc
+}
+
+var mockCommands = []acp.AvailableCommand{
+	{Name: "tool", Description: "Run a fake tool call"},
+	{Name: "diff", Description: "Propose an edit of mock.txt"},
+	{Name: "plan", Description: "Show a plan"},
+	{Name: "permission", Description: "Ask for permission"},
+	{Name: "read", Description: "Read a file through the client", Input: &acp.AvailableCommandInput{UnstructuredCommandInput: &acp.AvailableCommandUnstructuredCommandInput{Hint: "path"}}},
+	{Name: "slow", Description: "Stream a long reply slowly, to try cancellation"},
+	{Name: "stop", Description: "End the turn with a stop reason", Input: &acp.AvailableCommandInput{UnstructuredCommandInput: &acp.AvailableCommandUnstructuredCommandInput{Hint: "max_tokens, max_turn_requests or refusal"}}},
+}
+
+var mockModes = acp.SessionModeState{
+	CurrentModeId: "default",
+	AvailableModes: []acp.SessionMode{
+		{Id: "default", Name: "Default"},
+		{Id: "plan", Name: "Plan", Description: acp.Ptr("Only plan, don't edit")},
+	},
+}
+
+// runMockAgent serves the mock agent on stdio until the client disconnects.
+func runMockAgent() {
+	agent := &mockAgent{cancels: map[acp.SessionId]context.CancelFunc{}}
+	agent.conn = acp.NewAgentSideConnection(agent, os.Stdout, os.Stdin)
+	<-agent.conn.Done()
+}
+
+func (a *mockAgent) Initialize(ctx context.Context, params acp.InitializeRequest) (acp.InitializeResponse, error) {
+	return acp.InitializeResponse{
+		ProtocolVersion: acp.ProtocolVersionNumber,
+		AgentInfo:       &acp.Implementation{Name: "acp-nvim-mock", Title: acp.Ptr("Mock agent"), Version: clientVersion},
+		AgentCapabilities: acp.AgentCapabilities{
+			LoadSession:        true,
+			PromptCapabilities: acp.PromptCapabilities{Image: true, Audio: true, EmbeddedContext: true},
+			McpCapabilities:    acp.McpCapabilities{Http: true, Sse: true},
+		},
+		AuthMethods: []acp.AuthMethod{},
+	}, nil
+}
+
+func (a *mockAgent) Authenticate(ctx context.Context, params acp.AuthenticateRequest) (acp.AuthenticateResponse, error) {
+	return acp.AuthenticateResponse{}, nil
+}
+
+func (a *mockAgent) NewSession(ctx context.Context, params acp.NewSessionRequest) (acp.NewSessionResponse, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return acp.NewSessionResponse{}, err
+	}
+	id := acp.SessionId(hex.EncodeToString(b))
+	// The client only handles the commands once it knows the session
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		a.update(context.Background(), id, acp.SessionUpdate{AvailableCommandsUpdate: &acp.SessionAvailableCommandsUpdate{AvailableCommands: mockCommands}})
+	}()
+	return acp.NewSessionResponse{SessionId: id, Modes: &mockModes}, nil
+}
+
+func (a *mockAgent) LoadSession(ctx context.Context, params acp.LoadSessionRequest) (acp.LoadSessionResponse, error) {
+	return acp.LoadSessionResponse{Modes: &mockModes}, nil
+}
+
+func (a *mockAgent) SetSessionMode(ctx context.Context, params acp.SetSessionModeRequest) (acp.SetSessionModeResponse, error) {
+	a.update(ctx, params.SessionId, acp.SessionUpdate{CurrentModeUpdate: &acp.SessionCurrentModeUpdate{CurrentModeId: params.ModeId}})
+	return acp.SetSessionModeResponse{}, nil
+}
+
+func (a *mockAgent) Cancel(ctx context.Context, params acp.CancelNotification) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cancel, ok := a.cancels[params.SessionId]; ok {
+		cancel()
+	}
+	return nil
+}
+
+func (a *mockAgent) update(ctx context.Context, id acp.SessionId, u acp.SessionUpdate) {
+	_ = a.conn.SessionUpdate(ctx, acp.SessionNotification{SessionId: id, Update: u})
+}
+
+func (a *mockAgent) say(ctx context.Context, id acp.SessionId, text string) {
+	a.update(ctx, id, acp.UpdateAgentMessageText(text))
+}
+
+// mediaSize describes the size of base64-encoded media, for the echo to show
+// what the agent received.
+func mediaSize(data string) string {
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "invalid base64"
+	}
+	return fmt.Sprintf("%d bytes", len(b))
+}
+
+func (a *mockAgent) Prompt(ctx context.Context, params acp.PromptRequest) (acp.PromptResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	a.mu.Lock()
+	a.cancels[params.SessionId] = cancel
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		delete(a.cancels, params.SessionId)
+		a.mu.Unlock()
+		cancel()
+	}()
+
+	var text []string
+	for _, b := range params.Prompt {
+		switch {
+		case b.Text != nil:
+			text = append(text, b.Text.Text)
+		case b.Image != nil:
+			text = append(text, fmt.Sprintf("<image %s, %s>", b.Image.MimeType, mediaSize(b.Image.Data)))
+		case b.Audio != nil:
+			text = append(text, fmt.Sprintf("<audio %s, %s>", b.Audio.MimeType, mediaSize(b.Audio.Data)))
+		case b.Resource != nil:
+			text = append(text, "<resource>")
+		case b.ResourceLink != nil:
+			text = append(text, fmt.Sprintf("<%s>", b.ResourceLink.Uri))
+		}
+	}
+	prompt := strings.TrimSpace(strings.Join(text, "\n"))
+	id := params.SessionId
+
+	command, arg, _ := strings.Cut(prompt, " ")
+	switch command {
+	case "/tool":
+		a.update(ctx, id, acp.StartToolCall("mock-tool", "Listing files", acp.WithStartKind(acp.ToolKindExecute), acp.WithStartStatus(acp.ToolCallStatusPending)))
+		a.update(ctx, id, acp.UpdateToolCall("mock-tool", acp.WithUpdateStatus(acp.ToolCallStatusInProgress)))
+		a.update(ctx, id, acp.UpdateToolCall("mock-tool",
+			acp.WithUpdateStatus(acp.ToolCallStatusCompleted),
+			acp.WithUpdateContent([]acp.ToolCallContent{acp.ToolContent(acp.TextBlock("mock.txt\nREADME.md\n"))}),
+		))
+		a.say(ctx, id, "Listed the files.")
+	case "/diff":
+		a.update(ctx, id, acp.StartEditToolCall("mock-edit", "Editing mock.txt", "mock.txt", nil,
+			acp.WithStartContent([]acp.ToolCallContent{acp.ToolDiffContent("mock.txt", "hello\nmock world\n", "hello\nworld\n")}),
+		))
+		a.update(ctx, id, acp.UpdateToolCall("mock-edit", acp.WithUpdateStatus(acp.ToolCallStatusCompleted)))
+		a.say(ctx, id, "Proposed an edit of mock.txt.")
+	case "/plan":
+		a.update(ctx, id, acp.UpdatePlan(
+			acp.PlanEntry{Content: "Read the code", Priority: acp.PlanEntryPriorityHigh, Status: acp.PlanEntryStatusCompleted},
+			acp.PlanEntry{Content: "Write the fix", Priority: acp.PlanEntryPriorityMedium, Status: acp.PlanEntryStatusInProgress},
+			acp.PlanEntry{Content: "Run the tests", Priority: acp.PlanEntryPriorityLow, Status: acp.PlanEntryStatusPending},
+		))
+		a.say(ctx, id, "Here is the plan.")
+	case "/permission":
+		res, err := a.conn.RequestPermission(ctx, acp.RequestPermissionRequest{
+			SessionId: id,
+			ToolCall:  acp.RequestPermissionToolCall{ToolCallId: "mock-permission", Title: acp.Ptr("Delete mock.txt"), Kind: acp.Ptr(acp.ToolKindDelete)},
+			Options: []acp.PermissionOption{
+				{OptionId: "allow", Name: "Allow", Kind: acp.PermissionOptionKindAllowOnce},
+				{OptionId: "reject", Name: "Reject", Kind: acp.PermissionOptionKindRejectOnce},
+			},
+		})
+		switch {
+		case err != nil:
+			a.say(ctx, id, fmt.Sprintf("Permission request failed: %v", err))
+		case res.Outcome.Selected != nil:
+			a.say(ctx, id, fmt.Sprintf("You chose %s.", res.Outcome.Selected.OptionId))
+		default:
+			a.say(ctx, id, "The permission request was cancelled.")
+		}
+	case "/read":
+		res, err := a.conn.ReadTextFile(ctx, acp.ReadTextFileRequest{SessionId: id, Path: arg})
+		if err != nil {
+			a.say(ctx, id, fmt.Sprintf("Reading %s failed: %v", arg, err))
+		} else {
+			a.say(ctx, id, fmt.Sprintf("%s has %d bytes.", arg, len(res.Content)))
+		}
+	case "/slow":
+		for i := 1; i <= 50; i++ {
+			select {
+			case <-ctx.Done():
+				return acp.PromptResponse{StopReason: acp.StopReasonCancelled}, nil
+			case <-time.After(200 * time.Millisecond):
+			}
+			a.say(ctx, id, fmt.Sprintf("%d ", i))
+		}
+	case "/stop":
+		a.say(ctx, id, "Stopping here.")
+		return acp.PromptResponse{StopReason: acp.StopReason(arg)}, nil
+	default:
+		a.update(ctx, id, acp.UpdateAgentThoughtText("The user said something, I'll repeat it."))
+		for _, word := range strings.SplitAfter("You said: "+prompt, " ") {
+			a.say(ctx, id, word)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return acp.PromptResponse{StopReason: acp.StopReasonCancelled}, nil
+	}
+	return acp.PromptResponse{StopReason: acp.StopReasonEndTurn}, nil
+}
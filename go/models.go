@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// setModels records the models the agent lets the session pick from, nil
+// when it has none, and passes them on to Lua.
+func (s *AcpSession) setModels(models *acp.SessionModelState) {
+	state := acp.SessionModelState{}
+	if models != nil {
+		state = *models
+	}
+	s.mu.Lock()
+	s.models = state
+	s.mu.Unlock()
+	s.callLua(`require('acp').set_models(...)`, s.bufnr, state)
+}
+
+// checkModel returns an error listing the models of the session if it has
+// no model id.
+func (s *AcpSession) checkModel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.models.AvailableModels) == 0 {
+		return fmt.Errorf("the agent has no models to pick from")
+	}
+	var ids []string
+	for _, model := range s.models.AvailableModels {
+		if string(model.ModelId) == id {
+			return nil
+		}
+		ids = append(ids, string(model.ModelId))
+	}
+	return fmt.Errorf("unknown model %q, the models are: %s", id, strings.Join(ids, ", "))
+}
+
+// AcpListModels returns the models the agent of a session can use, and the
+// current one
+func (m *SessionManager) AcpListModels(bufnr int) (acp.SessionModelState, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return acp.SessionModelState{}, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.models, nil
+}
+
+// AcpSetModel switches the agent of a session to another model, keeping the
+// conversation
+func (m *SessionManager) AcpSetModel(bufnr int, modelId string) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.checkModel(modelId); err != nil {
+		return nil, err
+	}
+
+	defer session.watch(acp.AgentMethodSessionSetModel).done()
+	_, err = session.conn.SetSessionModel(session.ctx, acp.SetSessionModelRequest{
+		SessionId: session.sessionID,
+		ModelId:   acp.ModelId(modelId),
+	})
+	if err != nil {
+		session.metrics.failed()
+		session.reportError(acp.AgentMethodSessionSetModel, err)
+		return nil, err
+	}
+
+	session.mu.Lock()
+	session.models.CurrentModelId = acp.ModelId(modelId)
+	state := session.models
+	session.mu.Unlock()
+	session.callLua(`require('acp').set_models(...)`, session.bufnr, state)
+	session.appendToBuffer(fmt.Sprintf("\n[Model: %s]\n", modelId))
+	return modelId, nil
+}
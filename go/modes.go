@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// setModes records the modes the agent advertised for the session, nil when
+// it has none, and passes them on to Lua. They are ignored when the version
+// of ACP of the agent has no modes.
+func (s *AcpSession) setModes(modes *acp.SessionModeState) {
+	state := acp.SessionModeState{}
+	if modes != nil && s.supports(featureModes) {
+		state = *modes
+	}
+	s.mu.Lock()
+	s.modes = state
+	s.mu.Unlock()
+	s.callLua(`require('acp').set_modes(...)`, s.bufnr, state)
+}
+
+// setCurrentMode records the mode the session switched to.
+func (s *AcpSession) setCurrentMode(id acp.SessionModeId) {
+	s.mu.Lock()
+	s.modes.CurrentModeId = id
+	state := s.modes
+	s.mu.Unlock()
+	s.callLua(`require('acp').set_modes(...)`, s.bufnr, state)
+}
+
+// checkMode returns an error listing the modes of the session if it has no
+// mode id.
+func (s *AcpSession) checkMode(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.supports(featureModes) {
+		return fmt.Errorf("the version of ACP of the agent has no modes")
+	}
+	if len(s.modes.AvailableModes) == 0 {
+		return fmt.Errorf("the agent has no modes")
+	}
+	var ids []string
+	for _, mode := range s.modes.AvailableModes {
+		if string(mode.Id) == id {
+			return nil
+		}
+		ids = append(ids, string(mode.Id))
+	}
+	return fmt.Errorf("unknown mode %q, the modes are: %s", id, strings.Join(ids, ", "))
+}
+
+// AcpListModes returns the modes the agent of a session advertised, and the
+// current one
+func (m *SessionManager) AcpListModes(bufnr int) (acp.SessionModeState, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return acp.SessionModeState{}, err
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.modes, nil
+}
+
+// AcpCycleMode sets the mode of a session to the one step places after the
+// current one in the modes of the agent, wrapping around, and returns it
+func (m *SessionManager) AcpCycleMode(bufnr int, step int) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	session.mu.Lock()
+	modes := session.modes
+	session.mu.Unlock()
+	if len(modes.AvailableModes) == 0 {
+		return nil, fmt.Errorf("the agent has no modes")
+	}
+
+	i := slices.IndexFunc(modes.AvailableModes, func(mode acp.SessionMode) bool {
+		return mode.Id == modes.CurrentModeId
+	})
+	n := len(modes.AvailableModes)
+	if i < 0 {
+		// An unknown current mode is before the first and after the last
+		i = n
+		if step > 0 {
+			i = -1
+		}
+	}
+	next := modes.AvailableModes[((i+step)%n+n)%n]
+	return m.AcpSetMode(bufnr, string(next.Id))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+// toolOutputSpillBytes is the size of the output of a tool call beyond which
+// it is written to a file rather than to the chat buffer.
+const toolOutputSpillBytes = 64 * 1024
+
+// showToolOutput appends the text output of a tool call to the chat buffer.
+// Large outputs, e.g. build logs, would make the buffer slow to scroll and
+// bury the reply, so they are written to a temporary file instead, and only a
+// line telling how to open them is appended.
+func (s *AcpSession) showToolOutput(text string, hint outputHint) {
+	if len(text) <= toolOutputSpillBytes || s.bufnr == 0 {
+		s.appendToBuffer(fencedOutput(text, hint))
+		return
+	}
+
+	path, err := writeTempOutput(text)
+	if err != nil {
+		logError("Error writing tool call output: %v", err)
+		s.appendToBuffer(fencedOutput(text, hint))
+		return
+	}
+	s.mu.Lock()
+	s.outputs = append(s.outputs, path)
+	id := len(s.outputs)
+	s.mu.Unlock()
+	s.appendToBuffer(fmt.Sprintf("\n[Output #%d: %d lines, %s, :AcpOutput %d to open it]\n", id, strings.Count(text, "\n"), formatBytes(len(text)), id))
+}
+
+func writeTempOutput(text string) (string, error) {
+	f, err := os.CreateTemp("", "acp-output-*.txt")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(text)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// removeOutputs deletes the files of the outputs of the session.
+func (s *AcpSession) removeOutputs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, path := range s.outputs {
+		os.Remove(path)
+	}
+	s.outputs = nil
+}
+
+// formatBytes formats a size for people, e.g. "2.5 MiB".
+func formatBytes(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+// AcpLoadOutput loads the tool call output number id of a session, or the
+// last one when id is 0, into outBuf and returns its number
+func (m *SessionManager) AcpLoadOutput(bufnr int, id int, outBuf int) (int, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return 0, err
+	}
+	session.mu.Lock()
+	if id == 0 {
+		id = len(session.outputs)
+	}
+	if id < 1 || id > len(session.outputs) {
+		session.mu.Unlock()
+		return 0, fmt.Errorf("no output #%d", id)
+	}
+	path := session.outputs[id-1]
+	session.mu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if err := vim.api.SetBufferLines(nvim.Buffer(outBuf), 0, -1, false, lines); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// outputHint is what is known of the tool call of an output, to tell the
+// language of the output.
+type outputHint struct {
+	kind acp.ToolKind
+	// path is the first file the tool call touches
+	path string
+}
+
+// withUpdate returns the hint updated by a tool call update.
+func (h outputHint) withUpdate(tu *acp.SessionToolCallUpdate) outputHint {
+	if tu.Kind != nil {
+		h.kind = *tu.Kind
+	}
+	if len(tu.Locations) > 0 {
+		h.path = tu.Locations[0].Path
+	}
+	return h
+}
+
+// setToolHint records the hint of the outputs of a tool call of the turn.
+func (s *AcpSession) setToolHint(id acp.ToolCallId, hint outputHint) {
+	if s.toolHints == nil {
+		s.toolHints = map[acp.ToolCallId]outputHint{}
+	}
+	s.toolHints[id] = hint
+}
+
+// extLangs are the languages of the files read by tool calls, by extension,
+// named as Neovim's filetypes for the code fences to be highlighted.
+var extLangs = map[string]string{
+	".c": "c", ".h": "c", ".cc": "cpp", ".cpp": "cpp", ".hpp": "cpp",
+	".cs": "cs", ".css": "css", ".go": "go", ".html": "html", ".java": "java",
+	".js": "javascript", ".mjs": "javascript", ".jsx": "javascript",
+	".json": "json", ".kt": "kotlin", ".lua": "lua", ".md": "markdown",
+	".nix": "nix", ".php": "php", ".py": "python", ".rb": "ruby", ".rs": "rust",
+	".sh": "sh", ".bash": "sh", ".sql": "sql", ".swift": "swift", ".toml": "toml",
+	".ts": "typescript", ".tsx": "typescriptreact", ".vim": "vim",
+	".xml": "xml", ".yaml": "yaml", ".yml": "yaml", ".zig": "zig",
+}
+
+// nameLangs are the languages of files by name, for those without extension.
+var nameLangs = map[string]string{
+	"Makefile": "make", "Dockerfile": "dockerfile", "go.mod": "gomod",
+}
+
+// shebangLangs are the languages of scripts by interpreter.
+var shebangLangs = map[string]string{
+	"sh": "sh", "bash": "sh", "zsh": "zsh", "python": "python", "python3": "python",
+	"node": "javascript", "ruby": "ruby", "perl": "perl", "lua": "lua",
+}
+
+// outputLang returns the language of the output of a tool call, from its
+// content or else from the file the tool call read, "" when it is unknown.
+func outputLang(text string, hint outputHint) string {
+	t := strings.TrimSpace(text)
+	switch {
+	case t == "":
+		return ""
+	case (t[0] == '{' || t[0] == '[') && json.Valid([]byte(t)):
+		return "json"
+	case isDiff(t):
+		return "diff"
+	case strings.HasPrefix(t, "#!"):
+		if lang := shebangLangs[interpreter(t)]; lang != "" {
+			return lang
+		}
+	case hasPrefixFold(t, "<!doctype html") || hasPrefixFold(t, "<html"):
+		return "html"
+	}
+
+	// The output of the other kinds, e.g. commands, isn't the file's
+	if hint.path == "" || (hint.kind != acp.ToolKindRead && hint.kind != acp.ToolKindEdit) {
+		return ""
+	}
+	if lang, ok := nameLangs[filepath.Base(hint.path)]; ok {
+		return lang
+	}
+	return extLangs[strings.ToLower(filepath.Ext(hint.path))]
+}
+
+// interpreter returns the name of the interpreter of the shebang line of a
+// script, e.g. "python" for "#!/usr/bin/env python".
+func interpreter(script string) string {
+	line, _, _ := strings.Cut(strings.TrimPrefix(script, "#!"), "\n")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	name := filepath.Base(fields[0])
+	if name == "env" {
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				return filepath.Base(f)
+			}
+		}
+		return ""
+	}
+	return name
+}
+
+// isDiff reports whether text looks like a unified diff.
+func isDiff(text string) bool {
+	if strings.HasPrefix(text, "diff --git ") {
+		return true
+	}
+	return strings.HasPrefix(text, "--- ") && strings.Contains(text, "\n+++ ") && strings.Contains(text, "\n@@ ")
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// fenceOf returns a code fence for text, longer than the runs of backticks
+// starting its lines so that they can't close it.
+func fenceOf(text string) string {
+	n := 3
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimLeft(line, " ")
+		run := len(line) - len(strings.TrimLeft(line, "`"))
+		if run >= n {
+			n = run + 1
+		}
+	}
+	return strings.Repeat("`", n)
+}
+
+// fencedOutput returns the output of a tool call in a code fence tagged with
+// its language, for it to be highlighted, or as is when its language is
+// unknown or it already is a code block.
+func fencedOutput(text string, hint outputHint) string {
+	lang := outputLang(text, hint)
+	if lang == "" || fenceLine.MatchString(strings.TrimLeft(text, "\n")) {
+		return text
+	}
+	fence := fenceOf(text)
+	return "\n" + fence + lang + "\n" + strings.TrimSuffix(text, "\n") + "\n" + fence + "\n"
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+func TestOutputLang(t *testing.T) {
+	read := func(path string) outputHint { return outputHint{kind: acp.ToolKindRead, path: path} }
+	tests := []struct {
+		name string
+		text string
+		hint outputHint
+		want string
+	}{
+		{name: "empty", text: " \n", hint: read("/a.go"), want: ""},
+		{name: "JSON object", text: `{"a": 1}`, want: "json"},
+		{name: "JSON array", text: "\n[1, 2]\n", want: "json"},
+		{name: "not JSON", text: "[INFO] done", want: ""},
+		{name: "git diff", text: "diff --git a/x b/x\n", want: "diff"},
+		{name: "unified diff", text: "--- a\n+++ b\n@@ -1 +1 @@\n-x\n+y\n", want: "diff"},
+		{name: "env shebang", text: "#!/usr/bin/env -S python3 -u\nprint()\n", want: "python"},
+		{name: "shebang", text: "#!/bin/bash\necho\n", want: "sh"},
+		{name: "unknown shebang", text: "#!/usr/bin/awk -f\n", hint: read("/a.awk"), want: ""},
+		{name: "HTML", text: "<!DOCTYPE html><html></html>", want: "html"},
+		{name: "file read", text: "package main\n", hint: read("/src/main.go"), want: "go"},
+		{name: "extension case", text: "x", hint: read("/a.PY"), want: "python"},
+		{name: "file by name", text: "all:\n", hint: read("/src/Makefile"), want: "make"},
+		{name: "file edited", text: "x = 1", hint: outputHint{kind: acp.ToolKindEdit, path: "/a.lua"}, want: "lua"},
+		{name: "command output", text: "ok", hint: outputHint{kind: acp.ToolKindExecute, path: "/a.go"}, want: ""},
+		{name: "unknown extension", text: "x", hint: read("/a.unknown"), want: ""},
+		{name: "UTF-8", text: "é", hint: read("/é.md"), want: "markdown"},
+	}
+	for _, tt := range tests {
+		if got := outputLang(tt.text, tt.hint); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFencedOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		hint outputHint
+		want string
+	}{
+		{name: "unknown language", text: "plain\n", want: "plain\n"},
+		{name: "fenced", text: `{"a": 1}` + "\n", want: "\n```json\n{\"a\": 1}\n```\n"},
+		{name: "without newline", text: `[1]`, want: "\n```json\n[1]\n```\n"},
+		{name: "already a code block", text: "```go\nx\n```\n", hint: outputHint{kind: acp.ToolKindRead, path: "/a.go"}, want: "```go\nx\n```\n"},
+		{name: "backticks inside", text: "x\n````\n", hint: outputHint{kind: acp.ToolKindRead, path: "/a.md"}, want: "\n`````markdown\nx\n````\n`````\n"},
+		{name: "CRLF", text: "[1]\r\n", want: "\n```json\n[1]\r\n```\n"},
+	}
+	for _, tt := range tests {
+		if got := fencedOutput(tt.text, tt.hint); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// hasDrive reports whether the path p starts with a Windows drive letter,
+// like C:/Users.
+func hasDrive(p string) bool {
+	return len(p) >= 2 && p[1] == ':' && driveLetter(p[0])
+}
+
+// driveLetter reports whether c may be the letter of a Windows drive.
+func driveLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// localPath normalizes a path sent by the agent to the form of the paths of
+// this system. On Windows slashes become backslashes, and the slash before a
+// drive letter left by a file URI, as in /C:/Users, is dropped.
+func localPath(p string) string {
+	if p == "" || filepath.Separator == '/' {
+		return p
+	}
+	if strings.HasPrefix(p, "/") && hasDrive(p[1:]) {
+		p = p[1:]
+	}
+	return filepath.Clean(filepath.FromSlash(p))
+}
+
+// fileURI returns the file:// URI of path, with a #L<start>:<end> fragment
+// when a line range is given. Drive letters go in the path, as in
+// file:///C:/Users, and the server of UNC paths in the host, as in
+// file://server/share.
+func fileURI(path string, start, end *int) string {
+	p := filepath.ToSlash(path)
+	if hasDrive(path) || strings.HasPrefix(path, `\\`) {
+		// A Windows path of an agent running on Windows
+		p = strings.ReplaceAll(path, `\`, "/")
+	}
+	u := url.URL{Scheme: "file", Path: p}
+	switch {
+	case strings.HasPrefix(p, "//"):
+		host, rest, _ := strings.Cut(p[2:], "/")
+		u.Host, u.Path = host, "/"+rest
+	case hasDrive(p):
+		u.Path = "/" + p
+	}
+	if start != nil {
+		if end != nil {
+			u.Fragment = fmt.Sprintf("L%d:%d", *start, *end)
+		} else {
+			u.Fragment = fmt.Sprintf("L%d", *start)
+		}
+	}
+	return u.String()
+}
+
+// uriPath returns the path of a file:// URI, the reverse of fileURI.
+func uriPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	switch {
+	case u.Host != "" && u.Host != "localhost":
+		return "//" + u.Host + u.Path, true
+	case strings.HasPrefix(u.Path, "/") && hasDrive(u.Path[1:]):
+		return u.Path[1:], true
+	}
+	return u.Path, true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"time"
+)
+
+// servePprof serves the profiles of net/http/pprof on addr, which must be a
+// loopback address since the profiles reveal what the host is working on.
+func servePprof(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("pprof address %s is not a loopback address", addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logInfo("Serving pprof on http://%s/debug/pprof/", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, nil); err != nil {
+			logError("pprof server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// dumpProfiles writes the heap and goroutine profiles to files in the
+// temporary directory and returns their paths.
+func dumpProfiles() ([]string, error) {
+	stamp := time.Now().Format("20060102-150405")
+	var paths []string
+	for _, name := range []string{"heap", "goroutine"} {
+		path := filepath.Join(os.TempDir(), fmt.Sprintf("acp-nvim-%d-%s-%s.pprof", os.Getpid(), stamp, name))
+		f, err := os.Create(path)
+		if err != nil {
+			return paths, err
+		}
+		err = pprof.Lookup(name).WriteTo(f, 0)
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// dumpProfilesOnSignal does nothing where there is no SIGUSR1, use -pprof
+// instead.
+func dumpProfilesOnSignal() {}
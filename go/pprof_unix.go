@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// dumpProfilesOnSignal writes the heap and goroutine profiles each time the
+// host receives SIGUSR1, e.g. from `pkill -USR1 acp-nvim`.
+func dumpProfilesOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			paths, err := dumpProfiles()
+			if err != nil {
+				logError("Error writing profiles: %v", err)
+				continue
+			}
+			logWarn("Wrote profiles to %s", strings.Join(paths, ", "))
+		}
+	}()
+}
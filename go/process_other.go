@@ -0,0 +1,21 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup does nothing, the processes started by the process of cmd
+// can't be killed with it.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcess kills the process p.
+func killProcess(p *os.Process) error { return p.Kill() }
+
+// commandArgs returns the arguments that run the command args.
+func commandArgs(args []string) []string { return args }
+
+// shellArgs returns the arguments that run script with the shell.
+func shellArgs(script string) []string { return []string{"sh", "-c", script} }
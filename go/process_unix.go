@@ -0,0 +1,30 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes the process of cmd the leader of a new process group,
+// which the processes it starts join, so that they are killed with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcess kills the process p and its process group, e.g. node started
+// by npx and the MCP servers started by the agent.
+func killProcess(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGKILL); err != nil {
+		return p.Kill()
+	}
+	return nil
+}
+
+// commandArgs returns the arguments that run the command args.
+func commandArgs(args []string) []string { return args }
+
+// shellArgs returns the arguments that run script with the shell.
+func shellArgs(script string) []string { return []string{"sh", "-c", script} }
@@ -0,0 +1,41 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// setProcessGroup does nothing, killProcess finds the processes started by
+// the process of cmd from their parent.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcess kills the process p and the processes it started, which
+// Process.Kill leaves running, e.g. node started by the npx.cmd shim.
+func killProcess(p *os.Process) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.Pid)).Run(); err != nil {
+		return p.Kill()
+	}
+	return nil
+}
+
+// commandArgs returns the arguments that run the command args. Batch files,
+// like the npx.cmd and npm.cmd shims of npm, are run by cmd.exe.
+func commandArgs(args []string) []string {
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return args
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".cmd", ".bat":
+		return append([]string{"cmd.exe", "/d", "/c", path}, args[1:]...)
+	}
+	return args
+}
+
+// shellArgs returns the arguments that run script with the shell.
+func shellArgs(script string) []string { return []string{"cmd.exe", "/d", "/c", script} }
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"acp/go/internal/acpfs"
+	"github.com/coder/acp-go-sdk"
+)
+
+// AcpPromptOpts carries the attachments sent along with a prompt.
+type AcpPromptOpts struct {
+	// Parts are content blocks sent in the given order, right after the
+	// prompt text and before the other attachments.
+	Parts []PromptPart `json:"parts" msgpack:"parts"`
+	// Images are paths of image files to attach.
+	Images []string `json:"images" msgpack:"images"`
+	// Audio are paths of audio files to attach.
+	Audio []string `json:"audio" msgpack:"audio"`
+	// Files are files mentioned in the prompt.
+	Files []FileMention `json:"files" msgpack:"files"`
+	// Selection is code selected in an editor buffer.
+	Selection *Selection `json:"selection,omitempty" msgpack:"selection,omitempty"`
+	// Diagnostics are editor diagnostics to send as context.
+	Diagnostics []Diagnostic `json:"diagnostics" msgpack:"diagnostics"`
+	// GitDiff attaches the output of git diff in the session directory.
+	GitDiff *GitDiffOpts `json:"git_diff,omitempty" msgpack:"git_diff,omitempty"`
+}
+
+// PromptPart is one block of a prompt composed of several blocks. Type
+// selects which of the other fields is used: "text", "file", "image",
+// "audio", "selection", "diagnostics" or "git_diff".
+type PromptPart struct {
+	Type        string       `json:"type" msgpack:"type"`
+	Text        string       `json:"text,omitempty" msgpack:"text,omitempty"`
+	File        *FileMention `json:"file,omitempty" msgpack:"file,omitempty"`
+	Image       string       `json:"image,omitempty" msgpack:"image,omitempty"`
+	Audio       string       `json:"audio,omitempty" msgpack:"audio,omitempty"`
+	Selection   *Selection   `json:"selection,omitempty" msgpack:"selection,omitempty"`
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty" msgpack:"diagnostics,omitempty"`
+	GitDiff     *GitDiffOpts `json:"git_diff,omitempty" msgpack:"git_diff,omitempty"`
+}
+
+// Diagnostic is an entry of vim.diagnostic with a 1-based position.
+type Diagnostic struct {
+	Path     string `json:"path" msgpack:"path"`
+	Line     int    `json:"line" msgpack:"line"`
+	Col      int    `json:"col" msgpack:"col"`
+	EndLine  int    `json:"end_line" msgpack:"end_line"`
+	EndCol   int    `json:"end_col" msgpack:"end_col"`
+	Severity string `json:"severity" msgpack:"severity"`
+	Message  string `json:"message" msgpack:"message"`
+	Source   string `json:"source" msgpack:"source"`
+	Code     string `json:"code" msgpack:"code"`
+}
+
+// Selection is a range of lines selected in a buffer. Text is sent as is
+// rather than read back from the file, since the buffer may be unsaved.
+type Selection struct {
+	Path     string `json:"path" msgpack:"path"`
+	Start    int    `json:"start" msgpack:"start"`
+	End      int    `json:"end" msgpack:"end"`
+	Text     string `json:"text" msgpack:"text"`
+	Filetype string `json:"filetype" msgpack:"filetype"`
+}
+
+// FileMention refers to a file, or a range of its lines, from a prompt.
+type FileMention struct {
+	Path string `json:"path" msgpack:"path"`
+	// Start and End are the 1-based, inclusive line range. Both are optional.
+	Start *int `json:"start,omitempty" msgpack:"start,omitempty"`
+	End   *int `json:"end,omitempty" msgpack:"end,omitempty"`
+}
+
+// buildPrompt assembles the content blocks of a prompt: the text followed by
+// the attachments given in opts and those queued on the session. Queued
+// attachments are consumed.
+func (s *AcpSession) buildPrompt(text string, opts AcpPromptOpts) ([]acp.ContentBlock, error) {
+	text, err := s.slashCommand(text)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []acp.ContentBlock{}
+	if text != "" {
+		blocks = append(blocks, acp.TextBlock(text))
+	}
+
+	attachments, err := s.buildAttachments(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	attachments = append(attachments, s.attachments...)
+	s.attachments = nil
+	s.mu.Unlock()
+
+	attachments, warnings := s.applyLimits(attachments)
+	for _, w := range warnings {
+		s.appendToBuffer(fmt.Sprintf("[Warning: %s]\n", w))
+	}
+	blocks = append(blocks, attachments...)
+
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("no prompt provided")
+	}
+	blocks, err = s.promptMiddleware(text, blocks)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(s.takeInstructions(), s.takeSeed()...), blocks...), nil
+}
+
+// buildAttachments converts the attachments described by opts into content
+// blocks.
+func (s *AcpSession) buildAttachments(opts AcpPromptOpts) ([]acp.ContentBlock, error) {
+	blocks := []acp.ContentBlock{}
+
+	for i, part := range opts.Parts {
+		block, err := s.partBlock(part)
+		if err != nil {
+			return nil, fmt.Errorf("prompt part %d: %w", i+1, err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	if opts.Selection != nil {
+		blocks = append(blocks, s.selectionBlock(*opts.Selection))
+	}
+
+	if len(opts.Diagnostics) > 0 {
+		blocks = append(blocks, diagnosticsBlock(opts.Diagnostics))
+	}
+
+	if opts.GitDiff != nil {
+		block, err := s.gitDiffBlock(*opts.GitDiff)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	for _, file := range opts.Files {
+		block, err := s.fileBlock(file)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	for _, path := range opts.Images {
+		block, err := s.imageBlock(path)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	for _, path := range opts.Audio {
+		block, err := s.audioBlock(path)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+// partBlock converts one part of a composed prompt into a content block.
+func (s *AcpSession) partBlock(part PromptPart) (acp.ContentBlock, error) {
+	switch part.Type {
+	case "text":
+		return acp.TextBlock(part.Text), nil
+	case "file":
+		if part.File == nil {
+			return acp.ContentBlock{}, fmt.Errorf("file part without a file")
+		}
+		return s.fileBlock(*part.File)
+	case "image":
+		return s.imageBlock(part.Image)
+	case "audio":
+		return s.audioBlock(part.Audio)
+	case "selection":
+		if part.Selection == nil {
+			return acp.ContentBlock{}, fmt.Errorf("selection part without a selection")
+		}
+		return s.selectionBlock(*part.Selection), nil
+	case "diagnostics":
+		return diagnosticsBlock(part.Diagnostics), nil
+	case "git_diff":
+		if part.GitDiff == nil {
+			return s.gitDiffBlock(GitDiffOpts{})
+		}
+		return s.gitDiffBlock(*part.GitDiff)
+	default:
+		return acp.ContentBlock{}, fmt.Errorf("unknown part type %q", part.Type)
+	}
+}
+
+// attach queues a content block to be sent with the next prompt.
+func (s *AcpSession) attach(block acp.ContentBlock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attachments = append(s.attachments, block)
+}
+
+// imageBlock reads the image at path into an image content block.
+func (s *AcpSession) imageBlock(path string) (acp.ContentBlock, error) {
+	if !s.agentInfo.AgentCapabilities.PromptCapabilities.Image {
+		return acp.ContentBlock{}, fmt.Errorf("agent does not support image prompts")
+	}
+	data, mimeType, err := readMedia(path, "image")
+	if err != nil {
+		return acp.ContentBlock{}, err
+	}
+	return acp.ImageBlock(data, mimeType), nil
+}
+
+// audioBlock reads the audio file at path into an audio content block.
+func (s *AcpSession) audioBlock(path string) (acp.ContentBlock, error) {
+	if !s.agentInfo.AgentCapabilities.PromptCapabilities.Audio {
+		return acp.ContentBlock{}, fmt.Errorf("agent does not support audio prompts")
+	}
+	data, mimeType, err := readMedia(path, "audio")
+	if err != nil {
+		return acp.ContentBlock{}, err
+	}
+	return acp.AudioBlock(data, mimeType), nil
+}
+
+// readMedia reads the file at path and returns its content base64-encoded,
+// along with its MIME type, which must be of the given top-level kind.
+func readMedia(path string, kind string) (data string, mimeType string, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("read %s %s: %w", kind, path, err)
+	}
+	mimeType = mime.TypeByExtension(filepath.Ext(path))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(b)
+	}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	if !strings.HasPrefix(mimeType, kind+"/") {
+		return "", "", fmt.Errorf("%s is not an %s file (%s)", path, kind, mimeType)
+	}
+	return base64.StdEncoding.EncodeToString(b), mimeType, nil
+}
+
+// fileBlock turns a file mention into a content block. The file content is
+// embedded when the agent supports embedded context, otherwise only a link to
+// the file is sent.
+func (s *AcpSession) fileBlock(file FileMention) (acp.ContentBlock, error) {
+	if err := acpfs.CheckPath(file.Path); err != nil {
+		return acp.ContentBlock{}, err
+	}
+	uri := fileURI(s.paths.toRemote(file.Path), file.Start, file.End)
+	if !s.agentInfo.AgentCapabilities.PromptCapabilities.EmbeddedContext {
+		return acp.ResourceLinkBlock(filepath.Base(file.Path), uri), nil
+	}
+
+	var limit *int
+	if file.Start != nil && file.End != nil {
+		limit = acp.Ptr(max(*file.End-*file.Start+1, 0))
+	}
+	res, err := s.files.ReadTextFile(file.Path, file.Start, limit)
+	if err != nil {
+		return acp.ContentBlock{}, err
+	}
+	return acp.ResourceBlock(acp.EmbeddedResourceResource{
+		TextResourceContents: &acp.TextResourceContents{Uri: uri, Text: res.Content},
+	}), nil
+}
+
+// selectionBlock turns a selection into an embedded resource, or into a
+// fenced code block when the agent doesn't support embedded context.
+func (s *AcpSession) selectionBlock(sel Selection) acp.ContentBlock {
+	if s.agentInfo.AgentCapabilities.PromptCapabilities.EmbeddedContext && sel.Path != "" {
+		return acp.ResourceBlock(acp.EmbeddedResourceResource{
+			TextResourceContents: &acp.TextResourceContents{
+				Uri:  fileURI(s.paths.toRemote(sel.Path), &sel.Start, &sel.End),
+				Text: sel.Text,
+			},
+		})
+	}
+	name := sel.Path
+	if name == "" {
+		name = "[No Name]"
+	}
+	return acp.TextBlock(fmt.Sprintf("%s, lines %d-%d:\n```%s\n%s\n```", name, sel.Start, sel.End, sel.Filetype, sel.Text))
+}
+
+// diagnosticsBlock renders diagnostics as one line each, in the
+// path:line:col format compilers use.
+func diagnosticsBlock(diags []Diagnostic) acp.ContentBlock {
+	var b strings.Builder
+	b.WriteString("Diagnostics:\n")
+	for _, d := range diags {
+		fmt.Fprintf(&b, "%s:%d:%d: %s: %s", d.Path, d.Line, d.Col, strings.ToLower(d.Severity), d.Message)
+		if d.Source != "" || d.Code != "" {
+			b.WriteString(" [")
+			b.WriteString(strings.TrimSpace(d.Source + " " + d.Code))
+			b.WriteString("]")
+		}
+		b.WriteString("\n")
+	}
+	return acp.TextBlock(b.String())
+}
+
+// AcpSendPromptWithSelection sends a prompt together with code selected in
+// an editor buffer
+func (m *SessionManager) AcpSendPromptWithSelection(bufnr int, prompt string, sel Selection) (any, error) {
+	return m.AcpSendPrompt(bufnr, prompt, AcpPromptOpts{Selection: &sel})
+}
+
+// AcpAttach queues the attachments described by opts to be sent with the
+// next prompt
+func (m *SessionManager) AcpAttach(bufnr int, opts AcpPromptOpts) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := session.buildAttachments(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range blocks {
+		session.attach(block)
+	}
+	session.appendToBuffer(fmt.Sprintf("[Attached %d item(s)]\n", len(blocks)))
+	return nil, nil
+}
+
+// AcpAttachImage queues an image file to be sent with the next prompt
+func (m *SessionManager) AcpAttachImage(bufnr int, path string) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	block, err := session.imageBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	session.attach(block)
+	session.appendToBuffer(fmt.Sprintf("[Attached image %s]\n", path))
+	return nil, nil
+}
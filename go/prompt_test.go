@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/coder/acp-go-sdk"
+
+	"acp/go/internal/acpfs"
+)
+
+// startMockSession starts a session without a chat buffer with the mock
+// agent, printing the chat to chat.
+func startMockSession(t *testing.T, chat *strings.Builder) *AcpSession {
+	t.Helper()
+	t.Setenv("ACP_TEST_MOCK_AGENT", "1")
+	// Keep the MCP servers of the user out of the session
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("APPDATA", home)
+	s, _, err := startSession(0, []string{os.Args[0]}, AcpNewSessionOpts{}, &acpfs.FS{Buffers: noBuffers{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.cleanup)
+	s.print = chat
+	return s
+}
+
+// writeScreenshot writes a full HD PNG of flat panels and a noisy picture,
+// of the size of a screenshot, and returns its size.
+func writeScreenshot(t *testing.T, path string) int {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 1920, 1080))
+	r := rand.New(rand.NewSource(1))
+	for y := 0; y < 1080; y++ {
+		for x := 0; x < 1920; x++ {
+			c := color.RGBA{R: 30, G: 30, B: 46, A: 255}
+			if x >= 400 && x < 1000 && y >= 200 && y < 800 {
+				c = color.RGBA{R: uint8(r.Intn(256)), G: uint8(r.Intn(256)), B: uint8(r.Intn(256)), A: 255}
+			} else if y < 40 {
+				c = color.RGBA{R: 69, G: 71, B: 90, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(info.Size())
+}
+
+func TestBuildPromptSendsScreenshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "screenshot.png")
+	size := writeScreenshot(t, path)
+	if size < 1<<20 {
+		t.Fatalf("the screenshot is only %d bytes", size)
+	}
+
+	var chat strings.Builder
+	s := startMockSession(t, &chat)
+	blocks, err := s.buildPrompt("what is on screen?", AcpPromptOpts{Images: []string{path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.prompt(blocks); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("<image image/png, %d bytes>", size); !strings.Contains(chat.String(), want) {
+		t.Errorf("the agent didn't get the screenshot, want %q in the chat:\n%s", want, chat.String())
+	}
+}
+
+// loadedBuffer is an acpfs.Buffers with a single file loaded, as buffer 1.
+type loadedBuffer struct {
+	path  string
+	lines []string
+}
+
+func (b *loadedBuffer) Find(path string) (int, bool, error) { return 1, path == b.path, nil }
+func (b *loadedBuffer) LineCount(buf int) (int, error)      { return len(b.lines), nil }
+func (b *loadedBuffer) Lines(buf int, start, end int) ([]string, error) {
+	if end < 0 {
+		end = len(b.lines)
+	}
+	return slices.Clone(b.lines[start:end]), nil
+}
+func (b *loadedBuffer) EndsWithNewline(buf int) (bool, error) { return true, nil }
+func (b *loadedBuffer) SetLines(buf int, lines []string) error {
+	b.lines = slices.Clone(lines)
+	return nil
+}
+
+// embeddingSession returns a session reading files with f, for an agent
+// that takes embedded context.
+func embeddingSession(f *acpfs.FS) *AcpSession {
+	s := &AcpSession{files: f}
+	s.agentInfo.AgentCapabilities.PromptCapabilities.EmbeddedContext = true
+	return s
+}
+
+func TestFileBlockReadsWithSessionFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(path, []byte("saved\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	editor := embeddingSession(&acpfs.FS{Buffers: &loadedBuffer{path: path, lines: []string{"unsaved", "second"}}})
+	cli := embeddingSession(&acpfs.FS{Buffers: noBuffers{}})
+
+	tests := []struct {
+		name    string
+		session *AcpSession
+		file    FileMention
+		want    string
+	}{
+		{name: "buffer", session: editor, file: FileMention{Path: path}, want: "unsaved\nsecond\n"},
+		{name: "buffer range", session: editor, file: FileMention{Path: path, Start: acp.Ptr(2), End: acp.Ptr(2)}, want: "second\n"},
+		{name: "disk", session: cli, file: FileMention{Path: path}, want: "saved\n"},
+	}
+	for _, tt := range tests {
+		block, err := tt.session.fileBlock(tt.file)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got, _ := blockText(block); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSymbolBlockReadsWithSessionFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.go")
+	s := embeddingSession(&acpfs.FS{Buffers: &loadedBuffer{path: path, lines: []string{"package a", "", "func f() {}"}}})
+	block := s.symbolBlock(SymbolInfo{Path: path, Symbol: "f", Definitions: []SymbolLocation{{Path: path, Line: 3}}})
+	if text, _ := blockText(block); !strings.Contains(text, "```\nfunc f() {}\n```") {
+		t.Errorf("the definition wasn't read from the buffer: %q", text)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// oldestProtocolVersion is the oldest version of ACP the client falls back
+// to for agents that don't speak the version of the SDK.
+const oldestProtocolVersion acp.ProtocolVersion = 0
+
+// Features of the client that not every version of ACP has.
+const (
+	featureTerminals = "terminals"
+	featureModes     = "session modes"
+	featureMeta      = "extension metadata"
+)
+
+// featureVersions are the versions of ACP the features came with.
+var featureVersions = []struct {
+	feature string
+	version acp.ProtocolVersion
+}{
+	{featureTerminals, 1},
+	{featureModes, 1},
+	{featureMeta, 1},
+}
+
+// missingFeatures returns the features of the client that version of ACP
+// lacks.
+func missingFeatures(version acp.ProtocolVersion) []string {
+	var missing []string
+	for _, f := range featureVersions {
+		if version < f.version {
+			missing = append(missing, f.feature)
+		}
+	}
+	return missing
+}
+
+// supports reports whether the version of ACP the session speaks has
+// feature.
+func (s *AcpSession) supports(feature string) bool {
+	return !slices.Contains(s.disabled, feature)
+}
+
+// Capabilities are the capabilities the client advertises to the agent of a
+// session. Unset ones have their default: files may be read and written,
+// while terminals, which the client doesn't run yet, aren't offered.
+type Capabilities struct {
+	ReadTextFile  *bool `json:"read_text_file" msgpack:"read_text_file"`
+	WriteTextFile *bool `json:"write_text_file" msgpack:"write_text_file"`
+	Terminal      *bool `json:"terminal" msgpack:"terminal"`
+}
+
+// clientCaps are the capabilities of a session, with the defaults applied.
+type clientCaps struct {
+	read, write, terminal bool
+}
+
+func (c Capabilities) resolve() clientCaps {
+	or := func(b *bool, def bool) bool {
+		if b == nil {
+			return def
+		}
+		return *b
+	}
+	return clientCaps{
+		read:     or(c.ReadTextFile, true),
+		write:    or(c.WriteTextFile, true),
+		terminal: or(c.Terminal, false),
+	}
+}
+
+// clientCapabilities returns the capabilities the session advertises to an
+// agent in version of ACP. The file management extension methods go with
+// writing files.
+func (s *AcpSession) clientCapabilities(version acp.ProtocolVersion) acp.ClientCapabilities {
+	caps := acp.ClientCapabilities{
+		Fs: acp.FileSystemCapability{ReadTextFile: s.caps.read, WriteTextFile: s.caps.write},
+	}
+	missing := missingFeatures(version)
+	if s.caps.terminal && !slices.Contains(missing, featureTerminals) {
+		caps.Terminal = true
+	}
+	if s.caps.write && !slices.Contains(missing, featureMeta) {
+		caps.Meta = map[string]any{"acp.nvim": extFsCapabilities}
+	}
+	return caps
+}
+
+// initialize initializes the connection in the version of ACP of the SDK
+// or, when the agent rejects it or answers with an older one, in the older
+// version. The features of the client missing from the version the agent
+// speaks are disabled.
+func (s *AcpSession) initialize() (acp.InitializeResponse, error) {
+	var firstErr error
+	for version := acp.ProtocolVersion(acp.ProtocolVersionNumber); version >= oldestProtocolVersion; version-- {
+		res, err := s.conn.Initialize(s.ctx, acp.InitializeRequest{
+			ProtocolVersion:    version,
+			ClientCapabilities: s.clientCapabilities(version),
+			ClientInfo: &acp.Implementation{
+				Name:    "brianhuster/acp.nvim",
+				Title:   starString("ACP client plugin for Neovim"),
+				Version: clientVersion,
+			},
+		})
+		if err == nil {
+			if res.ProtocolVersion < oldestProtocolVersion {
+				return res, fmt.Errorf("the agent speaks ACP version %d, older than version %d, the oldest this client speaks", res.ProtocolVersion, oldestProtocolVersion)
+			}
+			s.disabled = missingFeatures(min(res.ProtocolVersion, version))
+			return res, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		// Only an answer of the agent may be about the version, the
+		// connection is lost otherwise
+		var re *acp.RequestError
+		if !errors.As(err, &re) || s.ctx.Err() != nil {
+			break
+		}
+		logWarn("The agent rejected ACP version %d: %v", version, err)
+	}
+	return acp.InitializeResponse{}, firstErr
+}
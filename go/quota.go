@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// WriteLimits caps what an agent may write during a single turn without
+// asking. Zero means unlimited.
+type WriteLimits struct {
+	MaxFiles int `json:"max_files" msgpack:"max_files"`
+	MaxBytes int `json:"max_bytes" msgpack:"max_bytes"`
+}
+
+// writeQuota tracks the files and bytes written during the current turn.
+type writeQuota struct {
+	mu     sync.Mutex
+	limits WriteLimits
+	files  map[string]struct{}
+	bytes  int
+}
+
+// reset starts accounting for a new turn.
+func (q *writeQuota) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.files = nil
+	q.bytes = 0
+}
+
+// exceeded reports why writing n bytes to path would go over the limits, or
+// "" if it would not.
+func (q *writeQuota) exceeded(path string, n int) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, seen := q.files[path]
+	if q.limits.MaxFiles > 0 && !seen && len(q.files)+1 > q.limits.MaxFiles {
+		return fmt.Sprintf("%d files already written this turn", len(q.files))
+	}
+	if q.limits.MaxBytes > 0 && q.bytes+n > q.limits.MaxBytes {
+		return fmt.Sprintf("%d bytes already written this turn", q.bytes)
+	}
+	return ""
+}
+
+// record accounts for n bytes written to path.
+func (q *writeQuota) record(path string, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.files == nil {
+		q.files = make(map[string]struct{})
+	}
+	q.files[path] = struct{}{}
+	q.bytes += n
+}
+
+// checkWrite asks the user to confirm a write that goes over the session's
+// limits, unless auto-approve is enabled. The write is only recorded once it
+// is done, see writeQuota.record.
+func (s *AcpSession) checkWrite(path string, n int) error {
+	if reason := s.quota.exceeded(path, n); reason != "" {
+		if !s.confirm(fmt.Sprintf("Write limit reached (%s): write %d bytes to %s", reason, n, path)) {
+			return errPermissionDenied
+		}
+	}
+	return nil
+}
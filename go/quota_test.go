@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/coder/acp-go-sdk"
+
+	"acp/go/internal/acpfs"
+)
+
+func TestWriteQuota(t *testing.T) {
+	type write struct {
+		path string
+		n    int
+		// exceeded is whether the write goes over the limits
+		exceeded bool
+	}
+	tests := []struct {
+		name   string
+		limits WriteLimits
+		writes []write
+	}{
+		{name: "unlimited", writes: []write{{"/a", 1 << 30, false}, {"/b", 1 << 30, false}}},
+		{name: "files", limits: WriteLimits{MaxFiles: 2}, writes: []write{{"/a", 1, false}, {"/b", 1, false}, {"/c", 1, true}}},
+		{name: "same file again", limits: WriteLimits{MaxFiles: 1}, writes: []write{{"/a", 1, false}, {"/a", 1, false}, {"/b", 1, true}}},
+		{name: "bytes", limits: WriteLimits{MaxBytes: 10}, writes: []write{{"/a", 6, false}, {"/b", 4, false}, {"/a", 1, true}}},
+		{name: "single write over the bytes", limits: WriteLimits{MaxBytes: 10}, writes: []write{{"/a", 11, true}}},
+		{name: "empty writes", limits: WriteLimits{MaxBytes: 1}, writes: []write{{"/a", 0, false}, {"/a", 1, false}, {"/a", 0, false}}},
+	}
+	for _, tt := range tests {
+		q := &writeQuota{limits: tt.limits}
+		for i, w := range tt.writes {
+			if reason := q.exceeded(w.path, w.n); (reason != "") != w.exceeded {
+				t.Errorf("%s: write %d: got %q, want exceeded %v", tt.name, i, reason, w.exceeded)
+			}
+			q.record(w.path, w.n)
+		}
+		q.reset()
+		if w := tt.writes[len(tt.writes)-1]; q.exceeded(w.path, 0) != "" {
+			t.Errorf("%s: limits still reached after reset", tt.name)
+		}
+	}
+}
+
+func TestWriteTextFileQuota(t *testing.T) {
+	dir := t.TempDir()
+	s := &AcpSession{
+		files:       &acpfs.FS{Buffers: noBuffers{}},
+		autoApprove: true,
+		caps:        clientCaps{write: true},
+		fsSlots:     newSemaphore(1),
+	}
+	s.quota.limits = WriteLimits{MaxFiles: 1}
+	c := &acpClientImpl{session: s}
+	ctx := context.Background()
+
+	// Over the limits, auto-approve allows the write without asking
+	for _, name := range []string{"a.txt", "b.txt"} {
+		path := filepath.Join(dir, name)
+		if _, err := c.WriteTextFile(ctx, acp.WriteTextFileRequest{Path: path, Content: "abc"}); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	if len(s.quota.files) != 2 || s.quota.bytes != 6 {
+		t.Errorf("got %d files and %d bytes recorded, want 2 and 6", len(s.quota.files), s.quota.bytes)
+	}
+
+	// Failed writes aren't counted
+	s.quota.reset()
+	blocked := filepath.Join(dir, "a.txt", "c.txt")
+	if _, err := c.WriteTextFile(ctx, acp.WriteTextFileRequest{Path: blocked, Content: "abc"}); err == nil {
+		t.Fatal("wrote under a file")
+	}
+	if len(s.quota.files) != 0 || s.quota.bytes != 0 {
+		t.Errorf("the failed write was recorded: %v, %d bytes", s.quota.files, s.quota.bytes)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit throttles the turns of a session, for agents whose provider
+// rejects requests beyond a rate. Zero fields don't limit.
+type RateLimit struct {
+	// MinIntervalMs is the least time between the starts of two turns
+	MinIntervalMs int `json:"min_interval_ms" msgpack:"min_interval_ms"`
+	// MaxTurnsPerMinute caps the turns started in any minute
+	MaxTurnsPerMinute int `json:"max_turns_per_minute" msgpack:"max_turns_per_minute"`
+}
+
+// rateLimiter keeps the starts of the recent turns of a session.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	starts []time.Time
+}
+
+func (r *rateLimiter) setLimit(limit RateLimit) {
+	r.mu.Lock()
+	r.limit = limit
+	r.mu.Unlock()
+}
+
+// delay returns how long a turn starting at now has to wait.
+func (r *rateLimiter) delay(now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Only the last minute matters
+	for len(r.starts) > 0 && now.Sub(r.starts[0]) >= time.Minute {
+		r.starts = r.starts[1:]
+	}
+
+	var wait time.Duration
+	n := len(r.starts)
+	if r.limit.MinIntervalMs > 0 && n > 0 {
+		wait = r.starts[n-1].Add(time.Duration(r.limit.MinIntervalMs) * time.Millisecond).Sub(now)
+	}
+	if k := r.limit.MaxTurnsPerMinute; k > 0 && n >= k {
+		wait = max(wait, r.starts[n-k].Add(time.Minute).Sub(now))
+	}
+	return wait
+}
+
+// record notes that a turn started at t.
+func (r *rateLimiter) record(t time.Time) {
+	r.mu.Lock()
+	r.starts = append(r.starts, t)
+	r.mu.Unlock()
+}
+
+// throttle waits until the rate limit of the session lets a turn start, and
+// records its start. The seconds left are passed on to Lua every second,
+// for the chat buffer to count down.
+func (s *AcpSession) throttle() {
+	waited := false
+	for {
+		wait := s.rate.delay(time.Now())
+		if wait <= 0 {
+			break
+		}
+		secs := int(math.Ceil(wait.Seconds()))
+		if !waited {
+			waited = true
+			s.appendToBuffer(fmt.Sprintf("[Rate limit: the prompt is sent in %ds]\n", secs))
+			s.flushBuffer()
+		}
+		s.callLua(`require('acp').on_throttle(...)`, s.bufnr, secs)
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(min(wait, time.Second)):
+		}
+	}
+	if waited {
+		s.callLua(`require('acp').on_throttle(...)`, s.bufnr, 0)
+	}
+	s.rate.record(time.Now())
+}
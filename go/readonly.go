@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// readOnlyDenied are the kinds of tool calls whose permission requests a
+// read-only session denies without asking.
+var readOnlyDenied = []acp.ToolKind{acp.ToolKindEdit, acp.ToolKindDelete, acp.ToolKindMove, acp.ToolKindExecute}
+
+// readOnlyDenies reports whether the session is read-only and denies the
+// tool call tc.
+func (s *AcpSession) readOnlyDenies(tc acp.RequestPermissionToolCall) bool {
+	return s.readOnly && tc.Kind != nil && slices.Contains(readOnlyDenied, *tc.Kind)
+}
+
+// denyReadOnly rejects a permission request of a read-only session, once so
+// that the agent may ask again in a session that isn't.
+func (s *AcpSession) denyReadOnly(params acp.RequestPermissionRequest) acp.RequestPermissionResponse {
+	title := string(*params.ToolCall.Kind)
+	if params.ToolCall.Title != nil {
+		title = *params.ToolCall.Title
+	}
+	s.appendToBuffer(fmt.Sprintf("\n[Permission denied, the session is read-only: %s]\n", title))
+	for _, o := range params.Options {
+		if o.Kind == acp.PermissionOptionKindRejectOnce {
+			return acp.RequestPermissionResponse{Outcome: acp.RequestPermissionOutcome{Selected: &acp.RequestPermissionOutcomeSelected{OptionId: o.OptionId}}}
+		}
+	}
+	return acp.RequestPermissionResponse{Outcome: acp.RequestPermissionOutcome{Cancelled: &acp.RequestPermissionOutcomeCancelled{}}}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// recoverPanic is deferred by the handlers of the agent's requests and
+// notifications. A panic there would otherwise take the whole RPC host down,
+// with every session. Instead the session is marked as failed, the stack is
+// kept in the agent log and the handler returns an internal error.
+func (s *AcpSession) recoverPanic(method string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	msg := fmt.Sprintf("internal error handling %s: %v", method, r)
+	fmt.Fprintf(&s.stderr, "[acp.nvim] panic: %s\n%s", msg, debug.Stack())
+	logError("Session of buffer %d: %s", s.bufnr, msg)
+
+	s.failure.Store(msg)
+	s.appendToBuffer(fmt.Sprintf("\n[Error: %s. The stack is in :AcpAgentLogs]\n", msg))
+
+	if err != nil {
+		*err = acp.NewInternalError(map[string]any{"error": msg})
+	}
+}
+
+// recovered wraps an extension handler with recoverPanic and watches it.
+func (c *acpClientImpl) recovered(method string, h extHandler) extHandler {
+	return func(ctx context.Context, params json.RawMessage) (res any, err error) {
+		defer c.session.recoverPanic(method, &err)
+		defer c.session.watch(method).done()
+		return h(ctx, params)
+	}
+}
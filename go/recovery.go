@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// checkpointInterval is how often the transcript of a session is saved while
+// it changes.
+const checkpointInterval = 30 * time.Second
+
+// checkpoint is the content of a checkpoint file: what is needed to restore a
+// session after Neovim or the RPC host crashed.
+type checkpoint struct {
+	// Agent and Profile are the names of the agent and credential profile
+	// in the config of the plugin
+	Agent      string     `json:"agent"`
+	Profile    string     `json:"profile"`
+	Cwd        string     `json:"cwd"`
+	SessionID  string     `json:"session_id"`
+	Pid        int        `json:"pid"`
+	Updated    time.Time  `json:"updated"`
+	Transcript Transcript `json:"transcript"`
+}
+
+// RecoverableSession is a checkpoint left by a session that didn't end
+// cleanly.
+type RecoverableSession struct {
+	Path    string `msgpack:"path"`
+	Agent   string `msgpack:"agent"`
+	Profile string `msgpack:"profile"`
+	Cwd     string `msgpack:"cwd"`
+	// Date is when the checkpoint was saved, as YYYY-MM-DD HH:MM
+	Date  string `msgpack:"date"`
+	Turns int    `msgpack:"turns"`
+	// Title is the first prompt of the session, cut short
+	Title string `msgpack:"title"`
+}
+
+// checkpointer saves the transcript of a session to a file of its own while
+// the session lives. The file is removed when Neovim exits cleanly, so any
+// file left is a session to recover.
+type checkpointer struct {
+	mu   sync.Mutex
+	path string
+	// agent and profile are saved to start the same agent again
+	agent   string
+	profile string
+	// saved is the version of the transcript last saved
+	saved int
+}
+
+// startCheckpoints saves the transcript of the session every
+// checkpointInterval until the session ends.
+func (s *AcpSession) startCheckpoints(dir string) {
+	if dir == "" || s.bufnr == 0 {
+		return
+	}
+	s.checkpoints.path = filepath.Join(dir, fmt.Sprintf("%d-%d.json", os.Getpid(), s.bufnr))
+	ctx := s.ctx
+	go func() {
+		ticker := time.NewTicker(checkpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.checkpoint()
+			}
+		}
+	}()
+}
+
+// checkpoint saves the transcript of the session if it changed since the last
+// checkpoint.
+func (s *AcpSession) checkpoint() {
+	c := &s.checkpoints
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path == "" {
+		return
+	}
+	version := s.transcript.changes()
+	if version == c.saved {
+		return
+	}
+	cp := checkpoint{
+		Agent:      c.agent,
+		Profile:    c.profile,
+		Cwd:        s.cwd,
+		SessionID:  string(s.sessionID),
+		Pid:        os.Getpid(),
+		Updated:    time.Now(),
+		Transcript: s.snapshot(),
+	}
+	if err := writeCheckpoint(c.path, cp); err != nil {
+		logError("Error saving session checkpoint: %v", err)
+		return
+	}
+	c.saved = version
+}
+
+// writeCheckpoint replaces the file at path with cp at once, so that a crash
+// while writing doesn't lose the previous checkpoint.
+func writeCheckpoint(path string, cp checkpoint) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".checkpoint-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// removeCheckpoint removes the checkpoint of the session, and stops saving
+// new ones.
+func (s *AcpSession) removeCheckpoint() {
+	c := &s.checkpoints
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path != "" {
+		os.Remove(c.path)
+		c.path = ""
+	}
+}
+
+// AcpDiscardCheckpoints removes the checkpoints of the sessions of this
+// host, for when Neovim exits cleanly
+func (m *SessionManager) AcpDiscardCheckpoints() (any, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, session := range m.sessions {
+		session.removeCheckpoint()
+	}
+	return nil, nil
+}
+
+// AcpListRecoverable returns the sessions with a checkpoint in dir whose host
+// is gone, newest first
+func (m *SessionManager) AcpListRecoverable(dir string) ([]RecoverableSession, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	type dated struct {
+		RecoverableSession
+		updated time.Time
+	}
+	var list []dated
+	for _, path := range paths {
+		cp, err := readCheckpoint(path)
+		if err != nil {
+			logWarn("Error reading session checkpoint: %v", err)
+			continue
+		}
+		if processAlive(cp.Pid) {
+			continue
+		}
+		rs := RecoverableSession{
+			Path:    path,
+			Agent:   cp.Agent,
+			Profile: cp.Profile,
+			Cwd:     cp.Cwd,
+			Date:    cp.Updated.Local().Format("2006-01-02 15:04"),
+			Turns:   len(cp.Transcript.Turns),
+		}
+		for _, turn := range cp.Transcript.Turns {
+			if t := strings.TrimSpace(turn.Prompt); t != "" {
+				rs.Title = truncate(strings.Join(strings.Fields(t), " "), 80)
+				break
+			}
+		}
+		list = append(list, dated{rs, cp.Updated})
+	}
+	slices.SortFunc(list, func(a, b dated) int { return b.updated.Compare(a.updated) })
+
+	found := []RecoverableSession{}
+	for _, d := range list {
+		found = append(found, d.RecoverableSession)
+	}
+	return found, nil
+}
+
+func readCheckpoint(path string) (checkpoint, error) {
+	var cp checkpoint
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, fmt.Errorf("%s: %w", path, err)
+	}
+	return cp, nil
+}
+
+// AcpDiscardRecoverable removes the checkpoint at path, a session the user
+// doesn't want to recover
+func (m *SessionManager) AcpDiscardRecoverable(path string) (any, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// AcpRecover restores the session saved at path in the session of bufnr,
+// started with the same agent. The conversation is shown in the chat buffer,
+// and the agent resumes the previous session when it can load sessions, or is
+// sent a summary of the conversation with the next prompt otherwise. The
+// checkpoint is removed, the new session saving its own
+func (m *SessionManager) AcpRecover(bufnr int, path string) (any, error) {
+	return nil, m.whenReady(bufnr, func(session *AcpSession) {
+		defer session.flushBuffer()
+		cp, err := readCheckpoint(path)
+		if err != nil {
+			session.appendToBuffer(fmt.Sprintf("Error: %v\n", err))
+			return
+		}
+
+		session.appendToBuffer(fmt.Sprintf("\n[Recovered the session of %s]\n", cp.Updated.Local().Format("2006-01-02 15:04")))
+		session.showTranscript(&cp.Transcript)
+		if err := session.resume(cp); err != nil {
+			logInfo("Couldn't resume session %s, replaying it: %v", cp.SessionID, err)
+			session.mu.Lock()
+			session.seed = cp.Transcript.summary(maxSeedBytes)
+			session.mu.Unlock()
+			session.appendToBuffer("\n[The agent can't resume the session, the conversation will be sent along with the next prompt]\n")
+		} else {
+			session.appendToBuffer("\n[Session resumed]\n")
+		}
+		if err := os.Remove(path); err != nil {
+			logWarn("Error removing session checkpoint: %v", err)
+		}
+	})
+}
+
+// resume loads the session of cp in place of the new session, if the agent
+// can load sessions. The updates of the replay are not shown, the
+// conversation is already in the chat buffer.
+func (s *AcpSession) resume(cp checkpoint) error {
+	if !s.agentInfo.AgentCapabilities.LoadSession {
+		return fmt.Errorf("the agent can't load sessions")
+	}
+	if cp.SessionID == "" || cp.Cwd != s.cwd {
+		return fmt.Errorf("the session ran in %s", cp.Cwd)
+	}
+	servers, _ := s.mcpServers()
+	s.loading.Store(true)
+	defer func() {
+		// The replayed updates may still be queued
+		s.updates.wait()
+		s.loading.Store(false)
+	}()
+	res, err := s.conn.LoadSession(s.ctx, acp.LoadSessionRequest{
+		SessionId:  acp.SessionId(cp.SessionID),
+		Cwd:        s.paths.toRemote(s.cwd),
+		McpServers: servers,
+	})
+	if err != nil {
+		return err
+	}
+	s.setModes(res.Modes)
+	s.setModels(res.Models)
+	s.sessionID = acp.SessionId(cp.SessionID)
+	return nil
+}
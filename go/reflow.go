@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// reflower breaks the prose of the replies at a maximum width as it is
+// streamed, for chat buffers shown without 'wrap'. Words are held back until
+// they end, to know whether they fit on the line. Lines of code and tables are
+// written as they are. The other text appended to the chat buffer goes
+// through it too, for it to know the column of the end of the buffer.
+type reflower struct {
+	mu sync.Mutex
+	// width is the maximum width of the lines, 0 to not reflow them
+	width int
+	// col is the width of the last line written
+	col int
+	// spaces and word are held back, spaces before word
+	spaces strings.Builder
+	word   strings.Builder
+}
+
+// setWidth sets the maximum width of the lines, 0 to stop reflowing them.
+func (r *reflower) setWidth(width int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.width = width
+}
+
+// reply returns the text to write for the next piece of a reply, which ends
+// the line or is in the middle of it. verbatim lines aren't broken.
+func (r *reflower) reply(text string, verbatim bool) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.width <= 0 || verbatim {
+		return r.takeLocked(text)
+	}
+
+	var b strings.Builder
+	for _, c := range text {
+		switch c {
+		case ' ', '\t':
+			r.putWord(&b)
+			r.spaces.WriteRune(c)
+		case '\n':
+			r.putWord(&b)
+			b.WriteString(r.spaces.String())
+			r.spaces.Reset()
+			b.WriteByte('\n')
+			r.col = 0
+		default:
+			r.word.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// putWord writes the word held back, on a line of its own if it doesn't fit
+// on the current one.
+func (r *reflower) putWord(b *strings.Builder) {
+	if r.word.Len() == 0 {
+		return
+	}
+	spaces, word := r.spaces.String(), r.word.String()
+	n := utf8.RuneCountInString(word)
+	if r.col > 0 && r.col+utf8.RuneCountInString(spaces)+n > r.width {
+		b.WriteByte('\n')
+		r.col = 0
+		spaces = ""
+	}
+	b.WriteString(spaces)
+	b.WriteString(word)
+	r.col += utf8.RuneCountInString(spaces) + n
+	r.spaces.Reset()
+	r.word.Reset()
+}
+
+// other returns the text to write for text that isn't part of a reply, after
+// what the reply held back.
+func (r *reflower) other(text string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.takeLocked(text)
+}
+
+// takeLocked returns what is held back followed by text, written as is.
+func (r *reflower) takeLocked(text string) string {
+	text = r.spaces.String() + r.word.String() + text
+	r.spaces.Reset()
+	r.word.Reset()
+	if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+		r.col = utf8.RuneCountInString(text[i+1:])
+	} else {
+		r.col += utf8.RuneCountInString(text)
+	}
+	return text
+}
+
+// verbatimLine reports whether a line of a reply, or its start, must not be
+// broken: a code fence, a table row or an indented code line.
+func verbatimLine(line string) bool {
+	return fenceLine.MatchString(line) ||
+		strings.HasPrefix(strings.TrimLeft(line, " "), "|") ||
+		strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReflower(t *testing.T) {
+	type piece struct {
+		text     string
+		verbatim bool
+		// other is text that isn't part of a reply
+		other bool
+	}
+	reply := func(text string) piece { return piece{text: text} }
+	tests := []struct {
+		name   string
+		width  int
+		pieces []piece
+		want   string
+	}{
+		{name: "no width", pieces: []piece{reply("a long line that isn't broken\n")}, want: "a long line that isn't broken\n"},
+		{name: "broken", width: 10, pieces: []piece{reply("one two three four\n")}, want: "one two\nthree four\n"},
+		{name: "words split between chunks", width: 10, pieces: []piece{reply("one tw"), reply("o thr"), reply("ee four\n")}, want: "one two\nthree four\n"},
+		{name: "fits exactly", width: 7, pieces: []piece{reply("one two\n")}, want: "one two\n"},
+		{name: "word longer than the width", width: 5, pieces: []piece{reply("a abcdefgh b\n")}, want: "a\nabcdefgh\nb\n"},
+		{name: "multi-byte characters", width: 9, pieces: []piece{reply("été café à\n")}, want: "été café\nà\n"},
+		{name: "emoji", width: 4, pieces: []piece{reply("😀😀 😀😀\n")}, want: "😀😀\n😀😀\n"},
+		{name: "verbatim", width: 5, pieces: []piece{{text: "    code that is long\n", verbatim: true}, reply("a b c d\n")}, want: "    code that is long\na b c\nd\n"},
+		{name: "held back word before other text", width: 20, pieces: []piece{reply("hello wor"), {text: "[x]\n", other: true}}, want: "hello wor[x]\n"},
+		{name: "other text moves the column", width: 10, pieces: []piece{{text: "123456789", other: true}, reply(" ab\n")}, want: "123456789\nab\n"},
+		{name: "empty", width: 10, pieces: []piece{reply(""), {text: "", other: true}}, want: ""},
+		{name: "tabs and spaces kept", width: 20, pieces: []piece{reply("a\t b\n")}, want: "a\t b\n"},
+	}
+	for _, tt := range tests {
+		r := &reflower{width: tt.width}
+		var got strings.Builder
+		for _, p := range tt.pieces {
+			if p.other {
+				got.WriteString(r.other(p.text))
+			} else {
+				got.WriteString(r.reply(p.text, p.verbatim))
+			}
+		}
+		got.WriteString(r.other(""))
+		if got.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got.String(), tt.want)
+		}
+	}
+}
+
+func TestVerbatimLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"```go", true},
+		{"| a | b |", true},
+		{"  | a |", true},
+		{"    indented code", true},
+		{"\tindented code", true},
+		{"prose", false},
+		{"  two spaces", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := verbatimLine(tt.line); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+)
+
+// ConfigReload tells which options of a session changed with a new config.
+type ConfigReload struct {
+	// Applied are the options the session now uses
+	Applied []string `msgpack:"applied"`
+	// Restart are the options only a new session will use
+	Restart []string `msgpack:"restart"`
+}
+
+// AcpReloadConfig applies the options of a session from a new config, those
+// that can be applied while the session runs. The agent command and
+// environment, the launcher and the logging of the messages can't, they are
+// reported for the user to start a new session. The options are applied once
+// the turn in progress is over
+func (m *SessionManager) AcpReloadConfig(bufnr int, agent_cmd []string, opts AcpNewSessionOpts) (ConfigReload, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return ConfigReload{}, err
+	}
+	session.mu.Lock()
+	old := session.opts
+	session.mu.Unlock()
+	var reload ConfigReload
+	changed := func(name string, a, b any) bool {
+		if reflect.DeepEqual(a, b) {
+			return false
+		}
+		reload.Applied = append(reload.Applied, name)
+		return true
+	}
+	restart := func(name string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			reload.Restart = append(reload.Restart, name)
+		}
+	}
+
+	restart("cmd", session.agentCmd, agent_cmd)
+	restart("env", old.Env, opts.Env)
+	restart("dotenv", old.Dotenv, opts.Dotenv)
+	restart("launcher", old.Launcher, opts.Launcher)
+	restart("path_style", old.PathStyle, opts.PathStyle)
+	restart("capabilities", old.Capabilities, opts.Capabilities)
+	restart("read_only", old.ReadOnly, opts.ReadOnly)
+	restart("address", old.Address, opts.Address)
+	restart("profile", old.Profile, opts.Profile)
+	restart("auth_method", old.AuthMethod, opts.AuthMethod)
+	restart("trace", old.Trace, opts.Trace)
+	restart("capture", old.CaptureDir, opts.CaptureDir)
+	restart("recovery", old.RecoveryDir, opts.RecoveryDir)
+	restart("history", old.HistoryDir, opts.HistoryDir)
+	restart("activity_limit.max_terminals", old.ActivityLimit.MaxTerminals, opts.ActivityLimit.MaxTerminals)
+	restart("activity_limit.max_fs_requests", old.ActivityLimit.MaxFsRequests, opts.ActivityLimit.MaxFsRequests)
+
+	var apply []func()
+	if changed("write_limit", old.WriteLimit, opts.WriteLimit) {
+		apply = append(apply, func() {
+			session.quota.mu.Lock()
+			session.quota.limits = opts.WriteLimit
+			session.quota.mu.Unlock()
+			session.mu.Lock()
+			session.opts.WriteLimit = opts.WriteLimit
+			session.mu.Unlock()
+		})
+	}
+	if changed("templates", old.Templates, opts.Templates) {
+		apply = append(apply, func() {
+			session.mu.Lock()
+			session.templates = opts.Templates
+			session.opts.Templates = opts.Templates
+			session.mu.Unlock()
+		})
+	}
+	if changed("context_limit", old.ContextLimit, opts.ContextLimit) {
+		apply = append(apply, func() {
+			session.mu.Lock()
+			session.contextLimits = opts.ContextLimit
+			session.opts.ContextLimit = opts.ContextLimit
+			session.mu.Unlock()
+		})
+	}
+	if changed("activity_limit.max_tool_calls", old.ActivityLimit.MaxToolCalls, opts.ActivityLimit.MaxToolCalls) {
+		apply = append(apply, func() {
+			// The tool calls are tracked by the update queue
+			session.updates.push(func(context.Context) {
+				session.tools.max = limitOrDefault(opts.ActivityLimit.MaxToolCalls, defaultMaxToolCalls)
+			})
+			session.mu.Lock()
+			session.opts.ActivityLimit.MaxToolCalls = opts.ActivityLimit.MaxToolCalls
+			session.mu.Unlock()
+		})
+	}
+	if changed("retry", old.Retry, opts.Retry) {
+		apply = append(apply, func() {
+			session.mu.Lock()
+			session.retryPolicy = opts.Retry
+			session.opts.Retry = opts.Retry
+			session.mu.Unlock()
+		})
+	}
+	if changed("rate_limit", old.RateLimit, opts.RateLimit) {
+		apply = append(apply, func() {
+			session.rate.setLimit(opts.RateLimit)
+			session.mu.Lock()
+			session.opts.RateLimit = opts.RateLimit
+			session.mu.Unlock()
+		})
+	}
+	if changed("auto_continue", old.AutoContinue, opts.AutoContinue) {
+		apply = append(apply, func() {
+			session.mu.Lock()
+			session.autoContinue = opts.AutoContinue
+			session.opts.AutoContinue = opts.AutoContinue
+			session.mu.Unlock()
+		})
+	}
+	if changed("request_timeouts", old.RequestTimeouts, opts.RequestTimeouts) {
+		apply = append(apply, func() {
+			session.mu.Lock()
+			session.opts.RequestTimeouts = opts.RequestTimeouts
+			session.mu.Unlock()
+		})
+	}
+	if changed("text_width", old.TextWidth, opts.TextWidth) {
+		apply = append(apply, func() {
+			session.reflow.setWidth(opts.TextWidth)
+			session.mu.Lock()
+			session.opts.TextWidth = opts.TextWidth
+			session.mu.Unlock()
+		})
+	}
+	if changed("secrets", old.Secrets, opts.Secrets) {
+		apply = append(apply, func() {
+			session.mu.Lock()
+			session.secrets = opts.Secrets
+			session.opts.Secrets = opts.Secrets
+			session.mu.Unlock()
+		})
+	}
+	if changed("archive", old.ArchiveDir, opts.ArchiveDir) {
+		apply = append(apply, func() {
+			session.archiver.dir = opts.ArchiveDir
+			session.mu.Lock()
+			session.opts.ArchiveDir = opts.ArchiveDir
+			session.mu.Unlock()
+		})
+	}
+	if !reflect.DeepEqual(old.Instructions, opts.Instructions) || !slices.Equal(old.InstructionFiles, opts.InstructionFiles) {
+		// Instructions go with the first prompt, later ones would repeat them
+		if session.transcript.count() > 0 {
+			reload.Restart = append(reload.Restart, "instructions")
+		} else {
+			reload.Applied = append(reload.Applied, "instructions")
+			apply = append(apply, func() {
+				text, err := loadInstructions(session.cwd, opts.Instructions, opts.InstructionFiles)
+				if err != nil {
+					logWarn("Error loading instructions: %v", err)
+					return
+				}
+				session.mu.Lock()
+				session.instructions = text
+				session.opts.Instructions = opts.Instructions
+				session.opts.InstructionFiles = opts.InstructionFiles
+				session.mu.Unlock()
+			})
+		}
+	}
+
+	mcp := map[string]map[string]any{}
+	for name, config := range opts.Mcp {
+		mcp[name], _ = session.env.expandAll(config).(map[string]any)
+	}
+	session.mu.Lock()
+	mcpChanged := !reflect.DeepEqual(session.mcp, mcp) && (len(session.mcp) > 0 || len(mcp) > 0)
+	session.mu.Unlock()
+	if mcpChanged {
+		reload.Applied = append(reload.Applied, "mcp")
+		apply = append(apply, func() {
+			session.mu.Lock()
+			session.mcp = mcp
+			session.mu.Unlock()
+			if err := session.reloadMcp(); err != nil {
+				session.appendToBuffer(fmt.Sprintf("\n[Error reloading MCP servers: %v]\n", err))
+			}
+		})
+	}
+
+	sort.Strings(reload.Applied)
+	sort.Strings(reload.Restart)
+	if len(apply) > 0 {
+		session.queueTurn(func() {
+			for _, fn := range apply {
+				fn()
+			}
+			session.flushBuffer()
+		})
+	}
+	return reload, nil
+}
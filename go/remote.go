@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// dialAgent connects to an ACP agent that is already running at address,
+// one of tcp://host:port, unix:///path, ws://host[:port]/path or wss://...
+// Messages are exchanged as newline delimited JSON, like over stdio, except
+// over WebSocket where each message is a text frame.
+func dialAgent(ctx context.Context, address string) (io.ReadWriteCloser, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid agent address %s: %w", address, err)
+	}
+
+	var d net.Dialer
+	switch u.Scheme {
+	case "tcp":
+		return d.DialContext(ctx, "tcp", u.Host)
+	case "unix":
+		return d.DialContext(ctx, "unix", u.Path)
+	case "ws", "wss":
+		return dialWebSocket(ctx, u)
+	default:
+		return nil, fmt.Errorf("unsupported agent address scheme %q", u.Scheme)
+	}
+}
+
+// WebSocket opcodes, see RFC 6455 section 5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxMessageBytes bounds the messages received over WebSocket, so that a
+// bad endpoint can't make the host allocate without bound. It is well above
+// the file contents agents and clients exchange.
+var wsMaxMessageBytes uint64 = 64 << 20
+
+// wsMaxControlBytes is the largest payload of a control frame.
+const wsMaxControlBytes = 125
+
+// wsConn is the client side of a WebSocket connection, carrying one JSON-RPC
+// message per frame.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// pending is the part of the last message not read yet
+	pending []byte
+
+	mu sync.Mutex // serializes frame writes
+}
+
+func dialWebSocket(ctx context.Context, u *url.URL) (*wsConn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if u.Scheme == "wss" {
+		d := tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = d.DialContext(ctx, "tcp", host)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, (&url.URL{Scheme: "http", Host: u.Host, Path: u.Path, RawQuery: u.RawQuery}).String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	sum := sha1.Sum([]byte(key + wsGUID))
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake with %s failed: %s", u.Host, res.Status)
+	}
+	return &wsConn{conn: conn, r: r}, nil
+}
+
+// Read returns the content of the data frames received, each message
+// followed by a newline.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.HasSuffix(msg, []byte("\n")) {
+			msg = append(msg, '\n')
+		}
+		c.pending = msg
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage reads frames until a complete data message is received,
+// answering pings on the way.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsClose:
+			_ = c.writeFrame(wsClose, nil)
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+			if uint64(len(msg))+uint64(len(payload)) > wsMaxMessageBytes {
+				return nil, fmt.Errorf("websocket message larger than %d bytes", wsMaxMessageBytes)
+			}
+			msg = append(msg, payload...)
+			if fin {
+				return msg, nil
+			}
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.r, b[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.r, b[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if op >= wsClose && (length > wsMaxControlBytes || !fin) {
+		err = fmt.Errorf("invalid websocket control frame of %d bytes", length)
+		return
+	}
+	if length > wsMaxMessageBytes {
+		err = fmt.Errorf("websocket frame larger than %d bytes", wsMaxMessageBytes)
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// Write sends each line of p as a text message.
+func (c *wsConn) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if err := c.writeFrame(wsText, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a single masked frame, as clients must.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+
+	frame := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) Close() error {
+	_ = c.writeFrame(wsClose, nil)
+	return c.conn.Close()
+}
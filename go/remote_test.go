@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// wsPair returns the client side of a WebSocket connection and the other
+// end of it, which the tests play the server on.
+func wsPair(t *testing.T) (*wsConn, net.Conn) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return &wsConn{conn: client, r: bufio.NewReader(client)}, server
+}
+
+// serverFrame returns an unmasked frame, as servers send them.
+func serverFrame(fin bool, op byte, payload []byte) []byte {
+	b := op
+	if fin {
+		b |= 0x80
+	}
+	frame := []byte{b}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	return append(frame, payload...)
+}
+
+// readClientFrame reads a frame sent by the client, checking that it is
+// masked, and returns its opcode and unmasked payload. It may run outside of
+// the goroutine of the test, so failures don't stop it.
+func readClientFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Errorf("read frame: %v", err)
+		return 0, nil
+	}
+	if head[0]&0x80 == 0 {
+		t.Errorf("client frame without FIN")
+	}
+	if head[1]&0x80 == 0 {
+		t.Errorf("client frame not masked")
+		return 0, nil
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		io.ReadFull(r, b[:])
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		io.ReadFull(r, b[:])
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	var mask [4]byte
+	io.ReadFull(r, mask[:])
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Errorf("read payload: %v", err)
+		return 0, nil
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return head[0] & 0x0f, payload
+}
+
+func TestWsConnWriteMasksFrames(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		c, server := wsPair(t)
+		msg := bytes.Repeat([]byte("x"), n)
+		if n == 0 {
+			msg = []byte("{}")
+		}
+		go c.Write(append(append([]byte{}, msg...), '\n'))
+		op, payload := readClientFrame(t, server)
+		if op != wsText || !bytes.Equal(payload, msg) {
+			t.Errorf("%d bytes: got op %d and %d bytes", n, op, len(payload))
+		}
+	}
+}
+
+func TestWsConnReadLengths(t *testing.T) {
+	for _, n := range []int{1, 125, 126, 0xffff, 0x10000} {
+		c, server := wsPair(t)
+		msg := strings.Repeat("y", n)
+		go server.Write(serverFrame(true, wsText, []byte(msg)))
+		line, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil || line != msg+"\n" {
+			t.Errorf("%d bytes: got %d bytes, %v", n, len(line), err)
+		}
+	}
+}
+
+func TestWsConnReadFragmentsAndPing(t *testing.T) {
+	c, server := wsPair(t)
+	go func() {
+		server.Write(serverFrame(false, wsText, []byte(`{"a":`)))
+		server.Write(serverFrame(true, wsPing, []byte("hi")))
+		server.Write(serverFrame(true, wsContinuation, []byte(`1}`)))
+	}()
+
+	pong := make(chan []byte, 1)
+	go func() {
+		op, payload := readClientFrame(t, server)
+		if op != wsPong {
+			t.Errorf("got op %d, want pong", op)
+		}
+		pong <- payload
+	}()
+
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != "{\"a\":1}\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+	if p := <-pong; string(p) != "hi" {
+		t.Errorf("pong payload %q, want the ping's", p)
+	}
+}
+
+func TestWsConnReadClose(t *testing.T) {
+	c, server := wsPair(t)
+	go server.Write(serverFrame(true, wsClose, nil))
+	closed := make(chan byte, 1)
+	go func() {
+		op, _ := readClientFrame(t, server)
+		closed <- op
+	}()
+	if _, err := c.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatalf("got %v, want EOF", err)
+	}
+	if op := <-closed; op != wsClose {
+		t.Errorf("client answered with op %d, want close", op)
+	}
+}
+
+func TestWsConnRejectsOversize(t *testing.T) {
+	defer func(max uint64) { wsMaxMessageBytes = max }(wsMaxMessageBytes)
+	wsMaxMessageBytes = 1024
+
+	tests := map[string][][]byte{
+		// Only the header is sent, nothing may be allocated for the rest
+		"huge frame": {{0x81, 127, 0x40, 0, 0, 0, 0, 0, 0, 0}},
+		"frame":      {serverFrame(true, wsText, make([]byte, 1025))[:4]},
+		"fragments": {
+			serverFrame(false, wsText, make([]byte, 1000)),
+			serverFrame(true, wsContinuation, make([]byte, 100)),
+		},
+		"control frame": {{0x89, 126, 0, 200}},
+	}
+	for name, frames := range tests {
+		c, server := wsPair(t)
+		go func() {
+			for _, f := range frames {
+				server.Write(f)
+			}
+		}()
+		if _, err := c.Read(make([]byte, 16)); err == nil || err == io.EOF {
+			t.Errorf("%s: got %v, want an error", name, err)
+		}
+	}
+}
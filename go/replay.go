@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// recordedMessage is a line of a capture file: a message exchanged with the
+// agent, as it was sent, and when relative to the start of the session.
+type recordedMessage struct {
+	Ms  int64           `json:"ms"`
+	Dir string          `json:"dir"`
+	Msg json.RawMessage `json:"msg"`
+}
+
+// recorder writes the messages of a session to a capture file, unlike tracer
+// without leaving anything out, so that AcpReplay can render them again. A
+// nil recorder records nothing.
+type recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+}
+
+func newRecorder(dir string, bufnr int) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("capture-%s-%d.jsonl", time.Now().Format("20060102-150405"), bufnr)
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{f: f, start: time.Now()}, nil
+}
+
+func (r *recorder) log(dir string, line []byte) {
+	line = bytes.TrimSpace(line)
+	if !json.Valid(line) {
+		return
+	}
+	b, err := json.Marshal(recordedMessage{Ms: time.Since(r.start).Milliseconds(), Dir: dir, Msg: line})
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, _ = r.f.Write(append(b, '\n'))
+}
+
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+	_ = r.f.Close()
+}
+
+// AcpReplay renders a recorded session in bufnr, a prompt buffer, by feeding
+// the updates the agent sent to the client implementation, without an
+// agent. Prompts are shown as they were sent, and other requests of the agent
+// are only mentioned since replaying them would e.g. write files again
+func (m *SessionManager) AcpReplay(bufnr int, path string) (any, error) {
+	session := &AcpSession{bufnr: bufnr}
+	session.ctx, session.cancel = context.WithCancel(context.Background())
+	defer session.cancel()
+	return nil, session.replay(path)
+}
+
+// replay renders the capture file path in the chat of s.
+func (s *AcpSession) replay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	client := &acpClientImpl{session: s}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var rec recordedMessage
+		var msg rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		if err := json.Unmarshal(rec.Msg, &msg); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+
+		switch {
+		case rec.Dir == "send" && msg.Method == acp.AgentMethodSessionPrompt:
+			var req acp.PromptRequest
+			if err := json.Unmarshal(msg.Params, &req); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			var text []string
+			for _, b := range req.Prompt {
+				if b.Text != nil {
+					text = append(text, b.Text.Text)
+				}
+			}
+			s.appendToBuffer(fmt.Sprintf("\n%s\n🤖 ", strings.Join(text, "\n")))
+		case rec.Dir == "recv" && msg.Method == acp.ClientMethodSessionUpdate:
+			var update acp.SessionNotification
+			if err := json.Unmarshal(msg.Params, &update); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			if err := client.SessionUpdate(s.ctx, update); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+		case rec.Dir == "recv" && msg.Method != "":
+			s.appendToBuffer(fmt.Sprintf("\n[Replay: the agent called %s]\n", msg.Method))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	s.appendToBuffer("\n[End of replay]\n")
+	s.flushBuffer()
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestReplay renders testdata/replay.jsonl, a session with the mock agent
+// recorded by the client: a reply streamed in chunks, a tool call with its
+// output, then an edit shown as a diff.
+func TestReplay(t *testing.T) {
+	var chat strings.Builder
+	s := &AcpSession{print: &chat}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+	if err := s.replay("testdata/replay.jsonl"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `
+hello there
+🤖 [Thought] The user said something, I'll repeat it.
+You said: hello there
+/tool
+🤖 
+🔧 Listing files (pending)
+
+🔧 completed
+mock.txt
+README.md
+Listed the files.
+/diff
+🤖 
+🔧 Editing mock.txt (pending)
+
+` + "```diff" + `
+--- mock.txt
++++ mock.txt
+@@ -1,2 +1,2 @@
+ hello
+-world
++mock world
+
+` + "```" + `
+Proposed an edit of mock.txt.
+[End of replay]
+`
+	if got := chat.String(); got != want {
+		t.Errorf("got chat:\n%s\nwant:\n%s", got, want)
+	}
+}
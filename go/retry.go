@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy retries the requests to the agent that fail for a reason that
+// may not last, waiting twice as long before each new attempt. Zero fields
+// use the defaults below and negative Attempts disables retries.
+type RetryPolicy struct {
+	// Attempts is how many times a request is retried
+	Attempts int `json:"attempts" msgpack:"attempts"`
+	// DelayMs is the wait before the first retry
+	DelayMs int `json:"delay_ms" msgpack:"delay_ms"`
+	// MaxDelayMs caps the wait before a retry
+	MaxDelayMs int `json:"max_delay_ms" msgpack:"max_delay_ms"`
+}
+
+const (
+	defaultRetryAttempts   = 2
+	defaultRetryDelayMs    = 500
+	defaultRetryMaxDelayMs = 8000
+)
+
+// noRetry wraps an error that must not be retried even if it is transient.
+type noRetry struct{ err error }
+
+func (e noRetry) Error() string { return e.err.Error() }
+func (e noRetry) Unwrap() error { return e.err }
+
+// transient reports whether err may not happen again: an internal error, a
+// rate limit or an overload of the agent, or a pipe to an agent that is
+// restarting.
+func transient(method string, err error) bool {
+	if errors.As(err, new(noRetry)) {
+		return false
+	}
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe) {
+		return true
+	}
+	return errorEvent(method, err).Retryable
+}
+
+// retry calls fn, the request method to the agent, until it succeeds, fails
+// for a reason that lasts or the retry policy of the session runs out of
+// attempts. Each retry is noted in the chat buffer and the transcript.
+func (s *AcpSession) retry(method string, fn func() error) error {
+	s.mu.Lock()
+	policy := s.retryPolicy
+	s.mu.Unlock()
+	attempts := max(limitOrDefault(policy.Attempts, defaultRetryAttempts), 0)
+	delay := time.Duration(limitOrDefault(policy.DelayMs, defaultRetryDelayMs)) * time.Millisecond
+	maxDelay := time.Duration(limitOrDefault(policy.MaxDelayMs, defaultRetryMaxDelayMs)) * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > attempts || !transient(method, err) {
+			var nr noRetry
+			if errors.As(err, &nr) {
+				err = nr.err
+			}
+			return err
+		}
+		// Without the advice to try again of a retryable error
+		ev := errorEvent(method, err)
+		ev.Retryable = false
+		note := fmt.Sprintf("%s failed: %s, retrying in %s (%d/%d)", method, ev, delay, attempt, attempts)
+		logWarn("%s", note)
+		s.transcript.add(TranscriptEvent{Kind: "retry", Text: note})
+		s.appendToBuffer(fmt.Sprintf("[%s]\n", note))
+		s.flushBuffer()
+
+		select {
+		case <-s.ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		if maxDelay > 0 {
+			delay = min(2*delay, maxDelay)
+		} else {
+			delay *= 2
+		}
+	}
+}
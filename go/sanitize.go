@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// sanitizer cleans the text appended to the chat buffer of the control
+// characters agents and tool outputs let through: line endings are made
+// "\n", terminal escape sequences are dropped, and so are the other control
+// characters but tabs. Chunks may split a "\r\n" or an escape sequence, so it
+// keeps its state from one chunk to the next.
+type sanitizer struct {
+	mu    sync.Mutex
+	state escState
+	// cr is set after a "\r", for the "\n" that may follow it to be dropped
+	cr bool
+}
+
+// escState tells where the sanitizer is in an escape sequence.
+type escState int
+
+const (
+	escNone escState = iota
+	// escStart follows an ESC
+	escStart
+	// escCSI is in a control sequence, "ESC [" up to a final byte
+	escCSI
+	// escOSC is in an operating system command, "ESC ]" up to BEL or ST
+	escOSC
+	// escOSCEnd follows an ESC in an operating system command, which may
+	// start ST, "ESC \"
+	escOSCEnd
+)
+
+// clean returns text without its control characters.
+func (z *sanitizer) clean(text string) string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.state == escNone && !z.cr && !hasControl(text) {
+		return text
+	}
+
+	var b strings.Builder
+	b.Grow(len(text))
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch z.state {
+		case escStart:
+			switch c {
+			case '[':
+				z.state = escCSI
+			case ']':
+				z.state = escOSC
+			default:
+				z.state = escNone
+			}
+			continue
+		case escCSI:
+			if c >= 0x40 && c <= 0x7e {
+				z.state = escNone
+			}
+			continue
+		case escOSC:
+			switch c {
+			case 0x07:
+				z.state = escNone
+			case 0x1b:
+				z.state = escOSCEnd
+			}
+			continue
+		case escOSCEnd:
+			z.state = escOSC
+			if c == '\\' {
+				z.state = escNone
+			}
+			continue
+		}
+
+		cr := z.cr
+		z.cr = false
+		switch {
+		case c == '\r':
+			z.cr = true
+			b.WriteByte('\n')
+		case c == '\n':
+			if !cr {
+				b.WriteByte('\n')
+			}
+		case c == 0x1b:
+			z.state = escStart
+		case c == '\t' || (c >= 0x20 && c != 0x7f):
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// hasControl reports whether text has a control character other than "\n"
+// and tabs.
+func hasControl(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if c := text[i]; (c < 0x20 && c != '\n' && c != '\t') || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizer(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{name: "plain", chunks: []string{"hello\n", "world"}, want: "hello\nworld"},
+		{name: "empty", chunks: []string{"", ""}, want: ""},
+		{name: "tabs", chunks: []string{"a\tb"}, want: "a\tb"},
+		{name: "CRLF", chunks: []string{"a\r\nb\r\n"}, want: "a\nb\n"},
+		{name: "CRLF split", chunks: []string{"a\r", "\nb"}, want: "a\nb"},
+		{name: "CR alone", chunks: []string{"a\rb"}, want: "a\nb"},
+		{name: "CR CR LF", chunks: []string{"a\r\r\nb"}, want: "a\n\nb"},
+		{name: "CR then empty chunk", chunks: []string{"a\r", "", "\nb"}, want: "a\nb"},
+		{name: "colors", chunks: []string{"\x1b[1;31mred\x1b[0m"}, want: "red"},
+		{name: "color split", chunks: []string{"\x1b", "[1;3", "1mred"}, want: "red"},
+		{name: "OSC ended by BEL", chunks: []string{"\x1b]0;title\x07text"}, want: "text"},
+		{name: "OSC ended by ST", chunks: []string{"\x1b]8;;http://a\x1b", "\\link"}, want: "link"},
+		{name: "two byte escape", chunks: []string{"a\x1b=b"}, want: "ab"},
+		{name: "other controls", chunks: []string{"a\x00b\x08c\x7fd\x0ce"}, want: "abcde"},
+		{name: "UTF-8 split", chunks: []string{"caf\xc3", "\xa9 😀"}, want: "café 😀"},
+		{name: "UTF-8 around an escape", chunks: []string{"é\x1b[0mè"}, want: "éè"},
+	}
+	for _, tt := range tests {
+		var z sanitizer
+		var got strings.Builder
+		for _, c := range tt.chunks {
+			got.WriteString(z.clean(c))
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got.String(), tt.want)
+		}
+	}
+}
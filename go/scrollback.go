@@ -0,0 +1,50 @@
+package main
+
+import "sync"
+
+// scrollback keeps the lines trimmed from the top of a chat buffer to keep it
+// short, so that they can be put back when the user scrolls up to them.
+type scrollback struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+// push adds lines trimmed below those trimmed before.
+func (s *scrollback) push(lines []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, lines...)
+}
+
+// pop removes and returns the last n lines, or all of them when n <= 0.
+func (s *scrollback) pop(n int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n <= 0 || n > len(s.lines) {
+		n = len(s.lines)
+	}
+	out := append([]string(nil), s.lines[len(s.lines)-n:]...)
+	s.lines = s.lines[:len(s.lines)-n]
+	return out
+}
+
+// AcpTrimLines keeps lines trimmed from the top of the chat buffer of a
+// session, below those trimmed before
+func (m *SessionManager) AcpTrimLines(bufnr int, lines []string) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	session.scrollback.push(lines)
+	return nil, nil
+}
+
+// AcpRestoreLines returns the last n lines trimmed from the chat buffer of a
+// session, or all of them when n is 0, and forgets them
+func (m *SessionManager) AcpRestoreLines(bufnr int, n int) ([]string, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	return session.scrollback.pop(n), nil
+}
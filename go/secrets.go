@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// secretPrefix namespaces the secrets stored by the plugin.
+const secretPrefix = "acp.nvim"
+
+// SecretStore is where API keys entered by the user are kept between
+// sessions, so that they never have to be written in the plugin config.
+type SecretStore struct {
+	// Type is "env_file", "pass" or "command"
+	Type string `json:"type" msgpack:"type"`
+	// Path is the file of the "env_file" store
+	Path string `json:"path" msgpack:"path"`
+	// Get and Set are the commands of the "command" store, e.g. an OS
+	// keychain CLI. {name} is replaced with the name of the secret. Get prints
+	// the secret and Set reads it from stdin.
+	Get []string `json:"get" msgpack:"get"`
+	Set []string `json:"set" msgpack:"set"`
+}
+
+// load returns the secret called name. ok is false when it isn't stored.
+func (s *SecretStore) load(ctx context.Context, name string) (value string, ok bool, err error) {
+	switch s.Type {
+	case "env_file":
+		env, err := readEnvFile(s.Path)
+		if err != nil {
+			return "", false, err
+		}
+		value, ok = env[envName(name)]
+		return value, ok, nil
+	case "pass":
+		out, err := exec.CommandContext(ctx, "pass", "show", secretPrefix+"/"+name).Output()
+		if err != nil {
+			return "", false, nil
+		}
+		value, _, _ = strings.Cut(string(out), "\n")
+		return value, value != "", nil
+	case "command":
+		if len(s.Get) == 0 {
+			return "", false, fmt.Errorf("secret store command has no get command")
+		}
+		args := commandArgs(expandSecretName(s.Get, name))
+		out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+		if err != nil {
+			return "", false, nil
+		}
+		value = strings.TrimRight(string(out), "\r\n")
+		return value, value != "", nil
+	default:
+		return "", false, fmt.Errorf("unknown secret store type %q", s.Type)
+	}
+}
+
+// save stores value as the secret called name.
+func (s *SecretStore) save(ctx context.Context, name, value string) error {
+	var cmd *exec.Cmd
+	switch s.Type {
+	case "env_file":
+		return writeEnvFile(s.Path, envName(name), value)
+	case "pass":
+		cmd = exec.CommandContext(ctx, "pass", "insert", "--multiline", "--force", secretPrefix+"/"+name)
+	case "command":
+		if len(s.Set) == 0 {
+			return fmt.Errorf("secret store command has no set command")
+		}
+		args := commandArgs(expandSecretName(s.Set, name))
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+	default:
+		return fmt.Errorf("unknown secret store type %q", s.Type)
+	}
+	cmd.Stdin = strings.NewReader(value + "\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("store secret %s: %w: %s", name, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func expandSecretName(args []string, name string) []string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = strings.ReplaceAll(a, "{name}", secretPrefix+"/"+name)
+	}
+	return out
+}
+
+// envName turns a secret name into an environment variable name, e.g.
+// "gemini/api-key" into "ACP_NVIM_GEMINI_API_KEY".
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, secretPrefix+"_"+name)
+}
+
+// readEnvFile reads the KEY=value lines of a dotenv style file. A missing
+// file has no entries.
+func readEnvFile(path string) (map[string]string, error) {
+	env := map[string]string{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return env, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if uq, err := strconv.Unquote(value); err == nil && value[0] == '"' {
+			value = uq
+		} else if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[strings.TrimSpace(key)] = value
+	}
+	return env, scanner.Err()
+}
+
+// writeEnvFile sets key in the env file at path, keeping its other lines.
+// The file is only readable by the user since it holds secrets.
+func writeEnvFile(path, key, value string) error {
+	var lines []string
+	if b, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+			k, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "export "), "=")
+			if strings.TrimSpace(k) != key {
+				lines = append(lines, line)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	lines = append(lines, fmt.Sprintf("%s=%q", key, value))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600)
+}
+
+// secretRef matches the secret references of MCP headers: {{env:NAME}},
+// {{file:path}} and {{cmd:shell command}}.
+var secretRef = regexp.MustCompile(`\{\{\s*(env|file|cmd):(.*?)\s*\}\}`)
+
+// resolveSecrets replaces the secret references in s with the value of the
+// environment variable, the content of the file or the output of the
+// command, so that e.g. "Bearer {{cmd:gh auth token}}" doesn't have to keep
+// the token in the config.
+func (e expander) resolveSecrets(ctx context.Context, s string) (string, error) {
+	var resolveErr error
+	out := secretRef.ReplaceAllStringFunc(s, func(ref string) string {
+		m := secretRef.FindStringSubmatch(ref)
+		kind, arg := m[1], strings.TrimSpace(m[2])
+		var value string
+		switch kind {
+		case "env":
+			v, ok := e.lookup(arg)
+			if !ok {
+				resolveErr = fmt.Errorf("environment variable %s is not set", arg)
+			}
+			value = v
+		case "file":
+			b, err := os.ReadFile(e.expand(arg))
+			if err != nil {
+				resolveErr = err
+			}
+			value = string(b)
+		case "cmd":
+			shell := shellArgs(arg)
+			out, err := exec.CommandContext(ctx, shell[0], shell[1:]...).Output()
+			if err != nil {
+				resolveErr = fmt.Errorf("command %q failed: %w", arg, err)
+			}
+			value = string(out)
+		}
+		return strings.TrimRight(value, "\r\n")
+	})
+	return out, resolveErr
+}
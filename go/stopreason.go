@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// continuePrompt asks the agent to go on with a turn cut short.
+const continuePrompt = "Continue"
+
+// cutShort tells why a turn that ended with a stop reason was cut short by a
+// limit of the agent, "" when it wasn't.
+func cutShort(reason acp.StopReason) string {
+	switch reason {
+	case acp.StopReasonMaxTokens:
+		return "the reply reached the token limit of the agent"
+	case acp.StopReasonMaxTurnRequests:
+		return "the turn reached the limit of requests to the model"
+	}
+	return ""
+}
+
+// stopped follows up on the stop reason of a turn that didn't fail: a turn
+// cut short is continued if the session allows more automatic continues in a
+// row, else the user is offered to continue it, and a refusal is flagged for
+// the UI. It runs on the update queue, after the updates of the turn.
+func (s *AcpSession) stopped(reason acp.StopReason) {
+	if reason == acp.StopReasonRefusal {
+		s.continued = 0
+		s.appendToBuffer("\n[The agent refused to answer]\n")
+		s.emit("refusal", nil)
+		s.callLua(`require('acp').on_refusal(...)`, s.bufnr)
+		return
+	}
+	why := cutShort(reason)
+	if why == "" {
+		s.continued = 0
+		return
+	}
+
+	s.mu.Lock()
+	auto := s.autoContinue
+	s.mu.Unlock()
+	if s.continued < auto {
+		s.continued++
+		s.appendToBuffer(fmt.Sprintf("\n[Stopped: %s, continuing (%d/%d)]\n🤖 ", why, s.continued, auto))
+		s.queuePrompt([]acp.ContentBlock{acp.TextBlock(continuePrompt)})
+		return
+	}
+	s.continued = 0
+	if s.bufnr == 0 {
+		s.appendToBuffer(fmt.Sprintf("\n[Stopped: %s]\n", why))
+		return
+	}
+	s.appendToBuffer(fmt.Sprintf("\n[Stopped: %s, :AcpContinue to continue]\n", why))
+}
+
+// AcpContinue asks the agent of a session to go on with the turn it cut
+// short
+func (m *SessionManager) AcpContinue(bufnr int) (any, error) {
+	return nil, m.whenReady(bufnr, func(session *AcpSession) {
+		session.queuePrompt([]acp.ContentBlock{acp.TextBlock(continuePrompt)})
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// templateDir is where project prompt templates live, relative to the
+// session directory. A template named "review" is read from review.md or
+// review.txt.
+var templateDir = filepath.Join(".acp", "prompts")
+
+var placeholderRe = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandTemplate replaces {name} placeholders with the matching args.
+// Placeholders without a value are left untouched.
+func expandTemplate(tmpl string, args map[string]string) string {
+	return placeholderRe.ReplaceAllStringFunc(tmpl, func(m string) string {
+		if v, ok := args[m[1:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+// loadTemplate returns the template called name, looking at the templates
+// from the session options first and the project's template directory next.
+func (s *AcpSession) loadTemplate(name string) (string, error) {
+	if tmpl, ok := s.templates[name]; ok {
+		return tmpl, nil
+	}
+	if strings.ContainsAny(name, `/\`) || name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid template name %q", name)
+	}
+	for _, ext := range []string{".md", ".txt"} {
+		b, err := os.ReadFile(filepath.Join(s.cwd, templateDir, name+ext))
+		if err == nil {
+			return string(b), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("read template %s: %w", name, err)
+		}
+	}
+	return "", fmt.Errorf("no prompt template named %q", name)
+}
+
+// AcpSendTemplate expands the prompt template called name with args and
+// sends the result as a prompt
+func (m *SessionManager) AcpSendTemplate(bufnr int, name string, args map[string]string) (any, error) {
+	return nil, m.whenReady(bufnr, func(session *AcpSession) {
+		tmpl, err := session.loadTemplate(name)
+		if err != nil {
+			session.appendToBuffer(fmt.Sprintf("Error: %v\n", err))
+			return
+		}
+		_, _ = m.AcpSendPrompt(bufnr, strings.TrimSpace(expandTemplate(tmpl, args)), AcpPromptOpts{})
+	})
+}
+
+// AcpListTemplates returns the names of the prompt templates available to a
+// session
+func (m *SessionManager) AcpListTemplates(bufnr int) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range session.templates {
+		names = append(names, name)
+	}
+	entries, _ := os.ReadDir(filepath.Join(session.cwd, templateDir))
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".md" && ext != ".txt") {
+			continue
+		}
+		if _, ok := session.templates[strings.TrimSuffix(e.Name(), ext)]; !ok {
+			names = append(names, strings.TrimSuffix(e.Name(), ext))
+		}
+	}
+	return names, nil
+}
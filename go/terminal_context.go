@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coder/acp-go-sdk"
+	"github.com/neovim/go-client/nvim"
+)
+
+// defaultTerminalLines is how many lines of a terminal buffer are attached
+// when no count is given.
+const defaultTerminalLines = 200
+
+// terminalBlock captures the last n non-blank lines of a Neovim terminal
+// buffer.
+func terminalBlock(termBuf int, n int) (acp.ContentBlock, error) {
+	if n <= 0 {
+		n = defaultTerminalLines
+	}
+	buf := nvim.Buffer(termBuf)
+
+	var buftype, name string
+	var raw [][]byte
+	b := vim.api.NewBatch()
+	b.BufferOption(buf, "buftype", &buftype)
+	b.BufferName(buf, &name)
+	b.BufferLines(buf, 0, -1, false, &raw)
+	if err := b.Execute(); err != nil {
+		return acp.ContentBlock{}, fmt.Errorf("buffer %d: %w", termBuf, err)
+	}
+	if buftype != "terminal" {
+		return acp.ContentBlock{}, fmt.Errorf("buffer %d is not a terminal", termBuf)
+	}
+	// The screen area below the last output is blank, skip it
+	end := len(raw)
+	for end > 0 && strings.TrimSpace(string(raw[end-1])) == "" {
+		end--
+	}
+	start := max(end-n, 0)
+	lines := make([]string, 0, end-start)
+	for _, l := range raw[start:end] {
+		lines = append(lines, strings.TrimRight(string(l), " "))
+	}
+
+	return acp.TextBlock(fmt.Sprintf("Last %d lines of %s:\n```\n%s\n```", len(lines), name, strings.Join(lines, "\n"))), nil
+}
+
+// AcpAttachTerminal attaches the last n lines of a terminal buffer to the
+// next prompt
+func (m *SessionManager) AcpAttachTerminal(bufnr int, termBuf int, n int) (any, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return nil, err
+	}
+	block, err := terminalBlock(termBuf, n)
+	if err != nil {
+		return nil, err
+	}
+	session.attach(block)
+	session.appendToBuffer(fmt.Sprintf("[Attached output of terminal buffer %d]\n", termBuf))
+	return nil, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// RequestTimeouts bounds how long the client takes to answer the requests of
+// the agent it handles through Neovim, e.g. file reads that look up buffers
+// and the extension methods handled in Lua, in milliseconds by method. The
+// "default" key applies to the methods without their own. A zero timeout
+// uses defaultRequestTimeout and a negative one disables it.
+type RequestTimeouts map[string]int
+
+// defaultRequestTimeout is the timeout of a request without one set.
+const defaultRequestTimeout = 30 * time.Second
+
+// of returns the timeout of method, 0 for none.
+func (t RequestTimeouts) of(method string) time.Duration {
+	ms, ok := t[method]
+	if !ok {
+		ms = t["default"]
+	}
+	switch {
+	case ms < 0:
+		return 0
+	case ms == 0:
+		return defaultRequestTimeout
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// withTimeout runs fn, which handles a request of the agent, and returns its
+// result, or an error once the timeout of method is over. A call to Neovim
+// can't be interrupted: fn goes on in the background, and a write may still
+// happen after the agent was told it failed.
+func withTimeout[T any](s *AcpSession, ctx context.Context, method string, fn func() (T, error)) (T, error) {
+	s.mu.Lock()
+	d := s.opts.RequestTimeouts.of(method)
+	s.mu.Unlock()
+	if d <= 0 {
+		return fn()
+	}
+
+	type result struct {
+		v   T
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		defer func() { done <- r }()
+		defer s.recoverPanic(method, &r.err)
+		r.v, r.err = fn()
+	}()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	var zero T
+	select {
+	case r := <-done:
+		return r.v, r.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case <-timer.C:
+		logWarn("%s of buffer %d timed out after %s, Neovim didn't answer", method, s.bufnr, d)
+		s.appendToBuffer(fmt.Sprintf("\n[%s timed out after %s]\n", method, d))
+		return zero, acp.NewInternalError(map[string]any{"error": fmt.Sprintf("%s timed out after %s", method, d)})
+	}
+}
+
+// timed bounds an extension handler with the timeout of its method.
+func (c *acpClientImpl) timed(method string, h extHandler) extHandler {
+	return func(ctx context.Context, params json.RawMessage) (any, error) {
+		return withTimeout(c.session, ctx, method, func() (any, error) {
+			return h(ctx, params)
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// TraceConfig enables logging of every JSON-RPC message exchanged with the
+// agent to a file, for debugging agents that misbehave.
+type TraceConfig struct {
+	// Dir is where the trace files are written, one per session
+	Dir string `json:"dir" msgpack:"dir"`
+	// Redact lists the keys whose string values are left out of the trace,
+	// at any depth. Defaults to defaultTraceRedact.
+	Redact []string `json:"redact" msgpack:"redact"`
+	// MaxLength truncates the params and results of the trace, 2000 bytes
+	// by default
+	MaxLength int `json:"max_length" msgpack:"max_length"`
+}
+
+// defaultTraceRedact leaves file contents, prompts, messages and credentials
+// out of traces.
+var defaultTraceRedact = []string{"text", "data", "content", "oldText", "newText", "output", "headers", "env", "api_key"}
+
+const defaultTraceMaxLength = 2000
+
+// tracer writes the messages of a session as JSON lines. A nil tracer
+// traces nothing.
+type tracer struct {
+	mu        sync.Mutex
+	f         *os.File
+	redact    map[string]bool
+	maxLength int
+	// pending holds the requests waiting for a response, keyed by the
+	// direction they were sent in and their ID
+	pending map[string]pendingCall
+}
+
+type pendingCall struct {
+	method string
+	start  time.Time
+}
+
+type traceEntry struct {
+	Time       string            `json:"time"`
+	Dir        string            `json:"dir"`
+	Kind       string            `json:"kind"`
+	ID         json.RawMessage   `json:"id,omitempty"`
+	Method     string            `json:"method,omitempty"`
+	DurationMs *int64            `json:"duration_ms,omitempty"`
+	Params     string            `json:"params,omitempty"`
+	Result     string            `json:"result,omitempty"`
+	Error      *acp.RequestError `json:"error,omitempty"`
+}
+
+// newTracer creates the trace file of the session of bufnr in the directory
+// of config.
+func newTracer(config TraceConfig, bufnr int) (*tracer, error) {
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("trace-%s-%d.jsonl", time.Now().Format("20060102-150405"), bufnr)
+	f, err := os.OpenFile(filepath.Join(config.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	redact := config.Redact
+	if redact == nil {
+		redact = defaultTraceRedact
+	}
+	t := &tracer{
+		f:         f,
+		redact:    map[string]bool{},
+		maxLength: config.MaxLength,
+		pending:   map[string]pendingCall{},
+	}
+	if t.maxLength <= 0 {
+		t.maxLength = defaultTraceMaxLength
+	}
+	for _, key := range redact {
+		t.redact[key] = true
+	}
+	return t, nil
+}
+
+// path returns the trace file, or "" when not tracing.
+func (t *tracer) path() string {
+	if t == nil {
+		return ""
+	}
+	return t.f.Name()
+}
+
+// log traces a message. Lines that aren't JSON-RPC messages are ignored.
+func (t *tracer) log(dir string, line []byte) {
+	var msg rpcMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return
+	}
+
+	now := time.Now()
+	entry := traceEntry{
+		Time:   now.Format(time.RFC3339Nano),
+		Dir:    dir,
+		Method: msg.Method,
+		Params: t.format(msg.Params),
+		Result: t.format(msg.Result),
+		Error:  msg.Error,
+	}
+	if msg.ID != nil {
+		entry.ID = *msg.ID
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case msg.Method != "" && msg.ID != nil:
+		entry.Kind = "request"
+		t.pending[dir+string(*msg.ID)] = pendingCall{method: msg.Method, start: now}
+	case msg.Method != "":
+		entry.Kind = "notification"
+	default:
+		entry.Kind = "response"
+		// The request was sent in the other direction
+		key := "send"
+		if dir == "send" {
+			key = "recv"
+		}
+		if msg.ID != nil {
+			key += string(*msg.ID)
+		}
+		if call, ok := t.pending[key]; ok {
+			delete(t.pending, key)
+			ms := now.Sub(call.start).Milliseconds()
+			entry.Method, entry.DurationMs = call.method, &ms
+		}
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	_, _ = t.f.Write(append(b, '\n'))
+}
+
+// format redacts and truncates the params or result of a message.
+func (t *tracer) format(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return ""
+	}
+	b, err := json.Marshal(t.redactValue(v, false))
+	if err != nil {
+		return ""
+	}
+	if len(b) > t.maxLength {
+		return fmt.Sprintf("%s... (%d bytes)", b[:t.maxLength], len(b))
+	}
+	return string(b)
+}
+
+// redactValue replaces the strings under the redacted keys with their size.
+// The "type" of redacted values is kept to show what was left out.
+func (t *tracer) redactValue(v any, redacted bool) any {
+	switch v := v.(type) {
+	case string:
+		if redacted {
+			return fmt.Sprintf("[redacted %d bytes]", len(v))
+		}
+		return v
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = t.redactValue(item, redacted)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			if redacted && k == "type" {
+				out[k] = item
+				continue
+			}
+			out[k] = t.redactValue(item, redacted || t.redact[k])
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+	_ = t.f.Close()
+}
+
+// AcpTracePath returns the trace file of a session, or "" when the session
+// isn't traced
+func (m *SessionManager) AcpTracePath(bufnr int) (string, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return "", err
+	}
+	return session.trace.path(), nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// Transcript is the structured record of a session, as exported by
+// AcpExportSession.
+type Transcript struct {
+	SessionID  string           `json:"session_id"`
+	Agent      string           `json:"agent"`
+	Cwd        string           `json:"cwd"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Turns      []TranscriptTurn `json:"turns"`
+}
+
+// TranscriptTurn is a prompt and what the agent did about it.
+type TranscriptTurn struct {
+	Start      time.Time         `json:"start"`
+	DurationMs int64             `json:"duration_ms"`
+	Prompt     string            `json:"prompt"`
+	StopReason string            `json:"stop_reason,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Events     []TranscriptEvent `json:"events"`
+	// mark is the bookmark of the turn in the chat buffer, 0 if none
+	mark int
+}
+
+// TranscriptEvent is a step of a turn. Kind is "message", "thought", "plan",
+// "tool_call", "permission" or "retry", and tells which of the other fields
+// is set. Retries, of a request that failed, are described in Text.
+type TranscriptEvent struct {
+	Time       time.Time             `json:"time"`
+	Kind       string                `json:"kind"`
+	Text       string                `json:"text,omitempty"`
+	Plan       []TranscriptPlanEntry `json:"plan,omitempty"`
+	ToolCall   *TranscriptToolCall   `json:"tool_call,omitempty"`
+	Permission *TranscriptPermission `json:"permission,omitempty"`
+}
+
+type TranscriptPlanEntry struct {
+	Content string `json:"content"`
+	Status  string `json:"status"`
+}
+
+// TranscriptToolCall is a tool call in its last known state.
+type TranscriptToolCall struct {
+	ID     string           `json:"id"`
+	Title  string           `json:"title"`
+	Kind   string           `json:"kind,omitempty"`
+	Status string           `json:"status,omitempty"`
+	Output string           `json:"output,omitempty"`
+	Diffs  []TranscriptDiff `json:"diffs,omitempty"`
+}
+
+type TranscriptDiff struct {
+	Path    string `json:"path"`
+	OldText string `json:"old_text"`
+	NewText string `json:"new_text"`
+}
+
+// TranscriptPermission is a permission request and the option chosen, empty
+// when it was denied.
+type TranscriptPermission struct {
+	Title  string `json:"title"`
+	Option string `json:"option,omitempty"`
+	Auto   bool   `json:"auto,omitempty"`
+}
+
+// transcript records the turns of a session as they happen. Prompts are
+// recorded by prompt, the rest from the session's updateQueue, except for
+// permission requests.
+type transcript struct {
+	mu    sync.Mutex
+	turns []TranscriptTurn
+	// version counts the changes, for checkpoints
+	version int
+	// marks is the last bookmark given to a turn
+	marks int
+}
+
+// startTurn records the start of a turn and returns the ID of its bookmark.
+func (t *transcript) startTurn(blocks []acp.ContentBlock) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.version++
+	t.marks++
+	t.turns = append(t.turns, TranscriptTurn{Start: time.Now(), Prompt: promptText(blocks), mark: t.marks})
+	return t.marks
+}
+
+func (t *transcript) endTurn(stopReason acp.StopReason, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.turns) == 0 {
+		return
+	}
+	t.version++
+	turn := &t.turns[len(t.turns)-1]
+	turn.DurationMs = time.Since(turn.Start).Milliseconds()
+	turn.StopReason = string(stopReason)
+	if err != nil {
+		turn.Error = err.Error()
+	}
+}
+
+// add appends ev to the current turn, merging text chunks into the event
+// before them.
+func (t *transcript) add(ev TranscriptEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.version++
+	if len(t.turns) == 0 {
+		// The agent may speak before the first prompt
+		t.turns = append(t.turns, TranscriptTurn{Start: time.Now()})
+	}
+	turn := &t.turns[len(t.turns)-1]
+	if n := len(turn.Events); n > 0 {
+		last := &turn.Events[n-1]
+		switch {
+		case (ev.Kind == "message" || ev.Kind == "thought") && last.Kind == ev.Kind:
+			last.Text += ev.Text
+			return
+		case ev.Kind == "plan" && last.Kind == "plan":
+			// Each plan replaces the previous one
+			last.Plan = ev.Plan
+			return
+		}
+	}
+	ev.Time = time.Now()
+	turn.Events = append(turn.Events, ev)
+}
+
+// update records a session update.
+func (t *transcript) update(u acp.SessionUpdate) {
+	switch {
+	case u.AgentMessageChunk != nil && u.AgentMessageChunk.Content.Text != nil:
+		t.add(TranscriptEvent{Kind: "message", Text: u.AgentMessageChunk.Content.Text.Text})
+	case u.AgentThoughtChunk != nil && u.AgentThoughtChunk.Content.Text != nil:
+		t.add(TranscriptEvent{Kind: "thought", Text: u.AgentThoughtChunk.Content.Text.Text})
+	case u.Plan != nil:
+		plan := []TranscriptPlanEntry{}
+		for _, e := range u.Plan.Entries {
+			plan = append(plan, TranscriptPlanEntry{Content: e.Content, Status: string(e.Status)})
+		}
+		t.add(TranscriptEvent{Kind: "plan", Plan: plan})
+	case u.ToolCall != nil:
+		tc := &TranscriptToolCall{
+			ID:     string(u.ToolCall.ToolCallId),
+			Title:  u.ToolCall.Title,
+			Kind:   string(u.ToolCall.Kind),
+			Status: string(u.ToolCall.Status),
+		}
+		tc.setContent(u.ToolCall.Content)
+		t.add(TranscriptEvent{Kind: "tool_call", ToolCall: tc})
+	case u.ToolCallUpdate != nil:
+		tu := u.ToolCallUpdate
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		tc := t.toolCall(string(tu.ToolCallId))
+		if tc == nil {
+			return
+		}
+		t.version++
+		if tu.Title != nil {
+			tc.Title = *tu.Title
+		}
+		if tu.Kind != nil {
+			tc.Kind = string(*tu.Kind)
+		}
+		if tu.Status != nil {
+			tc.Status = string(*tu.Status)
+		}
+		if tu.Content != nil {
+			tc.setContent(tu.Content)
+		}
+	}
+}
+
+// toolCall returns the last recorded tool call with the given id, if any.
+func (t *transcript) toolCall(id string) *TranscriptToolCall {
+	for i := len(t.turns) - 1; i >= 0; i-- {
+		events := t.turns[i].Events
+		for j := len(events) - 1; j >= 0; j-- {
+			if tc := events[j].ToolCall; tc != nil && tc.ID == id {
+				return tc
+			}
+		}
+	}
+	return nil
+}
+
+func (tc *TranscriptToolCall) setContent(content []acp.ToolCallContent) {
+	var out strings.Builder
+	tc.Diffs = nil
+	for _, c := range content {
+		if c.Content != nil && c.Content.Content.Text != nil {
+			out.WriteString(c.Content.Content.Text.Text)
+		}
+		if c.Diff != nil {
+			d := TranscriptDiff{Path: c.Diff.Path, NewText: c.Diff.NewText}
+			if c.Diff.OldText != nil {
+				d.OldText = *c.Diff.OldText
+			}
+			tc.Diffs = append(tc.Diffs, d)
+		}
+	}
+	tc.Output = out.String()
+}
+
+// permission records a permission request and its outcome.
+func (t *transcript) permission(params acp.RequestPermissionRequest, resp acp.RequestPermissionResponse, auto bool) {
+	p := &TranscriptPermission{Auto: auto}
+	if params.ToolCall.Title != nil {
+		p.Title = *params.ToolCall.Title
+	}
+	if sel := resp.Outcome.Selected; sel != nil {
+		for _, o := range params.Options {
+			if o.OptionId == sel.OptionId {
+				p.Option = o.Name
+			}
+		}
+	}
+	t.add(TranscriptEvent{Kind: "permission", Permission: p})
+}
+
+// promptText returns the text of a prompt, with attachments as @ mentions.
+func promptText(blocks []acp.ContentBlock) string {
+	var parts []string
+	for _, b := range blocks {
+		switch {
+		case b.Text != nil:
+			parts = append(parts, b.Text.Text)
+		case b.ResourceLink != nil:
+			parts = append(parts, "@"+mentionText(b.ResourceLink.Uri))
+		case b.Resource != nil && b.Resource.Resource.TextResourceContents != nil:
+			parts = append(parts, "@"+mentionText(b.Resource.Resource.TextResourceContents.Uri))
+		case b.Image != nil:
+			parts = append(parts, "[image]")
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// mentionText returns the path of the file of uri, or uri if it isn't a
+// file.
+func mentionText(uri string) string {
+	if p, ok := uriPath(uri); ok {
+		return p
+	}
+	return uri
+}
+
+// count returns the number of turns recorded.
+func (t *transcript) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.turns)
+}
+
+// changes returns the number of changes made to the transcript so far.
+func (t *transcript) changes() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.version
+}
+
+// snapshot returns a copy of the transcript of session s.
+func (s *AcpSession) snapshot() Transcript {
+	t := &s.transcript
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := Transcript{
+		SessionID:  string(s.sessionID),
+		Agent:      s.agentName,
+		Cwd:        s.cwd,
+		ExportedAt: time.Now(),
+		Turns:      make([]TranscriptTurn, len(t.turns)),
+	}
+	for i, turn := range t.turns {
+		turn.Events = append([]TranscriptEvent(nil), turn.Events...)
+		for j, ev := range turn.Events {
+			if ev.ToolCall != nil {
+				tc := *ev.ToolCall
+				turn.Events[j].ToolCall = &tc
+			}
+		}
+		out.Turns[i] = turn
+	}
+	return out
+}
+
+// markdown renders the transcript for people to read.
+func (tr Transcript) markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Session %s\n\n", tr.SessionID)
+	if tr.Agent != "" {
+		fmt.Fprintf(&b, "- Agent: %s\n", tr.Agent)
+	}
+	fmt.Fprintf(&b, "- Directory: %s\n- Exported: %s\n", tr.Cwd, tr.ExportedAt.Format(time.RFC3339))
+	for i, turn := range tr.Turns {
+		fmt.Fprintf(&b, "\n## Turn %d\n\n", i+1)
+		fmt.Fprintf(&b, "_%s, %s", turn.Start.Format(time.RFC3339), time.Duration(turn.DurationMs)*time.Millisecond)
+		if turn.StopReason != "" {
+			fmt.Fprintf(&b, ", %s", turn.StopReason)
+		}
+		b.WriteString("_\n")
+		if turn.Prompt != "" {
+			b.WriteString("\n### Prompt\n\n")
+			b.WriteString(strings.TrimSpace(turn.Prompt) + "\n")
+		}
+		if len(turn.Events) > 0 {
+			b.WriteString("\n### Response\n")
+		}
+		for _, ev := range turn.Events {
+			b.WriteString("\n")
+			switch ev.Kind {
+			case "message":
+				b.WriteString(strings.TrimSpace(ev.Text) + "\n")
+			case "thought":
+				for _, l := range strings.Split(strings.TrimSpace(ev.Text), "\n") {
+					b.WriteString(strings.TrimRight("> "+l, " ") + "\n")
+				}
+			case "plan":
+				b.WriteString("**Plan**\n\n")
+				for _, e := range ev.Plan {
+					mark := " "
+					if e.Status == string(acp.PlanEntryStatusCompleted) {
+						mark = "x"
+					}
+					fmt.Fprintf(&b, "- [%s] %s\n", mark, e.Content)
+				}
+			case "tool_call":
+				tc := ev.ToolCall
+				fmt.Fprintf(&b, "**🔧 %s** (%s)\n", tc.Title, tc.Status)
+				if tc.Output != "" {
+					b.WriteString("\n" + fence(tc.Output, ""))
+				}
+				for _, d := range tc.Diffs {
+					diff, ok := unifiedDiff(d.OldText, d.NewText)
+					if !ok {
+						fmt.Fprintf(&b, "\n_Diff of %s too large_\n", d.Path)
+						continue
+					}
+					b.WriteString("\n" + fence(fmt.Sprintf("--- %s\n+++ %s\n%s", d.Path, d.Path, diff), "diff"))
+				}
+			case "permission":
+				p := ev.Permission
+				switch {
+				case p.Option == "":
+					fmt.Fprintf(&b, "_Permission denied: %s_\n", p.Title)
+				case p.Auto:
+					fmt.Fprintf(&b, "_Permission granted automatically: %s (%s)_\n", p.Title, p.Option)
+				default:
+					fmt.Fprintf(&b, "_Permission granted: %s (%s)_\n", p.Title, p.Option)
+				}
+			}
+		}
+		if turn.Error != "" {
+			fmt.Fprintf(&b, "\n**Error:** %s\n", turn.Error)
+		}
+	}
+	return b.String()
+}
+
+// fence wraps text in a Markdown code block, with a fence longer than the
+// runs of backticks in it.
+func fence(text, lang string) string {
+	n, run := 3, 0
+	for _, r := range text {
+		if r == '`' {
+			run++
+			n = max(n, run+1)
+		} else {
+			run = 0
+		}
+	}
+	f := strings.Repeat("`", n)
+	return f + lang + "\n" + strings.TrimSuffix(text, "\n") + "\n" + f + "\n"
+}
+
+// AcpExportSession writes the transcript of a session to path, as "markdown"
+// or "json". An empty format is guessed from the extension of path
+func (m *SessionManager) AcpExportSession(bufnr int, format string, path string) (string, error) {
+	session, err := m.get(bufnr)
+	if err != nil {
+		return "", err
+	}
+	if format == "" {
+		format = "markdown"
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			format = "json"
+		}
+	}
+
+	// The transcript is only complete once the updates received are
+	session.updates.wait()
+	tr := session.snapshot()
+	var data []byte
+	switch format {
+	case "markdown", "md":
+		data = []byte(tr.markdown())
+	case "json":
+		data, err = json.MarshalIndent(tr, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		data = append(data, '\n')
+	default:
+		return "", fmt.Errorf("unknown format %q, expected markdown or json", format)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
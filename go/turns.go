@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/coder/acp-go-sdk"
+)
+
+// turnQueue runs the turns of a session one after the other. Neovim's
+// notifications are handled one at a time, so running a turn in the handler
+// of AcpSendPrompt would hold up every other notification until the turn
+// ends, including the prompts of other sessions and AcpCancel.
+type turnQueue struct {
+	mu      sync.Mutex
+	pending []func()
+	running bool
+}
+
+// queuePrompt runs a turn with the given content once the turns sent before
+// it are over. Failures are reported in the chat buffer.
+func (s *AcpSession) queuePrompt(blocks []acp.ContentBlock) {
+	s.queueTurn(func() { _ = s.prompt(blocks) })
+}
+
+// queueTurn runs fn, which talks to the agent like a turn does, once the
+// turns sent before it are over.
+func (s *AcpSession) queueTurn(fn func()) {
+	q := &s.turns
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, fn)
+	if !q.running {
+		q.running = true
+		go s.runTurns()
+	}
+}
+
+func (s *AcpSession) runTurns() {
+	q := &s.turns
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		fn := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+
+		fn()
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+)
+
+// chunkJoiner joins the characters agents split between two chunks of a
+// reply. An agent cutting its text in bytes sends the start of a multi-byte
+// UTF-8 sequence in one chunk and its end in the next, and one cutting it in
+// UTF-16 code units does the same with the halves of a surrogate pair. Either
+// half decodes to U+FFFD on its own, so the end of a chunk cut in a character
+// is held back, undecoded, and put in front of the next chunk of the same
+// kind. Updates are joined in the order they are read, by a single goroutine.
+type chunkJoiner struct {
+	// tails are the held back ends of the text of the last chunks, by kind
+	// of update
+	tails map[string][]byte
+}
+
+// chunkUpdate is the part of a session update the joiner looks at.
+type chunkUpdate struct {
+	Update struct {
+		SessionUpdate string `json:"sessionUpdate"`
+		Content       struct {
+			Text json.RawMessage `json:"text"`
+		} `json:"content"`
+	} `json:"update"`
+}
+
+// join returns params with the text of a chunk joined to the tail held back
+// from the previous one, and without its own tail cut in a character.
+func (j *chunkJoiner) join(params json.RawMessage) json.RawMessage {
+	var u chunkUpdate
+	if json.Unmarshal(params, &u) != nil {
+		return params
+	}
+	kind := u.Update.SessionUpdate
+	lit := u.Update.Content.Text
+	if !strings.HasSuffix(kind, "_chunk") || len(lit) < 2 || lit[0] != '"' {
+		return params
+	}
+
+	body := lit[1 : len(lit)-1]
+	held := j.tails[kind]
+	delete(j.tails, kind)
+	if len(held) > 0 && !continuesChar(body) {
+		// The character was never finished
+		held = nil
+	}
+	if len(held) > 0 {
+		body = append(bytes.Clone(held), body...)
+	}
+	tail := cutTail(body)
+	if len(held) == 0 && len(tail) == 0 {
+		return params
+	}
+	if len(tail) > 0 {
+		if j.tails == nil {
+			j.tails = map[string][]byte{}
+		}
+		j.tails[kind] = bytes.Clone(tail)
+		body = body[:len(body)-len(tail)]
+	}
+
+	joined := make([]byte, 0, len(body)+2)
+	joined = append(append(append(joined, '"'), body...), '"')
+	out, err := setChunkText(params, joined)
+	if err != nil {
+		logWarn("Error joining session update chunks: %v", err)
+		return params
+	}
+	return out
+}
+
+// cutTail returns the end of the body of a JSON string cut in a character:
+// an incomplete UTF-8 sequence or the escape of a high surrogate.
+func cutTail(body []byte) []byte {
+	for i := len(body) - 1; i >= 0 && i >= len(body)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(body[i]) {
+			if body[i] >= utf8.RuneSelf && !utf8.FullRune(body[i:]) {
+				return body[i:]
+			}
+			break
+		}
+	}
+	if n := len(body) - 6; n >= 0 && isSurrogateEscape(body[n:], 0xd800) && !escaped(body[:n]) {
+		return body[n:]
+	}
+	return nil
+}
+
+// continuesChar reports whether the body of a JSON string starts with the end
+// of a character: a UTF-8 continuation byte or the escape of a low surrogate.
+func continuesChar(body []byte) bool {
+	if len(body) > 0 && !utf8.RuneStart(body[0]) {
+		return true
+	}
+	return len(body) >= 6 && isSurrogateEscape(body[:6], 0xdc00)
+}
+
+// isSurrogateEscape reports whether esc is a \uXXXX escape of a surrogate in
+// the 1024 ones from base.
+func isSurrogateEscape(esc []byte, base rune) bool {
+	if len(esc) != 6 || esc[0] != '\\' || esc[1] != 'u' {
+		return false
+	}
+	var r rune
+	for _, c := range esc[2:] {
+		switch {
+		case '0' <= c && c <= '9':
+			r = r<<4 | rune(c-'0')
+		case 'a' <= c && c <= 'f':
+			r = r<<4 | rune(c-'a'+10)
+		case 'A' <= c && c <= 'F':
+			r = r<<4 | rune(c-'A'+10)
+		default:
+			return false
+		}
+	}
+	return base <= r && r < base+0x400
+}
+
+// escaped reports whether the body of a JSON string ends with an odd number
+// of backslashes, which escape what follows.
+func escaped(body []byte) bool {
+	n := 0
+	for i := len(body) - 1; i >= 0 && body[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+// setChunkText returns params with the text of the content of the update set
+// to the JSON string lit.
+func setChunkText(params json.RawMessage, lit []byte) (json.RawMessage, error) {
+	var n, update, content map[string]json.RawMessage
+	if err := json.Unmarshal(params, &n); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(n["update"], &update); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(update["content"], &content); err != nil {
+		return nil, err
+	}
+	content["text"] = lit
+	var err error
+	if update["content"], err = json.Marshal(content); err != nil {
+		return nil, err
+	}
+	if n["update"], err = json.Marshal(update); err != nil {
+		return nil, err
+	}
+	return json.Marshal(n)
+}
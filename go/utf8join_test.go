@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// chunkParams returns the params of a chunk of kind whose text is the body
+// of a JSON string, as is.
+func chunkParams(kind, body string) json.RawMessage {
+	return json.RawMessage(`{"sessionId":"s","update":{"sessionUpdate":"` + kind + `","content":{"type":"text","text":"` + body + `"}}}`)
+}
+
+func TestChunkJoiner(t *testing.T) {
+	type chunk struct{ kind, body string }
+	msg := func(body string) chunk { return chunk{"agent_message_chunk", body} }
+	thought := func(body string) chunk { return chunk{"agent_thought_chunk", body} }
+	tests := []struct {
+		name   string
+		chunks []chunk
+		// want is the text of the chunks of each kind once joined
+		want map[string]string
+	}{
+		{name: "whole characters", chunks: []chunk{msg("café "), msg("😀")}, want: map[string]string{"agent_message_chunk": "café 😀"}},
+		{name: "UTF-8 split", chunks: []chunk{msg("caf\xc3"), msg("\xa9")}, want: map[string]string{"agent_message_chunk": "café"}},
+		{name: "emoji split in three", chunks: []chunk{msg("a\xf0\x9f"), msg("\x98"), msg("\x80b")}, want: map[string]string{"agent_message_chunk": "a😀b"}},
+		{name: "surrogate pair split", chunks: []chunk{msg(`a\ud83d`), msg(`\ude00b`)}, want: map[string]string{"agent_message_chunk": "a😀b"}},
+		{name: "escaped backslash before u", chunks: []chunk{msg(`a\\ud83d`), msg("b")}, want: map[string]string{"agent_message_chunk": `a\ud83db`}},
+		{name: "kinds joined apart", chunks: []chunk{msg("\xc3"), thought("x"), msg("\xa9")}, want: map[string]string{"agent_message_chunk": "é", "agent_thought_chunk": "x"}},
+		{name: "character never finished", chunks: []chunk{msg("a\xc3"), msg("b")}, want: map[string]string{"agent_message_chunk": "ab"}},
+		{name: "empty chunks", chunks: []chunk{msg(""), msg("\xc3"), msg("\xa9")}, want: map[string]string{"agent_message_chunk": "é"}},
+		{name: "CRLF", chunks: []chunk{msg(`a\r`), msg(`\nb`)}, want: map[string]string{"agent_message_chunk": "a\r\nb"}},
+	}
+	for _, tt := range tests {
+		var j chunkJoiner
+		got := map[string]*strings.Builder{}
+		for _, c := range tt.chunks {
+			var u struct {
+				Update struct {
+					SessionUpdate string `json:"sessionUpdate"`
+					Content       struct {
+						Text string `json:"text"`
+					} `json:"content"`
+				} `json:"update"`
+			}
+			if err := json.Unmarshal(j.join(chunkParams(c.kind, c.body)), &u); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if got[c.kind] == nil {
+				got[c.kind] = &strings.Builder{}
+			}
+			got[c.kind].WriteString(u.Update.Content.Text)
+		}
+		for kind, want := range tt.want {
+			if got[kind].String() != want {
+				t.Errorf("%s: got %s %q, want %q", tt.name, kind, got[kind].String(), want)
+			}
+		}
+	}
+}
+
+func TestChunkJoinerPassesOtherUpdates(t *testing.T) {
+	var j chunkJoiner
+	params := json.RawMessage(`{"sessionId":"s","update":{"sessionUpdate":"tool_call","title":"\xc3"}}`)
+	if got := j.join(params); string(got) != string(params) {
+		t.Errorf("got %s", got)
+	}
+}
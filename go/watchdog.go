@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// slowCallThreshold is how long a call may take before a warning is logged,
+// 0 to never warn.
+var slowCallThreshold atomic.Int64
+
+func init() {
+	slowCallThreshold.Store(int64(5 * time.Second))
+}
+
+// slowCall warns when a call runs for longer than slowCallThreshold, to help
+// find what stalls the UI, e.g. a permission prompt left open or a Lua call
+// blocked by the editor.
+type slowCall struct {
+	name  string
+	start time.Time
+	timer *time.Timer
+}
+
+// watch starts watching the call called name, e.g. "session/prompt of buffer
+// 3". A nil slowCall is returned when watching is disabled.
+func watch(name string) *slowCall {
+	d := time.Duration(slowCallThreshold.Load())
+	if d <= 0 {
+		return nil
+	}
+	c := &slowCall{name: name, start: time.Now()}
+	c.timer = time.AfterFunc(d, func() {
+		logWarn("%s has been running for %s", name, d)
+	})
+	return c
+}
+
+// watch starts watching a call of the session to or from the agent.
+func (s *AcpSession) watch(method string) *slowCall {
+	return watch(fmt.Sprintf("%s of buffer %d", method, s.bufnr))
+}
+
+// done stops watching the call, reporting how long it took if it was slow.
+func (c *slowCall) done() {
+	if c == nil {
+		return
+	}
+	if !c.timer.Stop() {
+		logWarn("%s returned after %s", c.name, time.Since(c.start).Round(time.Millisecond))
+	}
+}
+
+// AcpSetSlowCallThreshold sets how many milliseconds a call may take before
+// a warning is logged, 0 to never warn
+func (m *SessionManager) AcpSetSlowCallThreshold(ms int) (any, error) {
+	slowCallThreshold.Store(int64(time.Duration(ms) * time.Millisecond))
+	return nil, nil
+}
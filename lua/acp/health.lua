@@ -0,0 +1,87 @@
+local M = {}
+
+local health = vim.health
+
+function M.check()
+	local acp = require("acp")
+
+	health.start("ACP RPC host")
+	local job_id = acp.state.rpc_host_job_id
+	if not job_id then
+		health.info("Not running. It is started with the first session")
+		return
+	end
+
+	local agents = {}
+	for name, config in pairs(acp.config.agents or {}) do
+		agents[name] = { cmd = config.cmd or {}, address = config.address, launcher = config.launcher }
+	end
+	local ok, report = pcall(vim.rpcrequest, job_id, "AcpHealth", next(agents) and agents or vim.empty_dict())
+	if not ok then
+		health.error("Not responding: " .. tostring(report))
+		return
+	end
+	health.ok(("Running version %s, built with %s, ACP version %d"):format(
+		report.version,
+		report.go_version,
+		report.protocol_version
+	))
+
+	health.start("ACP agents")
+	if #report.agents == 0 then
+		health.info("No agent configured. Run :AcpNewSession without arguments to pick a known agent")
+	end
+	for _, agent in ipairs(report.agents) do
+		if agent.address then
+			health.ok(("%s: connects to %s"):format(agent.name, agent.address))
+		elseif agent.command == "" then
+			health.error(("%s: neither cmd nor address is set"):format(agent.name))
+		elseif agent.found then
+			health.ok(("%s: %s"):format(agent.name, agent.path))
+		else
+			health.error(("%s: %s not found"):format(agent.name, agent.command))
+		end
+	end
+
+	health.start("ACP sessions")
+	if #report.sessions == 0 then
+		health.info("No active session")
+	end
+	for _, session in ipairs(report.sessions) do
+		local info = session.info
+		local agent = acp.state.sessions[session.bufnr] and acp.state.sessions[session.bufnr].agent or session.agent
+		local name = info.title ~= "" and info.title or info.name ~= "" and info.name or agent
+		local msg = ("%s (buffer %d%s): %s, protocol version %d"):format(
+			agent,
+			session.bufnr,
+			session.pid > 0 and ", pid " .. session.pid or "",
+			info.version ~= "" and (name .. " " .. info.version) or name,
+			info.protocol_version
+		)
+		if session.failure then
+			health.error(msg .. ": " .. session.failure)
+		elseif #info.warnings == 0 then
+			health.ok(msg)
+		else
+			for _, w in ipairs(info.warnings) do
+				health.warn(msg .. ": " .. w)
+			end
+		end
+		for _, srv in ipairs(session.mcp.serving) do
+			health.ok(("MCP server %s (%s)"):format(srv.name, srv.transport))
+		end
+		for _, srv in ipairs(session.mcp.skipped) do
+			health.warn(("MCP server %s (%s) skipped: %s"):format(srv.name, srv.transport, srv.reason))
+		end
+	end
+
+	health.start("ACP recent errors")
+	if #report.errors == 0 then
+		health.ok("None")
+	end
+	for _, line in ipairs(report.errors) do
+		health.warn(line)
+	end
+end
+
+return M
@@ -3,16 +3,50 @@ local vim = vim
 local api = vim.api
 
 ---@class acp.AgentConfig
----@field cmd string[] Command to start the agent (e.g., {"opencode", "acp"})
----@field env table<string, string>? Optional environment variables
+---@field cmd? string[] Command to start the agent (e.g., {"opencode", "acp"})
+---@field launcher? acp.Launcher Run cmd in a container, on another machine or in WSL
+---@field path_style? "wsl"|"windows" Translate paths between the Windows and WSL views of the files: "wsl" when the agent runs in WSL and Neovim on Windows (the default of the wsl launcher), "windows" for the reverse
+---@field address? string Address of an already running agent to connect to instead of starting cmd: tcp://host:port, unix:///path, ws://host:port/path or wss://...
+---@field env table<string, string>? Optional environment variables. ${VAR} and ~ are expanded here, in cmd and in MCP configs
+---@field dotenv? boolean|string Load the project .env file, or the given file relative to the working directory, into the agent environment
 ---@field mcp? string[]|true List of context server names to use, or true to use all defined
+---@field write_limit? { max_files: integer?, max_bytes: integer? } Writes per turn beyond which the agent must ask again
+---@field instructions? string Project instructions sent before the first prompt
+---@field context_limit? { max_block_bytes: integer?, max_total_bytes: integer?, max_binary_bytes: integer? } Size limits of prompt attachments: of a text attachment (default 256 KiB), of the text attachments together (1 MiB) and of an image or audio attachment, base64-encoded (20 MiB); -1 disables a limit
+---@field activity_limit? { max_tool_calls: integer?, max_terminals: integer?, max_fs_requests: integer? } Running tool calls shown at once (default 8), open terminals (4) and file requests handled at once (16); more wait for earlier ones to finish. -1 disables a limit
+---@field capabilities? { read_text_file: boolean?, write_text_file: boolean?, terminal: boolean? } Capabilities advertised to the agent, which can't use the others. Files may be read and written by default, terminals aren't offered as they are not supported yet
+---@field retry? { attempts: integer?, delay_ms: integer?, max_delay_ms: integer? } Retries of the prompts, mode changes and cancellations that fail for a transient reason, like an internal error of the agent (default 2), and the wait before the first one (500) which doubles up to max_delay_ms (8000). A negative attempts disables retries
+---@field rate_limit? { min_interval_ms: integer?, max_turns_per_minute: integer? } Throttle the prompts, for providers with strict rate limits. Prompts wait their turn, with a countdown in the status
+---@field auto_continue? integer Turns cut short by the token or request limit of the agent continued in a row without asking. By default they are only offered to be continued with :AcpContinue
+---@field request_timeouts? table<string, integer> Milliseconds the client may take to answer a request of the agent handled through Neovim, like fs/read_text_file or an extension method handled in Lua, before it answers with an error. The "default" key applies to the other methods (30000); -1 disables a timeout
+---@field text_width? integer Reflow the prose of the replies to lines of at most this width as it is streamed, for a chat buffer shown without 'wrap'. Code blocks, tables and indented code are kept as they are. 0 (default) keeps the lines of the agent
+---@field read_only? boolean Only let the agent explain and review code: files can't be written, terminals aren't offered and edits and commands are denied without asking
+---@field instruction_files? string[] Files whose content is sent with the instructions. Defaults to { ".acp/system.md" }
+---@field profiles? table<string, acp.CredentialProfile> Named sets of credentials, e.g. for a personal and a work account
+---@field profile? string Profile used when none is given
 
----@class acp.McpConfig.Http
+---@class acp.Launcher
+---@field type "docker"|"podman"|"ssh"|"wsl"
+---@field container? string Running container, for docker and podman
+---@field host? string [user@]host, for ssh
+---@field distro? string WSL distribution, for wsl. Defaults to the default distribution
+---@field workdir? string Checkout on the other side that mirrors the working directory. Paths are translated between the two
+---@field args? string[] Extra arguments of docker exec, podman exec, ssh or wsl.exe
+
+---@class acp.CredentialProfile
+---@field env? table<string, string> Environment variables added to those of the agent
+---@field auth_method? string ID of the auth method to use without asking when the agent requires authentication
+
+---@class acp.McpConfig.Common
+---@field disabled? boolean Never pass the server to agents
+---@field roots? string[] Only pass the server to agents in these project directories and below
+
+---@class acp.McpConfig.Http : acp.McpConfig.Common
 ---@field type "http"|"sse"
 ---@field url string URL of the HTTP context server
----@field headers? table<string, string> Optional HTTP headers
+---@field headers? table<string, string> Optional HTTP headers. Values may reference secrets with {{env:NAME}}, {{file:path}} or {{cmd:shell command}}, resolved when the session starts
 
----@class acp.McpConfig.Stdio
+---@class acp.McpConfig.Stdio : acp.McpConfig.Common
 ---@field cmd string[]
 ---@field env table<string, string>
 
@@ -21,30 +55,133 @@ local api = vim.api
 ---@class acp.Config
 ---@field agents? table<string, acp.AgentConfig> Mapping of agent names to their configurations
 ---@field mcp? table<string, acp.McpConfig> Mapping of context server names to their configurations
+---@field templates? table<string, string> Prompt templates by name. {selection}, {filename}, {filetype} and {diagnostics} are expanded
+---@field mcp_files? boolean|string[] Also read MCP servers from the config files of Claude, Cursor, VS Code and Zed, or from the given files. Servers in `mcp` take precedence
+---@field secrets? acp.SecretStore Where API keys entered at authentication are stored. Keys are not stored when unset
+---@field slow_call_ms? integer Warn when a call to or from an agent, e.g. a permission prompt, takes longer than this. 0 disables the warnings. Defaults to 5000
+---@field log_level? "error"|"warn"|"info"|"debug"|"trace" Most verbose messages of the RPC host that are shown. Defaults to "warn"
+---@field trace? boolean|acp.TraceConfig Log the messages exchanged with agents to a file per session under stdpath("log")/acp, see :AcpTrace
+---@field capture? boolean Record every message exchanged with agents to a file per session under stdpath("log")/acp, to be replayed with :AcpReplay
+---@field pprof? string Loopback address, e.g. "localhost:6060", on which the RPC host serves its Go profiles for debugging. Heap and goroutine profiles can also be written to the temporary directory by sending SIGUSR1 to the host
+---@field archive? boolean|string Archive the transcripts of sessions to stdpath("state")/acp/archive, or to the given directory, to be searched with :AcpArchive. Defaults to true
+---@field recovery? boolean Save the conversations in progress under stdpath("state")/acp/recovery, to be restored with :AcpRecover if Neovim or the RPC host crashes. Defaults to true
+---@field summarizer? string Agent writing the summary of the conversation for :AcpCompact, from its transcript. Defaults to the agent of the session
+---@field max_lines? integer Lines of a chat buffer beyond which the oldest are trimmed, to be shown again with :AcpOlder. 0 disables trimming. Defaults to 10000
+
+---@class acp.SecretStore
+---@field type "env_file"|"pass"|"command"
+---@field path? string File of the "env_file" store
+---@field get? string[] Command printing the secret, for "command". {name} is replaced with the name of the secret
+---@field set? string[] Command reading the secret from stdin, for "command"
+
+---@class acp.TraceConfig
+---@field redact? string[] Keys whose string values are left out of the trace, at any depth. Defaults to file contents, messages and credentials
+---@field max_length? integer Length beyond which params and results are truncated. Defaults to 2000
+
+---@class acp.ErrorEvent
+---@field method string ACP method of the failed request
+---@field code integer JSON-RPC error code, 0 when the request failed without reply
+---@field message string
+---@field data any Details sent by the agent
+---@field retryable boolean Whether the request may succeed if sent again
+
+---@class acp.Metrics
+---@field turns integer Completed turns
+---@field running boolean Whether a turn is in progress
+---@field first_chunk_ms integer Time to the first chunk of the last turn, -1 without chunk
+---@field last_turn_ms integer Duration of the last turn
+---@field avg_turn_ms integer Average duration of turns
+---@field chunks integer Chunks of replies and thoughts received
+---@field bytes integer Bytes of replies and thoughts received
+---@field tool_calls table<string, integer> Tool calls by kind
+---@field errors integer Failed requests to the agent
 
 ---@class acp.SessionModes
 ---@field CurrentModeId string
 ---@field AvailableModes { Description: string, Id: string, Name: string }[]
 
+---@class acp.SessionModels
+---@field CurrentModelId string
+---@field AvailableModels { Description: string?, ModelId: string, Name: string }[]
+
+---@class acp.Command
+---@field name string
+---@field description string
+---@field hint? string Hint for the input the command expects
+
 -- Get the directory where this script is located
 local script_path = debug.getinfo(1, "S").source:sub(2)
 local dirname = vim.fs.dirname
 local plugin_dir = dirname(dirname(dirname(script_path)))
 
+---@class acp.AgentInfo
+---@field name string
+---@field title string
+---@field version string
+---@field protocol_version integer
+---@field client_protocol_version integer
+---@field warnings string[] Compatibility problems
+---@field load_session boolean
+---@field image boolean
+---@field audio boolean
+---@field embedded_context boolean
+---@field mcp_http boolean
+---@field mcp_sse boolean
+---@field auth_methods { id: string, name: string, description: string }[]
+
 ---@class acp.State
 ---@field rpc_host_job_id number? Job ID of the RPC host process
----@field sessions table<number, { agent: string, window: number?, modes: acp.SessionModes? }> Active sessions per buffer
+---@field sessions table<number, { agent: string, profile: string?, read_only: boolean?, throttle: integer?, window: number?, modes: acp.SessionModes?, models: acp.SessionModels?, commands: acp.Command[]?, history: string[]?, history_index: integer?, agent_info: acp.AgentInfo?, trimmed: integer?, max_lines: integer?, status: string? }> Active sessions per buffer
 M.state = {
 	rpc_host_job_id = nil, -- Single RPC host for all sessions
 	sessions = {},      -- { [bufnr] = { agent = "opencode", window = win_id } }
+	broadcast = {},     -- Chat buffers prompted together by |M.broadcast()|
 }
 
 ---@type acp.Config
-local default_config = {}
+local default_config = { agents = {} }
 
 ---@type acp.Config
 M.config = vim.tbl_deep_extend("force", default_config, vim.g.acp or {})
 
+---@alias acp.Middleware.Kind "prompt"|"response"
+
+---@class acp.Middleware.Payload
+---@field text string Prompt as typed by the user, or chunk of the agent's reply
+---@field blocks? table[] Content blocks of the prompt, in their ACP JSON form. Only for "prompt"
+
+-- Hooks registered with M.add_middleware, by kind
+---@type table<acp.Middleware.Kind, (fun(payload: acp.Middleware.Payload, bufnr: number): acp.Middleware.Payload|false|nil)[]>
+local hooks = { prompt = {}, response = {} }
+
+-- Tell the RPC host which kinds of hooks are registered
+local function sync_middleware()
+	if M.state.rpc_host_job_id then
+		vim.rpcnotify(M.state.rpc_host_job_id, "AcpSetMiddleware", #hooks.prompt > 0, #hooks.response > 0)
+	end
+end
+
+-- Handlers of extension methods of the agent registered with
+-- M.register_handler, by method
+---@type table<string, fun(params: any, bufnr: number): any, string?>
+local handlers = {}
+
+-- Tell the RPC host which extension methods have a handler
+local function sync_handlers()
+	if M.state.rpc_host_job_id then
+		vim.rpcnotify(M.state.rpc_host_job_id, "AcpSetLuaHandlers", vim.tbl_keys(handlers))
+	end
+end
+
+-- Directory of the checkpoints of sessions, nil when disabled
+---@return string?
+local function recovery_dir()
+	if M.config.recovery == false then
+		return nil
+	end
+	return vim.fs.joinpath(vim.fn.stdpath("state"), "acp", "recovery")
+end
+
 -- Start RPC host if not already running
 local function ensure_rpc_host()
 	if M.state.rpc_host_job_id then
@@ -52,19 +189,33 @@ local function ensure_rpc_host()
 	end
 
 	-- Start the RPC host
-	M.state.rpc_host_job_id = vim.fn.jobstart({ vim.fs.joinpath(plugin_dir, "bin", "acp-nvim") }, {
+	local cmd = { vim.fs.joinpath(plugin_dir, "bin", "acp-nvim") }
+	if M.config.pprof then
+		vim.list_extend(cmd, { "-pprof", M.config.pprof })
+	end
+	M.state.rpc_host_job_id = vim.fn.jobstart(cmd, {
 		rpc = true,
 		on_exit = function(_, exit_code)
 			M.state.rpc_host_job_id = nil
+			local had_sessions = next(M.state.sessions) ~= nil
 			M.state.sessions = {}
 			if exit_code ~= 0 then
-				vim.notify("ACP RPC host exited with code " .. exit_code, vim.log.levels.ERROR)
+				local msg = "ACP RPC host exited with code " .. exit_code
+				if had_sessions and recovery_dir() then
+					msg = msg .. ", restore the chats with :AcpRecover"
+				end
+				vim.notify(msg, vim.log.levels.ERROR)
 			end
 		end,
 		on_stderr = function(_, data)
 			if data then
 				for _, line in ipairs(data) do
-					if line ~= "" then
+					-- Messages are prefixed with their level, anything else
+					-- is a crash
+					local level, msg = line:match("^%[(%a+)%] (.*)$")
+					if level then
+						vim.notify("ACP: " .. msg, vim.log.levels[level:upper()] or vim.log.levels.ERROR)
+					elseif line ~= "" then
 						vim.notify("ACP: " .. line, vim.log.levels.ERROR)
 					end
 				end
@@ -82,174 +233,1976 @@ local function ensure_rpc_host()
 		return nil
 	end
 
+	-- Sessions still saved when Neovim is gone were interrupted
+	local job_id = M.state.rpc_host_job_id
+	api.nvim_create_autocmd("VimLeavePre", {
+		once = true,
+		callback = function()
+			if M.state.rpc_host_job_id == job_id then
+				pcall(vim.rpcrequest, job_id, "AcpDiscardCheckpoints")
+			end
+		end,
+	})
+
+	sync_middleware()
+	sync_handlers()
+	if M.config.log_level then
+		vim.rpcnotify(M.state.rpc_host_job_id, "AcpSetLogLevel", M.config.log_level)
+	end
+	if M.config.slow_call_ms then
+		vim.rpcnotify(M.state.rpc_host_job_id, "AcpSetSlowCallThreshold", M.config.slow_call_ms)
+	end
 	return M.state.rpc_host_job_id
 end
 
--- Start the ACP connection for a buffer
----@param agent string
-function M.start(agent)
-	-- Ensure RPC host is running
-	local cmd = M.config.agents[agent].cmd
-	local job_id = ensure_rpc_host()
-	if not job_id then
+-- Change the most verbose level of the messages of the RPC host that are
+-- shown, for this Neovim instance
+---@param level "error"|"warn"|"info"|"debug"|"trace"
+function M.set_log_level(level)
+	M.config.log_level = level
+	if not M.state.rpc_host_job_id then
 		return
 	end
+	local ok, err = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpSetLogLevel", level)
+	if not ok then
+		vim.notify(tostring(err), vim.log.levels.ERROR)
+	end
+end
 
-	-- Create new buffer
-	local bufnr = api.nvim_create_buf(false, true)
+-- Register a hook that transforms prompts before they are sent ("prompt") or
+-- chunks of the agent's reply before they are shown ("response"). A hook
+-- returns the new payload, nil to leave it unchanged or false to drop it.
+-- Hooks run in the order they were added.
+---@param kind acp.Middleware.Kind
+---@param fn fun(payload: acp.Middleware.Payload, bufnr: number): acp.Middleware.Payload|false|nil
+---@return fun() remove Unregisters the hook
+function M.add_middleware(kind, fn)
+	assert(hooks[kind], "unknown middleware kind: " .. tostring(kind))
+	table.insert(hooks[kind], fn)
+	sync_middleware()
+	return function()
+		for i, hook in ipairs(hooks[kind]) do
+			if hook == fn then
+				table.remove(hooks[kind], i)
+				break
+			end
+		end
+		sync_middleware()
+	end
+end
 
-	-- Track the session
-    M.state.sessions[bufnr] = { agent = agent, modes = nil }
+-- Register a handler for requests and notifications of an extension method
+-- the agent sends, one outside of the ACP spec whose name starts with an
+-- underscore. The handler gets the params and the chat buffer, and returns
+-- the result of the request, or nil and an error message. It runs while
+-- the RPC host waits, so it must not wait for the user.
+---@param method string
+---@param fn fun(params: any, bufnr: number): any, string?
+---@return fun() remove Unregisters the handler
+function M.register_handler(method, fn)
+	assert(method:sub(1, 1) == "_", "extension methods start with an underscore: " .. method)
+	handlers[method] = fn
+	sync_handlers()
+	return function()
+		if handlers[method] == fn then
+			handlers[method] = nil
+			sync_handlers()
+		end
+	end
+end
+
+-- Run the handler of an extension method.
+-- Only called from Go
+---@param bufnr number
+---@param method string
+---@param params any
+---@return any
+function M.handle_request(bufnr, method, params)
+	local fn = handlers[method]
+	if not fn then
+		error("no handler for " .. method, 0)
+	end
+	local ok, result, err = pcall(fn, params, bufnr)
+	if not ok then
+		error(("%s handler failed: %s"):format(method, result), 0)
+	end
+	if err then
+		error(err, 0)
+	end
+	if result == nil then
+		return vim.empty_dict()
+	end
+	return result
+end
+
+-- Pass payload through the hooks of kind
+-- Only called from Go
+---@param kind acp.Middleware.Kind
+---@param bufnr number Chat buffer, 0 for one-shot prompts
+---@param payload acp.Middleware.Payload
+---@return acp.Middleware.Payload|nil payload nil when a hook dropped it
+function M.middleware(kind, bufnr, payload)
+	for _, hook in ipairs(hooks[kind] or {}) do
+		local ok, result = pcall(hook, payload, bufnr)
+		if not ok then
+			error(("%s hook failed: %s"):format(kind, result), 0)
+		end
+		if result == false then
+			return nil
+		elseif result ~= nil then
+			payload = result
+		end
+	end
+	return payload
+end
+
+-- Get the MCP servers of the config, along with those of the MCP config files
+-- of other tools when enabled
+---@return table<string, acp.McpConfig>
+local function mcp_configs()
+	local files = M.config.mcp_files
+	if not files or not M.state.rpc_host_job_id then
+		return M.config.mcp or {}
+	end
+	local paths = files == true and {} or vim.tbl_map(function(path)
+		return vim.fs.abspath(vim.fn.expand(path))
+	end, files)
+	local ok, loaded = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpLoadMcpFiles", paths)
+	if not ok then
+		vim.notify("Failed to load MCP config files: " .. tostring(loaded), vim.log.levels.WARN)
+		return M.config.mcp or {}
+	end
+	return vim.tbl_extend("force", loaded, M.config.mcp or {})
+end
+
+-- Directory of the archive of transcripts, nil when disabled
+---@return string?
+local function archive_dir()
+	if M.config.archive == false then
+		return nil
+	end
+	if type(M.config.archive) == "string" then
+		return vim.fn.fnamemodify(vim.fs.normalize(M.config.archive --[[@as string]]), ":p")
+	end
+	return vim.fs.joinpath(vim.fn.stdpath("state"), "acp", "archive")
+end
 
+-- Build the options of AcpNewSession for an agent
+---@param agent string
+---@param profile? string Credential profile, defaults to the agent's default profile
+---@return table? opts nil when the profile doesn't exist
+---@return string? err
+local function session_opts(agent, profile)
 	local mcp
+	local env = M.config.agents[agent].env or {}
+	local creds = {}
+
+	profile = profile or M.config.agents[agent].profile
+	if profile then
+		creds = (M.config.agents[agent].profiles or {})[profile]
+		if not creds then
+			return nil, ("Unknown profile %s for agent %s"):format(profile, agent)
+		end
+		env = vim.tbl_extend("force", env, creds.env or {})
+	end
 
 	if M.config.agents[agent].mcp then
         local mcp_names = M.config.agents[agent].mcp
+		local configs = mcp_configs()
 		if vim.islist(mcp_names) then
             mcp = {}
             for _, name in ipairs(mcp_names --[[@as string[] ]]) do
-				mcp[name] = M.config.mcp[name]
+				mcp[name] = configs[name]
 			end
         else
-			mcp = M.config.mcp
+			mcp = configs
 		end
 	end
 
-	local opts = {
-        env = M.config.agents[agent].env or vim.empty_dict(),
+	return {
+		env = next(env) and env or vim.empty_dict(),
 		mcp = mcp,
+		write_limit = M.config.agents[agent].write_limit or vim.empty_dict(),
+		templates = M.config.templates or vim.empty_dict(),
+		instructions = M.config.agents[agent].instructions,
+		instruction_files = M.config.agents[agent].instruction_files,
+		context_limit = M.config.agents[agent].context_limit or vim.empty_dict(),
+		activity_limit = M.config.agents[agent].activity_limit or vim.empty_dict(),
+		capabilities = M.config.agents[agent].capabilities or vim.empty_dict(),
+		read_only = M.config.agents[agent].read_only,
+		retry = M.config.agents[agent].retry or vim.empty_dict(),
+		rate_limit = M.config.agents[agent].rate_limit or vim.empty_dict(),
+		auto_continue = M.config.agents[agent].auto_continue,
+		request_timeouts = M.config.agents[agent].request_timeouts or vim.empty_dict(),
+		text_width = M.config.agents[agent].text_width,
+		history_dir = vim.fs.joinpath(vim.fn.stdpath("state"), "acp", "history"),
+		archive_dir = archive_dir(),
+		recovery_dir = recovery_dir(),
+		agent = agent,
+		secrets = M.config.secrets,
+		profile = profile,
+		auth_method = creds.auth_method,
+		dotenv = M.config.agents[agent].dotenv == true and ".env" or M.config.agents[agent].dotenv or nil,
+		launcher = M.config.agents[agent].launcher,
+		path_style = M.config.agents[agent].path_style,
+		address = M.config.agents[agent].address,
+		trace = M.config.trace and vim.tbl_extend("force", M.config.trace == true and {} or M.config.trace, {
+			dir = vim.fs.joinpath(vim.fn.stdpath("log"), "acp"),
+		}) or nil,
+		capture_dir = M.config.capture and vim.fs.joinpath(vim.fn.stdpath("log"), "acp") or nil,
 	}
-	vim.rpcnotify(job_id, "AcpNewSession", bufnr, cmd, opts)
 end
 
---- Change ACP mode for a buffer
---- Only called from Go
---- @param bufnr number
---- @param mode_id string
-function M.set_mode(bufnr, mode_id)
-	local ok, result = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpSetMode", bufnr, mode_id)
-	if not ok then
-		vim.notify("Failed to set ACP mode: " .. vim.inspect(result), vim.log.levels.ERROR)
+---@class acp.ConfigReload
+---@field applied string[]? Options the session now uses
+---@field restart string[]? Options only a new session uses
+
+-- Read vim.g.acp again and apply it to the running sessions. The options
+-- that can't change while an agent runs, like its command, are reported so
+-- that the session can be restarted.
+function M.reload_config()
+	M.config = vim.tbl_deep_extend("force", default_config, vim.g.acp or {})
+	local job_id = M.state.rpc_host_job_id
+	if not job_id then
 		return
 	end
-	M.state.sessions[bufnr].modes.CurrentModeId = result --[[@as string]]
-end
+	if M.config.log_level then
+		vim.rpcnotify(job_id, "AcpSetLogLevel", M.config.log_level)
+	end
+	if M.config.slow_call_ms then
+		vim.rpcnotify(job_id, "AcpSetSlowCallThreshold", M.config.slow_call_ms)
+	end
 
--- Show the ACP buffer in a window
----@param bufnr number
-local function show(bufnr)
-    if not api.nvim_buf_is_valid(bufnr) then
-        vim.notify("Invalid buffer", vim.log.levels.ERROR)
-        return
-    end
+	local lines = {}
+	for bufnr, session in vim.spairs(M.state.sessions) do
+		local name = ("%s (buffer %d)"):format(session.agent, bufnr)
+		if not M.config.agents[session.agent] then
+			table.insert(lines, name .. ": agent removed from the config, the session is kept")
+		else
+			local opts, err = session_opts(session.agent, session.profile)
+			local ok, result = false, err
+			if opts then
+				local cmd = M.config.agents[session.agent].cmd or {}
+				ok, result = pcall(vim.rpcrequest, job_id, "AcpReloadConfig", bufnr, cmd, opts)
+			end
+			if not ok then
+				table.insert(lines, ("%s: %s"):format(name, tostring(result)))
+			else
+				---@cast result acp.ConfigReload
+				if result.applied and #result.applied > 0 then
+					table.insert(lines, ("%s: applied %s"):format(name, table.concat(result.applied, ", ")))
+				end
+				if result.restart and #result.restart > 0 then
+					table.insert(lines, ("%s: restart the session for %s"):format(name, table.concat(result.restart, ", ")))
+				end
+			end
+		end
+	end
+	vim.notify(#lines > 0 and table.concat(lines, "\n") or "Config reloaded", vim.log.levels.INFO)
+end
 
-    local session = M.state.sessions[bufnr]
-    if not session then
-        vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
-        return
-    end
+-- Start the ACP connection for a buffer
+---@param agent string
+---@param profile? string Credential profile of the agent to use
+---@param start_opts? { lazy: boolean? } With lazy, only open the chat buffer and start the agent on the first prompt, e.g. for buffers created ahead of time
+---@return integer? bufnr The chat buffer
+function M.start(agent, profile, start_opts)
+	if not M.config.agents[agent] then
+		vim.notify("Unknown agent: " .. agent, vim.log.levels.ERROR)
+		return
+	end
+	-- Ensure RPC host is running
+	local cmd = M.config.agents[agent].cmd or {}
+	local job_id = ensure_rpc_host()
+	if not job_id then
+		return
+	end
 
-    -- Check if already visible in a window
-    if session.window and api.nvim_win_is_valid(session.window) then
-        api.nvim_set_current_win(session.window)
-        return
-    end
+	local opts, err = session_opts(agent, profile)
+	if not opts then
+		vim.notify(err, vim.log.levels.ERROR)
+		return
+	end
 
-    -- Create a split window
-    vim.cmd("vsplit")
-    local window = api.nvim_get_current_win()
-    api.nvim_win_set_buf(window, bufnr)
-    vim.wo[window].wrap = true
-    vim.wo[window].linebreak = true
+	-- Create new buffer
+	local bufnr = api.nvim_create_buf(false, true)
 
-    session.window = window
+	-- Track the session
+    M.state.sessions[bufnr] = { agent = agent, profile = profile, read_only = opts.read_only, modes = nil }
+	-- Closing the chat stops its agent
+	api.nvim_create_autocmd("BufWipeout", {
+		buffer = bufnr,
+		once = true,
+		callback = function()
+			M.stop_session(bufnr)
+		end,
+	})
 
-    -- Go to the end of the buffer and enter insert mode
-    vim.cmd("normal! G")
-    vim.cmd("startinsert")
+	if start_opts and start_opts.lazy then
+		vim.rpcnotify(job_id, "AcpDeclareSession", bufnr, cmd, opts)
+		-- Renamed after the session ID once the agent is started
+		M.set_and_show_prompt_buf(bufnr, { session_id = "new" })
+	else
+		vim.rpcnotify(job_id, "AcpNewSession", bufnr, cmd, opts)
+	end
+	return bufnr
 end
 
--- Send a prompt to agent
+-- Stop the session of a chat buffer, killing its agent
 ---@param bufnr number
----@param text string
-function M.send_prompt(bufnr, text)
-	if not M.state.rpc_host_job_id then
-		vim.notify("ACP not running. Run :AcpNewSession first.", vim.log.levels.ERROR)
-		return
+function M.stop_session(bufnr)
+	M.state.sessions[bufnr] = nil
+	if M.state.rpc_host_job_id then
+		vim.rpcnotify(M.state.rpc_host_job_id, "AcpStopSession", bufnr)
 	end
+end
 
-	if not M.state.sessions[bufnr] then
-		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+---@class acp.AgentStatus
+---@field name string
+---@field description string
+---@field cmd string[]
+---@field env string[] Environment variables the agent needs
+---@field package string
+---@field installed boolean
+---@field path string
+---@field missing_env string[]
+
+-- Pick an agent from the configured agents and the known agents that are
+-- installed, and start a session with it. Known agents picked this way are
+-- added to the config with their default command.
+function M.pick_agent()
+	local job_id = ensure_rpc_host()
+	if not job_id then
 		return
 	end
-
-	if not text or text == "" then
+	local ok, known = pcall(vim.rpcrequest, job_id, "AcpListAgents")
+	if not ok then
+		vim.notify("Failed to list agents: " .. tostring(known), vim.log.levels.ERROR)
 		return
 	end
 
-	vim.rpcnotify(M.state.rpc_host_job_id, "AcpSendPrompt", bufnr, text)
+	local items = {}
+	for name in vim.spairs(M.config.agents) do
+		table.insert(items, { name = name })
+	end
+	for _, agent in ipairs(known --[[@as acp.AgentStatus[] ]]) do
+		if not M.config.agents[agent.name] then
+			table.insert(items, { name = agent.name, preset = agent })
+		end
+	end
+
+	vim.ui.select(items, {
+		prompt = "Agent",
+		format_item = function(item)
+			local preset = item.preset
+			if not preset then
+				return item.name
+			end
+			local label = ("%s - %s"):format(item.name, preset.description)
+			if not preset.installed then
+				label = label .. " (not installed)"
+			elseif #preset.missing_env > 0 then
+				label = label .. " (needs " .. table.concat(preset.missing_env, ", ") .. ")"
+			end
+			return label
+		end,
+	}, function(item)
+		if not item then
+			return
+		end
+		if item.preset then
+			if not item.preset.installed then
+				M.install_agent(item.preset)
+				return
+			end
+			M.config.agents[item.name] = { cmd = item.preset.cmd }
+		end
+		M.start(item.name)
+	end)
 end
 
---- Called from Go
+-- Get what the agent of a session reported about itself and the capabilities
+-- it negotiated
 ---@param bufnr number
----@param opts { modes: acp.SessionModes, session_id: string }
-function M.set_and_show_prompt_buf(bufnr, opts)
-	api.nvim_buf_set_name(bufnr, ("acp://%s/%s"):format(M.state.sessions[bufnr].agent, opts.session_id))
-	show(bufnr)
-	vim.bo[bufnr].filetype = "acpchat"
-	M.state.sessions[bufnr].modes = opts.modes
+---@return acp.AgentInfo?
+function M.agent_info(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		return nil
+	end
+	local ok, info = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpAgentInfo", bufnr)
+	if not ok then
+		return nil
+	end
+	M.state.sessions[bufnr].agent_info = info
+	return info
 end
 
--- Cancel the current operation
+-- Add the MCP server called name in the config to a live session, or remove
+-- it, once the running turn ends. The agent may have to start a new session to
+-- apply the change
 ---@param bufnr number
-function M.cancel(bufnr)
-	if not M.state.rpc_host_job_id then
-		vim.notify("ACP not running", vim.log.levels.WARN)
+---@param action "add"|"remove"
+---@param name string
+function M.mcp(bufnr, action, name)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
 		return
 	end
 
-	if not M.state.sessions[bufnr] then
-		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+	local ok, err
+	if action == "add" then
+		local config = (M.config.mcp or {})[name]
+		if not config then
+			vim.notify("Unknown MCP server: " .. name, vim.log.levels.ERROR)
+			return
+		end
+		ok, err = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpAddMcpServer", bufnr, name, config)
+	elseif action == "remove" then
+		ok, err = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpRemoveMcpServer", bufnr, name)
+	else
+		vim.notify("Unknown MCP action: " .. tostring(action), vim.log.levels.ERROR)
 		return
 	end
+	if not ok then
+		vim.notify(("Failed to %s MCP server %s: %s"):format(action, name, tostring(err)), vim.log.levels.ERROR)
+	end
+end
 
-	vim.rpcnotify(M.state.rpc_host_job_id, "AcpCancel", bufnr)
+-- List the MCP servers of a session
+---@param bufnr number
+---@return string[]
+function M.mcp_servers(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		return {}
+	end
+	local ok, names = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpListMcpServers", bufnr)
+	return ok and names or {}
 end
 
--- Append text to a specific buffer
--- Also called from Go
+-- Show which MCP servers of a session are passed to the agent and which are
+-- skipped because the agent doesn't support their transport
 ---@param bufnr number
----@param text string
-function M.append_text(bufnr, text)
-	if not api.nvim_buf_is_valid(bufnr) then
+function M.mcp_status(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+	local ok, report = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpMcpStatus", bufnr)
+	if not ok then
+		vim.notify("Failed to get MCP status: " .. tostring(report), vim.log.levels.ERROR)
 		return
 	end
 
-	vim.schedule(function()
-		-- Get the prompt line position using the ': mark
-		local prompt_pos = api.nvim_buf_get_mark(bufnr, ":")
-		local prompt_line = prompt_pos[1] -- 1-indexed line number
-
-		-- Get the line just before the prompt (where we append content)
-		local content_line_idx = prompt_line - 2 -- 0-indexed (prompt_line - 1 - 1)
+	local lines = {}
+	for _, srv in ipairs(report.serving) do
+		table.insert(lines, ("%s (%s)"):format(srv.name, srv.transport))
+	end
+	for _, srv in ipairs(report.skipped) do
+		table.insert(lines, ("%s (%s): skipped, %s"):format(srv.name, srv.transport, srv.reason))
+	end
+	vim.notify(#lines > 0 and "MCP servers:\n" .. table.concat(lines, "\n") or "No MCP server", vim.log.levels.INFO)
+end
 
-		if content_line_idx < 0 then
-			-- No content line exists yet, insert a new line before prompt
-			api.nvim_buf_set_lines(bufnr, 0, 0, false, { "" })
-			content_line_idx = 0
-		end
+-- Render a session recorded with the `capture` option in a new buffer,
+-- without starting the agent
+---@param path string Capture file
+function M.replay(path)
+	local job_id = ensure_rpc_host()
+	if not job_id then
+		return
+	end
+	local bufnr = api.nvim_create_buf(false, true)
+	api.nvim_buf_set_name(bufnr, "acp://replay/" .. vim.fs.basename(path))
+	vim.bo[bufnr].buftype = "prompt"
+	vim.fn.prompt_setprompt(bufnr, "")
+	vim.cmd.sbuffer(bufnr)
+	vim.treesitter.start(bufnr, "markdown")
+	vim.rpcnotify(job_id, "AcpReplay", bufnr, vim.fn.fnamemodify(path, ":p"))
+end
 
-		-- Get the current content of that line
-		local current_line = api.nvim_buf_get_lines(bufnr, content_line_idx, content_line_idx + 1, false)[1] or ""
+-- Get the performance counters of the session of a buffer, e.g. for a
+-- statusline. Returns nil when the buffer has no session.
+---@param bufnr integer
+---@return acp.Metrics?
+function M.metrics(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		return nil
+	end
+	local ok, metrics = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpMetrics", bufnr)
+	return ok and metrics or nil
+end
 
-		-- Append the new text to the current line
-		local new_text = current_line .. text
+-- Open the trace file of the session of a buffer in a split
+---@param bufnr integer
+function M.open_trace(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+	local ok, path = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpTracePath", bufnr)
+	if not ok then
+		vim.notify("Failed to get trace file: " .. tostring(path), vim.log.levels.ERROR)
+		return
+	elseif path == "" then
+		vim.notify("This session isn't traced, set `trace` in the config to trace new sessions", vim.log.levels.WARN)
+		return
+	end
+	vim.cmd.split(vim.fn.fnameescape(path))
+end
 
-		-- Split by newlines if the text contains them
-		local lines = vim.split(new_text, "\n", { plain = true })
+-- Show what the agent of a session wrote to stderr in a split, following new
+-- lines as they come
+---@param bufnr integer
+---@param count? integer Number of recent lines to show, all kept lines by default
+function M.agent_logs(bufnr, count)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+	local job_id = M.state.rpc_host_job_id
+	local ok, lines = pcall(vim.rpcrequest, job_id, "AcpAgentLogs", bufnr, count or 0)
+	if not ok then
+		vim.notify("Failed to get agent logs: " .. tostring(lines), vim.log.levels.ERROR)
+		return
+	end
 
-		-- Replace the current line and add any additional lines
-		api.nvim_buf_set_lines(bufnr, content_line_idx, content_line_idx + 1, false, lines)
+	local name = "acp://logs/" .. bufnr
+	local log = vim.fn.bufnr(name)
+	if log ~= -1 then
+		api.nvim_buf_delete(log, { force = true })
+	end
+	log = api.nvim_create_buf(false, true)
+	api.nvim_buf_set_name(log, name)
+	api.nvim_buf_set_lines(log, 0, -1, false, lines)
+	vim.cmd.sbuffer(log)
+	vim.rpcnotify(job_id, "AcpMirrorAgentLogs", bufnr, log)
+	api.nvim_create_autocmd("BufWipeout", {
+		buffer = log,
+		once = true,
+		callback = function()
+			if M.state.sessions[bufnr] then
+				vim.rpcnotify(job_id, "AcpMirrorAgentLogs", bufnr, 0)
+			end
+		end,
+	})
+end
+
+--- Open a large tool call output of a session, which is kept out of the chat
+--- buffer, in a scratch buffer
+---@param bufnr integer
+---@param id? integer Number of the output, the last one when nil
+function M.open_output(bufnr, id)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	local out = api.nvim_create_buf(false, true)
+	local ok, loaded = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpLoadOutput", bufnr, id or 0, out)
+	if not ok then
+		api.nvim_buf_delete(out, { force = true })
+		vim.notify("Failed to load output: " .. tostring(loaded), vim.log.levels.ERROR)
+		return
+	end
+
+	local name = ("acp://output/%d/%d"):format(bufnr, loaded)
+	local existing = vim.fn.bufnr(name)
+	if existing ~= -1 then
+		api.nvim_buf_delete(existing, { force = true })
+	end
+	api.nvim_buf_set_name(out, name)
+	vim.bo[out].modifiable = false
+	vim.cmd.sbuffer(out)
+end
+
+-- Write the transcript of the session of a buffer to path, as Markdown or
+-- JSON. The format is guessed from the extension of path when not given
+---@param bufnr integer
+---@param path string
+---@param format? "markdown"|"json"
+function M.export_session(bufnr, path, format)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	path = vim.fn.fnamemodify(vim.fs.normalize(path), ":p")
+	local ok, written = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpExportSession", bufnr, format or "", path)
+	if not ok then
+		vim.notify("Failed to export session: " .. tostring(written), vim.log.levels.ERROR)
+		return
+	end
+	vim.notify("Session exported to " .. written)
+end
+
+-- Show a transcript written by |M.export_session()| in the chat buffer of a
+-- session. With replay, a summary of it is sent to the agent along with the
+-- next prompt so that the conversation can go on
+---@param bufnr integer
+---@param path string
+---@param opts? { replay: boolean? }
+function M.import_transcript(bufnr, path, opts)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	path = vim.fn.fnamemodify(vim.fs.normalize(path), ":p")
+	local ok, err = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpImportTranscript", bufnr, path, opts or vim.empty_dict())
+	if not ok then
+		vim.notify("Failed to import transcript: " .. tostring(err), vim.log.levels.ERROR)
+	end
+end
+
+---@class acp.ArchiveQuery
+---@field text? string Words that must all appear in the conversation, in any case
+---@field agent? string Part of the agent's command
+---@field project? string Part of the working directory of the session
+---@field since? string First day, as YYYY-MM-DD
+---@field until? string Last day, as YYYY-MM-DD
+---@field limit? integer Defaults to 50
+
+---@class acp.ArchiveHit
+---@field path string Transcript file, in JSON
+---@field session_id string
+---@field agent string
+---@field cwd string
+---@field date string Start of the session, as YYYY-MM-DD HH:MM
+---@field title string First prompt of the session
+---@field snippet string Text around the first match of the query text
+
+-- Search the archived conversations, newest first
+---@param query? acp.ArchiveQuery
+---@return acp.ArchiveHit[]
+function M.search_archive(query)
+	local dir = archive_dir()
+	if not dir then
+		vim.notify("The archive is disabled, set `archive` in the config to enable it", vim.log.levels.WARN)
+		return {}
+	end
+	local job_id = ensure_rpc_host()
+	if not job_id then
+		return {}
+	end
+	local ok, hits = pcall(vim.rpcrequest, job_id, "AcpSearchArchive", dir, query or vim.empty_dict())
+	if not ok then
+		vim.notify("Failed to search the archive: " .. tostring(hits), vim.log.levels.ERROR)
+		return {}
+	end
+	return hits
+end
+
+-- Open an archived conversation as Markdown in a split
+---@param path string Transcript file of an |acp.ArchiveHit|
+function M.open_archived(path)
+	local job_id = ensure_rpc_host()
+	if not job_id then
+		return
+	end
+	local out = api.nvim_create_buf(false, true)
+	local ok, err = pcall(vim.rpcrequest, job_id, "AcpLoadArchived", path, out)
+	if not ok then
+		api.nvim_buf_delete(out, { force = true })
+		vim.notify("Failed to load conversation: " .. tostring(err), vim.log.levels.ERROR)
+		return
+	end
+
+	local name = "acp://archive/" .. vim.fs.basename(path)
+	local existing = vim.fn.bufnr(name)
+	if existing ~= -1 then
+		api.nvim_buf_delete(existing, { force = true })
+	end
+	api.nvim_buf_set_name(out, name)
+	vim.bo[out].filetype = "markdown"
+	vim.bo[out].modifiable = false
+	vim.cmd.sbuffer(out)
+end
+
+-- Pick an archived conversation matching query with |vim.ui.select()| and
+-- open it
+---@param query? acp.ArchiveQuery
+function M.pick_archive(query)
+	local hits = M.search_archive(query)
+	if #hits == 0 then
+		vim.notify("No archived conversation found", vim.log.levels.INFO)
+		return
+	end
+	vim.ui.select(hits, {
+		prompt = "Archived conversations",
+		kind = "acp_archive",
+		---@param hit acp.ArchiveHit
+		format_item = function(hit)
+			local item = ("%s  %s  %s  %s"):format(hit.date, hit.agent, vim.fn.fnamemodify(hit.cwd, ":~"), hit.title)
+			if hit.snippet ~= "" then
+				item = item .. "  — " .. hit.snippet
+			end
+			return item
+		end,
+	}, function(hit)
+		if hit then
+			M.open_archived(hit.path)
+		end
+	end)
+end
+
+---@class acp.RecoverableSession
+---@field path string Checkpoint file
+---@field agent string
+---@field profile string
+---@field cwd string
+---@field date string When it was last saved, as YYYY-MM-DD HH:MM
+---@field turns integer
+---@field title string First prompt of the session
+
+-- Tell about the sessions interrupted by a crash, if any. Checkpoints are
+-- named after the process ID of their RPC host, so that those of running
+-- Neovim instances are left out without starting the host
+function M.check_recovery()
+	local dir = recovery_dir()
+	if not dir or vim.fn.isdirectory(dir) == 0 then
+		return
+	end
+	local count = 0
+	for name, type in vim.fs.dir(dir) do
+		local pid = type == "file" and tonumber(name:match("^(%d+)%-%d+%.json$"))
+		if pid and vim.uv.kill(pid, 0) ~= 0 then
+			count = count + 1
+		end
+	end
+	if count > 0 then
+		vim.notify(("%d ACP chat(s) were interrupted, restore them with :AcpRecover"):format(count), vim.log.levels.WARN)
+	end
+end
+
+---@return acp.RecoverableSession[]
+local function list_recoverable()
+	local dir = recovery_dir()
+	if not dir then
+		vim.notify("Recovery is disabled, set `recovery` in the config to enable it", vim.log.levels.WARN)
+		return {}
+	end
+	local job_id = ensure_rpc_host()
+	if not job_id then
+		return {}
+	end
+	local ok, found = pcall(vim.rpcrequest, job_id, "AcpListRecoverable", dir)
+	if not ok then
+		vim.notify("Failed to list interrupted sessions: " .. tostring(found), vim.log.levels.ERROR)
+		return {}
+	end
+	return found
+end
+
+-- Pick a session interrupted by a crash and restore it in a new chat, with
+-- the same agent
+function M.recover()
+	local found = list_recoverable()
+	if #found == 0 then
+		vim.notify("No interrupted ACP chat", vim.log.levels.INFO)
+		return
+	end
+	vim.ui.select(found, {
+		prompt = "Restore chat",
+		kind = "acp_recover",
+		---@param rs acp.RecoverableSession
+		format_item = function(rs)
+			return ("%s  %s  %s  %d turn(s)  %s"):format(rs.date, rs.agent, vim.fn.fnamemodify(rs.cwd, ":~"), rs.turns, rs.title)
+		end,
+	}, function(rs)
+		if not rs then
+			return
+		end
+		if not M.config.agents[rs.agent] then
+			vim.notify(("Agent %s is no longer configured"):format(rs.agent), vim.log.levels.ERROR)
+			return
+		end
+		local bufnr = M.start(rs.agent, rs.profile ~= "" and rs.profile or nil)
+		if bufnr then
+			-- Queued after AcpNewSession, which is a notification too
+			vim.rpcnotify(M.state.rpc_host_job_id, "AcpRecover", bufnr, rs.path)
+		end
+	end)
+end
+
+-- Forget all the sessions interrupted by a crash
+function M.discard_recoverable()
+	local found = list_recoverable()
+	for _, rs in ipairs(found) do
+		local ok, err = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpDiscardRecoverable", rs.path)
+		if not ok then
+			vim.notify("Failed to discard " .. rs.path .. ": " .. tostring(err), vim.log.levels.WARN)
+		end
+	end
+	vim.notify(("Discarded %d interrupted ACP chat(s)"):format(#found), vim.log.levels.INFO)
+end
+
+-- Replace the conversation of the session of a buffer by a summary of it, to
+-- free the context window of the agent
+---@param bufnr integer
+function M.compact(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	local opts = vim.empty_dict()
+	local summarizer = M.config.summarizer
+	if summarizer then
+		if not M.config.agents[summarizer] then
+			vim.notify("Unknown summarizer agent: " .. summarizer, vim.log.levels.ERROR)
+			return
+		end
+		local summarizer_opts, err = session_opts(summarizer)
+		if not summarizer_opts then
+			vim.notify(err, vim.log.levels.ERROR)
+			return
+		end
+		opts = {
+			summarizer_cmd = M.config.agents[summarizer].cmd or {},
+			summarizer_opts = summarizer_opts,
+		}
+	end
+	vim.rpcnotify(M.state.rpc_host_job_id, "AcpCompact", bufnr, opts)
+end
+
+-- Offer to install a known agent, showing the output of the install command
+-- in a split, then start a session with it
+---@param preset acp.AgentStatus
+function M.install_agent(preset)
+	if #preset.install == 0 then
+		vim.notify(("%s is not installed (%s)"):format(preset.name, preset.package), vim.log.levels.WARN)
+		return
+	end
+	local install = table.concat(preset.install, " ")
+	vim.ui.select({ "Yes", "No" }, { prompt = ("%s is not installed. Run `%s`?"):format(preset.name, install) }, function(choice)
+		if choice ~= "Yes" then
+			return
+		end
+		local log = api.nvim_create_buf(false, true)
+		api.nvim_buf_set_name(log, "acp://install/" .. preset.name)
+		vim.cmd.sbuffer(log)
+		local ok, err = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpInstallAgent", preset.name, log)
+		if not ok then
+			vim.notify("Failed to install " .. preset.name .. ": " .. tostring(err), vim.log.levels.ERROR)
+		end
+	end)
+end
+
+-- Called from Go when the installation of an agent is over
+---@param name string
+---@param cmd string[]
+---@param err string?
+function M.agent_installed(name, cmd, err)
+	if err then
+		vim.notify(("Failed to install %s: %s"):format(name, err), vim.log.levels.ERROR)
+		return
+	end
+	vim.notify(name .. " installed", vim.log.levels.INFO)
+	M.config.agents[name] = M.config.agents[name] or { cmd = cmd }
+	M.start(name)
+end
+
+-- Run one turn with a fresh agent process, without chat buffer, and return
+-- the agent's reply. Blocks until the turn is over.
+---@param agent string
+---@param prompt string
+---@param profile? string Credential profile of the agent to use
+---@return string? reply
+---@return string? err
+function M.ask(agent, prompt, profile)
+	if not M.config.agents[agent] then
+		return nil, "Unknown agent: " .. agent
+	end
+	local job_id = ensure_rpc_host()
+	if not job_id then
+		return nil, "ACP RPC host is not running"
+	end
+	local opts, err = session_opts(agent, profile)
+	if not opts then
+		return nil, err
+	end
+
+	local ok, result = pcall(vim.rpcrequest, job_id, "AcpAsk", M.config.agents[agent].cmd or {}, prompt, opts)
+	if not ok then
+		return nil, tostring(result)
+	end
+	return result
+end
+
+--- Change ACP mode for a buffer
+--- Only called from Go
+--- @param bufnr number
+--- @param mode_id string
+function M.set_mode(bufnr, mode_id)
+	local ok, result = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpSetMode", bufnr, mode_id)
+	if not ok then
+		vim.notify("Failed to set ACP mode: " .. tostring(result), vim.log.levels.ERROR)
+		return
+	end
+	M.state.sessions[bufnr].modes.CurrentModeId = result --[[@as string]]
+end
+
+-- Switch the session of a buffer to the mode step places after the current
+-- one, before it when step is negative
+---@param bufnr number
+---@param step integer
+function M.cycle_mode(bufnr, step)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+	local ok, result = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpCycleMode", bufnr, step)
+	if not ok then
+		vim.notify("Failed to set ACP mode: " .. tostring(result), vim.log.levels.ERROR)
+		return
+	end
+	vim.notify("ACP mode: " .. result, vim.log.levels.INFO)
+end
+
+-- Switch the agent of the session of a buffer to another model, picked
+-- with |vim.ui.select()| when model_id is nil
+---@param bufnr number
+---@param model_id? string
+function M.set_model(bufnr, model_id)
+	local session = M.state.sessions[bufnr]
+	if not M.state.rpc_host_job_id or not session then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+	if not model_id or model_id == "" then
+		local models = session.models and session.models.AvailableModels or {}
+		if #models == 0 then
+			vim.notify("The agent has no models to pick from", vim.log.levels.INFO)
+			return
+		end
+		vim.ui.select(models, {
+			prompt = "Model",
+			kind = "acp_model",
+			format_item = function(model)
+				local item = model.Name
+				if model.ModelId == session.models.CurrentModelId then
+					item = item .. " (current)"
+				end
+				return model.Description and ("%s: %s"):format(item, model.Description) or item
+			end,
+		}, function(model)
+			if model then
+				M.set_model(bufnr, model.ModelId)
+			end
+		end)
+		return
+	end
+	local ok, result = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpSetModel", bufnr, model_id)
+	if not ok then
+		vim.notify("Failed to set ACP model: " .. tostring(result), vim.log.levels.ERROR)
+	end
+end
+
+-- Record the models of the session of a buffer and the current one.
+-- Only called from Go
+---@param bufnr number
+---@param models acp.SessionModels
+function M.set_models(bufnr, models)
+	if M.state.sessions[bufnr] then
+		M.state.sessions[bufnr].models = models
+	end
+end
+
+-- Get the agent, mode and model of the session of a buffer, whether it is
+-- read-only and when its next prompt is sent if it waits for the rate limit,
+-- in a few words, e.g. for a statusline. Returns nil when the buffer has no
+-- session.
+---@param bufnr integer
+---@return string?
+function M.status(bufnr)
+	local session = M.state.sessions[bufnr]
+	if not session then
+		return nil
+	end
+	local parts = { session.agent }
+	if session.modes and session.modes.CurrentModeId ~= "" then
+		table.insert(parts, session.modes.CurrentModeId)
+	end
+	if session.models and session.models.CurrentModelId ~= "" then
+		table.insert(parts, session.models.CurrentModelId)
+	end
+	if session.read_only then
+		table.insert(parts, "read-only")
+	end
+	if session.throttle then
+		table.insert(parts, ("next prompt in %ds"):format(session.throttle))
+	end
+	if session.cancelling then
+		table.insert(parts, "cancelling")
+	end
+	return table.concat(parts, " · ")
+end
+
+-- Record the modes of the session of a buffer and the current one.
+-- Only called from Go
+---@param bufnr number
+---@param modes acp.SessionModes
+function M.set_modes(bufnr, modes)
+	if M.state.sessions[bufnr] then
+		M.state.sessions[bufnr].modes = modes
+	end
+end
+
+-- Show the ACP buffer in a window
+---@param bufnr number
+local function show(bufnr)
+    if not api.nvim_buf_is_valid(bufnr) then
+        vim.notify("Invalid buffer", vim.log.levels.ERROR)
+        return
+    end
+
+    local session = M.state.sessions[bufnr]
+    if not session then
+        vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+        return
+    end
+
+    -- Check if already visible in a window
+    if session.window and api.nvim_win_is_valid(session.window) then
+        api.nvim_set_current_win(session.window)
+        return
+    end
+
+    -- Create a split window
+    vim.cmd("vsplit")
+    local window = api.nvim_get_current_win()
+    api.nvim_win_set_buf(window, bufnr)
+    vim.wo[window].wrap = true
+    vim.wo[window].linebreak = true
+
+    session.window = window
+    if session.label then
+        vim.wo[window].winbar = session.label
+    end
+
+    -- Go to the end of the buffer and enter insert mode
+    vim.cmd("normal! G")
+    vim.cmd("startinsert")
+end
+
+---@class acp.FileMention
+---@field path string Absolute path of the file
+---@field start? integer First line of the mentioned range
+---@field end? integer Last line of the mentioned range
+
+---@class acp.PromptPart
+---@field type "text"|"file"|"image"|"audio"|"selection"|"diagnostics"|"git_diff"
+---@field text? string
+---@field file? acp.FileMention
+---@field image? string Path of an image file
+---@field audio? string Path of an audio file
+---@field selection? { path: string, start: integer, end: integer, text: string, filetype: string }
+---@field diagnostics? table[]
+---@field git_diff? { staged: boolean?, range: string?, paths: string[]? }
+
+---@class acp.PromptOpts
+---@field parts? acp.PromptPart[] Blocks sent in order right after the text
+---@field images? string[] Paths of image files
+---@field audio? string[] Paths of audio files
+---@field files? acp.FileMention[]
+---@field diagnostics? table[]
+---@field git_diff? { staged: boolean?, range: string?, paths: string[]? }
+
+-- Find the files mentioned as `@path`, `@path:10` or `@path:10-20` in a prompt
+---@param text string
+---@return acp.FileMention[]
+local function parse_mentions(text)
+	local mentions = {}
+	for token in text:gmatch("@(%S+)") do
+		local path, first, last = token:match("^(.-):(%d+)-(%d+)$")
+		if not path then
+			path, first = token:match("^(.-):(%d+)$")
+		end
+		path = path or token
+		local abspath = vim.fs.abspath(vim.fn.expand(path))
+		local stat = vim.uv.fs_stat(abspath)
+		if stat and stat.type == "file" then
+			table.insert(mentions, {
+				path = abspath,
+				start = tonumber(first),
+				["end"] = tonumber(last or first),
+			})
+		end
+	end
+	return mentions
+end
+
+-- Send a prompt to agent
+-- Files mentioned with `@path` are sent along as resources
+---@param bufnr number
+---@param text string
+---@param opts? acp.PromptOpts Attachments to send along with the text
+function M.send_prompt(bufnr, text, opts)
+	if not M.state.rpc_host_job_id then
+		vim.notify("ACP not running. Run :AcpNewSession first.", vim.log.levels.ERROR)
+		return
+	end
+
+	if not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	if not text or text == "" then
+		return
+	end
+
+	M.state.sessions[bufnr].history_index = nil
+
+	opts = vim.deepcopy(opts or {})
+	opts.files = vim.list_extend(opts.files or {}, parse_mentions(text))
+	if vim.tbl_isempty(opts.files) then
+		opts.files = nil
+	end
+	vim.rpcnotify(M.state.rpc_host_job_id, "AcpSendPrompt", bufnr, text, next(opts) and opts or vim.empty_dict())
+end
+
+-- Start a session with each agent, shown side by side, and make them the
+-- group prompted by |M.broadcast()|. Without agents, the group is made of
+-- the sessions already started
+---@param agents string[]
+function M.broadcast_group(agents)
+	local group = {}
+	if #agents == 0 then
+		for bufnr in pairs(M.state.sessions) do
+			table.insert(group, bufnr)
+		end
+		table.sort(group)
+	end
+	for _, agent in ipairs(agents) do
+		local bufnr = M.start(agent)
+		if bufnr then
+			M.state.sessions[bufnr].label = agent
+			table.insert(group, bufnr)
+		end
+	end
+	M.state.broadcast = group
+end
+
+-- Send the same prompt to the sessions of the broadcast group, to compare
+-- their answers. Files mentioned with `@path` are sent along as resources
+---@param text string
+function M.broadcast(text)
+	local group = vim.tbl_filter(function(bufnr)
+		return M.state.sessions[bufnr] ~= nil and api.nvim_buf_is_valid(bufnr)
+	end, M.state.broadcast)
+	if not M.state.rpc_host_job_id or #group == 0 then
+		vim.notify("No broadcast group. Run :AcpBroadcastGroup first.", vim.log.levels.ERROR)
+		return
+	end
+	if not text or text == "" then
+		return
+	end
+
+	for _, bufnr in ipairs(group) do
+		M.state.sessions[bufnr].history_index = nil
+		M.append_text(bufnr, ("\n[Broadcast] %s\n🤖 "):format(text))
+	end
+	local files = parse_mentions(text)
+	local opts = #files > 0 and { files = files } or vim.empty_dict()
+	vim.rpcnotify(M.state.rpc_host_job_id, "AcpBroadcastPrompt", group, text, opts)
+end
+
+-- Attach an image file to the next prompt
+---@param bufnr number
+---@param path string
+function M.attach_image(bufnr, path)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	local ok, err = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpAttachImage", bufnr, vim.fs.abspath(path))
+	if not ok then
+		vim.notify("Failed to attach image: " .. tostring(err), vim.log.levels.ERROR)
+	end
+end
+
+-- Queue attachments to be sent with the next prompt
+---@param bufnr number
+---@param opts table Attachments, as accepted by send_prompt
+---@param what string Description of the attachments for error messages
+local function attach(bufnr, opts, what)
+	local ok, err = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpAttach", bufnr, opts)
+	if not ok then
+		vim.notify(("Failed to attach %s: %s"):format(what, tostring(err)), vim.log.levels.ERROR)
+	end
+end
+
+-- Attach diagnostics to the next prompt
+---@param bufnr number Chat buffer
+---@param scope "buffer"|"workspace" Diagnostics of the buffer in the previous window, or of all buffers
+function M.attach_diagnostics(bufnr, scope)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	local source
+	if scope == "buffer" then
+		source = vim.fn.winbufnr(vim.fn.winnr("#"))
+		if source == -1 or source == bufnr then
+			vim.notify("No buffer to take diagnostics from", vim.log.levels.WARN)
+			return
+		end
+	end
+
+	local diagnostics = vim.iter(vim.diagnostic.get(source)):map(function(d)
+		return {
+			path = api.nvim_buf_get_name(d.bufnr),
+			line = d.lnum + 1,
+			col = d.col + 1,
+			end_line = (d.end_lnum or d.lnum) + 1,
+			end_col = (d.end_col or d.col) + 1,
+			severity = vim.diagnostic.severity[d.severity] or "",
+			message = d.message,
+			source = d.source or "",
+			code = d.code and tostring(d.code) or "",
+		}
+	end):totable()
+	if #diagnostics == 0 then
+		vim.notify("No diagnostics to attach", vim.log.levels.INFO)
+		return
+	end
+
+	attach(bufnr, { diagnostics = diagnostics }, "diagnostics")
+end
+
+-- Ask the language servers of the buffer in win about the symbol under the
+-- cursor. Called by the host when attaching the symbol to a prompt
+---@param win number
+---@return table
+function M.lsp_symbol(win)
+	local buf = api.nvim_win_get_buf(win)
+	if #vim.lsp.get_clients({ bufnr = buf }) == 0 then
+		error("No language server attached to buffer " .. buf)
+	end
+
+	local cursor = api.nvim_win_get_cursor(win)
+	local info = {
+		path = api.nvim_buf_get_name(buf),
+		line = cursor[1],
+		col = cursor[2] + 1,
+		symbol = api.nvim_win_call(win, function()
+			return vim.fn.expand("<cword>")
+		end),
+		hover = "",
+		signature = "",
+		definitions = {},
+	}
+
+	local function request(method)
+		return vim.lsp.buf_request_sync(buf, method, function(client)
+			return vim.lsp.util.make_position_params(win, client.offset_encoding)
+		end, 2000) or {}
+	end
+
+	for _, res in pairs(request("textDocument/hover")) do
+		if res.result and res.result.contents then
+			local lines = vim.lsp.util.convert_input_to_markdown_lines(res.result.contents)
+			info.hover = vim.trim(table.concat(lines, "\n"))
+			break
+		end
+	end
+
+	for _, res in pairs(request("textDocument/signatureHelp")) do
+		local signatures = res.result and res.result.signatures or {}
+		local sig = signatures[(res.result and res.result.activeSignature or 0) + 1] or signatures[1]
+		if sig then
+			info.signature = sig.label
+			break
+		end
+	end
+
+	for _, res in pairs(request("textDocument/definition")) do
+		local result = res.result or {}
+		-- A single Location, or a list of Location or LocationLink
+		if result.uri then
+			result = { result }
+		end
+		for _, loc in ipairs(result) do
+			local uri = loc.uri or loc.targetUri
+			local range = loc.range or loc.targetSelectionRange
+			if uri and range then
+				table.insert(info.definitions, { path = vim.uri_to_fname(uri), line = range.start.line + 1 })
+			end
+		end
+	end
+
+	return info
+end
+
+-- Attach the hover text, signature and definition of the symbol under the
+-- cursor in the previous window to the next prompt
+---@param bufnr number Chat buffer
+function M.attach_symbol(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	local win = vim.fn.win_getid(vim.fn.winnr("#"))
+	if win == 0 or api.nvim_win_get_buf(win) == bufnr then
+		vim.notify("No window to take the symbol from", vim.log.levels.WARN)
+		return
+	end
+
+	local ok, err = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpAttachSymbol", bufnr, win)
+	if not ok then
+		vim.notify("Failed to attach symbol: " .. tostring(err), vim.log.levels.ERROR)
+	end
+end
+
+-- Attach an audio file, such as a voice note, to the next prompt
+---@param bufnr number
+---@param path string
+function M.attach_audio(bufnr, path)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	attach(bufnr, { audio = { vim.fs.abspath(path) } }, "audio")
+end
+
+-- Attach the last lines of a terminal buffer to the next prompt. When
+-- term_buf is nil, the only terminal buffer is used, or the user picks one
+---@param bufnr number
+---@param term_buf number?
+---@param count number? Number of lines, defaults to 200
+function M.attach_terminal(bufnr, term_buf, count)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	local function send(buf)
+		local ok, err = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpAttachTerminal", bufnr, buf, count or 0)
+		if not ok then
+			vim.notify("Failed to attach terminal: " .. tostring(err), vim.log.levels.ERROR)
+		end
+	end
+
+	if term_buf then
+		send(term_buf)
+		return
+	end
+
+	local terminals = vim.tbl_filter(function(buf)
+		return api.nvim_buf_is_loaded(buf) and vim.bo[buf].buftype == "terminal"
+	end, api.nvim_list_bufs())
+	if #terminals == 0 then
+		vim.notify("No terminal buffer to attach", vim.log.levels.WARN)
+	elseif #terminals == 1 then
+		send(terminals[1])
+	else
+		vim.ui.select(terminals, {
+			prompt = "Terminal to attach",
+			format_item = function(buf)
+				return ("%d: %s"):format(buf, api.nvim_buf_get_name(buf))
+			end,
+		}, function(buf)
+			if buf then
+				send(buf)
+			end
+		end)
+	end
+end
+
+-- Attach the output of git diff in the session directory to the next prompt
+---@param bufnr number
+---@param opts { staged: boolean?, range: string?, paths: string[]? }
+function M.attach_git_diff(bufnr, opts)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	attach(bufnr, { git_diff = opts }, "git diff")
+end
+
+-- Send a prompt template, expanded with the context of the buffer in the
+-- previous window and with args
+---@param bufnr number
+---@param name string
+---@param args? table<string, string>
+function M.send_template(bufnr, name, args)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	local values = {}
+	local source = vim.fn.winbufnr(vim.fn.winnr("#"))
+	if source ~= -1 and source ~= bufnr then
+		values.filename = api.nvim_buf_get_name(source)
+		values.filetype = vim.bo[source].filetype
+		local first = api.nvim_buf_get_mark(source, "<")[1]
+		local last = api.nvim_buf_get_mark(source, ">")[1]
+		if first > 0 and last >= first then
+			values.selection = table.concat(api.nvim_buf_get_lines(source, first - 1, last, false), "\n")
+		end
+		values.diagnostics = table.concat(vim.iter(vim.diagnostic.get(source)):map(function(d)
+			return ("%d:%d: %s"):format(d.lnum + 1, d.col + 1, d.message)
+		end):totable(), "\n")
+	end
+	values = vim.tbl_extend("force", values, args or {})
+
+	M.append_text(bufnr, ("\n[Template %s]\n🤖 "):format(name))
+	vim.rpcnotify(M.state.rpc_host_job_id, "AcpSendTemplate", bufnr, name, values)
+end
+
+function M.acptemplate_complete()
+	local buf = api.nvim_get_current_buf()
+	local ok, names = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpListTemplates", buf)
+	return ok and table.concat(names, "\n") or ""
+end
+
+-- Attach the image on the system clipboard to the next prompt
+---@param bufnr number
+function M.attach_clipboard_image(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	local ok, err = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpAttachClipboardImage", bufnr)
+	if not ok then
+		vim.notify("Failed to attach clipboard image: " .. tostring(err), vim.log.levels.ERROR)
+	end
+end
+
+-- Find the chat buffer that prompts sent from other buffers should go to:
+-- the one shown in a window if any, otherwise any active session
+---@return number?
+local function target_session()
+	local fallback
+	for bufnr, session in pairs(M.state.sessions) do
+		if session.window and api.nvim_win_is_valid(session.window) then
+			return bufnr
+		end
+		fallback = fallback or bufnr
+	end
+	return fallback
+end
+
+-- Send a question about lines of the current buffer to the active session
+---@param line1 integer
+---@param line2 integer
+---@param question string
+function M.send_selection(line1, line2, question)
+	local chat = target_session()
+	if not chat or not M.state.rpc_host_job_id then
+		vim.notify("No ACP session. Run :AcpNewSession first.", vim.log.levels.ERROR)
+		return
+	end
+
+	local source = api.nvim_get_current_buf()
+	local path = api.nvim_buf_get_name(source)
+	local selection = {
+		path = path ~= "" and vim.fs.abspath(path) or "",
+		start = line1,
+		["end"] = line2,
+		text = table.concat(api.nvim_buf_get_lines(source, line1 - 1, line2, false), "\n"),
+		filetype = vim.bo[source].filetype,
+	}
+
+	M.append_text(chat, ("\n[%s:%d-%d] %s\n🤖 "):format(vim.fn.fnamemodify(path, ":~:."), line1, line2, question))
+	vim.rpcnotify(M.state.rpc_host_job_id, "AcpSendPromptWithSelection", chat, question, selection)
+end
+
+-- Ask the active session to rewrite lines of the current buffer as told by
+-- instruction, asked for when empty. The rewrite is shown as a diff in the
+-- chat and applied once accepted
+---@param line1 integer
+---@param line2 integer
+---@param instruction? string
+function M.inline_edit(line1, line2, instruction)
+	local chat = target_session()
+	if not chat or not M.state.rpc_host_job_id then
+		vim.notify("No ACP session. Run :AcpNewSession first.", vim.log.levels.ERROR)
+		return
+	end
+	if not instruction or instruction == "" then
+		local source = api.nvim_get_current_buf()
+		vim.ui.input({ prompt = "Edit: " }, function(input)
+			if input and input ~= "" then
+				api.nvim_buf_call(source, function()
+					M.inline_edit(line1, line2, input)
+				end)
+			end
+		end)
+		return
+	end
+
+	local source = api.nvim_get_current_buf()
+	local path = api.nvim_buf_get_name(source)
+	local selection = {
+		path = path ~= "" and vim.fs.abspath(path) or "",
+		start = line1,
+		["end"] = line2,
+		text = table.concat(api.nvim_buf_get_lines(source, line1 - 1, line2, false), "\n"),
+		filetype = vim.bo[source].filetype,
+	}
+
+	M.append_text(chat, ("\n[Edit %s:%d-%d] %s\n🤖 "):format(vim.fn.fnamemodify(path, ":~:."), line1, line2, instruction))
+	vim.rpcnotify(M.state.rpc_host_job_id, "AcpInlineEdit", chat, source, selection, instruction)
+end
+
+--- Called from Go
+---@param bufnr number
+---@param opts { modes: acp.SessionModes?, session_id: string, agent_info: acp.AgentInfo? }
+function M.set_and_show_prompt_buf(bufnr, opts)
+	api.nvim_buf_set_name(bufnr, ("acp://%s/%s"):format(M.state.sessions[bufnr].agent, opts.session_id))
+	-- Set before the filetype so that the ftplugin can adapt to the agent
+	M.state.sessions[bufnr].agent_info = opts.agent_info
+	show(bufnr)
+	vim.bo[bufnr].filetype = "acpchat"
+	M.state.sessions[bufnr].modes = opts.modes
+end
+
+--- Called from Go as the session of a buffer starts. Fires the
+--- AcpSessionStatus User autocommand with the buffer, the status and, for
+--- "failed", the error as data.
+---@param bufnr number
+---@param status "launching"|"initializing"|"creating"|"ready"|"failed"
+---@param message string
+function M.on_session_status(bufnr, status, message)
+	vim.schedule(function()
+		local session = M.state.sessions[bufnr]
+		if session then
+			session.status = status
+		end
+		if status == "failed" and session and not session.window then
+			-- Nothing to show the buffer for, unlike lazy sessions, which
+			-- try again on the next prompt
+			M.state.sessions[bufnr] = nil
+			if api.nvim_buf_is_valid(bufnr) then
+				api.nvim_buf_delete(bufnr, { force = true })
+			end
+		end
+		api.nvim_exec_autocmds("User", {
+			pattern = "AcpSessionStatus",
+			data = { bufnr = bufnr, status = status, message = message },
+		})
+	end)
+end
+
+--- Called from Go every second while a prompt waits for the rate limit of
+-- the session, with the seconds left, and with 0 once it is sent. Fires the
+-- AcpThrottle User autocommand with the buffer and the seconds as data.
+---@param bufnr number
+---@param seconds integer
+function M.on_throttle(bufnr, seconds)
+	vim.schedule(function()
+		local session = M.state.sessions[bufnr]
+		if session then
+			session.throttle = seconds > 0 and seconds or nil
+		end
+		vim.cmd.redrawstatus({ bang = true })
+		api.nvim_exec_autocmds("User", {
+			pattern = "AcpThrottle",
+			data = { bufnr = bufnr, seconds = seconds },
+		})
+	end)
+end
+
+--- Called from Go when the turn in progress is cancelled, with true, and
+-- once the agent ended it, with false. Prompts sent in between wait for the
+-- end of the turn. Fires the AcpCancel User autocommand with the buffer and
+-- whether the turn is still cancelling as data.
+---@param bufnr number
+---@param cancelling boolean
+function M.on_cancel(bufnr, cancelling)
+	vim.schedule(function()
+		local session = M.state.sessions[bufnr]
+		if session then
+			session.cancelling = cancelling or nil
+		end
+		vim.cmd.redrawstatus({ bang = true })
+		api.nvim_exec_autocmds("User", {
+			pattern = "AcpCancel",
+			data = { bufnr = bufnr, cancelling = cancelling },
+		})
+	end)
+end
+
+--- Called from Go when the agent refuses to answer a prompt. Fires the
+-- AcpRefusal User autocommand with the buffer as data.
+---@param bufnr number
+function M.on_refusal(bufnr)
+	vim.schedule(function()
+		api.nvim_exec_autocmds("User", {
+			pattern = "AcpRefusal",
+			data = { bufnr = bufnr },
+		})
+	end)
+end
+
+--- Called from Go when a request to the agent fails. Fires the AcpError User
+-- autocommand with the error and the buffer as data.
+---@param bufnr number
+---@param event acp.ErrorEvent
+function M.on_error(bufnr, event)
+	vim.schedule(function()
+		api.nvim_exec_autocmds("User", {
+			pattern = "AcpError",
+			data = vim.tbl_extend("force", event, { bufnr = bufnr }),
+		})
+	end)
+end
+
+--- Called from Go when the agent sends an extension notification the plugin
+-- doesn't handle. Fires the AcpExtNotification User autocommand with the
+-- buffer, the method and the params as data.
+---@param bufnr number
+---@param method string
+---@param params any
+function M.on_ext_notification(bufnr, method, params)
+	vim.schedule(function()
+		api.nvim_exec_autocmds("User", {
+			pattern = "AcpExtNotification",
+			data = { bufnr = bufnr, method = method, params = params },
+		})
+	end)
+end
+
+--- Called from Go when the agent sends a session update of a kind the plugin
+-- doesn't know, e.g. from a newer version of the protocol. Fires the
+-- AcpUnsupportedUpdate User autocommand with the buffer, the kind and the
+-- params of the notification as data.
+---@param bufnr number
+---@param kind string
+---@param params table
+function M.on_unsupported_update(bufnr, kind, params)
+	vim.schedule(function()
+		api.nvim_exec_autocmds("User", {
+			pattern = "AcpUnsupportedUpdate",
+			data = { bufnr = bufnr, kind = kind, params = params },
+		})
+	end)
+end
+
+-- Call an extension method of the agent of a session, one outside of the ACP
+-- spec whose name starts with an underscore, e.g. a feature of a single agent
+---@param bufnr integer
+---@param method string
+---@param params? table
+---@return any? result
+---@return string? err
+function M.ext_request(bufnr, method, params)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		return nil, "No ACP session in this buffer"
+	end
+	local ok, result = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpExtRequest", bufnr, method, params or vim.empty_dict())
+	if not ok then
+		return nil, tostring(result)
+	end
+	return result
+end
+
+-- Send an extension notification to the agent of a session
+---@param bufnr integer
+---@param method string
+---@param params? table
+function M.ext_notify(bufnr, method, params)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+	vim.rpcnotify(M.state.rpc_host_job_id, "AcpExtNotify", bufnr, method, params or vim.empty_dict())
+end
+
+-- Show the last failed request of the session of a buffer with all the
+-- details the agent sent
+---@param bufnr integer
+function M.last_error(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+	local ok, event = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpLastError", bufnr)
+	if not ok then
+		vim.notify("Failed to get the last error: " .. tostring(event), vim.log.levels.ERROR)
+	elseif event == vim.NIL or event == nil then
+		vim.notify("No request failed in this session", vim.log.levels.INFO)
+	else
+		vim.notify(vim.inspect(event), vim.log.levels.INFO)
+	end
+end
+
+-- Called from Go when the agent advertises its slash commands
+---@param bufnr number
+---@param commands acp.Command[]
+function M.set_commands(bufnr, commands)
+	if M.state.sessions[bufnr] then
+		M.state.sessions[bufnr].commands = commands
+	end
+end
+
+-- Whether the completion started by the last omnifunc call is of a mention
+local completing_mention = false
+
+-- 'omnifunc' of chat buffers completing the agent's slash commands and the
+-- project files after `@`
+---@param findstart integer
+---@param base string
+function M.omnifunc(findstart, base)
+	if findstart == 1 then
+		local line = api.nvim_get_current_line():sub(1, api.nvim_win_get_cursor(0)[2])
+		local mention = line:find("@%S*$")
+		completing_mention = mention ~= nil
+		if mention then
+			return mention
+		end
+		local slash = line:find("/[^%s/]*$")
+		return slash and slash - 1 or -3
+	end
+
+	local bufnr = api.nvim_get_current_buf()
+	if completing_mention and M.state.rpc_host_job_id and M.state.sessions[bufnr] then
+		local ok, files = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpFindFiles", bufnr, base, 50)
+		if not ok then
+			return {}
+		end
+		return vim.tbl_map(function(file)
+			return { word = file, menu = "[file]" }
+		end, files)
+	end
+
+	local session = M.state.sessions[bufnr]
+	return vim.iter(session and session.commands or {}):filter(function(cmd)
+		return vim.startswith("/" .. cmd.name, base)
+	end):map(function(cmd)
+		return { word = "/" .. cmd.name, menu = cmd.hint, info = cmd.description }
+	end):totable()
+end
+
+-- Replace the text on the prompt line
+---@param bufnr number
+---@param text string
+local function set_prompt_text(bufnr, text)
+	local lines = vim.split(text, "\n", { plain = true })
+	lines[1] = vim.fn.prompt_getprompt(bufnr) .. lines[1]
+	local last = api.nvim_buf_line_count(bufnr)
+	api.nvim_buf_set_lines(bufnr, last - 1, last, false, lines)
+	local win = vim.fn.bufwinid(bufnr)
+	if win ~= -1 then
+		api.nvim_win_set_cursor(win, { api.nvim_buf_line_count(bufnr), #lines[#lines] })
+	end
+end
+
+-- Send the previous prompt again
+---@param bufnr number
+function M.resend_last(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	M.append_text(bufnr, "\n[Resending previous prompt]\n🤖 ")
+	vim.rpcnotify(M.state.rpc_host_job_id, "AcpResendLast", bufnr)
+end
+
+-- Ask the agent to go on with the turn it cut short
+---@param bufnr number
+function M.continue(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	M.append_text(bufnr, "\n[Continue]\n🤖 ")
+	vim.rpcnotify(M.state.rpc_host_job_id, "AcpContinue", bufnr)
+end
+
+-- Put the previous prompt back on the prompt line for editing
+---@param bufnr number
+function M.edit_last(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	local ok, text = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpEditLast", bufnr)
+	if not ok then
+		vim.notify("Failed to get previous prompt: " .. tostring(text), vim.log.levels.WARN)
+		return
+	end
+
+	set_prompt_text(bufnr, text)
+end
+
+-- Fetch previous prompts of the session's project, newest first
+---@param bufnr number
+---@param query? string Only keep prompts fuzzy-matching this
+---@return string[]
+local function fetch_history(bufnr, query)
+	local ok, result = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpHistory", bufnr, query or "", 0)
+	if not ok then
+		vim.notify("Failed to get prompt history: " .. tostring(result), vim.log.levels.WARN)
+		return {}
+	end
+	return result
+end
+
+-- Recall an older (delta = 1) or newer (delta = -1) prompt on the prompt line
+---@param bufnr number
+---@param delta integer
+function M.history_step(bufnr, delta)
+	local session = M.state.sessions[bufnr]
+	if not session or not M.state.rpc_host_job_id then
+		return
+	end
+
+	if not session.history_index then
+		session.history = fetch_history(bufnr)
+		session.history_index = 0
+	end
+	local index = session.history_index + delta
+	if index < 0 or index > #session.history then
+		return
+	end
+	session.history_index = index
+	set_prompt_text(bufnr, index == 0 and "" or session.history[index])
+end
+
+-- Pick a previous prompt matching query and put it on the prompt line
+---@param bufnr number
+---@param query? string
+function M.search_history(bufnr, query)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	vim.ui.select(fetch_history(bufnr, query), { prompt = "Prompt history" }, function(choice)
+		if choice then
+			set_prompt_text(bufnr, choice)
+			vim.cmd("startinsert!")
+		end
+	end)
+end
+
+-- Cancel the current operation
+---@param bufnr number
+function M.cancel(bufnr)
+	if not M.state.rpc_host_job_id then
+		vim.notify("ACP not running", vim.log.levels.WARN)
+		return
+	end
+
+	if not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+
+	vim.rpcnotify(M.state.rpc_host_job_id, "AcpCancel", bufnr)
+end
+
+---@param trimmed integer
+---@return string
+local function trimmed_header(trimmed)
+	return ("[%d earlier lines, :AcpOlder to show them]"):format(trimmed)
+end
+
+-- Move the oldest lines of a chat buffer to the RPC host once it grows past
+-- max_lines, leaving a line that tells how many there are
+---@param bufnr number
+local function trim(bufnr)
+	local session = M.state.sessions[bufnr]
+	local limit = session and (session.max_lines or M.config.max_lines or 10000)
+	if not limit or limit <= 0 or not M.state.rpc_host_job_id then
+		return
+	end
+
+	-- Trim in batches rather than a few lines on every append
+	local count = api.nvim_buf_line_count(bufnr)
+	if count <= limit + math.ceil(limit / 10) then
+		return
+	end
+	local trimmed = session.trimmed or 0
+	local first = trimmed > 0 and 1 or 0
+	-- Never trim the line being appended to, nor the prompt
+	local prompt_line = api.nvim_buf_get_mark(bufnr, ":")[1]
+	local excess = math.min(count - limit, prompt_line - 2 - first)
+	if excess <= 0 then
+		return
+	end
+
+	local lines = api.nvim_buf_get_lines(bufnr, first, first + excess, false)
+	vim.rpcnotify(M.state.rpc_host_job_id, "AcpTrimLines", bufnr, lines)
+	session.trimmed = trimmed + excess
+	api.nvim_buf_set_lines(bufnr, 0, first + excess, false, { trimmed_header(session.trimmed) })
+end
+
+--- Put back lines trimmed from the top of a chat buffer
+---@param bufnr integer
+---@param count? integer Number of lines, all of them when nil
+function M.show_older(bufnr, count)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+	local session = M.state.sessions[bufnr]
+	if (session.trimmed or 0) == 0 then
+		vim.notify("No older lines", vim.log.levels.INFO)
+		return
+	end
+
+	local ok, lines = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpRestoreLines", bufnr, count or 0)
+	if not ok then
+		vim.notify("Failed to get older lines: " .. tostring(lines), vim.log.levels.ERROR)
+		return
+	end
+
+	session.trimmed = session.trimmed - #lines
+	-- Make room for the lines so that they aren't trimmed again right away
+	session.max_lines = (session.max_lines or M.config.max_lines or 10000) + #lines
+	local header = session.trimmed > 0 and { trimmed_header(session.trimmed) } or {}
+	api.nvim_buf_set_lines(bufnr, 0, 1, false, vim.list_extend(header, lines))
+end
+
+-- Append text to a specific buffer
+-- Also called from Go
+---@param bufnr number
+---@param text string
+function M.append_text(bufnr, text)
+	if not api.nvim_buf_is_valid(bufnr) then
+		return
+	end
+
+	vim.schedule(function()
+		-- Get the prompt line position using the ': mark
+		local prompt_pos = api.nvim_buf_get_mark(bufnr, ":")
+		local prompt_line = prompt_pos[1] -- 1-indexed line number
+
+		-- Get the line just before the prompt (where we append content)
+		local content_line_idx = prompt_line - 2 -- 0-indexed (prompt_line - 1 - 1)
+
+		if content_line_idx < 0 then
+			-- No content line exists yet, insert a new line before prompt
+			api.nvim_buf_set_lines(bufnr, 0, 0, false, { "" })
+			content_line_idx = 0
+		end
+
+		-- Get the current content of that line
+		local current_line = api.nvim_buf_get_lines(bufnr, content_line_idx, content_line_idx + 1, false)[1] or ""
+
+		-- Append the new text to the current line
+		local new_text = current_line .. text
+
+		-- Split by newlines if the text contains them
+		local lines = vim.split(new_text, "\n", { plain = true })
+
+		-- Replace the current line and add any additional lines
+		api.nvim_buf_set_lines(bufnr, content_line_idx, content_line_idx + 1, false, lines)
+		trim(bufnr)
 
 		-- Scroll to the bottom if the window is visible
 		local session = M.state.sessions[bufnr]
@@ -260,14 +2213,354 @@ function M.append_text(bufnr, text)
 	end)
 end
 
+local turns_ns = api.nvim_create_namespace("acp_turns")
+
+-- Bookmark turn id of a chat buffer: its prompt is on the line before the
+-- last one appended, and the reply starts on the last one. Scheduled like
+-- |M.append_text()|, so that it runs after the text appended before.
+-- Only called from Go
+---@param bufnr integer
+---@param id integer
+function M.mark_turn(bufnr, id)
+	vim.schedule(function()
+		if not api.nvim_buf_is_valid(bufnr) then
+			return
+		end
+		local reply = math.max(api.nvim_buf_get_mark(bufnr, ":")[1] - 2, 0)
+		local opts = { invalidate = true, undo_restore = false, right_gravity = false }
+		api.nvim_buf_set_extmark(bufnr, turns_ns, math.max(reply - 1, 0), 0, vim.tbl_extend("force", opts, { id = 2 * id - 1 }))
+		api.nvim_buf_set_extmark(bufnr, turns_ns, reply, 0, vim.tbl_extend("force", opts, { id = 2 * id }))
+	end)
+end
+
+-- Positions of the bookmarks of turns, 0 when their lines were trimmed.
+-- Only called from Go
+---@param bufnr integer
+---@param ids integer[]
+---@return { prompt_line: integer, prompt_byte: integer, reply_line: integer, reply_byte: integer }[]
+function M.turn_positions(bufnr, ids)
+	local function position(id)
+		local pos = api.nvim_buf_get_extmark_by_id(bufnr, turns_ns, id, { details = true })
+		if not pos[1] or pos[3].invalid then
+			return 0, 0
+		end
+		return pos[1] + 1, api.nvim_buf_get_offset(bufnr, pos[1])
+	end
+	local result = {}
+	for _, id in ipairs(ids) do
+		local item = {}
+		item.prompt_line, item.prompt_byte = position(2 * id - 1)
+		item.reply_line, item.reply_byte = position(2 * id)
+		table.insert(result, item)
+	end
+	return result
+end
+
+-- Move the cursor to the next (dir = 1) or previous (dir = -1) prompt or
+-- reply in the chat buffer. Chats without bookmarks, e.g. replays, jump
+-- between prompts
+---@param bufnr integer
+---@param dir 1|-1
+function M.jump_turn(bufnr, dir)
+	if #api.nvim_buf_get_extmarks(bufnr, turns_ns, 0, -1, { limit = 1 }) == 0 then
+		vim.fn.search([[^\%x1b]133;A\%x07]], dir > 0 and "" or "b")
+		return
+	end
+
+	local row = api.nvim_win_get_cursor(0)[1] - 1
+	local marks
+	if dir > 0 then
+		marks = api.nvim_buf_get_extmarks(bufnr, turns_ns, { row + 1, 0 }, -1, { details = true })
+	elseif row > 0 then
+		marks = api.nvim_buf_get_extmarks(bufnr, turns_ns, { row - 1, -1 }, 0, { details = true })
+	else
+		return
+	end
+	for _, mark in ipairs(marks) do
+		if not mark[4].invalid then
+			vim.cmd("normal! m'")
+			api.nvim_win_set_cursor(0, { mark[2] + 1, 0 })
+			return
+		end
+	end
+end
+
+---@class acp.TurnBookmark
+---@field turn integer
+---@field prompt_line integer 0 when trimmed from the chat
+---@field prompt_byte integer
+---@field reply_line integer
+---@field reply_byte integer
+---@field title string
+---@field time string Start of the turn, as HH:MM
+---@field duration_ms integer
+---@field tool_calls integer
+
+-- Get the bookmarks of the turns of the session of a buffer
+---@param bufnr integer
+---@return acp.TurnBookmark[]
+function M.turns(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		return {}
+	end
+	local ok, turns = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpTurns", bufnr)
+	if not ok then
+		vim.notify("Failed to get turns: " .. tostring(turns), vim.log.levels.ERROR)
+		return {}
+	end
+	return turns
+end
+
+-- Pick a turn of the chat with |vim.ui.select()| and jump to its prompt
+---@param bufnr integer
+function M.pick_turn(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		vim.notify("No ACP session in this buffer", vim.log.levels.WARN)
+		return
+	end
+	local turns = vim.tbl_filter(function(turn)
+		return turn.prompt_line > 0
+	end, M.turns(bufnr))
+	if #turns == 0 then
+		vim.notify("No turn to go to", vim.log.levels.INFO)
+		return
+	end
+	vim.ui.select(turns, {
+		prompt = "Turns",
+		kind = "acp_turn",
+		---@param turn acp.TurnBookmark
+		format_item = function(turn)
+			local item = ("%d. %s  %s"):format(turn.turn, turn.time, turn.title)
+			if turn.tool_calls > 0 then
+				item = item .. ("  (%d tool calls)"):format(turn.tool_calls)
+			end
+			return item
+		end,
+	}, function(turn)
+		if not turn then
+			return
+		end
+		local win = vim.fn.bufwinid(bufnr)
+		if win == -1 then
+			vim.cmd.sbuffer(bufnr)
+			win = api.nvim_get_current_win()
+		end
+		api.nvim_set_current_win(win)
+		vim.cmd("normal! m'")
+		api.nvim_win_set_cursor(win, { turn.prompt_line, 0 })
+	end)
+end
+
+local code_ns = api.nvim_create_namespace("acp_code_blocks")
+
+-- Bookmark code block id of a chat buffer: its opening fence is the last
+-- full line appended. Scheduled like |M.append_text()|.
+-- Only called from Go
+---@param bufnr integer
+---@param id integer
+function M.mark_code_block(bufnr, id)
+	vim.schedule(function()
+		if not api.nvim_buf_is_valid(bufnr) then
+			return
+		end
+		local row = math.max(api.nvim_buf_get_mark(bufnr, ":")[1] - 3, 0)
+		api.nvim_buf_set_extmark(bufnr, code_ns, row, 0, { id = id, invalidate = true, undo_restore = false })
+	end)
+end
+
+-- Lines of the opening fences of code blocks, 0 when they were trimmed.
+-- Only called from Go
+---@param bufnr integer
+---@param ids integer[]
+---@return integer[]
+function M.code_block_lines(bufnr, ids)
+	local result = {}
+	for _, id in ipairs(ids) do
+		local pos = api.nvim_buf_get_extmark_by_id(bufnr, code_ns, id, { details = true })
+		table.insert(result, (pos[1] and not pos[3].invalid) and pos[1] + 1 or 0)
+	end
+	return result
+end
+
+---@class acp.CodeBlock
+---@field id integer
+---@field turn integer
+---@field lang string
+---@field content string
+---@field complete boolean false when the turn ended before the closing fence
+---@field line integer Line of the opening fence, 0 when trimmed from the chat
+
+-- Get the code blocks of the replies in the session of a buffer, the last
+-- one last
+---@param bufnr integer
+---@return acp.CodeBlock[]
+function M.code_blocks(bufnr)
+	if not M.state.rpc_host_job_id or not M.state.sessions[bufnr] then
+		return {}
+	end
+	local ok, blocks = pcall(vim.rpcrequest, M.state.rpc_host_job_id, "AcpGetCodeBlocks", bufnr)
+	if not ok then
+		vim.notify("Failed to get code blocks: " .. tostring(blocks), vim.log.levels.ERROR)
+		return {}
+	end
+	return blocks
+end
+
+-- Yank the content of the [n]th last code block of the replies to a register
+---@param bufnr integer
+---@param n? integer 1 by default
+---@param reg? string The unnamed register by default
+function M.yank_code_block(bufnr, n, reg)
+	local blocks = M.code_blocks(bufnr)
+	local block = blocks[#blocks + 1 - (n or 1)]
+	if not block then
+		vim.notify("No such code block", vim.log.levels.WARN)
+		return
+	end
+	reg = (reg and reg ~= "") and reg or '"'
+	vim.fn.setreg(reg, block.content, "l")
+	vim.notify(("Yanked code block %d of turn %d"):format(block.id, block.turn), vim.log.levels.INFO)
+end
+
+---@class acp.ApplyCodeOpts
+---@field placement? "auto"|"cursor"|"selection"|"function"
+---@field line? integer Cursor line, the code goes after it
+---@field start? integer First line of the selection
+---@field end? integer Last line of the selection
+
+-- Put a code block of the replies of the active session in the current
+-- buffer: in place of the selection, of the function with the same header,
+-- or after the cursor
+---@param id? integer The last block by default
+---@param opts? acp.ApplyCodeOpts
+function M.apply_code_block(id, opts)
+	local chat = target_session()
+	if not chat or not M.state.rpc_host_job_id then
+		vim.notify("No ACP session. Run :AcpNewSession first.", vim.log.levels.ERROR)
+		return
+	end
+	opts = vim.tbl_extend("keep", opts or {}, { line = api.nvim_win_get_cursor(0)[1] })
+	local ok, placement = pcall(
+		vim.rpcrequest,
+		M.state.rpc_host_job_id,
+		"AcpApplyCodeBlock",
+		chat,
+		id or 0,
+		api.nvim_get_current_buf(),
+		opts
+	)
+	if not ok then
+		vim.notify("Failed to apply code block: " .. tostring(placement), vim.log.levels.ERROR)
+		return
+	end
+	if placement == "function" then
+		vim.notify("Replaced the function with the code block", vim.log.levels.INFO)
+	end
+end
+
+---@class acp.TextEdit
+---@field start_row integer
+---@field start_col integer
+---@field end_row integer
+---@field end_col integer
+---@field lines string[]
+
+---@class acp.BufferEdit
+---@field tick integer changedtick of the buffer the edits were computed for
+---@field edits acp.TextEdit[] From the bottom of the buffer to the top
+---@field first integer
+---@field last integer
+
+--- Replace the content of a loaded buffer with the agent's version of the file.
+--- Only the text that differs is replaced, so that marks, extmarks and folds
+--- elsewhere stay in place, as a single undo step, and the '[ and '] marks are
+--- set around the changed region. When the buffer changed since the edits
+--- were computed, the lines that differ are replaced instead.
+--- Called from Go
+---@param bufnr number
+---@param lines string[]
+---@param edit acp.BufferEdit
+function M.apply_edit(bufnr, lines, edit)
+	local first, last
+	if api.nvim_buf_get_changedtick(bufnr) == edit.tick then
+		if #edit.edits == 0 then
+			return
+		end
+		api.nvim_buf_call(bufnr, function()
+			-- Setting 'undolevels' closes the current undo block, so the edit
+			-- never gets merged into a change the user is in the middle of
+			vim.o.undolevels = vim.o.undolevels
+			for _, e in ipairs(edit.edits) do
+				api.nvim_buf_set_text(bufnr, e.start_row, e.start_col, e.end_row, e.end_col, e.lines)
+			end
+		end)
+		first, last = edit.first, edit.last
+	else
+		local old = api.nvim_buf_get_lines(bufnr, 0, -1, false)
+
+		local common = math.min(#old, #lines)
+		local prefix = 0
+		while prefix < common and old[prefix + 1] == lines[prefix + 1] do
+			prefix = prefix + 1
+		end
+		local suffix = 0
+		while suffix < common - prefix and old[#old - suffix] == lines[#lines - suffix] do
+			suffix = suffix + 1
+		end
+		if prefix == #old and prefix == #lines then
+			return
+		end
+
+		local replacement = vim.list_slice(lines, prefix + 1, #lines - suffix)
+		api.nvim_buf_call(bufnr, function()
+			vim.o.undolevels = vim.o.undolevels
+			api.nvim_buf_set_lines(bufnr, prefix, #old - suffix, false, replacement)
+		end)
+		first, last = prefix + 1, prefix + #replacement
+	end
+
+	local line_count = api.nvim_buf_line_count(bufnr)
+	first = math.min(first, line_count)
+	last = math.min(math.max(last, first), line_count)
+	api.nvim_buf_set_mark(bufnr, "[", first, 0, {})
+	api.nvim_buf_set_mark(bufnr, "]", last, 0, {})
+end
+
 ---@return string
-function M.acpstart_complete()
+function M.acpstart_complete(_, cmdline)
+	local agent = cmdline:match("^%S+%s+(%S+)%s")
+	if agent then
+		local profiles = M.config.agents[agent] and M.config.agents[agent].profiles or {}
+		return vim.iter(vim.tbl_keys(profiles)):join("\n")
+	end
 	return vim.iter(vim.tbl_keys(M.config.agents)):join("\n")
 end
 
+function M.acpmcp_complete(_, cmdline)
+	local action = cmdline:match("^%S+%s+(%S+)%s")
+	if action == "add" then
+		return vim.iter(vim.tbl_keys(M.config.mcp or {})):join("\n")
+	elseif action == "remove" then
+		return vim.iter(M.mcp_servers(api.nvim_get_current_buf())):join("\n")
+	elseif not action then
+		return "add\nremove"
+	end
+	return ""
+end
+
+function M.acpmodel_complete()
+    local session = M.state.sessions[api.nvim_get_current_buf()]
+    local models = session and session.models
+    return vim.iter(models and models.AvailableModels or {}):map(function(model)
+        return model.ModelId
+    end):join("\n")
+end
+
 function M.acpsetmode_complete()
     local buf = api.nvim_get_current_buf()
-    return vim.iter(M.state.sessions[buf].modes.AvailableModes):map(function(mode)
+    -- Sessions get their modes once the agent is started
+    local modes = M.state.sessions[buf].modes
+    return vim.iter(modes and modes.AvailableModes or {}):map(function(mode)
         return mode.Id
     end):join("\n")
 end
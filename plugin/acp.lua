@@ -1,11 +1,125 @@
 local command = vim.api.nvim_create_user_command
 
 command("AcpNewSession", function(opts)
-	require("acp").start(opts.args)
+	if #opts.fargs == 0 then
+		require("acp").pick_agent()
+		return
+	end
+	require("acp").start(opts.fargs[1], opts.fargs[2])
 end, {
-	nargs = 1,
+	nargs = "*",
     desc = "Start ACP connection and open chat window.",
 	complete = "custom,v:lua.require'acp'.acpstart_complete"
 })
 
 vim.treesitter.language.register("markdown", "acpchat")
+
+command("AcpSendSelection", function(opts)
+	require("acp").send_selection(opts.line1, opts.line2, opts.args)
+end, {
+	nargs = "+",
+	range = true,
+	desc = "Ask the ACP agent about the selected lines.",
+})
+
+command("AcpEdit", function(opts)
+	require("acp").inline_edit(opts.line1, opts.line2, opts.args)
+end, {
+	nargs = "*",
+	range = true,
+	desc = "Ask the ACP agent to rewrite the selected lines, and apply the rewrite once accepted",
+})
+
+command("AcpApplyCode", function(opts)
+	require("acp").apply_code_block(tonumber(opts.fargs[1]), {
+		placement = opts.fargs[2],
+		start = opts.range > 0 and opts.line1 or nil,
+		["end"] = opts.range > 0 and opts.line2 or nil,
+	})
+end, {
+	nargs = "*",
+	range = true,
+	desc = "Put a code block of the agent's replies, the last one by default, in place of the selection or function, or after the cursor ([id] [auto|cursor|selection|function])",
+	complete = function(_, cmdline)
+		if #vim.split(cmdline, "%s+") > 2 then
+			return { "auto", "cursor", "selection", "function" }
+		end
+		return {}
+	end,
+})
+
+command("AcpBroadcastGroup", function(opts)
+	require("acp").broadcast_group(opts.fargs)
+end, {
+	nargs = "*",
+	desc = "Start a session with each agent, side by side, to prompt them together with :AcpBroadcast. Without agents, group the sessions already started",
+	complete = function()
+		return vim.tbl_keys(require("acp").config.agents)
+	end,
+})
+
+command("AcpBroadcast", function(opts)
+	require("acp").broadcast(opts.args)
+end, {
+	nargs = "+",
+	desc = "Send a prompt to all the sessions of the broadcast group",
+})
+
+command("AcpReloadConfig", function()
+	require("acp").reload_config()
+end, {
+	desc = "Read g:acp again and apply it to the running sessions",
+})
+
+command("AcpLogLevel", function(opts)
+	require("acp").set_log_level(opts.args)
+end, {
+	nargs = 1,
+	desc = "Set the most verbose level of ACP messages shown",
+	complete = function()
+		return { "error", "warn", "info", "debug", "trace" }
+	end,
+})
+
+command("AcpReplay", function(opts)
+	require("acp").replay(vim.fn.expand(opts.args))
+end, {
+	nargs = 1,
+	desc = "Render a session recorded with the capture option",
+	complete = "file",
+})
+
+command("AcpArchive", function(opts)
+	local query, words = {}, {}
+	for _, arg in ipairs(opts.fargs) do
+		local key, value = arg:match("^(%a+)=(.*)$")
+		if key == "agent" or key == "project" or key == "since" or key == "until" then
+			query[key] = value
+		else
+			table.insert(words, arg)
+		end
+	end
+	query.text = table.concat(words, " ")
+	require("acp").pick_archive(query)
+end, {
+	nargs = "*",
+	desc = "Search the archived conversations: words, agent=, project=, since=YYYY-MM-DD, until=YYYY-MM-DD",
+})
+
+command("AcpRecover", function(opts)
+	if opts.bang then
+		require("acp").discard_recoverable()
+	else
+		require("acp").recover()
+	end
+end, {
+	bang = true,
+	desc = "Restore a chat interrupted by a crash, with ! forget them all",
+})
+
+vim.api.nvim_create_autocmd("VimEnter", {
+	once = true,
+	callback = function()
+		require("acp").check_recovery()
+	end,
+})
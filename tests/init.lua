@@ -5,7 +5,10 @@ vim.g.acp = {
 		test = {
 			cmd = { "npx", "tsx", "agent.ts" },
 			mcp = true
-		}
+		},
+		mock = {
+			cmd = { "../bin/acp-nvim", "-mock" },
+		},
 	},    mcp = {
         nvim = {
 			cmd = { 'nvim-mcp' },
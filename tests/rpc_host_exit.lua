@@ -0,0 +1,44 @@
+-- Run from the root of the repository with:
+--   nvim --headless -l tests/rpc_host_exit.lua
+-- The RPC host isn't started, jobstart is stubbed to get its callbacks.
+vim.opt.rtp:prepend(vim.fn.getcwd())
+vim.g.acp = { agents = { mock = { cmd = { "acp-nvim", "-mock" } } } }
+
+local host
+vim.fn.jobstart = function(_, opts)
+	host = opts
+	return 42
+end
+vim.rpcnotify = function() end
+local notified = {}
+vim.notify = function(msg, level)
+	table.insert(notified, { msg = msg, level = level })
+end
+
+local acp = require("acp")
+
+-- A crash with chats open points to their recovery
+assert(acp.start("mock") and host, "the session didn't start")
+host.on_exit(42, 2, "exit")
+assert(acp.state.rpc_host_job_id == nil, "the job of the host is kept")
+assert(next(acp.state.sessions) == nil, "the sessions of the host are kept")
+local last = notified[#notified]
+assert(last and last.level == vim.log.levels.ERROR, "the exit isn't reported")
+assert(last.msg:find("exited with code 2", 1, true), last.msg)
+assert(last.msg:find(":AcpRecover", 1, true), "recovery isn't offered: " .. last.msg)
+
+-- Not when recovery is disabled
+acp.config.recovery = false
+notified = {}
+assert(acp.start("mock"), "the session didn't start again")
+host.on_exit(42, 1, "exit")
+last = notified[#notified]
+assert(last and not last.msg:find(":AcpRecover", 1, true), "recovery is offered while disabled")
+
+-- A clean exit isn't reported
+notified = {}
+acp.start("mock")
+host.on_exit(42, 0, "exit")
+assert(#notified == 0, "a clean exit is reported")
+
+print("ok")